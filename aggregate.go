@@ -0,0 +1,163 @@
+// Licensed under the Apache License, Version 2.0 (the "License");
+// you may not use this file except in compliance with the License.
+// You may obtain a copy of the License at
+//
+// http://www.apache.org/licenses/LICENSE-2.0
+//
+// Unless required by applicable law or agreed to in writing, software
+// distributed under the License is distributed on an "AS IS" BASIS,
+// WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+// See the License for the specific language governing permissions and
+// limitations under the License.
+
+package main
+
+import (
+	"fmt"
+	"io"
+	"sort"
+)
+
+// aggregate is the summary of the json reports of many runs, e.g. of every
+// repository of an organization.
+type aggregate struct {
+	Reports  int `json:"reports"`
+	Errors   int `json:"errors"`
+	Warnings int `json:"warnings"`
+
+	// Rules are the totals of every rule or check with violations, most
+	// violated first.
+	Rules []*ruleTotal `json:"rules"`
+
+	// Offenders are the reports with the most violations, first.
+	Offenders []*offender `json:"offenders"`
+
+	// ThirdParties are the third party modules of the reports recording
+	// them, those shared by the most reports first.
+	ThirdParties []*thirdPartyUse `json:"third_parties"`
+}
+
+// ruleTotal is the number of violations of a rule or check, by ID, across
+// reports, and of the reports with any.
+type ruleTotal struct {
+	ID         string `json:"id"`
+	Name       string `json:"name"`
+	Violations int    `json:"violations"`
+	Reports    int    `json:"reports"`
+}
+
+// offender is a report, by path, and its number of violations.
+type offender struct {
+	Report     string `json:"report"`
+	Violations int    `json:"violations"`
+}
+
+// thirdPartyUse is a third party module, and the number of reports using it.
+type thirdPartyUse struct {
+	Module  string `json:"module"`
+	Reports int    `json:"reports"`
+}
+
+// aggregateReports sums up the reports, read from the paths, keeping the top
+// offenders, or all of them if top is not positive.
+func aggregateReports(paths []string, reports []*report, top int) *aggregate {
+	a := &aggregate{Reports: len(reports), Rules: []*ruleTotal{}, Offenders: []*offender{}, ThirdParties: []*thirdPartyUse{}}
+	totals := make(map[string]*ruleTotal)
+	uses := make(map[string]*thirdPartyUse)
+	for i, report := range reports {
+		a.Errors += report.Errors
+		a.Warnings += report.Warnings
+		violations := 0
+		for _, section := range report.Sections {
+			if len(section.Violations) == 0 {
+				continue
+			}
+			total, ok := totals[section.ID]
+			if !ok {
+				total = &ruleTotal{ID: section.ID, Name: section.Name}
+				totals[section.ID] = total
+				a.Rules = append(a.Rules, total)
+			}
+			total.Violations += len(section.Violations)
+			total.Reports++
+			violations += len(section.Violations)
+		}
+		if violations != 0 {
+			a.Offenders = append(a.Offenders, &offender{Report: paths[i], Violations: violations})
+		}
+		for _, module := range report.ThirdParties {
+			use, ok := uses[module]
+			if !ok {
+				use = &thirdPartyUse{Module: module}
+				uses[module] = use
+				a.ThirdParties = append(a.ThirdParties, use)
+			}
+			use.Reports++
+		}
+	}
+
+	sort.SliceStable(a.Rules, func(i, j int) bool {
+		return a.Rules[i].Violations > a.Rules[j].Violations
+	})
+	sort.SliceStable(a.Offenders, func(i, j int) bool {
+		return a.Offenders[i].Violations > a.Offenders[j].Violations
+	})
+	if top > 0 && len(a.Offenders) > top {
+		a.Offenders = a.Offenders[:top]
+	}
+	sort.Slice(a.ThirdParties, func(i, j int) bool {
+		if a.ThirdParties[i].Reports != a.ThirdParties[j].Reports {
+			return a.ThirdParties[i].Reports > a.ThirdParties[j].Reports
+		}
+		return a.ThirdParties[i].Module < a.ThirdParties[j].Module
+	})
+	return a
+}
+
+// writeText writes the totals, followed by those of every rule, the worst
+// offenders and the third parties, each under a heading.
+func (a *aggregate) writeText(w io.Writer) {
+	fmt.Fprintf(w, "%s, %s, %s\n", plural(a.Reports, "report"), plural(a.Errors, "error"), plural(a.Warnings, "warning"))
+	if len(a.Rules) != 0 {
+		fmt.Fprintf(w, "rules (%s)\n", plural(len(a.Rules), "rule"))
+		for _, total := range a.Rules {
+			fmt.Fprintf(w, "- %s, %s in %s\n", total.Name, plural(total.Violations, "violation"), plural(total.Reports, "report"))
+		}
+	}
+	if len(a.Offenders) != 0 {
+		fmt.Fprintf(w, "worst offenders (%s)\n", plural(len(a.Offenders), "report"))
+		for _, offender := range a.Offenders {
+			fmt.Fprintf(w, "- %s, %s\n", offender.Report, plural(offender.Violations, "violation"))
+		}
+	}
+	if len(a.ThirdParties) != 0 {
+		fmt.Fprintf(w, "third parties (%s)\n", plural(len(a.ThirdParties), "module"))
+		for _, use := range a.ThirdParties {
+			fmt.Fprintf(w, "- %s, in %s\n", use.Module, plural(use.Reports, "report"))
+		}
+	}
+}
+
+// thirdParties returns the third party modules working packages depend on,
+// in name order, as the longest of the modules prefixing their packages, or
+// guessed as per moduleOf.
+func (defs *defs) thirdParties(g *graph, modules []string) []string {
+	seen := make(map[string]bool)
+	var thirdParties []string
+	for _, pkg := range g.nodes() {
+		if pkg.goroot || !defs.isWorking(pkg.name) {
+			continue
+		}
+		for _, depPkg := range g.dependencies(pkg) {
+			if depPkg.goroot || defs.isWorking(depPkg.name) {
+				continue
+			}
+			if module := moduleOf(modules, depPkg.name); !seen[module] {
+				seen[module] = true
+				thirdParties = append(thirdParties, module)
+			}
+		}
+	}
+	sort.Strings(thirdParties)
+	return thirdParties
+}
@@ -0,0 +1,68 @@
+// Licensed under the Apache License, Version 2.0 (the "License");
+// you may not use this file except in compliance with the License.
+// You may obtain a copy of the License at
+//
+// http://www.apache.org/licenses/LICENSE-2.0
+//
+// Unless required by applicable law or agreed to in writing, software
+// distributed under the License is distributed on an "AS IS" BASIS,
+// WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+// See the License for the specific language governing permissions and
+// limitations under the License.
+
+package main
+
+import (
+	"bytes"
+
+	"github.com/stretchr/testify/require"
+)
+
+func (s *Zuite) TestAggregateReports() {
+	var api, billing, clean report
+	api.add("", "no db", severityError, []*violation{{Kind: kindDisallowed, From: "wp/a", To: "wp/dal"}})
+	api.add("", "layers", severityWarn, []*violation{{Kind: kindCycle, From: "wp/a", To: "wp/b"}})
+	api.ThirdParties = []string{"github.com/pkg/errors", "gopkg.in/yaml.v2"}
+	billing.add("", "no db", severityError, []*violation{{Kind: kindDisallowed, From: "wp/a", To: "wp/dal"}, {Kind: kindDisallowed, From: "wp/b", To: "wp/dal"}, {Kind: kindDisallowed, From: "wp/c", To: "wp/dal"}})
+	billing.ThirdParties = []string{"github.com/pkg/errors"}
+	clean.add("", "no db", severityError, nil)
+
+	a := aggregateReports([]string{"api.json", "billing.json", "clean.json"}, []*report{&api, &billing, &clean}, 1)
+	require.Equal(s.T(), &aggregate{
+		Reports:      3,
+		Errors:       4,
+		Warnings:     1,
+		Rules:        []*ruleTotal{{ID: "no-db", Name: "no db", Violations: 4, Reports: 2}, {ID: "layers", Name: "layers", Violations: 1, Reports: 1}},
+		Offenders:    []*offender{{Report: "billing.json", Violations: 3}},
+		ThirdParties: []*thirdPartyUse{{Module: "github.com/pkg/errors", Reports: 2}, {Module: "gopkg.in/yaml.v2", Reports: 1}},
+	}, a)
+
+	var buf bytes.Buffer
+	a.writeText(&buf)
+	require.Equal(s.T(), `3 reports, 4 errors, 1 warning
+rules (2 rules)
+- no db, 4 violations in 2 reports
+- layers, 1 violation in 1 report
+worst offenders (1 report)
+- billing.json, 3 violations
+third parties (2 modules)
+- github.com/pkg/errors, in 2 reports
+- gopkg.in/yaml.v2, in 1 report
+`, buf.String())
+}
+
+func (s *Zuite) TestThirdParties() {
+	defs, err := parse([]byte("config:\n  working_package: wp\n"))
+	require.NoError(s.T(), err)
+	g := graphOf(map[string]*pkg{
+		"wp/a":                           &pkg{name: "wp/a"},
+		"wp/b":                           &pkg{name: "wp/b"},
+		"github.com/pkg/errors":          &pkg{name: "github.com/pkg/errors"},
+		"example.com/lib/v2/http":        &pkg{name: "example.com/lib/v2/http"},
+		"github.com/other/transitive/go": &pkg{name: "github.com/other/transitive/go"},
+		"fmt":                            &pkg{name: "fmt", goroot: true},
+	}, "wp/a -> wp/b", "wp/a -> fmt", "wp/a -> github.com/pkg/errors", "wp/b -> example.com/lib/v2/http", "example.com/lib/v2/http -> github.com/other/transitive/go")
+
+	// Only direct dependencies of working packages are recorded.
+	require.Equal(s.T(), []string{"example.com/lib/v2", "github.com/pkg/errors"}, defs.thirdParties(g, []string{"example.com/lib/v2"}))
+}
@@ -0,0 +1,155 @@
+// Licensed under the Apache License, Version 2.0 (the "License");
+// you may not use this file except in compliance with the License.
+// You may obtain a copy of the License at
+//
+// http://www.apache.org/licenses/LICENSE-2.0
+//
+// Unless required by applicable law or agreed to in writing, software
+// distributed under the License is distributed on an "AS IS" BASIS,
+// WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+// See the License for the specific language governing permissions and
+// limitations under the License.
+
+package main
+
+import (
+	"fmt"
+	"io/ioutil"
+	"path/filepath"
+	"sort"
+	"strings"
+)
+
+// selection selects violations of a report to annotate, by their IDs, the
+// rule or check they violate, their package and their dependency. Empty
+// criteria select any violation.
+type selection struct {
+	ids      globs
+	rules    globs
+	from, to string
+}
+
+func (sel *selection) match(section *section, v *violation) bool {
+	if len(sel.ids) != 0 && !sel.ids.match(v.ID) {
+		return false
+	}
+	if len(sel.rules) != 0 && !sel.rules.match(section.ID) && !sel.rules.match(section.Name) {
+		return false
+	}
+	return (sel.from == "" || sel.from == v.From) && (sel.to == "" || sel.to == v.To)
+}
+
+// annotation is an import to suppress with `//depper:allow`.
+type annotation struct {
+	file string
+	line int
+}
+
+// annotations returns the imports responsible for the selected violations,
+// in file and line order. Violations with a position are responsible for
+// the import at their position, others, and uses of net/http globals, for
+// the imports of their dependency by their package, in the graph their rule
+// is checked against, as per check. Violations without imports, e.g. of
+// transitive rules, and violations of exclusive rules, which suppressions do
+// not apply to, are returned as skipped.
+func (defs *defs) annotations(g *graph, tagged map[string]*graph, report *report, sel *selection) ([]*annotation, []*violation) {
+	graphs := defs.sectionGraphs(g, tagged)
+	exclusive := make(map[string]bool)
+	for _, rule := range defs.Rules {
+		if rule.Exclusive {
+			exclusive[rule.id()] = true
+		}
+	}
+
+	var (
+		annotations []*annotation
+		skipped     []*violation
+		found       = make(map[annotation]bool)
+	)
+	for _, section := range report.Sections {
+		ruleGraph := graphs[section.ID]
+		if ruleGraph == nil {
+			ruleGraph = g
+		}
+		for _, v := range section.Violations {
+			if !sel.match(section, v) {
+				continue
+			}
+			if exclusive[section.ID] {
+				skipped = append(skipped, v)
+				continue
+			}
+			var imports []*annotation
+			if path, line, ok := splitPosition(v.Position); ok && v.Kind != kindGlobal {
+				imports = append(imports, &annotation{file: path, line: line})
+			} else if pkg, ok := ruleGraph.pkgs[v.From]; ok {
+				to := strings.TrimSuffix(strings.TrimPrefix(v.To, "<"), ">")
+				for _, file := range pkg.files {
+					for _, imp := range file.imports {
+						if imp.path == to && imp.allow == "" {
+							imports = append(imports, &annotation{file: file.name, line: imp.line})
+						}
+					}
+				}
+			}
+			if len(imports) == 0 {
+				skipped = append(skipped, v)
+			}
+			for _, imp := range imports {
+				if !found[*imp] {
+					found[*imp] = true
+					annotations = append(annotations, imp)
+				}
+			}
+		}
+	}
+	sort.Slice(annotations, func(i, j int) bool {
+		if annotations[i].file != annotations[j].file {
+			return annotations[i].file < annotations[j].file
+		}
+		return annotations[i].line < annotations[j].line
+	})
+	return annotations, skipped
+}
+
+// annotate inserts the `//depper:allow` comment with the reason above each
+// import, in the files relative to dir, indented like the import.
+func annotate(dir string, annotations []*annotation, reason string) error {
+	byFile := make(map[string][]int)
+	var files []string
+	for _, a := range annotations {
+		if _, ok := byFile[a.file]; !ok {
+			files = append(files, a.file)
+		}
+		byFile[a.file] = append(byFile[a.file], a.line)
+	}
+
+	for _, file := range files {
+		path := file
+		if !filepath.IsAbs(path) {
+			path = filepath.Join(dir, path)
+		}
+		data, err := ioutil.ReadFile(path)
+		if err != nil {
+			return err
+		}
+		lines := strings.SplitAfter(string(data), "\n")
+
+		// Insert from the bottom up, so that line numbers still hold.
+		numbers := byFile[file]
+		sort.Sort(sort.Reverse(sort.IntSlice(numbers)))
+		for _, number := range numbers {
+			if number < 1 || number > len(lines) {
+				return fmt.Errorf("%s:%d: no such line", file, number)
+			}
+			line := lines[number-1]
+			indent := line[:len(line)-len(strings.TrimLeft(line, " \t"))]
+			comment := fmt.Sprintf("%s//%s %s\n", indent, allowDirective, reason)
+			lines = append(lines[:number-1], append([]string{comment}, lines[number-1:]...)...)
+		}
+		if err := ioutil.WriteFile(path, []byte(strings.Join(lines, "")), 0644); err != nil {
+			return err
+		}
+	}
+	return nil
+}
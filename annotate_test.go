@@ -0,0 +1,134 @@
+// Licensed under the Apache License, Version 2.0 (the "License");
+// you may not use this file except in compliance with the License.
+// You may obtain a copy of the License at
+//
+// http://www.apache.org/licenses/LICENSE-2.0
+//
+// Unless required by applicable law or agreed to in writing, software
+// distributed under the License is distributed on an "AS IS" BASIS,
+// WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+// See the License for the specific language governing permissions and
+// limitations under the License.
+
+package main
+
+import (
+	"io/ioutil"
+	"os"
+	"path/filepath"
+
+	"github.com/stretchr/testify/require"
+	"golang.org/x/tools/go/packages"
+)
+
+func (s *Zuite) TestAnnotations_buildTags() {
+	g := graphOf(map[string]*pkg{"wp/foo": &pkg{name: "wp/foo", files: []*goFile{{name: "foo/foo.go"}}}})
+	tagged := map[string]*graph{"integration": graphOf(map[string]*pkg{"wp/foo": &pkg{name: "wp/foo", files: []*goFile{
+		{name: "foo/foo_integration.go", imports: []*goImport{{path: "wp/fixtures", line: 5}}},
+	}}})}
+	var report report
+	report.add("integration", "integration", severityError, []*violation{{Kind: kindDisallowed, From: "wp/foo", To: "wp/fixtures"}})
+	defs := &defs{Rules: []*rule{&rule{ID: "integration", Name: "integration", BuildTags: []string{"integration"}}}}
+
+	// Violations of rules with build tags are suppressed in the files of
+	// their tags.
+	annotations, skipped := defs.annotations(g, tagged, &report, &selection{})
+	require.Equal(s.T(), []*annotation{{"foo/foo_integration.go", 5}}, annotations)
+	require.Empty(s.T(), skipped)
+}
+
+func (s *Zuite) TestAnnotateImports() {
+	dir, err := ioutil.TempDir("", "depper")
+	require.NoError(s.T(), err)
+	defer os.RemoveAll(dir)
+	path := filepath.Join(dir, "foo", "foo.go")
+	require.NoError(s.T(), os.MkdirAll(filepath.Dir(path), 0755))
+	require.NoError(s.T(), ioutil.WriteFile(path, []byte(`package foo
+
+import (
+	"fmt"
+	_ "net/http/pprof"
+	"wp/bar"
+)
+
+import "wp/baz"
+`), 0644))
+
+	goPkg := &packages.Package{GoFiles: []string{path}}
+	files, _, err := parseFiles(dir, goPkg)
+	require.NoError(s.T(), err)
+	g := graphOf(map[string]*pkg{"wp/foo": &pkg{name: "wp/foo", files: files}})
+
+	var report report
+	report.add("", "services", severityError, []*violation{
+		{Kind: kindDisallowed, From: "wp/foo", To: "wp/bar"},
+		{Kind: kindDisallowed, From: "wp/foo", To: "wp/qux"},
+	})
+	report.add("", "crypto", severityError, []*violation{
+		{Kind: kindDisallowed, From: "wp/foo", To: "wp/baz"},
+	})
+	report.add("", "blank imports", severityError, []*violation{
+		{Kind: kindBlank, From: "wp/foo", To: "net/http/pprof", Position: "foo/foo.go:5"},
+	})
+	defs := &defs{Rules: []*rule{&rule{Name: "crypto", Exclusive: true}}}
+
+	// Violations of exclusive rules, and without imports, cannot be
+	// suppressed.
+	annotations, skipped := defs.annotations(g, nil, &report, &selection{})
+	require.Equal(s.T(), []*annotation{{"foo/foo.go", 5}, {"foo/foo.go", 6}}, annotations)
+	require.Equal(s.T(), []string{
+		"- disallowed wp/foo -> wp/qux",
+		"- disallowed wp/foo -> wp/baz",
+	}, lines(skipped))
+
+	annotations, _ = defs.annotations(g, nil, &report, &selection{rules: globs{"serv*"}, to: "wp/bar"})
+	require.Equal(s.T(), []*annotation{{"foo/foo.go", 6}}, annotations)
+	annotations, _ = defs.annotations(g, nil, &report, &selection{ids: globs{report.Sections[0].Violations[0].ID}})
+	require.Equal(s.T(), []*annotation{{"foo/foo.go", 6}}, annotations)
+	annotations, _ = defs.annotations(g, nil, &report, &selection{from: "wp/bar"})
+	require.Empty(s.T(), annotations)
+
+	annotations, _ = defs.annotations(g, nil, &report, &selection{})
+	require.NoError(s.T(), annotate(dir, annotations, "legacy, see #123"))
+	data, err := ioutil.ReadFile(path)
+	require.NoError(s.T(), err)
+	require.Equal(s.T(), `package foo
+
+import (
+	"fmt"
+	//depper:allow legacy, see #123
+	_ "net/http/pprof"
+	//depper:allow legacy, see #123
+	"wp/bar"
+)
+
+import "wp/baz"
+`, string(data))
+
+	// The comments are read back, along with trailing ones and those of
+	// single imports.
+	require.NoError(s.T(), ioutil.WriteFile(path, []byte(string(data)+`
+// depper:allow crypto predates the rule
+import "wp/qux"
+
+import "wp/quux" //depper:allow generated
+`), 0644))
+	files, _, err = parseFiles(dir, goPkg)
+	require.NoError(s.T(), err)
+	var allowed []string
+	for _, imp := range files[0].imports {
+		allowed = append(allowed, imp.path+": "+imp.allow)
+	}
+	require.Equal(s.T(), []string{
+		"fmt: ",
+		"net/http/pprof: legacy, see #123",
+		"wp/bar: legacy, see #123",
+		"wp/baz: ",
+		"wp/qux: crypto predates the rule",
+		"wp/quux: generated",
+	}, allowed)
+
+	require.NoError(s.T(), ioutil.WriteFile(path, []byte("package foo\n\nimport \"fmt\" //depper:allow\n"), 0644))
+	_, _, err = parseFiles(dir, goPkg)
+	require.EqualError(s.T(), err, path+":3:14: depper:allow must give a reason")
+}
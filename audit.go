@@ -0,0 +1,67 @@
+// Licensed under the Apache License, Version 2.0 (the "License");
+// you may not use this file except in compliance with the License.
+// You may obtain a copy of the License at
+//
+// http://www.apache.org/licenses/LICENSE-2.0
+//
+// Unless required by applicable law or agreed to in writing, software
+// distributed under the License is distributed on an "AS IS" BASIS,
+// WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+// See the License for the specific language governing permissions and
+// limitations under the License.
+
+package main
+
+import (
+	"fmt"
+	"io"
+)
+
+// unusedAllowances returns, for each rule in order, the `may_depend` entries
+// which allow none of the dependencies of the packages the rule selects, i.e.
+// which match none of those the rule does not forbid with `may_not_depend`,
+// and could be pruned. Rules with build tags, whose dependencies are not part
+// of the graph, have none.
+func (defs *defs) unusedAllowances(g *graph) [][]string {
+	unused := make([][]string, len(defs.Rules))
+	selected := defs.selectPackages(g, nil)
+	for i, rule := range defs.Rules {
+		if len(rule.BuildTags) != 0 {
+			continue
+		}
+		used := make([]bool, len(rule.MayDepend))
+		for _, pkg := range selected[i] {
+			for _, depPkg := range g.dependencies(pkg) {
+				if rule.mayNotDepends.match(depPkg) {
+					continue
+				}
+				for j, pattern := range rule.mayDepends.patterns {
+					used[j] = used[j] || pattern.match(depPkg)
+				}
+			}
+		}
+		for j, expr := range rule.MayDepend {
+			if !used[j] {
+				unused[i] = append(unused[i], expr)
+			}
+		}
+	}
+	return unused
+}
+
+// writeUnusedAllowances writes the unused allowances of every rule having
+// any, under a heading with their count, and returns their total.
+func writeUnusedAllowances(w io.Writer, defs *defs, unused [][]string) int {
+	total := 0
+	for i, rule := range defs.Rules {
+		if len(unused[i]) == 0 {
+			continue
+		}
+		total += len(unused[i])
+		fmt.Fprintf(w, "%s (unused, %s)\n", rule.Name, plural(len(unused[i]), "allowance"))
+		for _, expr := range unused[i] {
+			fmt.Fprintf(w, "- unused     may_depend %s\n", expr)
+		}
+	}
+	return total
+}
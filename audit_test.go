@@ -0,0 +1,68 @@
+// Licensed under the Apache License, Version 2.0 (the "License");
+// you may not use this file except in compliance with the License.
+// You may obtain a copy of the License at
+//
+// http://www.apache.org/licenses/LICENSE-2.0
+//
+// Unless required by applicable law or agreed to in writing, software
+// distributed under the License is distributed on an "AS IS" BASIS,
+// WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+// See the License for the specific language governing permissions and
+// limitations under the License.
+
+package main
+
+import (
+	"bytes"
+
+	"github.com/stretchr/testify/require"
+)
+
+func (s *Zuite) TestUnusedAllowances() {
+	defs, err := parse([]byte(`
+config:
+  working_package: wp
+rules:
+  - name: services
+    packages: services/.*
+    may_depend:
+      - <.*>
+      - models/.*
+      - dal/.*
+      - legacy
+    may_not_depend:
+      - dal/sql
+  - name: models
+    packages: models/.*
+    may_depend:
+      - <.*>
+  - name: tools
+    packages: .*
+    build_tags:
+      - tools
+    may_depend:
+      - third_parties
+`))
+	require.NoError(s.T(), err)
+	g := graphOf(map[string]*pkg{
+		"wp/services/user": &pkg{name: "wp/services/user"},
+		"wp/models/user":   &pkg{name: "wp/models/user"},
+		"wp/dal/sql":       &pkg{name: "wp/dal/sql"},
+		"wp/legacy":        &pkg{name: "wp/legacy"},
+		"fmt":              &pkg{name: "fmt", goroot: true},
+	}, "wp/services/user -> wp/models/user", "wp/services/user -> wp/dal/sql", "wp/services/user -> fmt", "wp/legacy -> fmt")
+
+	// Entries only matching forbidden dependencies allow nothing, and
+	// dependencies of packages the rule does not select do not count.
+	unused := defs.unusedAllowances(g)
+	require.Equal(s.T(), [][]string{{"dal/.*", "legacy"}, {"<.*>"}, nil}, unused)
+
+	var buf bytes.Buffer
+	require.Equal(s.T(), 3, writeUnusedAllowances(&buf, defs, unused))
+	require.Equal(s.T(), `services (unused, 2 allowances)
+- unused     may_depend dal/.*
+- unused     may_depend legacy
+models (unused, 1 allowance)
+- unused     may_depend <.*>
+`, buf.String())
+}
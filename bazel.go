@@ -0,0 +1,197 @@
+// Licensed under the Apache License, Version 2.0 (the "License");
+// you may not use this file except in compliance with the License.
+// You may obtain a copy of the License at
+//
+// http://www.apache.org/licenses/LICENSE-2.0
+//
+// Unless required by applicable law or agreed to in writing, software
+// distributed under the License is distributed on an "AS IS" BASIS,
+// WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+// See the License for the specific language governing permissions and
+// limitations under the License.
+
+package main
+
+import (
+	"bytes"
+	"encoding/xml"
+	"fmt"
+	"os"
+	"os/exec"
+	"path/filepath"
+	"sort"
+	"strings"
+
+	"golang.org/x/tools/go/packages"
+)
+
+// defaultBazelQuery selects the go rules the working rules depend on.
+const defaultBazelQuery = `kind("go_(library|binary)", deps(//...))`
+
+// bazelQuery is the output of bazel query --output=xml, of which only rules
+// are of interest.
+type bazelQuery struct {
+	Rules []*bazelRule `xml:"rule"`
+}
+
+// bazelRule is a rule, e.g. a go_library, along with its attributes.
+type bazelRule struct {
+	Class   string `xml:"class,attr"`
+	Label   string `xml:"name,attr"`
+	Strings []struct {
+		Name  string `xml:"name,attr"`
+		Value string `xml:"value,attr"`
+	} `xml:"string"`
+	Lists []struct {
+		Name   string `xml:"name,attr"`
+		Labels []struct {
+			Value string `xml:"value,attr"`
+		} `xml:"label"`
+	} `xml:"list"`
+}
+
+// attr returns the value of the string attribute.
+func (rule *bazelRule) attr(name string) string {
+	for _, attr := range rule.Strings {
+		if attr.Name == name {
+			return attr.Value
+		}
+	}
+	return ""
+}
+
+// labels returns the labels of the list attribute.
+func (rule *bazelRule) labels(name string) []string {
+	var labels []string
+	for _, list := range rule.Lists {
+		if list.Name != name {
+			continue
+		}
+		for _, label := range list.Labels {
+			labels = append(labels, label.Value)
+		}
+	}
+	return labels
+}
+
+// collectBazel collects the graph from the go rules of the Bazel workspace in
+// root selected by the query, as reported by bazel query, rather than with
+// the go command, e.g. so that generated sources are seen.
+func (defs *defs) collectBazel(root, query string) (*graph, error) {
+	cmd := exec.Command("bazel", "query", "--output=xml", query)
+	cmd.Dir = root
+	if len(defs.env) != 0 {
+		cmd.Env = append(os.Environ(), defs.env...)
+	}
+	var stderr bytes.Buffer
+	cmd.Stderr = &stderr
+	out, err := cmd.Output()
+	if err != nil {
+		return nil, fmt.Errorf("failed to query %s: %s", query, strings.TrimSpace(stderr.String()))
+	}
+	return defs.bazelGraph(root, out)
+}
+
+// bazelGraph returns the graph of the go rules of the query output, rooted at
+// the working package. Packages are known by the importpath of their rules,
+// or for rules of the workspace without one, by their location relative to
+// the working package. They depend on the packages of their deps.
+//
+// As rules do not list the standard library packages they depend on, those
+// are found in the sources of working packages, which are parsed when found
+// in root. Generated sources are not, so that their standard library
+// dependencies are missed.
+func (defs *defs) bazelGraph(root string, output []byte) (*graph, error) {
+	if defs.Config.WorkingPackage == "" {
+		return nil, fmt.Errorf("collecting with bazel needs a working_package")
+	}
+	// Bazel declares XML 1.1, which encoding/xml refuses, but needs none of.
+	if bytes.HasPrefix(output, []byte("<?xml")) {
+		if end := bytes.Index(output, []byte("?>")); end >= 0 {
+			output = output[end+2:]
+		}
+	}
+	var query bazelQuery
+	if err := xml.Unmarshal(output, &query); err != nil {
+		return nil, fmt.Errorf("malformed bazel query output: %s", err)
+	}
+
+	// import paths, by label
+	var (
+		importPaths = make(map[string]string)
+		known       = make(map[string]bool)
+	)
+	for _, rule := range query.Rules {
+		importPath := rule.attr("importpath")
+		if importPath == "" && strings.HasPrefix(rule.Label, "//") {
+			dir := strings.SplitN(strings.TrimPrefix(rule.Label, "//"), ":", 2)[0]
+			importPath = strings.TrimSuffix(defs.Config.WorkingPackage+"/"+dir, "/")
+		}
+		if importPath != "" {
+			importPaths[rule.Label] = importPath
+			known[importPath] = true
+		}
+	}
+
+	g := newGraph(defs.Config.WorkingPackage)
+	for _, rule := range query.Rules {
+		importPath, ok := importPaths[rule.Label]
+		if !ok {
+			continue
+		}
+		node := g.add(&pkg{name: importPath})
+		for _, dep := range rule.labels("deps") {
+			if depPath, ok := importPaths[dep]; ok {
+				g.depend(node, g.add(&pkg{name: depPath}))
+			}
+		}
+		if !defs.isWorking(importPath) {
+			continue
+		}
+		if !strings.HasPrefix(rule.Label, "//") {
+			continue
+		}
+		g.roots = append(g.roots, importPath)
+		node.dir = strings.SplitN(strings.TrimPrefix(rule.Label, "//"), ":", 2)[0]
+
+		// sources of the workspace, i.e. `//dir:file.go`
+		goPkg := &packages.Package{PkgPath: importPath}
+		for _, src := range rule.labels("srcs") {
+			if !strings.HasPrefix(src, "//") || !strings.HasSuffix(src, ".go") {
+				continue
+			}
+			path := filepath.Join(root, filepath.FromSlash(strings.Replace(strings.TrimPrefix(src, "//"), ":", "/", 1)))
+			if _, err := os.Stat(path); err == nil {
+				goPkg.GoFiles = append(goPkg.GoFiles, path)
+			}
+		}
+		files, annotations, err := parseFiles(root, goPkg)
+		if err != nil {
+			g.addLoadError(&violation{Kind: kindBroken, From: importPath, Message: err.Error()})
+		}
+		node.files = append(node.files, files...)
+		if node.annotations == nil {
+			node.annotations = make(map[string]string)
+		}
+		for key, value := range annotations {
+			node.annotations[key] = value
+		}
+		for _, file := range files {
+			for _, imp := range file.imports {
+				first := strings.SplitN(imp.path, "/", 2)[0]
+				if !known[imp.path] && !strings.Contains(first, ".") && !defs.isWorking(imp.path) {
+					g.depend(node, g.add(&pkg{name: imp.path, goroot: true}))
+				}
+			}
+		}
+	}
+	sort.Strings(g.roots)
+	roots := g.roots[:0]
+	for i, root := range g.roots {
+		if i == 0 || root != g.roots[i-1] {
+			roots = append(roots, root)
+		}
+	}
+	g.roots = roots
+	return g, nil
+}
@@ -0,0 +1,99 @@
+// Licensed under the Apache License, Version 2.0 (the "License");
+// you may not use this file except in compliance with the License.
+// You may obtain a copy of the License at
+//
+// http://www.apache.org/licenses/LICENSE-2.0
+//
+// Unless required by applicable law or agreed to in writing, software
+// distributed under the License is distributed on an "AS IS" BASIS,
+// WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+// See the License for the specific language governing permissions and
+// limitations under the License.
+
+package main
+
+import (
+	"io/ioutil"
+	"os"
+
+	"github.com/stretchr/testify/require"
+)
+
+const bazelQueryOutput = `<?xml version="1.1" encoding="UTF-8" standalone="no"?>
+<query version="2">
+    <rule class="go_binary" location="/ws/cmd/server/BUILD.bazel:3:10" name="//cmd/server:server">
+        <list name="deps">
+            <label value="//services/billing:billing"/>
+        </list>
+        <list name="srcs">
+            <label value="//cmd/server:main.go"/>
+        </list>
+    </rule>
+    <rule class="go_library" location="/ws/services/billing/BUILD.bazel:3:11" name="//services/billing:billing">
+        <string name="importpath" value="example.com/app/services/billing"/>
+        <list name="deps">
+            <label value="//proto:billing_go_proto"/>
+            <label value="@com_github_pkg_errors//:errors"/>
+            <label value="@io_bazel_rules_go//go/runfiles:go_default_library"/>
+        </list>
+        <list name="srcs">
+            <label value="//services/billing:billing.go"/>
+        </list>
+    </rule>
+    <rule class="go_library" location="/ws/proto/BUILD.bazel:9:11" name="//proto:billing_go_proto">
+        <string name="importpath" value="example.com/app/proto/billing"/>
+        <list name="srcs">
+            <label value="//proto:billing.pb.go"/>
+        </list>
+    </rule>
+    <rule class="go_library" location="/ext/BUILD.bazel:1:11" name="@com_github_pkg_errors//:errors">
+        <string name="importpath" value="github.com/pkg/errors"/>
+        <list name="srcs">
+            <label value="@com_github_pkg_errors//:errors.go"/>
+        </list>
+    </rule>
+</query>
+`
+
+func (s *Zuite) TestBazelGraph() {
+	dir, err := ioutil.TempDir("", "depper")
+	require.NoError(s.T(), err)
+	defer os.RemoveAll(dir)
+
+	// The generated billing.pb.go is not in the workspace.
+	files := map[string]string{
+		"cmd/server/main.go":          "package main\n\nimport (\n\t\"net/http\"\n\n\t\"example.com/app/services/billing\"\n)\n",
+		"services/billing/billing.go": "// Package billing bills.\n//\n// depper:layer=service\npackage billing\n\nimport (\n\t\"fmt\"\n\n\t\"example.com/app/proto/billing\"\n\t\"github.com/pkg/errors\"\n)\n",
+	}
+	s.writeFiles(dir, files)
+
+	defs := &defs{}
+	defs.Config.WorkingPackage = "example.com/app"
+	g, err := defs.bazelGraph(dir, []byte(bazelQueryOutput))
+	require.NoError(s.T(), err)
+	require.Empty(s.T(), g.loadErrors)
+	require.Equal(s.T(), "example.com/app", g.root)
+	require.Equal(s.T(), []string{"example.com/app/cmd/server", "example.com/app/proto/billing", "example.com/app/services/billing"}, g.roots)
+
+	// Binaries without importpath are known by their location, and
+	// dependencies on rules which are not go rules of the query are left
+	// out.
+	require.Equal(s.T(), []string{"example.com/app/services/billing", "net/http"}, names(g.dependenciesOf("example.com/app/cmd/server")))
+	require.Equal(s.T(), []string{"example.com/app/proto/billing", "fmt", "github.com/pkg/errors"}, names(g.dependenciesOf("example.com/app/services/billing")))
+	require.True(s.T(), g.pkgs["fmt"].goroot)
+	require.False(s.T(), g.pkgs["github.com/pkg/errors"].goroot)
+	require.Empty(s.T(), g.dependenciesOf("github.com/pkg/errors"))
+
+	// Sources found are parsed, for positions and annotations.
+	billing := g.pkgs["example.com/app/services/billing"]
+	require.Equal(s.T(), "services/billing", billing.dir)
+	require.Len(s.T(), billing.files, 1)
+	require.Equal(s.T(), "service", billing.annotations["layer"])
+	require.Empty(s.T(), g.pkgs["example.com/app/proto/billing"].files)
+
+	_, err = defs.bazelGraph(dir, []byte("<query"))
+	require.Error(s.T(), err)
+	defs.Config.WorkingPackage = ""
+	_, err = defs.bazelGraph(dir, []byte(bazelQueryOutput))
+	require.EqualError(s.T(), err, "collecting with bazel needs a working_package")
+}
@@ -0,0 +1,190 @@
+// Licensed under the Apache License, Version 2.0 (the "License");
+// you may not use this file except in compliance with the License.
+// You may obtain a copy of the License at
+//
+// http://www.apache.org/licenses/LICENSE-2.0
+//
+// Unless required by applicable law or agreed to in writing, software
+// distributed under the License is distributed on an "AS IS" BASIS,
+// WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+// See the License for the specific language governing permissions and
+// limitations under the License.
+
+package main
+
+import (
+	"bufio"
+	"bytes"
+	"fmt"
+	"os/exec"
+	"path/filepath"
+	"regexp"
+	"strconv"
+	"strings"
+	"time"
+)
+
+// blame is the commit which introduced a line, as blamed by git.
+type blame struct {
+	Commit string `json:"commit"`
+	Author string `json:"author"`
+	Date   string `json:"date"`
+
+	// boundary is set for lines predating the point of the blamer.
+	boundary bool
+}
+
+// blamer blames the lines of the files of a git checkout, caching the blame
+// of each file. With a point of its history, a revision, e.g. `v2.3.0`, or a
+// date, e.g. `2024-01-31`, it tells which lines were added after it.
+type blamer struct {
+	root  string
+	point string
+	files map[string]map[int]*blame
+}
+
+// sinceLayouts are the layouts of dates accepted as points, others being
+// revisions.
+var sinceLayouts = []string{"2006-01-02", time.RFC3339}
+
+func newBlamer(root, point string) (*blamer, error) {
+	b := &blamer{root: root, point: point, files: make(map[string]map[int]*blame)}
+	if point == "" || b.date() {
+		return b, nil
+	}
+	cmd := exec.Command("git", "rev-parse", "--verify", "--quiet", point+"^{commit}")
+	cmd.Dir = root
+	if err := cmd.Run(); err != nil {
+		return nil, fmt.Errorf("%s is neither a date nor a revision of the git checkout at %s", point, root)
+	}
+	return b, nil
+}
+
+func (b *blamer) date() bool {
+	for _, layout := range sinceLayouts {
+		if _, err := time.Parse(layout, b.point); err == nil {
+			return true
+		}
+	}
+	return false
+}
+
+// blameHeader is the header of each line in porcelain blames, made of the
+// commit, the line in the original file, and the line in the final one.
+var blameHeader = regexp.MustCompile(`^([0-9a-f]{40}) [0-9]+ ([0-9]+)`)
+
+// line returns the blame of the line of the file, relative to the root, or
+// nil when git cannot blame it, e.g. for untracked files.
+func (b *blamer) line(file string, line int) *blame {
+	lines, ok := b.files[file]
+	if !ok {
+		lines = b.blame(file)
+		b.files[file] = lines
+	}
+	return lines[line]
+}
+
+// old indicates whether the line of the file predates the point. Lines git
+// cannot blame are new.
+func (b *blamer) old(file string, line int) bool {
+	blame := b.line(file, line)
+	return blame != nil && blame.boundary
+}
+
+// blame returns the blame of the lines of the file, where those predating
+// the point are blamed on boundary commits, uncommitted changes being new.
+func (b *blamer) blame(file string) map[int]*blame {
+	// Root commits are boundaries too, unless told otherwise.
+	args := []string{"blame", "--porcelain", "--root"}
+	if b.point != "" && b.date() {
+		args = append(args, "--since="+b.point)
+	} else if b.point != "" {
+		args = append(args, "^"+b.point)
+	}
+	cmd := exec.Command("git", append(args, "--", filepath.FromSlash(file))...)
+	cmd.Dir = b.root
+	out, err := cmd.Output()
+	if err != nil {
+		return nil
+	}
+
+	// Commits are described the first time they are blamed.
+	var (
+		lines   = make(map[int]*blame)
+		commits = make(map[string]*blame)
+		commit  *blame
+	)
+	scanner := bufio.NewScanner(bytes.NewReader(out))
+	scanner.Buffer(nil, 1<<20)
+	for scanner.Scan() {
+		text := scanner.Text()
+		if match := blameHeader.FindStringSubmatch(text); match != nil {
+			commit = commits[match[1]]
+			if commit == nil {
+				commit = &blame{Commit: match[1]}
+				commits[match[1]] = commit
+			}
+			line, _ := strconv.Atoi(match[2])
+			lines[line] = commit
+			continue
+		}
+		switch key := strings.SplitN(text, " ", 2); {
+		case commit == nil || strings.HasPrefix(text, "\t"):
+		case key[0] == "boundary":
+			commit.boundary = true
+		case key[0] == "author" && len(key) == 2:
+			commit.Author = key[1]
+		case key[0] == "author-time" && len(key) == 2:
+			seconds, _ := strconv.ParseInt(key[1], 10, 64)
+			commit.Date = time.Unix(seconds, 0).UTC().Format(time.RFC3339)
+		}
+	}
+	return lines
+}
+
+// blameViolations sets the blame of violations, i.e. that of their line for
+// those with a position, or that of the oldest import of the dependency by
+// the package otherwise, so that their age can be told when triaging them.
+func (defs *defs) blameViolations(report *report, g *graph, tagged map[string]*graph, b *blamer) {
+	graphs := defs.sectionGraphs(g, tagged)
+	for _, section := range report.Sections {
+		for _, v := range section.Violations {
+			if path, line, ok := splitPosition(v.Position); ok {
+				v.Blame = b.line(path, line)
+				continue
+			}
+			ruleGraph := graphs[section.ID]
+			if ruleGraph == nil {
+				ruleGraph = g
+			}
+			pkg := ruleGraph.pkgs[v.From]
+			if pkg == nil {
+				continue
+			}
+			to := strings.TrimSuffix(strings.TrimPrefix(v.To, "<"), ">")
+			for _, file := range pkg.files {
+				for _, imp := range file.imports {
+					if imp.path != to {
+						continue
+					}
+					if blame := b.line(file.name, imp.line); blame != nil && (v.Blame == nil || blame.Date < v.Blame.Date) {
+						v.Blame = blame
+					}
+				}
+			}
+		}
+	}
+}
+
+// sectionGraphs returns the graph each rule is checked against, by the ID of
+// its section.
+func (defs *defs) sectionGraphs(g *graph, tagged map[string]*graph) map[string]*graph {
+	graphs := make(map[string]*graph)
+	for _, rule := range defs.Rules {
+		graphs[rule.ID] = g
+		if len(rule.BuildTags) != 0 {
+			graphs[rule.ID] = tagged[strings.Join(rule.BuildTags, ",")]
+		}
+	}
+	return graphs
+}
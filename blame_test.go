@@ -0,0 +1,81 @@
+// Licensed under the Apache License, Version 2.0 (the "License");
+// you may not use this file except in compliance with the License.
+// You may obtain a copy of the License at
+//
+// http://www.apache.org/licenses/LICENSE-2.0
+//
+// Unless required by applicable law or agreed to in writing, software
+// distributed under the License is distributed on an "AS IS" BASIS,
+// WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+// See the License for the specific language governing permissions and
+// limitations under the License.
+
+package main
+
+import (
+	"io/ioutil"
+	"os"
+	"os/exec"
+
+	"github.com/stretchr/testify/require"
+)
+
+func (s *Zuite) TestBlameViolations() {
+	dir, err := ioutil.TempDir("", "depper")
+	require.NoError(s.T(), err)
+	defer os.RemoveAll(dir)
+
+	commit := func(author, date string, files map[string]string) {
+		s.writeFiles(dir, files)
+		for _, args := range [][]string{
+			{"init", "-q"},
+			{"add", "."},
+			{"-c", "user.name=" + author, "-c", "user.email=" + author + "@example.com", "commit", "-q", "-m", "change"},
+		} {
+			cmd := exec.Command("git", args...)
+			cmd.Dir = dir
+			cmd.Env = append(os.Environ(), "GIT_AUTHOR_DATE="+date, "GIT_COMMITTER_DATE="+date)
+			out, err := cmd.CombinedOutput()
+			require.NoError(s.T(), err, string(out))
+		}
+	}
+	commit("alice", "2020-01-01T00:00:00Z", map[string]string{
+		"services/user/user.go": "package user\n\nimport (\n\t_ \"wp/dal/sql\"\n)\n",
+	})
+	commit("bob", "2022-06-01T12:00:00Z", map[string]string{
+		"services/user/admin.go": "package user\n\nimport (\n\t_ \"wp/dal/sql\"\n\t_ \"wp/dal/legacy\"\n)\n",
+	})
+	s.writeFiles(dir, map[string]string{
+		"services/order/order.go": "package order\n\nimport _ \"wp/dal/sql\"\n",
+	})
+
+	g := graphOf(map[string]*pkg{
+		"wp/services/user": &pkg{name: "wp/services/user", files: []*goFile{
+			{name: "services/user/admin.go", imports: []*goImport{{path: "wp/dal/sql", line: 4}, {path: "wp/dal/legacy", line: 5}}},
+			{name: "services/user/user.go", imports: []*goImport{{path: "wp/dal/sql", line: 4}}},
+		}},
+		"wp/services/order": &pkg{name: "wp/services/order", files: []*goFile{{name: "services/order/order.go", imports: []*goImport{{path: "wp/dal/sql", line: 3}}}}},
+		"wp/dal/legacy":     &pkg{name: "wp/dal/legacy"},
+		"wp/dal/sql":        &pkg{name: "wp/dal/sql"},
+	}, "wp/services/user -> wp/dal/legacy", "wp/services/user -> wp/dal/sql", "wp/services/order -> wp/dal/sql")
+	var report report
+	report.add("", "no db", severityError, []*violation{
+		{Kind: kindDisallowed, From: "wp/services/user", To: "wp/dal/sql"},
+		{Kind: kindDisallowed, From: "wp/services/order", To: "wp/dal/sql"},
+		{Kind: kindBlank, From: "wp/services/user", To: "wp/dal/legacy", Position: "services/user/admin.go:5"},
+	})
+
+	// Dependencies are blamed on their oldest import, untracked files on
+	// nothing.
+	b, err := newBlamer(dir, "")
+	require.NoError(s.T(), err)
+	var defs defs
+	defs.blameViolations(&report, g, nil, b)
+	violations := report.Sections[0].Violations
+	require.Equal(s.T(), "alice", violations[0].Blame.Author)
+	require.Equal(s.T(), "2020-01-01T00:00:00Z", violations[0].Blame.Date)
+	require.Len(s.T(), violations[0].Blame.Commit, 40)
+	require.Nil(s.T(), violations[1].Blame)
+	require.Equal(s.T(), "bob", violations[2].Blame.Author)
+	require.Equal(s.T(), "2022-06-01T12:00:00Z", violations[2].Blame.Date)
+}
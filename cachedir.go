@@ -0,0 +1,79 @@
+// Licensed under the Apache License, Version 2.0 (the "License");
+// you may not use this file except in compliance with the License.
+// You may obtain a copy of the License at
+//
+// http://www.apache.org/licenses/LICENSE-2.0
+//
+// Unless required by applicable law or agreed to in writing, software
+// distributed under the License is distributed on an "AS IS" BASIS,
+// WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+// See the License for the specific language governing permissions and
+// limitations under the License.
+
+package main
+
+import (
+	"fmt"
+	"os"
+	"os/exec"
+	"path/filepath"
+	"strings"
+)
+
+// cacheEnv is the environment variable setting the directory of everything
+// depper caches, e.g. for CI to restore a single directory.
+const cacheEnv = "DEPPER_CACHE"
+
+// cacheDir returns the directory of everything depper caches, i.e. workspace
+// clones, included files and published modules checked. It is, in order
+//
+// - DEPPER_CACHE, set in the environment or with the go command's;
+// - the `cache_dir` of the config;
+// - `depper` next to the build cache of the go command, i.e. GOCACHE; or
+// - `depper` in the user cache directory.
+func (defs *defs) cacheDir() (string, error) {
+	if dir := defs.getenv(cacheEnv); dir != "" {
+		return dir, nil
+	}
+	if defs.Config.CacheDir != "" {
+		return defs.Config.CacheDir, nil
+	}
+	cmd := exec.Command("go", "env", "GOCACHE")
+	if len(defs.env) != 0 {
+		cmd.Env = append(os.Environ(), defs.env...)
+	}
+	if out, err := cmd.Output(); err == nil {
+		if gocache := strings.TrimSpace(string(out)); filepath.IsAbs(gocache) {
+			return filepath.Join(filepath.Dir(gocache), "depper"), nil
+		}
+	}
+	dir, err := os.UserCacheDir()
+	if err != nil {
+		return "", err
+	}
+	return filepath.Join(dir, "depper"), nil
+}
+
+// getenv returns the environment variable, as set for the go command, or in
+// the environment.
+func (defs *defs) getenv(key string) string {
+	for i := len(defs.env) - 1; i >= 0; i-- {
+		if strings.HasPrefix(defs.env[i], key+"=") {
+			return strings.TrimPrefix(defs.env[i], key+"=")
+		}
+	}
+	return os.Getenv(key)
+}
+
+// cleanCache removes the cache directory, unless it holds the current
+// directory cwd, e.g. when DEPPER_CACHE is mistakenly set to the repository.
+func cleanCache(dir, cwd string) error {
+	dir, err := filepath.Abs(dir)
+	if err != nil {
+		return err
+	}
+	if rel, err := filepath.Rel(dir, cwd); err == nil && rel != ".." && !strings.HasPrefix(rel, ".."+string(filepath.Separator)) {
+		return fmt.Errorf("refusing to remove %s, which holds the current directory", dir)
+	}
+	return os.RemoveAll(dir)
+}
@@ -0,0 +1,52 @@
+// Licensed under the Apache License, Version 2.0 (the "License");
+// you may not use this file except in compliance with the License.
+// You may obtain a copy of the License at
+//
+// http://www.apache.org/licenses/LICENSE-2.0
+//
+// Unless required by applicable law or agreed to in writing, software
+// distributed under the License is distributed on an "AS IS" BASIS,
+// WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+// See the License for the specific language governing permissions and
+// limitations under the License.
+
+package main
+
+import (
+	"io/ioutil"
+	"os"
+	"path/filepath"
+
+	"github.com/stretchr/testify/require"
+)
+
+func (s *Zuite) TestCacheDir() {
+	dir, err := ioutil.TempDir("", "depper")
+	require.NoError(s.T(), err)
+	defer os.RemoveAll(dir)
+
+	// The cache follows the build cache of the go command, unless
+	// configured.
+	defs := &defs{env: []string{"GOCACHE=" + filepath.Join(dir, "go-build")}}
+	cacheDir, err := defs.cacheDir()
+	require.NoError(s.T(), err)
+	require.Equal(s.T(), filepath.Join(dir, "depper"), cacheDir)
+
+	defs.Config.CacheDir = filepath.Join(dir, "config")
+	cacheDir, err = defs.cacheDir()
+	require.NoError(s.T(), err)
+	require.Equal(s.T(), filepath.Join(dir, "config"), cacheDir)
+
+	defs.env = append(defs.env, "DEPPER_CACHE="+filepath.Join(dir, "ci"))
+	cacheDir, err = defs.cacheDir()
+	require.NoError(s.T(), err)
+	require.Equal(s.T(), filepath.Join(dir, "ci"), cacheDir)
+
+	// Cleaning removes the cache, but never the current directory.
+	require.NoError(s.T(), os.MkdirAll(filepath.Join(cacheDir, "workspace", "repo"), 0755))
+	require.NoError(s.T(), cleanCache(cacheDir, dir))
+	_, err = os.Stat(cacheDir)
+	require.True(s.T(), os.IsNotExist(err))
+	require.EqualError(s.T(), cleanCache(dir, filepath.Join(dir, "repo")), "refusing to remove "+dir+", which holds the current directory")
+	require.NoError(s.T(), cleanCache(filepath.Join(dir, "repo-cache"), filepath.Join(dir, "repo")))
+}
@@ -0,0 +1,1392 @@
+// Licensed under the Apache License, Version 2.0 (the "License");
+// you may not use this file except in compliance with the License.
+// You may obtain a copy of the License at
+//
+// http://www.apache.org/licenses/LICENSE-2.0
+//
+// Unless required by applicable law or agreed to in writing, software
+// distributed under the License is distributed on an "AS IS" BASIS,
+// WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+// See the License for the specific language governing permissions and
+// limitations under the License.
+
+package main
+
+import (
+	"encoding/json"
+	"flag"
+	"fmt"
+	"io"
+	"io/ioutil"
+	"os"
+	"path/filepath"
+	"sort"
+	"strings"
+	"text/template"
+)
+
+// command is a subcommand of depper, e.g. `depper check`.
+type command struct {
+	name    string
+	args    string // usage of the arguments following the flags
+	summary string
+
+	// setup defines the flags of the command, and returns the function
+	// running it with the remaining arguments, which returns the exit code.
+	setup func(flags *flag.FlagSet) func(args []string) int
+}
+
+// commands are the subcommands of depper. Without any, depper checks, i.e.
+// `depper config.yaml` is `depper check config.yaml`.
+var commands []*command
+
+func init() {
+	commands = []*command{
+		{"check", "[config.yaml|-]", "check the rules against the collected graph", func(flags *flag.FlagSet) func([]string) int {
+			return setupCheck(flags, false)
+		}},
+		{"merge", "[config.yaml|-] graph.json...", "check the rules against the merged graph snapshots of shards", func(flags *flag.FlagSet) func([]string) int {
+			return setupCheck(flags, true)
+		}},
+		{"graph", "[config.yaml|-]", "export the collected graph as DOT, Mermaid or GraphML", setupGraph},
+		{"list", "[config.yaml|-]", "list the collected packages", setupList},
+		{"why", "[config.yaml|-] package dependency", "show the shortest chain of imports from a package to a dependency, or of imports and requirements to a module", setupWhy},
+		{"simulate", "[config.yaml|-]", "check the rules as if packages were moved with --move, or dependencies added with --add-edge, and report what would break", setupSimulate},
+		{"audit", "[config.yaml|-]", "list the may_depend entries of rules allowing none of the dependencies of the graph", setupAudit},
+		{"annotate", "[config.yaml|-]", "suppress the selected violations with //depper:allow comments on their imports", setupAnnotate},
+		{"aggregate", "report.json...", "summarize the json reports of many runs, e.g. of every repository of an organization", setupAggregate},
+		{"cycles", "[config.yaml|-]", "check the cycle pairs among acyclic groups against the budget stored with --update, failing on new ones", setupCycles},
+		{"modules", "[config.yaml|-]", "list the modules go.mod requires, marking those no working package reaches", setupModules},
+		{"closure", "[config.yaml|-] main", "list the packages and modules an entry point links", setupClosure},
+		{"test", "[config.yaml] fixtures", "check the config against fixture trees and compare with their expected violations", setupTest},
+		{"init", "[dir]", "write a starter depper.yaml for the module", setupInit},
+		{"doctor", "[config.yaml]", "check the environment depper runs in", setupDoctor},
+		{"cache", "dir|clean [config.yaml|-]", "print or remove the directory of what depper caches", setupCache},
+		{"schema", "", "write the JSON Schema of configs", setupSchema},
+		{"version", "", "print the version of depper and the config schema versions it supports", setupVersion},
+	}
+}
+
+func main() {
+	os.Exit(run(os.Args[1:]))
+}
+
+// run runs the subcommand named by the first argument, checking if there is
+// none, and returns the exit code.
+func run(args []string) int {
+	cmd := commands[0]
+	if len(args) != 0 {
+		switch args[0] {
+		case "help", "-h", "-help", "--help":
+			usage(os.Stdout)
+			return 0
+		}
+		for _, c := range commands {
+			if c.name == args[0] {
+				cmd, args = c, args[1:]
+				break
+			}
+		}
+	}
+
+	flags := flag.NewFlagSet("depper "+cmd.name, flag.ContinueOnError)
+	runCommand := cmd.setup(flags)
+	flags.Usage = func() {
+		fmt.Fprintf(flags.Output(), "usage: depper %s [flags] %s\n\n%s.\n\n", cmd.name, cmd.args, cmd.summary)
+		flags.PrintDefaults()
+	}
+	if err := flags.Parse(args); err != nil {
+		if err == flag.ErrHelp {
+			return 0
+		}
+		return 2
+	}
+	return runCommand(flags.Args())
+}
+
+// usage writes the subcommands of depper.
+func usage(w io.Writer) {
+	fmt.Fprintln(w, "usage: depper [command] [flags] [arguments]")
+	fmt.Fprintln(w)
+	fmt.Fprintln(w, "Commands:")
+	width := 0
+	for _, cmd := range commands {
+		if len(cmd.name) > width {
+			width = len(cmd.name)
+		}
+	}
+	for _, cmd := range commands {
+		fmt.Fprintf(w, "  %-*s  %s\n", width, cmd.name, cmd.summary)
+	}
+	fmt.Fprintln(w)
+	fmt.Fprintln(w, "Without a command, depper checks, i.e. depper config.yaml is depper check config.yaml.")
+	fmt.Fprintln(w, "Use depper <command> -h for the flags and arguments of a command.")
+}
+
+// collection holds the flags of commands collecting the graph.
+type collection struct {
+	roots, buildFlags, mod, mode, cachePath, loadGraph *string
+	loader, bazelQuery, module                         *string
+	incremental                                        *bool
+	env                                                environment
+}
+
+func (c *collection) register(flags *flag.FlagSet) {
+	c.loadGraph = flags.String("load-graph", "", "use the graph saved with --save-graph rather than collecting it")
+	c.cachePath = flags.String("cache", "", "cache the collected graph in this file, and only collect the packages which changed since again")
+	c.incremental = flags.Bool("incremental", false, "cache the collected graph as --cache does, in the cache directory")
+	c.roots = flags.String("roots", "", "comma separated patterns of the packages to collect the graph from, e.g. ./services/..., rather than load_patterns of the config or the package in the current directory")
+	c.loader = flags.String("loader", "go", "how the graph is collected, one of go, or bazel for the go rules of a Bazel workspace")
+	c.bazelQuery = flags.String("bazel-query", defaultBazelQuery, "bazel query of the go rules to collect the graph from, with --loader=bazel")
+	c.registerGo(flags)
+}
+
+// registerGo defines the flags of the go command collecting packages only.
+func (c *collection) registerGo(flags *flag.FlagSet) {
+	c.buildFlags = flags.String("buildflags", "", "space separated flags of the go command collecting packages, e.g. '-tags=integration'")
+	flags.Var(&c.env, "env", "KEY=VALUE environment variable of the go command collecting packages, e.g. GOPRIVATE=github.com/org (repeatable)")
+	c.mod = flags.String("mod", "", "module download mode of the go command collecting packages, one of readonly, vendor or mod")
+	c.mode = flags.String("mode", "auto", "how packages are collected, one of modules, gopath for pre-modules projects, or auto for gopath outside of modules within the GOPATH")
+}
+
+// prepare applies the flags to the definitions, loads the graph snapshots,
+// if any, and compiles the definitions. The working package defaults to the
+// root of the snapshots, or the package in dir.
+func (c *collection) prepare(defs *defs, dir string, snapshots []string) (*graph, map[string]*graph, error) {
+	if *c.mod != "" && *c.mod != "readonly" && *c.mod != "vendor" && *c.mod != "mod" {
+		return nil, nil, fmt.Errorf("unknown module download mode %s, must be readonly, vendor or mod", *c.mod)
+	}
+	if *c.mode != "auto" && *c.mode != "modules" && *c.mode != "gopath" {
+		return nil, nil, fmt.Errorf("unknown mode %s, must be auto, modules or gopath", *c.mode)
+	}
+	bazel := c.loader != nil && *c.loader == "bazel"
+	if c.loader != nil && *c.loader != "go" && !bazel {
+		return nil, nil, fmt.Errorf("unknown loader %s, must be go or bazel", *c.loader)
+	}
+	defs.buildFlags, defs.env = strings.Fields(*c.buildFlags), c.env
+	if *c.mod != "" {
+		defs.buildFlags = append(defs.buildFlags, "-mod="+*c.mod)
+	}
+	if *c.mode == "gopath" || *c.mode == "auto" && inGopath(dir, defs.env) {
+		defs.env = append(defs.env, "GO111MODULE=off")
+	}
+
+	// Load the saved graph, if any.
+	var (
+		g      *graph
+		tagged map[string]*graph
+		err    error
+	)
+	if len(snapshots) != 0 {
+		g, tagged, err = mergeSnapshots(snapshots)
+		if err != nil {
+			return nil, nil, err
+		}
+	}
+
+	if defs.Config.WorkingPackage == "" {
+		if g != nil {
+			defs.Config.WorkingPackage = g.root
+		} else if bazel {
+			// Without the go command, the working package is only known
+			// from the config.
+			return nil, nil, fmt.Errorf("collecting with bazel needs a working_package")
+		} else {
+			defs.Config.WorkingPackage, err = defs.rootPackage(dir)
+			if err != nil {
+				return nil, nil, err
+			}
+		}
+	}
+	if err := defs.compile(); err != nil {
+		return nil, nil, err
+	}
+	return g, tagged, nil
+}
+
+// collector returns the function collecting the graph from dir with build
+// tags, reusing the cached graph where possible, and the function saving the
+// cache, if any.
+func (c *collection) collector(defs *defs, dir string) (func(tags []string) (*graph, error), func() error) {
+	roots := defs.Config.LoadPatterns
+	if *c.roots != "" {
+		roots = strings.Split(*c.roots, ",")
+	}
+	var (
+		cache     *cache
+		cachePath = *c.cachePath
+		cacheErr  error
+	)
+	if cachePath == "" && *c.incremental {
+		cachePath, cacheErr = defs.graphCachePath(dir)
+	}
+	if cachePath != "" {
+		cache = loadCache(cachePath)
+	}
+	collect := func(tags []string) (*graph, error) {
+		if cacheErr != nil {
+			return nil, cacheErr
+		}
+		var (
+			g    *graph
+			err  error
+			span = defs.trace.child("collect")
+		)
+		defer span.finish()
+		span.set("depper.build_tags", strings.Join(tags, ","))
+		switch {
+		case c.module != nil && *c.module != "":
+			if cache != nil {
+				return nil, fmt.Errorf("caching is not supported when checking a published module")
+			}
+			g, err = defs.collectModule(*c.module, tags)
+		case *c.loader == "bazel":
+			if len(tags) != 0 || cache != nil {
+				return nil, fmt.Errorf("build tags and caching are not supported when collecting with bazel")
+			}
+			g, err = defs.collectBazel(dir, *c.bazelQuery)
+		case cache == nil:
+			g, err = defs.collectPackages(dir, roots, tags)
+		default:
+			g, err = defs.collectIncrementally(dir, roots, tags, cache)
+		}
+		if err == nil && len(defs.Config.Workspace) != 0 {
+			g, err = defs.collectWorkspace(g, tags)
+		}
+		if err == nil {
+			span.set("depper.packages", len(g.pkgs))
+		}
+		return g, err
+	}
+	save := func() error {
+		if cache == nil {
+			return nil
+		}
+		return cache.save(cachePath)
+	}
+	return collect, save
+}
+
+// graph returns the graph of the definitions, either saved or collected from
+// dir.
+func (c *collection) graph(defs *defs, dir string) (*graph, error) {
+	var snapshots []string
+	if *c.loadGraph != "" {
+		snapshots = append(snapshots, *c.loadGraph)
+	}
+	g, _, err := c.prepare(defs, dir, snapshots)
+	if err != nil || g != nil {
+		return g, err
+	}
+	collect, save := c.collector(defs, dir)
+	if g, err = collect(nil); err != nil {
+		return nil, err
+	}
+	return g, save()
+}
+
+// graphs returns the graph of the definitions as graph does, along with the
+// graphs of the build tags of rules, keyed by the comma separated tags, as
+// check takes them.
+func (c *collection) graphs(defs *defs, dir string) (*graph, map[string]*graph, error) {
+	var snapshots []string
+	if *c.loadGraph != "" {
+		snapshots = append(snapshots, *c.loadGraph)
+	}
+	g, tagged, err := c.prepare(defs, dir, snapshots)
+	if err != nil {
+		return nil, nil, err
+	}
+	collect, save := c.collector(defs, dir)
+	if g == nil {
+		if g, err = collect(nil); err != nil {
+			return nil, nil, err
+		}
+		tagged = make(map[string]*graph)
+	}
+	for _, rule := range defs.Rules {
+		key := strings.Join(rule.BuildTags, ",")
+		if _, ok := tagged[key]; ok || key == "" {
+			continue
+		}
+		if len(snapshots) != 0 {
+			return nil, nil, fmt.Errorf("graph snapshots lack build tags %s of rule %s, save them again", key, rule.Name)
+		}
+		taggedGraph, err := collect(rule.BuildTags)
+		if err != nil {
+			return nil, nil, err
+		}
+		tagged[key] = taggedOnly(g, taggedGraph)
+	}
+	return g, tagged, save()
+}
+
+// loadDefs reads the config at configPath, from the standard input if `-`,
+// or the config found from dir if empty. Without a config, the definitions
+// are empty unless required.
+func loadDefs(dir, configPath string, required bool) (*defs, error) {
+	if configPath == "" {
+		var err error
+		configPath, err = findConfig(dir)
+		if err != nil {
+			return nil, err
+		}
+		if configPath == "" {
+			if required {
+				return nil, fmt.Errorf("no depper.yaml or .depper.yaml found up to the module root")
+			}
+			return &defs{}, nil
+		}
+	}
+	return readFile(configPath)
+}
+
+// setupCheck defines the flags of the check command, which when merging
+// checks against the graph snapshots of shards, merged.
+func setupCheck(flags *flag.FlagSet, merging bool) func([]string) int {
+	var c collection
+	c.register(flags)
+	c.module = flags.String("module", "", "check the published module of this version, e.g. github.com/org/lib@v1.4.0, downloaded into the module cache rather than checked out, as the working package")
+	showExpected := flags.Bool("show-expected", false, "list the expected dependencies exercised, per rule")
+	showProgress := flags.Bool("progress", false, "print each rule and check to the standard error once checked, with the number of packages rules selected and of violations")
+	cycleBudget := flags.String("cycle-budget", "", "tolerate cycles among acyclic groups, as warnings, while their pairs are within the budget stored in this file by depper cycles --update")
+	enforceSince := flags.String("enforce-since", "", "only enforce rules on imports added after this git revision or date, e.g. v2.3.0 or 2024-01-31, as blamed by git")
+	inventory := flags.Bool("inventory", false, "record the third party modules working packages depend on as third_parties in the json format, e.g. for depper aggregate")
+	blameFlag := flags.Bool("blame", false, "annotate violations with the commit, author and date which introduced them, as blamed by git, e.g. in the json format")
+	explain := flags.String("explain-match", "", "explain on the standard error how every rule evaluates this package, written as in rules or by import path")
+	failOn := flags.String("fail-on", severityError, "lowest severity failing the run, one of error, warn or never")
+	maxViolations := flags.Int("max-violations", 0, "number of violations at the fail-on severity or above tolerated before failing")
+	output := flags.String("output", "-", "default destination of formats, - for the standard output")
+	known := strings.Join(formats, ", ")
+	var formats outputs
+	flags.Var(&formats, "format", "output format, one of "+known+", optionally followed by :destination (repeatable)")
+	templatePath := flags.String("template", "", "template file for the template format")
+	saveGraph := flags.String("save-graph", "", "save the collected graph to this file, - for the standard output")
+	var rules inlineRules
+	flags.Var(&rules, "rule", "ad-hoc rule, e.g. 'services/.* !> dal/.*' (repeatable)")
+	flags.StringVar(&formats.color, "color", "auto", "colorize the text format, one of auto, always or never")
+	flags.BoolVar(&formats.sources, "show-rule-source", false, "tell where every rule with violations was read from, e.g. its file, in the text format")
+	parallelism := flags.Int("parallelism", 0, "number of rules checked concurrently, as many as there are CPUs by default")
+	dryRun := flags.Bool("dry-run", false, "report what would be violations, and never fail")
+	var onlyRules, skipRules globs
+	flags.Var(&onlyRules, "only-rule", "only check the rules of this name or ID, where * matches any characters (repeatable)")
+	flags.Var(&skipRules, "skip-rule", "do not check the rules of this name or ID, where * matches any characters (repeatable)")
+	webhook := flags.String("notify-webhook", "", "post a summary of new violations to this Slack compatible webhook")
+	baselinePath := flags.String("notify-baseline", "", "json report of a previous run, violations of which are not new to --notify-webhook")
+	baselineMatch := flags.String("notify-baseline-match", matchID, "how violations are matched with those of --notify-baseline, one of id, or target to match by rule and dependency target, e.g. when importers move")
+
+	return func(args []string) int {
+		if *failOn != severityError && *failOn != severityWarn && *failOn != "never" ||
+			formats.color != "auto" && formats.color != "always" && formats.color != "never" ||
+			*baselineMatch != matchID && *baselineMatch != matchTarget {
+			flags.Usage()
+			return 1
+		}
+
+		if *templatePath != "" {
+			var err error
+			formats.template, err = template.ParseFiles(*templatePath)
+			if err != nil {
+				fmt.Fprintln(os.Stderr, err)
+				return 1
+			}
+		}
+
+		cwd, err := os.Getwd()
+		if err != nil {
+			fmt.Fprintln(os.Stderr, err)
+			return 1
+		}
+		var b *blamer
+		if *enforceSince != "" || *blameFlag {
+			b, err = newBlamer(cwd, *enforceSince)
+			if err != nil {
+				fmt.Fprintln(os.Stderr, err)
+				return 1
+			}
+		}
+
+		// When merging, arguments are graph snapshots, but for the config.
+		var snapshots, configArgs []string
+		for _, arg := range args {
+			if merging && strings.HasSuffix(arg, ".json") {
+				snapshots = append(snapshots, arg)
+			} else {
+				configArgs = append(configArgs, arg)
+			}
+		}
+		if merging && len(snapshots) == 0 || len(configArgs) > 1 {
+			flags.Usage()
+			return 1
+		}
+		if *c.loadGraph != "" {
+			snapshots = append(snapshots, *c.loadGraph)
+		}
+
+		// When only ad-hoc rules are given, no config is looked for.
+		var configPath string
+		if len(configArgs) == 1 {
+			configPath = configArgs[0]
+		}
+		defs := &defs{}
+		if configPath != "" || len(rules) == 0 {
+			defs, err = loadDefs(cwd, configPath, true)
+			if err != nil {
+				fmt.Fprintln(os.Stderr, err)
+				flags.Usage()
+				return 1
+			}
+		}
+		if warning := defs.schemaWarning(); warning != "" {
+			fmt.Fprintln(os.Stderr, "warning: "+warning)
+		}
+		defs.Rules = append(defs.Rules, rules...)
+		if err := defs.filterRules(onlyRules, skipRules); err != nil {
+			fmt.Fprintln(os.Stderr, err)
+			return 1
+		}
+		defs.parallelism = *parallelism
+		if *c.module != "" {
+			defs.Config.WorkingPackage = strings.SplitN(*c.module, "@", 2)[0]
+		}
+
+		// Trace the run, if configured.
+		tracer := newTracer(os.Getenv)
+		defs.trace = tracer.start("depper check")
+
+		g, tagged, err := c.prepare(defs, cwd, snapshots)
+		if err != nil {
+			fmt.Fprintln(os.Stderr, err)
+			return 1
+		}
+
+		// Collect all packages, reusing the cached graph where possible.
+		collect, saveCache := c.collector(defs, cwd)
+		if g == nil {
+			g, err = collect(nil)
+			if err != nil {
+				fmt.Fprintln(os.Stderr, err)
+				return 1
+			}
+			tagged = make(map[string]*graph)
+		}
+
+		// Rules with build tags only consider dependencies introduced by files
+		// which require those tags.
+		for _, rule := range defs.Rules {
+			key := strings.Join(rule.BuildTags, ",")
+			if key == "" {
+				continue
+			}
+			if _, ok := tagged[key]; ok {
+				continue
+			}
+			if len(snapshots) != 0 {
+				fmt.Fprintf(os.Stderr, "graph snapshots lack build tags %s of rule %s, save them again\n", key, rule.Name)
+				return 1
+			}
+			taggedGraph, err := collect(rule.BuildTags)
+			if err != nil {
+				fmt.Fprintln(os.Stderr, err)
+				return 1
+			}
+			tagged[key] = taggedOnly(g, taggedGraph)
+		}
+
+		if len(snapshots) == 0 {
+			if err := saveCache(); err != nil {
+				fmt.Fprintln(os.Stderr, err)
+				return 1
+			}
+		}
+		if *saveGraph != "" {
+			if err := saveSnapshot(*saveGraph, g, tagged); err != nil {
+				fmt.Fprintln(os.Stderr, err)
+				return 1
+			}
+		}
+
+		if *explain != "" {
+			if err := defs.explainMatch(os.Stderr, g, tagged, *explain); err != nil {
+				fmt.Fprintln(os.Stderr, err)
+				return 1
+			}
+		}
+
+		// Run all checks.
+		var opts []checkOption
+		if *showProgress {
+			opts = progress(os.Stderr)
+		}
+		report := defs.check(g, tagged, *showExpected, opts...)
+		report.DryRun = *dryRun
+		if *enforceSince != "" {
+			if dropped := defs.enforceSince(report, g, tagged, b); dropped != 0 {
+				fmt.Fprintf(os.Stderr, "not enforcing %s predating %s\n", plural(dropped, "violation"), *enforceSince)
+			}
+		}
+		if *blameFlag {
+			defs.blameViolations(report, g, tagged, b)
+		}
+		if defs.Score != nil {
+			report.Score = defs.score(report, g)
+		}
+		if *cycleBudget != "" {
+			sections, count := defs.cycleSections(report)
+			message, above, err := checkCycleBudget(*cycleBudget, count, false)
+			if err != nil {
+				fmt.Fprintln(os.Stderr, err)
+				return 1
+			}
+			fmt.Fprintln(os.Stderr, message)
+			if !above {
+				for _, section := range sections {
+					report.demote(section)
+				}
+			}
+		}
+		if *inventory {
+			// Without the build list, e.g. outside of the module, modules
+			// are guessed.
+			buildList, _ := buildList(defs.loadConfig(cwd, nil))
+			report.ThirdParties = defs.thirdParties(g, buildList)
+		}
+
+		// Notify of new violations, before the baseline may be written
+		// over.
+		if *webhook != "" {
+			baseline, err := loadReport(*baselinePath)
+			if err != nil {
+				fmt.Fprintln(os.Stderr, err)
+				return 1
+			}
+			if err := notify(*webhook, report, newViolations(report, baseline, *baselineMatch)); err != nil {
+				fmt.Fprintln(os.Stderr, err)
+			}
+		}
+
+		// Write the report in all formats.
+		if err := formats.write(report, *output); err != nil {
+			fmt.Fprintln(os.Stderr, err)
+			return 1
+		}
+
+		defs.trace.set("depper.errors", report.Errors)
+		defs.trace.set("depper.warnings", report.Warnings)
+		if report.Score != nil {
+			defs.trace.set("depper.score", report.Score.Score)
+		}
+		defs.trace.finish()
+		if err := tracer.export(); err != nil {
+			fmt.Fprintln(os.Stderr, err)
+		}
+
+		// Status code.
+		if !report.DryRun && failing(report.Errors, report.Warnings, *failOn, *maxViolations) {
+			return 1
+		}
+		return 0
+	}
+}
+
+// setupGraph defines the flags of the graph command.
+func setupGraph(flags *flag.FlagSet) func([]string) int {
+	var c collection
+	c.register(flags)
+	format := flags.String("format", "dot", "export format, one of dot, mermaid or graphml")
+	output := flags.String("output", "-", "destination of the export, - for the standard output")
+	std := flags.Bool("std", false, "include standard library packages")
+	modules := flags.Bool("modules", true, "collapse the packages of each third party module into one")
+	var expand globs
+	flags.Var(&expand, "expand", "keep the packages of the third party modules of this path, where * matches any characters (repeatable)")
+
+	return func(args []string) int {
+		write, ok := exporters[*format]
+		if !ok || len(args) > 1 {
+			flags.Usage()
+			return 1
+		}
+		g, defs, ok := collectFromArgs(&c, args)
+		if !ok {
+			return 1
+		}
+		annotations := defs.annotate(g)
+		if !*std {
+			g = g.subgraph(func(pkg *pkg) bool {
+				return !pkg.goroot
+			})
+		}
+		if *modules {
+			// Without the build list, e.g. outside of the module, modules
+			// are guessed.
+			cwd, err := os.Getwd()
+			if err != nil {
+				fmt.Fprintln(os.Stderr, err)
+				return 1
+			}
+			buildList, _ := buildList(defs.loadConfig(cwd, nil))
+			g, annotations = groupModules(g, annotations, func(pkg *pkg) string {
+				if pkg.goroot || defs.isWorking(pkg.name) {
+					return ""
+				}
+				return moduleOf(buildList, pkg.name)
+			}, expand)
+		}
+		if err := writeTo(*output, func(w io.Writer) error {
+			return write(w, g, annotations)
+		}); err != nil {
+			fmt.Fprintln(os.Stderr, err)
+			return 1
+		}
+		return 0
+	}
+}
+
+// setupList defines the flags of the list command.
+func setupList(flags *flag.FlagSet) func([]string) int {
+	var c collection
+	c.register(flags)
+	working := flags.Bool("working", false, "only list working packages")
+	selectedBy := flags.String("selected-by", "", "only list the packages selected by the rule of this name, or ID")
+	rules := flags.Bool("rules", false, "list the rules rather than packages, with their ID and where they were read from")
+
+	return func(args []string) int {
+		if len(args) > 1 {
+			flags.Usage()
+			return 1
+		}
+		if *rules {
+			return listRules(args)
+		}
+		g, defs, ok := collectFromArgs(&c, args)
+		if !ok {
+			return 1
+		}
+		var selector func(pkg *pkg) bool
+		if *selectedBy != "" {
+			rule := defs.findRule(*selectedBy)
+			if rule == nil {
+				fmt.Fprintf(os.Stderr, "no rule named %s\n", *selectedBy)
+				return 1
+			}
+			selector = rule.matches
+		}
+		for _, pkg := range g.nodes() {
+			if *working && (!defs.isWorking(pkg.name) || pkg.goroot) || selector != nil && !selector(pkg) {
+				continue
+			}
+			fmt.Println(pkg)
+		}
+		if selector == nil && !*working {
+			for _, tool := range g.toolPackages() {
+				fmt.Println(tool)
+			}
+		}
+		return 0
+	}
+}
+
+// listRules lists the rules of the config given by the arguments, if any, as
+// per writeRules.
+func listRules(args []string) int {
+	cwd, err := os.Getwd()
+	if err != nil {
+		fmt.Fprintln(os.Stderr, err)
+		return 1
+	}
+	var configPath string
+	if len(args) != 0 {
+		configPath = args[0]
+	}
+	defs, err := loadDefs(cwd, configPath, true)
+	if err != nil {
+		fmt.Fprintln(os.Stderr, err)
+		return 1
+	}
+	writeRules(os.Stdout, defs)
+	return 0
+}
+
+// setupWhy defines the flags of the why command. Packages are given by import
+// path, or as in rules, i.e. relative to the working package unless standard
+// library packages written `<pkg>`, or fully qualified third parties.
+func setupWhy(flags *flag.FlagSet) func([]string) int {
+	var c collection
+	c.register(flags)
+	module := flags.String("module", "", "rather than of a dependency, show why the module of this path is needed, from the roots of the graph and from the main module")
+
+	return func(args []string) int {
+		if *module != "" {
+			if len(args) > 1 {
+				flags.Usage()
+				return 1
+			}
+			return whyModule(&c, args, *module)
+		}
+		if len(args) != 2 && len(args) != 3 {
+			flags.Usage()
+			return 1
+		}
+		g, defs, ok := collectFromArgs(&c, args[:len(args)-2])
+		if !ok {
+			return 1
+		}
+		names := make([]string, 2)
+		for i, arg := range args[len(args)-2:] {
+			names[i] = arg
+			if _, ok := g.pkgs[arg]; !ok {
+				names[i] = qualify(defs.Config.WorkingPackage, arg)
+			}
+			if _, ok := g.pkgs[names[i]]; !ok {
+				fmt.Fprintf(os.Stderr, "%s is not part of the graph\n", names[i])
+				return 1
+			}
+		}
+		from, to := names[0], names[1]
+		path := g.path(from, to)
+		if path == nil {
+			fmt.Printf("%s does not depend on %s\n", from, to)
+			return 1
+		}
+		for i, pkg := range path {
+			fmt.Printf("%s%s\n", strings.Repeat("  ", i), pkg)
+		}
+		return 0
+	}
+}
+
+// setupSimulate defines the flags of the simulate command. Packages of moves
+// and edges are given as to the why command. Rules with build tags are left
+// out, as the changes are not tagged.
+func setupSimulate(flags *flag.FlagSet) func([]string) int {
+	var c collection
+	c.register(flags)
+	var moves, edges pairs
+	flags.Var(&moves, "move", "package to move along with its subpackages, e.g. dal/mongo=storage/mongo (repeatable)")
+	flags.Var(&edges, "add-edge", "dependency to add, after moves, e.g. services/user=dal/mongo (repeatable)")
+
+	return func(args []string) int {
+		if len(args) > 1 || len(moves) == 0 && len(edges) == 0 {
+			flags.Usage()
+			return 1
+		}
+		g, defs, ok := collectFromArgs(&c, args)
+		if !ok {
+			return 1
+		}
+		var rules []*rule
+		for _, rule := range defs.Rules {
+			if len(rule.BuildTags) == 0 {
+				rules = append(rules, rule)
+			}
+		}
+		defs.Rules = rules
+
+		violations, err := defs.simulate(g, moves, edges)
+		if err != nil {
+			fmt.Fprintln(os.Stderr, err)
+			return 1
+		}
+		changes := append(append([]string(nil), moves...), edges...)
+		if len(violations) == 0 {
+			fmt.Printf("%s would introduce no violations\n", strings.Join(changes, ", "))
+			return 0
+		}
+		fmt.Printf("%s would introduce %d violations:\n", strings.Join(changes, ", "), len(violations))
+		for _, v := range violations {
+			fmt.Println(v.Error())
+		}
+		return 1
+	}
+}
+
+// setupAudit defines the flags of the audit command.
+func setupAudit(flags *flag.FlagSet) func([]string) int {
+	var c collection
+	c.register(flags)
+	fail := flags.Bool("fail", false, "fail when any rule has unused allowances, e.g. to keep configs pruned")
+
+	return func(args []string) int {
+		if len(args) > 1 {
+			flags.Usage()
+			return 1
+		}
+		g, defs, ok := collectFromArgs(&c, args)
+		if !ok {
+			return 1
+		}
+		total := writeUnusedAllowances(os.Stdout, defs, defs.unusedAllowances(g))
+		if total == 0 {
+			fmt.Println("every allowance is used")
+		}
+		if *fail && total != 0 {
+			return 1
+		}
+		return 0
+	}
+}
+
+// whyModule shows the shortest chain of imports from the roots of the graph
+// to any package of the module, and the shortest chain of requirements from
+// the main module to the module. Modules only imported by other third party
+// modules have no chain of imports, as their packages are not collected.
+func whyModule(c *collection, args []string, module string) int {
+	g, defs, ok := collectFromArgs(c, args)
+	if !ok {
+		return 1
+	}
+	roots := append([]string(nil), g.roots...)
+	if len(roots) == 0 {
+		roots = []string{g.root}
+	}
+	sort.Strings(roots)
+	var imports []*pkg
+	for _, root := range roots {
+		path := g.pathTo(root, func(pkg *pkg) bool {
+			return pkg.name == module || strings.HasPrefix(pkg.name, module+"/")
+		})
+		if path != nil && (imports == nil || len(path) < len(imports)) {
+			imports = path
+		}
+	}
+	cwd, err := os.Getwd()
+	if err != nil {
+		fmt.Fprintln(os.Stderr, err)
+		return 1
+	}
+	requirements, err := requirementPath(defs.loadConfig(cwd, nil), module)
+	if err != nil {
+		fmt.Fprintln(os.Stderr, err)
+		return 1
+	}
+
+	if imports == nil {
+		fmt.Printf("%s is not imported by working packages\n", module)
+	} else {
+		fmt.Println("imported along")
+		for i, pkg := range imports {
+			fmt.Printf("%s%s\n", strings.Repeat("  ", i), pkg)
+		}
+	}
+	if requirements == nil {
+		fmt.Printf("%s is not required by the main module\n", module)
+		return 1
+	}
+	fmt.Println("required along")
+	for i, requirement := range requirements {
+		fmt.Printf("%s%s\n", strings.Repeat("  ", i), requirement)
+	}
+	return 0
+}
+
+// setupModules defines the flags of the modules command.
+func setupModules(flags *flag.FlagSet) func([]string) int {
+	var c collection
+	c.registerGo(flags)
+	format := flags.String("format", "text", "output format, one of text or json")
+	unreachable := flags.Bool("unreachable", false, "only list the modules no working package reaches, failing if any")
+
+	return func(args []string) int {
+		if len(args) > 1 || *format != "text" && *format != "json" {
+			flags.Usage()
+			return 1
+		}
+		cwd, err := os.Getwd()
+		if err != nil {
+			fmt.Fprintln(os.Stderr, err)
+			return 1
+		}
+		var configPath string
+		if len(args) == 1 {
+			configPath = args[0]
+		}
+		defs, err := loadDefs(cwd, configPath, false)
+		if err == nil {
+			_, _, err = c.prepare(defs, cwd, nil)
+		}
+		if err != nil {
+			fmt.Fprintln(os.Stderr, err)
+			return 1
+		}
+
+		requirements, err := defs.requirements(defs.loadConfig(cwd, nil))
+		if err != nil {
+			fmt.Fprintln(os.Stderr, err)
+			return 1
+		}
+		if *unreachable {
+			var kept []*requirement
+			for _, requirement := range requirements {
+				if !requirement.Reachable {
+					kept = append(kept, requirement)
+				}
+			}
+			requirements = kept
+		}
+		if *format == "json" {
+			encoder := json.NewEncoder(os.Stdout)
+			encoder.SetIndent("", "  ")
+			if requirements == nil {
+				requirements = []*requirement{}
+			}
+			if err := encoder.Encode(requirements); err != nil {
+				fmt.Fprintln(os.Stderr, err)
+				return 1
+			}
+		} else {
+			writeRequirements(os.Stdout, requirements)
+		}
+		if *unreachable && len(requirements) != 0 {
+			return 1
+		}
+		return 0
+	}
+}
+
+// setupCycles defines the flags of the cycles command.
+func setupCycles(flags *flag.FlagSet) func([]string) int {
+	var c collection
+	c.register(flags)
+	budgetPath := flags.String("budget", ".depper-cycles", "file storing the budget of cycle pairs")
+	update := flags.Bool("update", false, "ratchet the budget down to the cycle pairs, or store it if there is none")
+
+	return func(args []string) int {
+		if len(args) > 1 {
+			flags.Usage()
+			return 1
+		}
+		g, defs, ok := collectFromArgs(&c, args)
+		if !ok {
+			return 1
+		}
+		report := defs.checkCycles(g)
+		if err := writeText(os.Stdout, report, false, false); err != nil {
+			fmt.Fprintln(os.Stderr, err)
+			return 1
+		}
+		message, above, err := checkCycleBudget(*budgetPath, report.Errors, *update)
+		if err != nil {
+			fmt.Fprintln(os.Stderr, err)
+			return 1
+		}
+		fmt.Println(message)
+		if above {
+			return 1
+		}
+		return 0
+	}
+}
+
+// setupAggregate defines the flags of the aggregate command.
+func setupAggregate(flags *flag.FlagSet) func([]string) int {
+	format := flags.String("format", "text", "output format, one of text or json")
+	top := flags.Int("top", 10, "number of worst offenders listed, all of them if not positive")
+
+	return func(args []string) int {
+		if len(args) == 0 || *format != "text" && *format != "json" {
+			flags.Usage()
+			return 1
+		}
+		var reports []*report
+		for _, path := range args {
+			if _, err := os.Stat(path); err != nil {
+				fmt.Fprintln(os.Stderr, err)
+				return 1
+			}
+			report, err := loadReport(path)
+			if err != nil {
+				fmt.Fprintln(os.Stderr, err)
+				return 1
+			}
+			reports = append(reports, report)
+		}
+
+		a := aggregateReports(args, reports, *top)
+		if *format == "json" {
+			encoder := json.NewEncoder(os.Stdout)
+			encoder.SetIndent("", "  ")
+			if err := encoder.Encode(a); err != nil {
+				fmt.Fprintln(os.Stderr, err)
+				return 1
+			}
+		} else {
+			a.writeText(os.Stdout)
+		}
+		return 0
+	}
+}
+
+// setupClosure defines the flags of the closure command. Unlike other
+// commands, it loads every dependency of the entry point, rather than
+// collecting the graph.
+func setupClosure(flags *flag.FlagSet) func([]string) int {
+	var c collection
+	c.registerGo(flags)
+	diff := flags.String("diff", "", "only list what either this entry point or the given one links")
+	format := flags.String("format", "text", "output format, one of text or json")
+	std := flags.Bool("std", false, "list standard library packages, rather than only counting them")
+	sizes := flags.Bool("sizes", false, "estimate what each package and module adds to the binary, building it")
+
+	return func(args []string) int {
+		if len(args) != 1 && len(args) != 2 || *format != "text" && *format != "json" {
+			flags.Usage()
+			return 1
+		}
+		cwd, err := os.Getwd()
+		if err != nil {
+			fmt.Fprintln(os.Stderr, err)
+			return 1
+		}
+		var configPath string
+		if len(args) == 2 {
+			configPath = args[0]
+		}
+		defs, err := loadDefs(cwd, configPath, false)
+		if err == nil {
+			_, _, err = c.prepare(defs, cwd, nil)
+		}
+		if err != nil {
+			fmt.Fprintln(os.Stderr, err)
+			return 1
+		}
+
+		mains := []string{args[len(args)-1]}
+		if *diff != "" {
+			mains = append(mains, *diff)
+		}
+		var closures []*closure
+		for _, entry := range mains {
+			if entry != defs.Config.WorkingPackage && !strings.HasPrefix(entry, ".") {
+				entry = qualify(defs.Config.WorkingPackage, entry)
+			}
+			closure, err := defs.closureOf(defs.loadConfig(cwd, nil), entry)
+			if err == nil && *sizes {
+				err = closure.estimateSizes(defs.loadConfig(cwd, nil))
+			}
+			if err != nil {
+				fmt.Fprintln(os.Stderr, err)
+				return 1
+			}
+			closures = append(closures, closure)
+		}
+		headings := []string{closures[0].Main}
+		if len(closures) == 2 {
+			closures = []*closure{closures[0].without(closures[1]), closures[1].without(closures[0])}
+			headings = []string{"only " + closures[0].Main, "only " + closures[1].Main}
+		}
+
+		if *format == "json" {
+			encoder := json.NewEncoder(os.Stdout)
+			encoder.SetIndent("", "  ")
+			var value interface{} = closures[0]
+			if len(closures) == 2 {
+				value = closures
+			}
+			if err := encoder.Encode(value); err != nil {
+				fmt.Fprintln(os.Stderr, err)
+				return 1
+			}
+			return 0
+		}
+		for i, closure := range closures {
+			if i != 0 {
+				fmt.Println()
+			}
+			closure.writeText(os.Stdout, headings[i], *std)
+		}
+		return 0
+	}
+}
+
+// collectFromArgs returns the graph, saved or collected from the current
+// directory, of the definitions read from the config argument, if any, or
+// the config found. It reports errors, and returns false on failure.
+func collectFromArgs(c *collection, args []string) (*graph, *defs, bool) {
+	defs, cwd, ok := defsFromArgs(args)
+	if !ok {
+		return nil, nil, false
+	}
+	g, err := c.graph(defs, cwd)
+	if err != nil {
+		fmt.Fprintln(os.Stderr, err)
+		return nil, nil, false
+	}
+	return g, defs, true
+}
+
+// collectTaggedFromArgs collects the graph as collectFromArgs does, along
+// with the graphs of the build tags of rules, as per graphs.
+func collectTaggedFromArgs(c *collection, args []string) (*graph, map[string]*graph, *defs, bool) {
+	defs, cwd, ok := defsFromArgs(args)
+	if !ok {
+		return nil, nil, nil, false
+	}
+	g, tagged, err := c.graphs(defs, cwd)
+	if err != nil {
+		fmt.Fprintln(os.Stderr, err)
+		return nil, nil, nil, false
+	}
+	return g, tagged, defs, true
+}
+
+// defsFromArgs loads the definitions of the config given as the only
+// argument, if any, and returns them with the current directory. It reports
+// errors, and returns false on failure.
+func defsFromArgs(args []string) (*defs, string, bool) {
+	cwd, err := os.Getwd()
+	if err != nil {
+		fmt.Fprintln(os.Stderr, err)
+		return nil, "", false
+	}
+	var configPath string
+	if len(args) != 0 {
+		configPath = args[0]
+	}
+	defs, err := loadDefs(cwd, configPath, false)
+	if err != nil {
+		fmt.Fprintln(os.Stderr, err)
+		return nil, "", false
+	}
+	return defs, cwd, true
+}
+
+// starterConfig is the config written by the init command.
+var starterConfig = template.Must(template.New("depper.yaml").Parse(`config:
+  working_package: {{.}}
+
+rules:
+  # Packages matching the pattern, relative to the working package, may only
+  # depend on the packages listed, e.g.
+  #
+  # - name: services
+  #   packages: services/.*
+  #   may_depend:
+  #     - models/.*
+  #     - util/.*
+  #     - <net/http>
+  #     - github.com/pkg/errors
+`))
+
+// setupInit defines the flags of the init command.
+func setupInit(flags *flag.FlagSet) func([]string) int {
+	force := flags.Bool("force", false, "overwrite any existing depper.yaml")
+
+	return func(args []string) int {
+		if len(args) > 1 {
+			flags.Usage()
+			return 1
+		}
+		dir := "."
+		if len(args) == 1 {
+			dir = args[0]
+		}
+		path, err := initConfig(dir, *force)
+		if err != nil {
+			fmt.Fprintln(os.Stderr, err)
+			return 1
+		}
+		fmt.Printf("wrote %s\n", path)
+		return 0
+	}
+}
+
+// initConfig writes a starter config for the package in dir, and returns its
+// path. Existing configs are only overwritten if forced.
+func initConfig(dir string, force bool) (string, error) {
+	path := filepath.Join(dir, configNames[0])
+	if _, err := os.Stat(path); err == nil && !force {
+		return "", fmt.Errorf("%s already exists, use --force to overwrite it", path)
+	}
+	var defs defs
+	workingPackage, err := defs.rootPackage(dir)
+	if err != nil {
+		return "", err
+	}
+	var config strings.Builder
+	if err := starterConfig.Execute(&config, workingPackage); err != nil {
+		return "", err
+	}
+	if _, err := parse([]byte(config.String())); err != nil {
+		return "", err
+	}
+	return path, ioutil.WriteFile(path, []byte(config.String()), 0644)
+}
+
+// setupAnnotate defines the flags of the annotate command.
+func setupAnnotate(flags *flag.FlagSet) func([]string) int {
+	var c collection
+	c.register(flags)
+	reason := flags.String("reason", "", "reason of the suppressions, required")
+	var sel selection
+	flags.Var(&sel.ids, "id", "only annotate the violation of this ID, as in the json format (repeatable)")
+	flags.Var(&sel.rules, "rule", "only annotate violations of the rules or checks of this name or ID, where * matches any characters (repeatable)")
+	flags.StringVar(&sel.from, "from", "", "only annotate violations of this package")
+	flags.StringVar(&sel.to, "to", "", "only annotate violations of this dependency")
+
+	return func(args []string) int {
+		if len(args) > 1 || strings.TrimSpace(*reason) == "" || strings.Contains(*reason, "\n") {
+			flags.Usage()
+			return 1
+		}
+		g, tagged, defs, ok := collectTaggedFromArgs(&c, args)
+		if !ok {
+			return 1
+		}
+		cwd, err := os.Getwd()
+		if err != nil {
+			fmt.Fprintln(os.Stderr, err)
+			return 1
+		}
+
+		annotations, skipped := defs.annotations(g, tagged, defs.check(g, tagged, false), &sel)
+		for _, v := range skipped {
+			fmt.Fprintf(os.Stderr, "cannot suppress %s\n", v.Error())
+		}
+		if len(annotations) == 0 {
+			fmt.Fprintln(os.Stderr, "no violations to suppress")
+			return 1
+		}
+		if err := annotate(cwd, annotations, strings.TrimSpace(*reason)); err != nil {
+			fmt.Fprintln(os.Stderr, err)
+			return 1
+		}
+		for _, a := range annotations {
+			fmt.Printf("%s:%d\n", a.file, a.line)
+		}
+		return 0
+	}
+}
+
+// setupTest defines the flags of the test command.
+func setupTest(flags *flag.FlagSet) func([]string) int {
+	update := flags.Bool("update", false, "write the violations of each fixture to its "+expectedFile+" rather than comparing them")
+	return func(args []string) int {
+		if len(args) == 0 || len(args) > 2 || args[0] == "-" {
+			flags.Usage()
+			return 1
+		}
+		cwd, err := os.Getwd()
+		if err != nil {
+			fmt.Fprintln(os.Stderr, err)
+			return 1
+		}
+		var configPath string
+		if len(args) == 2 {
+			configPath = args[0]
+		}
+		passed, err := testFixtures(os.Stdout, cwd, configPath, args[len(args)-1], *update)
+		if err != nil {
+			fmt.Fprintln(os.Stderr, err)
+			return 1
+		}
+		if !passed {
+			return 1
+		}
+		return 0
+	}
+}
+
+// setupDoctor defines the flags of the doctor command.
+func setupDoctor(flags *flag.FlagSet) func([]string) int {
+	return func(args []string) int {
+		if len(args) > 1 {
+			flags.Usage()
+			return 1
+		}
+		cwd, err := os.Getwd()
+		if err != nil {
+			fmt.Fprintln(os.Stderr, err)
+			return 1
+		}
+		var configPath string
+		if len(args) == 1 {
+			configPath = args[0]
+		}
+		if !doctor(os.Stdout, cwd, configPath) {
+			return 1
+		}
+		return 0
+	}
+}
+
+// setupCache defines the flags of the cache command.
+func setupCache(flags *flag.FlagSet) func([]string) int {
+	var env environment
+	flags.Var(&env, "env", "KEY=VALUE environment variable of the go command, e.g. DEPPER_CACHE=/ci/cache (repeatable)")
+	return func(args []string) int {
+		if len(args) == 0 || len(args) > 2 || args[0] != "dir" && args[0] != "clean" {
+			flags.Usage()
+			return 1
+		}
+		cwd, err := os.Getwd()
+		if err != nil {
+			fmt.Fprintln(os.Stderr, err)
+			return 1
+		}
+		var configPath string
+		if len(args) == 2 {
+			configPath = args[1]
+		}
+		defs, err := loadDefs(cwd, configPath, false)
+		if err != nil {
+			fmt.Fprintln(os.Stderr, err)
+			return 1
+		}
+		defs.env = env
+		dir, err := defs.cacheDir()
+		if err != nil {
+			fmt.Fprintln(os.Stderr, err)
+			return 1
+		}
+		if args[0] == "dir" {
+			fmt.Println(dir)
+			return 0
+		}
+		if err := cleanCache(dir, cwd); err != nil {
+			fmt.Fprintln(os.Stderr, err)
+			return 1
+		}
+		fmt.Fprintf(os.Stderr, "removed %s\n", dir)
+		return 0
+	}
+}
+
+// setupVersion defines the flags of the version command.
+func setupVersion(flags *flag.FlagSet) func([]string) int {
+	format := flags.String("format", "text", "output format, one of text or json")
+	return func(args []string) int {
+		if len(args) != 0 || *format != "text" && *format != "json" {
+			flags.Usage()
+			return 1
+		}
+		build := currentBuild()
+		if *format == "text" {
+			fmt.Println(build)
+			return 0
+		}
+		encoder := json.NewEncoder(os.Stdout)
+		encoder.SetIndent("", "  ")
+		if err := encoder.Encode(build); err != nil {
+			fmt.Fprintln(os.Stderr, err)
+			return 1
+		}
+		return 0
+	}
+}
+
+// setupSchema defines the flags of the schema command.
+func setupSchema(flags *flag.FlagSet) func([]string) int {
+	return func(args []string) int {
+		if len(args) != 0 {
+			flags.Usage()
+			return 1
+		}
+		encoder := json.NewEncoder(os.Stdout)
+		encoder.SetIndent("", "  ")
+		if err := encoder.Encode(configSchema()); err != nil {
+			fmt.Fprintln(os.Stderr, err)
+			return 1
+		}
+		return 0
+	}
+}
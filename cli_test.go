@@ -0,0 +1,71 @@
+// Licensed under the Apache License, Version 2.0 (the "License");
+// you may not use this file except in compliance with the License.
+// You may obtain a copy of the License at
+//
+// http://www.apache.org/licenses/LICENSE-2.0
+//
+// Unless required by applicable law or agreed to in writing, software
+// distributed under the License is distributed on an "AS IS" BASIS,
+// WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+// See the License for the specific language governing permissions and
+// limitations under the License.
+
+package main
+
+import (
+	"bytes"
+	"io/ioutil"
+	"os"
+	"path/filepath"
+
+	"github.com/stretchr/testify/require"
+)
+
+func (s *Zuite) TestUsage() {
+	var buf bytes.Buffer
+	usage(&buf)
+	for _, cmd := range commands {
+		require.Contains(s.T(), buf.String(), "  "+cmd.name+" ")
+	}
+}
+
+func (s *Zuite) TestRun_usageErrors() {
+	devNull, err := os.Open(os.DevNull)
+	require.NoError(s.T(), err)
+	defer devNull.Close()
+	stderr := os.Stderr
+	os.Stderr = devNull
+	defer func() { os.Stderr = stderr }()
+
+	require.Equal(s.T(), 2, run([]string{"--no-such-flag"}))
+	require.Equal(s.T(), 2, run([]string{"check", "--no-such-flag"}))
+	require.Equal(s.T(), 1, run([]string{"--fail-on=sometimes", "config.yaml"}))
+	require.Equal(s.T(), 1, run([]string{"merge", "config.yaml"}))
+	require.Equal(s.T(), 1, run([]string{"graph", "--format=svg"}))
+	require.Equal(s.T(), 1, run([]string{"why", "foo"}))
+	require.Equal(s.T(), 1, run([]string{"init", "a", "b"}))
+	require.Equal(s.T(), 1, run([]string{"list", "--mode=legacy"}))
+	require.Equal(s.T(), 1, run([]string{"list", "--loader=make"}))
+}
+
+func (s *Zuite) TestInitConfig() {
+	dir, err := ioutil.TempDir("", "depper")
+	require.NoError(s.T(), err)
+	defer os.RemoveAll(dir)
+	require.NoError(s.T(), ioutil.WriteFile(filepath.Join(dir, "go.mod"), []byte("module example.com/starter\n"), 0644))
+	require.NoError(s.T(), ioutil.WriteFile(filepath.Join(dir, "main.go"), []byte("package main\n\nfunc main() {}\n"), 0644))
+
+	path, err := initConfig(dir, false)
+	require.NoError(s.T(), err)
+	require.Equal(s.T(), filepath.Join(dir, "depper.yaml"), path)
+	defs, err := readFile(path)
+	require.NoError(s.T(), err)
+	require.Equal(s.T(), "example.com/starter", defs.Config.WorkingPackage)
+	require.NoError(s.T(), defs.compile())
+
+	// Existing configs are kept, unless forced.
+	_, err = initConfig(dir, false)
+	require.Error(s.T(), err)
+	_, err = initConfig(dir, true)
+	require.NoError(s.T(), err)
+}
@@ -0,0 +1,304 @@
+// Licensed under the Apache License, Version 2.0 (the "License");
+// you may not use this file except in compliance with the License.
+// You may obtain a copy of the License at
+//
+// http://www.apache.org/licenses/LICENSE-2.0
+//
+// Unless required by applicable law or agreed to in writing, software
+// distributed under the License is distributed on an "AS IS" BASIS,
+// WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+// See the License for the specific language governing permissions and
+// limitations under the License.
+
+package main
+
+import (
+	"fmt"
+	"io"
+	"io/ioutil"
+	"os"
+	"os/exec"
+	"sort"
+	"strconv"
+	"strings"
+
+	"golang.org/x/tools/go/packages"
+)
+
+// closure is what an entry point links, i.e. the packages it depends on,
+// directly or transitively, and itself. Third party packages are reported by
+// module.
+type closure struct {
+	Main    string           `json:"main"`
+	Working []string         `json:"working"`
+	Modules []*closureModule `json:"modules"`
+	Std     []string         `json:"std"`
+
+	// Sizes estimates what each of the packages and modules adds to the
+	// binary, largest first, when asked.
+	Sizes []*closureSize `json:"sizes,omitempty"`
+}
+
+// closureModule is a third party module linked by an entry point.
+type closureModule struct {
+	Path    string `json:"path"`
+	Version string `json:"version,omitempty"`
+}
+
+// closureSize is the estimated size of the symbols of a package or module
+// in a binary.
+type closureSize struct {
+	Name  string `json:"name"`
+	Bytes int64  `json:"bytes"`
+}
+
+// closureOf loads the package along with every dependency, unlike collecting
+// the graph which leaves third party packages unexpanded, and returns its
+// closure.
+func (defs *defs) closureOf(cfg *packages.Config, name string) (*closure, error) {
+	cfg.Mode |= packages.NeedName | packages.NeedImports | packages.NeedDeps | packages.NeedModule
+	goPkgs, err := packages.Load(cfg, name)
+	if err != nil {
+		return nil, err
+	}
+	if len(goPkgs) != 1 {
+		return nil, fmt.Errorf("%s must be one package, was %d", name, len(goPkgs))
+	}
+	if errs := goPkgs[0].Errors; len(errs) != 0 {
+		return nil, fmt.Errorf("failed to load %s: %s", name, errs[0].Msg)
+	}
+
+	closure := &closure{Main: goPkgs[0].PkgPath}
+	modules := make(map[string]*closureModule)
+	packages.Visit(goPkgs, nil, func(goPkg *packages.Package) {
+		switch {
+		case defs.isStd(goPkg):
+			closure.Std = append(closure.Std, goPkg.PkgPath)
+		case defs.isWorking(goPkg.PkgPath):
+			closure.Working = append(closure.Working, goPkg.PkgPath)
+		case goPkg.Module != nil:
+			modules[goPkg.Module.Path] = &closureModule{Path: goPkg.Module.Path, Version: goPkg.Module.Version}
+		default:
+			// Outside of modules, e.g. in GOPATH mode, modules are guessed.
+			path := moduleOf(nil, goPkg.PkgPath)
+			modules[path] = &closureModule{Path: path}
+		}
+	})
+	for _, module := range modules {
+		closure.Modules = append(closure.Modules, module)
+	}
+	sort.Strings(closure.Working)
+	sort.Strings(closure.Std)
+	sort.Slice(closure.Modules, func(i, j int) bool {
+		return closure.Modules[i].Path < closure.Modules[j].Path
+	})
+	return closure, nil
+}
+
+// without returns the closure stripped of what the other closure links too.
+func (c *closure) without(other *closure) *closure {
+	minus := func(names, others []string) []string {
+		seen := make(map[string]bool)
+		for _, name := range others {
+			seen[name] = true
+		}
+		var kept []string
+		for _, name := range names {
+			if !seen[name] {
+				kept = append(kept, name)
+			}
+		}
+		return kept
+	}
+	stripped := &closure{
+		Main:    c.Main,
+		Working: minus(c.Working, other.Working),
+		Std:     minus(c.Std, other.Std),
+	}
+	otherModules := make(map[string]bool)
+	for _, module := range other.Modules {
+		otherModules[module.Path] = true
+	}
+	for _, module := range c.Modules {
+		if !otherModules[module.Path] {
+			stripped.Modules = append(stripped.Modules, module)
+		}
+	}
+	kept := make(map[string]bool)
+	for _, name := range append(stripped.Working, stripped.Std...) {
+		kept[name] = true
+	}
+	for _, module := range stripped.Modules {
+		kept[module.Path] = true
+	}
+	for _, size := range c.Sizes {
+		if kept[size.Name] {
+			stripped.Sizes = append(stripped.Sizes, size)
+		}
+	}
+	return stripped
+}
+
+// estimateSizes builds the entry point with the config, and attributes the
+// sizes of the symbols of the binary, as reported by go tool nm, to the
+// packages and modules of the closure. Symbols of no package of the closure,
+// e.g. of the runtime laid out by the linker, are left out.
+func (c *closure) estimateSizes(cfg *packages.Config) error {
+	bin, err := ioutil.TempFile("", "depper")
+	if err != nil {
+		return err
+	}
+	bin.Close()
+	defer os.Remove(bin.Name())
+
+	args := append([]string{"build", "-o", bin.Name()}, cfg.BuildFlags...)
+	build := exec.Command("go", append(args, c.Main)...)
+	build.Dir, build.Env = cfg.Dir, cfg.Env
+	if out, err := build.CombinedOutput(); err != nil {
+		return fmt.Errorf("failed to build %s: %s", c.Main, strings.TrimSpace(string(out)))
+	}
+	nm := exec.Command("go", "tool", "nm", "-size", bin.Name())
+	nm.Dir, nm.Env = cfg.Dir, cfg.Env
+	out, err := nm.Output()
+	if err != nil {
+		return fmt.Errorf("failed to list the symbols of %s: %s", c.Main, err)
+	}
+
+	// Lines are address, size, type and name, without address for
+	// undefined symbols. Only text and data symbols take room in the
+	// binary, unlike bss ones.
+	units := map[string]string{"main": c.Main}
+	for _, name := range append(append([]string(nil), c.Working...), c.Std...) {
+		units[name] = name
+	}
+	sizes := make(map[string]int64)
+	for _, line := range strings.Split(string(out), "\n") {
+		fields := strings.Fields(line)
+		if len(fields) < 4 || !strings.Contains("TtRrDd", fields[2]) {
+			continue
+		}
+		size, err := strconv.ParseInt(fields[1], 10, 64)
+		if err != nil {
+			continue
+		}
+		pkgName := symbolPackage(strings.Join(fields[3:], " "))
+		unit, ok := units[pkgName]
+		if !ok {
+			// Third party packages are attributed to their module.
+			for _, module := range c.Modules {
+				if (pkgName == module.Path || strings.HasPrefix(pkgName, module.Path+"/")) && len(module.Path) > len(unit) {
+					unit = module.Path
+				}
+			}
+			units[pkgName] = unit
+		}
+		if unit != "" {
+			sizes[unit] += size
+		}
+	}
+	c.Sizes = nil
+	for name, bytes := range sizes {
+		c.Sizes = append(c.Sizes, &closureSize{Name: name, Bytes: bytes})
+	}
+	sort.Slice(c.Sizes, func(i, j int) bool {
+		if c.Sizes[i].Bytes != c.Sizes[j].Bytes {
+			return c.Sizes[i].Bytes > c.Sizes[j].Bytes
+		}
+		return c.Sizes[i].Name < c.Sizes[j].Name
+	})
+	return nil
+}
+
+// symbolPackage returns the import path of the package defining the symbol,
+// e.g. `github.com/pkg/errors` for `github.com/pkg/errors.(*fundamental).Error`.
+// Type descriptors, itabs and the like are attributed to the package of their
+// type.
+func symbolPackage(symbol string) string {
+	for _, prefix := range []string{"type:", "type.", "go:itab.", "go.itab.", "go:", "go."} {
+		if strings.HasPrefix(symbol, prefix) {
+			symbol = strings.TrimPrefix(symbol, prefix)
+			break
+		}
+	}
+	symbol = strings.TrimLeft(symbol, "*")
+	if i := strings.IndexAny(symbol, "[("); i >= 0 {
+		symbol = symbol[:i]
+	}
+	// Dots of the last element of the path are escaped, e.g.
+	// `gopkg.in/yaml%2ev2.Unmarshal`.
+	slash := strings.LastIndex(symbol, "/")
+	if dot := strings.Index(symbol[slash+1:], "."); dot >= 0 {
+		symbol = symbol[:slash+1+dot]
+	}
+	return strings.Replace(symbol, "%2e", ".", -1)
+}
+
+// writeText writes the closure under the heading, with counts by kind.
+// Standard library packages are only counted, unless listing them.
+func (c *closure) writeText(w io.Writer, heading string, std bool) {
+	fmt.Fprintf(w, "%s (%s, %s, %s)\n", heading,
+		plural(len(c.Working), "working package"),
+		plural(len(c.Modules), "third party module"),
+		plural(len(c.Std), "standard library package"))
+	if len(c.Working) != 0 {
+		fmt.Fprintln(w, "working packages")
+		for _, name := range c.Working {
+			fmt.Fprintf(w, "  %s\n", name)
+		}
+	}
+	if len(c.Modules) != 0 {
+		fmt.Fprintln(w, "third party modules")
+		for _, module := range c.Modules {
+			if module.Version == "" {
+				fmt.Fprintf(w, "  %s\n", module.Path)
+			} else {
+				fmt.Fprintf(w, "  %s %s\n", module.Path, module.Version)
+			}
+		}
+	}
+	if std && len(c.Std) != 0 {
+		fmt.Fprintln(w, "standard library packages")
+		for _, name := range c.Std {
+			fmt.Fprintf(w, "  %s\n", name)
+		}
+	}
+	if len(c.Sizes) != 0 {
+		// Unless listed, standard library packages add up to one.
+		var (
+			sizes   []*closureSize
+			library = &closureSize{Name: "standard library"}
+			isStd   = make(map[string]bool)
+		)
+		for _, name := range c.Std {
+			isStd[name] = true
+		}
+		for _, size := range c.Sizes {
+			if !std && isStd[size.Name] {
+				library.Bytes += size.Bytes
+			} else {
+				sizes = append(sizes, size)
+			}
+		}
+		if library.Bytes != 0 {
+			sizes = append(sizes, library)
+			sort.SliceStable(sizes, func(i, j int) bool {
+				return sizes[i].Bytes > sizes[j].Bytes
+			})
+		}
+		fmt.Fprintln(w, "estimated sizes")
+		for _, size := range sizes {
+			fmt.Fprintf(w, "  %9s %s\n", formatBytes(size.Bytes), size.Name)
+		}
+	}
+}
+
+// formatBytes formats the size in bytes, kB or MB, e.g. `1.5 MB`.
+func formatBytes(bytes int64) string {
+	switch {
+	case bytes >= 1000*1000:
+		return fmt.Sprintf("%.1f MB", float64(bytes)/(1000*1000))
+	case bytes >= 1000:
+		return fmt.Sprintf("%.1f kB", float64(bytes)/1000)
+	}
+	return fmt.Sprintf("%d B", bytes)
+}
@@ -0,0 +1,107 @@
+// Licensed under the Apache License, Version 2.0 (the "License");
+// you may not use this file except in compliance with the License.
+// You may obtain a copy of the License at
+//
+// http://www.apache.org/licenses/LICENSE-2.0
+//
+// Unless required by applicable law or agreed to in writing, software
+// distributed under the License is distributed on an "AS IS" BASIS,
+// WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+// See the License for the specific language governing permissions and
+// limitations under the License.
+
+package main
+
+import (
+	"bytes"
+	"io/ioutil"
+	"os"
+	"path/filepath"
+
+	"github.com/stretchr/testify/require"
+)
+
+func (s *Zuite) TestClosureOf() {
+	dir, err := ioutil.TempDir("", "depper")
+	require.NoError(s.T(), err)
+	defer os.RemoveAll(dir)
+
+	files := map[string]string{
+		"app/go.mod":                "module example.com/app\n\nrequire example.com/lib v0.1.0\n\nreplace example.com/lib => ../lib\n",
+		"app/cmd/api/main.go":       "package main\n\nimport \"example.com/app/server\"\n\nfunc main() { println(server.Serve()) }\n",
+		"app/cmd/worker/main.go":    "package main\n\nimport _ \"example.com/app/jobs\"\n\nfunc main() {}\n",
+		"app/server/server.go":      "package server\n\nimport \"example.com/lib/http\"\n\n//go:noinline\nfunc Serve() string { return http.Name() }\n",
+		"app/jobs/jobs.go":          "package jobs\n\nimport _ \"strings\"\n",
+		"lib/go.mod":                "module example.com/lib\n",
+		"lib/http/http.go":          "package http\n\nimport \"example.com/lib/internal/wire\"\n\n//go:noinline\nfunc Name() string { return wire.Format(\"http\") }\n",
+		"lib/internal/wire/wire.go": "package wire\n\nimport \"fmt\"\n\n//go:noinline\nfunc Format(s string) string { return fmt.Sprintf(\"<%s>\", s) }\n",
+	}
+	s.writeFiles(dir, files)
+
+	// Third party packages are expanded, and reported by module.
+	var defs defs
+	defs.Config.WorkingPackage = "example.com/app"
+	root := filepath.Join(dir, "app")
+	api, err := defs.closureOf(defs.loadConfig(root, nil), "example.com/app/cmd/api")
+	require.NoError(s.T(), err)
+	require.Equal(s.T(), "example.com/app/cmd/api", api.Main)
+	require.Equal(s.T(), []string{"example.com/app/cmd/api", "example.com/app/server"}, api.Working)
+	require.Equal(s.T(), []*closureModule{&closureModule{Path: "example.com/lib", Version: "v0.1.0"}}, api.Modules)
+	require.Contains(s.T(), api.Std, "fmt")
+
+	worker, err := defs.closureOf(defs.loadConfig(root, nil), "./cmd/worker")
+	require.NoError(s.T(), err)
+	require.Empty(s.T(), worker.Modules)
+
+	// Diffs only keep what either links.
+	onlyAPI := api.without(worker)
+	require.Equal(s.T(), []string{"example.com/app/cmd/api", "example.com/app/server"}, onlyAPI.Working)
+	require.Len(s.T(), onlyAPI.Modules, 1)
+	require.NotContains(s.T(), onlyAPI.Std, "strings")
+	require.Equal(s.T(), []string{"example.com/app/cmd/worker", "example.com/app/jobs"}, worker.without(api).Working)
+
+	var buf bytes.Buffer
+	onlyAPI.writeText(&buf, "only "+onlyAPI.Main, false)
+	require.Contains(s.T(), buf.String(), `working packages
+  example.com/app/cmd/api
+  example.com/app/server
+third party modules
+  example.com/lib v0.1.0
+`)
+	require.NotContains(s.T(), buf.String(), "standard library packages\n")
+
+	_, err = defs.closureOf(defs.loadConfig(root, nil), "example.com/app/...")
+	require.Error(s.T(), err)
+
+	// Sizes are attributed to packages and modules, the main package by its
+	// import path.
+	require.NoError(s.T(), api.estimateSizes(defs.loadConfig(root, nil)))
+	sizes := make(map[string]int64)
+	for _, size := range api.Sizes {
+		sizes[size.Name] = size.Bytes
+	}
+	for _, name := range []string{"example.com/app/cmd/api", "example.com/app/server", "example.com/lib", "fmt", "runtime"} {
+		require.NotZero(s.T(), sizes[name], name)
+	}
+	require.Equal(s.T(), "runtime", api.Sizes[0].Name)
+
+	buf.Reset()
+	api.writeText(&buf, api.Main, false)
+	require.Contains(s.T(), buf.String(), "estimated sizes\n")
+	require.Contains(s.T(), buf.String(), " standard library\n")
+	require.NotContains(s.T(), buf.String(), " runtime\n")
+}
+
+func (s *Zuite) TestSymbolPackage() {
+	for symbol, expected := range map[string]string{
+		"main.main": "main",
+		"github.com/pkg/errors.(*fundamental).Error": "github.com/pkg/errors",
+		"gopkg.in/yaml%2ev2.Unmarshal":               "gopkg.in/yaml.v2",
+		"type:*github.com/pkg/errors.withStack":      "github.com/pkg/errors",
+		"go:itab.*os.File,io.Reader":                 "os",
+		"example.com/app.Map[go.shape.string]":       "example.com/app",
+		"runtime.text":                               "runtime",
+	} {
+		require.Equal(s.T(), expected, symbolPackage(symbol), symbol)
+	}
+}
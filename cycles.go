@@ -0,0 +1,104 @@
+// Licensed under the Apache License, Version 2.0 (the "License");
+// you may not use this file except in compliance with the License.
+// You may obtain a copy of the License at
+//
+// http://www.apache.org/licenses/LICENSE-2.0
+//
+// Unless required by applicable law or agreed to in writing, software
+// distributed under the License is distributed on an "AS IS" BASIS,
+// WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+// See the License for the specific language governing permissions and
+// limitations under the License.
+
+package main
+
+import (
+	"fmt"
+	"io/ioutil"
+	"os"
+	"strconv"
+	"strings"
+)
+
+// checkCycles reports the package dependencies forming cycles among the
+// groups of every acyclic groups entry, i.e. the cycle pairs, as check does.
+func (defs *defs) checkCycles(g *graph) *report {
+	var report report
+	for _, acyclic := range defs.AcyclicGroups {
+		report.add("", acyclic.Name, severityError, acyclic.process(g))
+	}
+	return &report
+}
+
+// cycleSections returns the sections of the report of acyclic groups, and
+// their number of cycle pairs.
+func (defs *defs) cycleSections(report *report) ([]*section, int) {
+	groups := make(map[string]bool)
+	for _, acyclic := range defs.AcyclicGroups {
+		groups[slugify(acyclic.Name)] = true
+	}
+	var (
+		sections []*section
+		count    int
+	)
+	for _, section := range report.Sections {
+		if groups[section.ID] {
+			sections = append(sections, section)
+			count += len(section.Violations)
+		}
+	}
+	return sections, count
+}
+
+// demote demotes the violations of the section of the report to warnings,
+// e.g. cycles within their budget.
+func (report *report) demote(section *section) {
+	if section.Severity == severityWarn {
+		return
+	}
+	section.Severity = severityWarn
+	report.Errors -= len(section.Violations)
+	report.Warnings += len(section.Violations)
+}
+
+// checkCycleBudget compares the count of cycle pairs with the budget stored
+// in the file at path, so that existing cycles are tolerated while new ones
+// are refused. With update, the budget is ratcheted down to the count, or
+// stored if there is none yet. It returns how the count compares, and
+// whether it is above the budget.
+func checkCycleBudget(path string, count int, update bool) (string, bool, error) {
+	budget, err := readCycleBudget(path)
+	missing := os.IsNotExist(err)
+	if err != nil && !missing {
+		return "", false, err
+	}
+	pairs := plural(count, "cycle pair")
+	switch {
+	case !missing && count > budget:
+		return fmt.Sprintf("%s, above the budget of %d", pairs, budget), true, nil
+	case update && (missing || count < budget):
+		if err := ioutil.WriteFile(path, []byte(strconv.Itoa(count)+"\n"), 0644); err != nil {
+			return "", false, err
+		}
+		if missing {
+			return fmt.Sprintf("%s, budget of %d stored", pairs, count), false, nil
+		}
+		return fmt.Sprintf("%s, budget ratcheted down to %d", pairs, count), false, nil
+	case missing:
+		return "", false, fmt.Errorf("no cycle budget in %s, store it with --update", path)
+	}
+	return fmt.Sprintf("%s, within the budget of %d", pairs, budget), false, nil
+}
+
+// readCycleBudget reads the budget stored in the file at path, a count.
+func readCycleBudget(path string) (int, error) {
+	data, err := ioutil.ReadFile(path)
+	if err != nil {
+		return 0, err
+	}
+	budget, err := strconv.Atoi(strings.TrimSpace(string(data)))
+	if err != nil || budget < 0 {
+		return 0, fmt.Errorf("malformed cycle budget in %s, must be a count", path)
+	}
+	return budget, nil
+}
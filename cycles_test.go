@@ -0,0 +1,94 @@
+// Licensed under the Apache License, Version 2.0 (the "License");
+// you may not use this file except in compliance with the License.
+// You may obtain a copy of the License at
+//
+// http://www.apache.org/licenses/LICENSE-2.0
+//
+// Unless required by applicable law or agreed to in writing, software
+// distributed under the License is distributed on an "AS IS" BASIS,
+// WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+// See the License for the specific language governing permissions and
+// limitations under the License.
+
+package main
+
+import (
+	"io/ioutil"
+	"os"
+	"path/filepath"
+
+	"github.com/stretchr/testify/require"
+)
+
+func (s *Zuite) TestCheckCycleBudget() {
+	dir, err := ioutil.TempDir("", "depper")
+	require.NoError(s.T(), err)
+	defer os.RemoveAll(dir)
+	path := filepath.Join(dir, ".depper-cycles")
+
+	// The budget is stored once, and only ever ratcheted down.
+	_, _, err = checkCycleBudget(path, 3, false)
+	require.EqualError(s.T(), err, "no cycle budget in "+path+", store it with --update")
+	for _, step := range []struct {
+		count   int
+		update  bool
+		message string
+		above   bool
+		budget  string
+	}{
+		{3, true, "3 cycle pairs, budget of 3 stored", false, "3\n"},
+		{2, false, "2 cycle pairs, within the budget of 3", false, "3\n"},
+		{2, true, "2 cycle pairs, budget ratcheted down to 2", false, "2\n"},
+		{3, true, "3 cycle pairs, above the budget of 2", true, "2\n"},
+		{1, false, "1 cycle pair, within the budget of 2", false, "2\n"},
+	} {
+		message, above, err := checkCycleBudget(path, step.count, step.update)
+		require.NoError(s.T(), err)
+		require.Equal(s.T(), step.message, message)
+		require.Equal(s.T(), step.above, above)
+		data, err := ioutil.ReadFile(path)
+		require.NoError(s.T(), err)
+		require.Equal(s.T(), step.budget, string(data))
+	}
+
+	require.NoError(s.T(), ioutil.WriteFile(path, []byte("many\n"), 0644))
+	_, _, err = checkCycleBudget(path, 1, true)
+	require.EqualError(s.T(), err, "malformed cycle budget in "+path+", must be a count")
+}
+
+func (s *Zuite) TestCycleSections() {
+	defs, err := parse([]byte(`
+config:
+  working_package: wp
+rules:
+  - name: api
+    packages: api/.*
+    may_not_depend:
+      - dal/.*
+acyclic_groups:
+  - name: layers are acyclic
+    groups:
+      api: api/.*
+      service: service/.*
+`))
+	require.NoError(s.T(), err)
+	g := graphOf(map[string]*pkg{
+		"wp/api/user":     &pkg{name: "wp/api/user"},
+		"wp/api/base":     &pkg{name: "wp/api/base"},
+		"wp/service/user": &pkg{name: "wp/service/user"},
+		"wp/dal/user":     &pkg{name: "wp/dal/user"},
+	}, "wp/api/user -> wp/service/user", "wp/service/user -> wp/api/base", "wp/api/user -> wp/dal/user")
+
+	// Only the cycles of acyclic groups are demoted.
+	report := defs.check(g, nil, false)
+	require.Equal(s.T(), 3, report.Errors)
+	sections, count := defs.cycleSections(report)
+	require.Len(s.T(), sections, 1)
+	require.Equal(s.T(), 2, count)
+	report.demote(sections[0])
+	require.Equal(s.T(), 1, report.Errors)
+	require.Equal(s.T(), 2, report.Warnings)
+	require.Equal(s.T(), severityWarn, sections[0].Severity)
+
+	require.Equal(s.T(), 2, defs.checkCycles(g).Errors)
+}
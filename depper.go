@@ -13,12 +13,24 @@
 package main
 
 import (
+	"encoding/json"
+	"errors"
 	"fmt"
+	"go/ast"
+	"go/parser"
+	"go/token"
+	"io"
 	"io/ioutil"
 	"os"
+	"os/exec"
+	"path"
+	"path/filepath"
 	"regexp"
 	"runtime"
+	"sort"
+	"strconv"
 	"strings"
+	"sync"
 
 	"golang.org/x/tools/go/packages"
 	"gopkg.in/yaml.v2"
@@ -26,32 +38,431 @@ import (
 
 type defs struct {
 	Config struct {
-		WorkingPackage string `yaml:"working_package"`
+		WorkingPackage string      `yaml:"working_package"`
+		RulesDir       string      `yaml:"rules_dir"`
+		LoadPatterns   []string    `yaml:"load_patterns"`
+		Workspace      []string    `yaml:"workspace"`
+		CacheDir       string      `yaml:"cache_dir"`
+		Signatures     *signatures `yaml:"signatures"`
+
+		// SchemaVersion is the version of the config schema the config is
+		// written against, so that older binaries warn rather than
+		// misread it.
+		SchemaVersion int `yaml:"schema_version"`
+
+		// CaseInsensitive matches the import paths of rules, import
+		// aliases, single providers, the packages of layouts and the
+		// dependencies of propagations regardless of case, e.g. so that
+		// `github.com/azure/.*` catches `github.com/Azure/go-autorest`.
+		CaseInsensitive bool `yaml:"case_insensitive"`
+
+		// Inspect lists the third party modules, where `*` matches any
+		// characters, the imports of which are collected too, up to
+		// InspectDepth third party packages away from working packages,
+		// or without limit if zero.
+		Inspect      globs `yaml:"inspect"`
+		InspectDepth int   `yaml:"inspect_depth"`
+
+		// ToolsFile is the name of the files of working packages which
+		// pin the versions of tools in go.mod by blank importing them,
+		// `tools.go` by default. Their imports are not dependencies of
+		// their package, unless collecting with build tags.
+		ToolsFile string `yaml:"tools_file"`
 	} `yaml:"config"`
-	Rules []*rule `yaml:"rules"`
+	Rules             []*rule             `yaml:"rules"`
+	EquivalenceGroups map[string][]string `yaml:"equivalence_groups"`
+	SingleProviders   []*singleProvider   `yaml:"single_providers"`
+	TestOnlyMarkers   []string            `yaml:"test_only_markers"`
+	BlankImports      *blankImports       `yaml:"blank_imports"`
+	NoCgo             *noCgo              `yaml:"no_cgo"`
+	HTTPGlobals       *httpGlobals        `yaml:"http_globals"`
+	Embeds            *embeds             `yaml:"embeds"`
+	ImportAliases     []*importAlias      `yaml:"import_aliases"`
+	Layouts           []*layout           `yaml:"layouts"`
+	AcyclicGroups     []*acyclicGroups    `yaml:"acyclic_groups"`
+	Independent       []*independence     `yaml:"independent"`
+	Propagate         []*propagation      `yaml:"propagate"`
+	Score             *scoreWeights       `yaml:"score"`
+	Include           []string            `yaml:"include"`
+
+	// fields denormalized on parse
+	equivalenceGroups []*equivalenceGroup
+	testOnly          *testOnly
+	ruleIndex         *selectorIndex
+
+	// settings of the go command collecting packages, on top of those of
+	// the environment
+	buildFlags []string
+	env        []string
+
+	// number of rules checked concurrently, as many as there are CPUs if
+	// not set
+	parallelism int
+
+	// span the run is traced in, if any
+	trace *span
+}
+
+// Severities of rules. Violations of rules with severity warn are reported,
+// but do not fail the run unless asked to.
+const (
+	severityError = "error"
+	severityWarn  = "warn"
+)
+
+// selector selects packages by import path, declared name, annotation, being
+// generated from protos, or any combination of these. Packages matching the
+// except pattern, or any of the except packages patterns, are left out.
+// Import path patterns are relative to the
+// working package, unless they select std lib packages, e.g. `<net/http>`,
+// or are fully qualified, e.g. `github.com/org/fork/.*`.
+type selector struct {
+	Packages        string   `yaml:"packages"`
+	PackageName     string   `yaml:"package_name"`
+	Annotation      string   `yaml:"annotation"`
+	GeneratedProtos bool     `yaml:"generated_protos"`
+	Except          string   `yaml:"except"`
+	ExceptPackages  []string `yaml:"except_packages"`
+
+	// fields denormalized on parse
+	packagePattern     *regexp.Regexp
+	packageNamePattern *regexp.Regexp
+	exceptPatterns     []*regexp.Regexp
+	goroot             bool // whether the packages pattern selects std lib packages
+	exceptGoroots      []bool
+	external           bool // whether the packages pattern selects non working packages
+	annotationKey      string
+	annotationValue    string
 }
 
+// rule constrains the dependencies of the packages it selects. Rules are
+// referred to by ID in outputs and flags, which defaults to the slug of the
+// name, e.g. `sample-deps` for `Sample deps`.
 type rule struct {
-	Name      string   `yaml:"name"`
-	Packages  string   `yaml:"packages"`
-	MayDepend []string `yaml:"may_depend"`
-	Expected  []string `yaml:"deprecated_dependencies"`
+	ID             string `yaml:"id"`
+	Name           string `yaml:"name"`
+	WorkingPackage string `yaml:"working_package"`
+	selector       `yaml:",inline"`
+	MayDepend      []string `yaml:"may_depend"`
+	MayNotDepend   []string `yaml:"may_not_depend"`
+	MustDepend     []string `yaml:"must_depend"`
+	Expected       []string `yaml:"deprecated_dependencies"`
+	BuildTags      []string `yaml:"build_tags"`
+	Severity       string   `yaml:"severity"`
+
+	// Exclusive rules close the allowed set to their may_depend, e.g. for
+	// security sensitive packages. Anything else is disallowed, unless
+	// expected by the rule itself, and violations are never mere warnings.
+	Exclusive bool `yaml:"exclusive"`
 
 	// fields denormalized on parse
-	packagePattern           *regexp.Regexp
-	mayDepends               []*pkgpattern
+	mayDepends               *pkgpatternSet
+	mayNotDepends            *pkgpatternSet
+	mustDepends              []*pkgpattern
 	expectedStarToPackage    map[string]bool
 	expectedPackageToPackage map[string]map[string]bool
+	expectedPatterns         []*expectedPattern
+	foldCase                 bool
+
+	// source is where the rule was read from, e.g. the config file, a file
+	// of its rules directory or an included entry such as `preset:go-std`.
+	source string
+}
+
+// ruleIDRegexp matches IDs of rules.
+var ruleIDRegexp = regexp.MustCompile(`^[a-z0-9][a-z0-9._-]*$`)
+
+// id returns the ID of the rule, defaulting to the slug of its name, or of
+// its selector for unnamed rules.
+func (rule *rule) id() string {
+	if rule.ID != "" {
+		return rule.ID
+	}
+	if rule.Name != "" {
+		return slugify(rule.Name)
+	}
+	var parts []string
+	for i, value := range []string{rule.Packages, rule.PackageName, rule.Annotation, rule.Except} {
+		if value != "" {
+			parts = append(parts, []string{"packages", "package_name", "annotation", "except"}[i], value)
+		}
+	}
+	for _, except := range rule.ExceptPackages {
+		parts = append(parts, "except", except)
+	}
+	if rule.GeneratedProtos {
+		parts = append(parts, "generated_protos")
+	}
+	return slugify(strings.Join(parts, " "))
+}
+
+// findRule returns the rule of the name, or else of the ID or slug of its
+// name, e.g. `billing-no-db` for `billing: no db`, or nil if there is none.
+func (defs *defs) findRule(name string) *rule {
+	for _, rule := range defs.Rules {
+		if rule.Name == name {
+			return rule
+		}
+	}
+	for _, rule := range defs.Rules {
+		if rule.id() == name || rule.Name != "" && slugify(rule.Name) == name {
+			return rule
+		}
+	}
+	return nil
+}
+
+// slugify lowercases s, and replaces runs of anything but letters, digits,
+// '.' and '_' with '-', e.g. `billing-no-db` for `billing: no db`.
+func slugify(s string) string {
+	var b strings.Builder
+	dash := false
+	for _, r := range strings.ToLower(s) {
+		if r >= 'a' && r <= 'z' || r >= '0' && r <= '9' || (r == '.' || r == '_') && b.Len() != 0 {
+			if dash && b.Len() != 0 {
+				b.WriteByte('-')
+			}
+			b.WriteRune(r)
+			dash = false
+		} else {
+			dash = true
+		}
+	}
+	return b.String()
+}
+
+// ruleResult gathers the outcome of processing a rule, which is kept apart
+// from the rule so that rules may be processed concurrently.
+type ruleResult struct {
+	violations []*violation
+	exercised  []string
+
+	// processed lists the packages processed, and exercisedPatterns the
+	// pattern expectations exercised by any of them
+	processed         map[string]bool
+	exercisedPatterns map[*expectedPattern]bool
+}
+
+func newRuleResult() *ruleResult {
+	return &ruleResult{
+		processed:         make(map[string]bool),
+		exercisedPatterns: make(map[*expectedPattern]bool),
+	}
+}
+
+// expectedPattern is an expectation using patterns rather than literal
+// packages, e.g. `legacy/.*` or `legacy/.* -> server/.*`.
+type expectedPattern struct {
+	expr string
+	from *regexp.Regexp // nil for expectations on the whole rule
+	to   *regexp.Regexp
+}
+
+// equivalenceGroup is a set of interchangeable libraries, of which at most one
+// may be part of the dependency graph.
+type equivalenceGroup struct {
+	name     string
+	packages []string
+}
+
+// singleProvider maps a capability, such as logging, to the one approved
+// package providing it. Importing any of the alternatives is a violation.
+type singleProvider struct {
+	Capability   string   `yaml:"capability"`
+	Provider     string   `yaml:"provider"`
+	Alternatives []string `yaml:"alternatives"`
+
+	// fields denormalized on parse
+	alternatives *pkgpatternSet
+}
+
+// testOnly flags production code importing packages meant for tests only,
+// i.e. packages with a path element equal to one of the markers.
+type testOnly struct {
+	markers []string
+}
+
+// blankImports whitelists the packages which may use blank imports for side
+// effect registration, e.g. of sql drivers or image decoders.
+type blankImports struct {
+	Packages []string `yaml:"packages"`
+
+	// fields denormalized on parse
+	packagePatterns []*regexp.Regexp
+}
+
+// httpGlobals whitelists the packages which may use the globals of
+// net/http, e.g. to configure the default client once for the program.
+type httpGlobals struct {
+	Packages []string `yaml:"packages"`
+
+	// fields denormalized on parse
+	packagePatterns []*regexp.Regexp
+}
+
+// embeds governs the files working packages embed with `//go:embed`: only
+// the packages listed may embed files, if any are, and no embedded file may
+// be larger than MaxBytes, if set.
+type embeds struct {
+	Packages []string `yaml:"packages"`
+	MaxBytes int      `yaml:"max_bytes"`
+
+	// fields denormalized on parse
+	packagePatterns []*regexp.Regexp
+}
+
+// noCgo forbids third party packages requiring cgo, which break static
+// builds, but for the excepted ones, fully qualified.
+type noCgo struct {
+	Except []string `yaml:"except"`
+
+	// fields denormalized on parse
+	exceptPatterns []*regexp.Regexp
+}
+
+// importAlias requires packages to be imported under a canonical alias, or
+// to never be aliased.
+type importAlias struct {
+	Packages string `yaml:"packages"`
+	Alias    string `yaml:"alias"`
+	NoAlias  bool   `yaml:"no_alias"`
+
+	// fields denormalized on parse
+	pattern *pkgpattern
+}
+
+// layout requires selected packages to live under expected parents, and/or
+// at an expected depth relative to the working package.
+type layout struct {
+	Name     string `yaml:"name"`
+	selector `yaml:",inline"`
+	Parents  []string `yaml:"parents"`
+	Depth    int      `yaml:"depth"`
+
+	// fields denormalized on parse
+	workingPackage string
+}
+
+// acyclicGroups forbids cycles among named groups of packages, even though
+// such cycles are legal at the package level.
+type acyclicGroups struct {
+	Name   string            `yaml:"name"`
+	Groups map[string]string `yaml:"groups"`
+
+	// fields denormalized on parse
+	groupNames    []string
+	groupPatterns map[string]*regexp.Regexp
+}
+
+// independence forbids groups of packages from depending on one another, in
+// either direction, directly or transitively.
+type independence struct {
+	Name   string   `yaml:"name"`
+	Groups []string `yaml:"groups"`
+
+	// fields denormalized on parse
+	groupPatterns []*regexp.Regexp
+}
 
-	// violations are gathered during rule processing
-	actualPackagesProcessed map[string]bool
-	violations              []string
+// propagation requires the packages depending on downstream packages which
+// import a dependency, e.g. `<context>`, to import it too, as those which do
+// not likely swallow it, e.g. create contexts rather than pass theirs down.
+// Downstream packages are any working package unless given.
+type propagation struct {
+	Name       string `yaml:"name"`
+	Packages   string `yaml:"packages"`
+	Downstream string `yaml:"downstream"`
+	Dependency string `yaml:"dependency"`
+
+	// fields denormalized on parse
+	packagePattern    *regexp.Regexp
+	downstreamPattern *regexp.Regexp
+	dependency        *pkgpattern
 }
 
 type pkg struct {
-	name      string
-	goroot    bool
-	dependsOn map[string]*pkg
+	name        string
+	pkgName     string // declared name, e.g. `model` for `github.com/org/app/user/model`
+	goroot      bool
+	annotations map[string]string
+	files       []*goFile
+	tools       []*goFile // tools files, left out of files
+	id          int32     // in the graph holding the package
+
+	// dir is the directory of working packages relative to the root, and
+	// hash the hash of its Go files, for incremental collection
+	dir  string
+	hash string
+
+	// cgo indicates whether a third party package requires cgo, when
+	// checked
+	cgo bool
+
+	// embeds are the files a working package embeds, when governed
+	embeds []*embed
+}
+
+// embed is a file embedded by a working package, relative to the root.
+type embed struct {
+	path string
+	size int64
+}
+
+// goFile records the imports of a file, for violations which are attributed
+// to a specific import rather than to the package as a whole, along with its
+// uses of net/http globals.
+type goFile struct {
+	name    string
+	imports []*goImport
+	uses    []*goUse
+}
+
+// goUse is a use of a global of net/http, e.g. `http.DefaultClient`.
+type goUse struct {
+	name string
+	line int
+}
+
+type goImport struct {
+	path string
+	name string // explicit import name, e.g. `_` for blank imports
+	line int
+
+	// allow is the reason given by the `//depper:allow` comment suppressing
+	// the violations of the import, if any.
+	allow string
+}
+
+// allowDirective is the comment suppressing the violations of an import,
+// followed by the reason, e.g. `//depper:allow reporting predates the dal`.
+const allowDirective = "depper:allow"
+
+// allows indicates whether the package imports the dependency, and every
+// import of it is suppressed with `//depper:allow`.
+func (pkg *pkg) allows(path string) bool {
+	imported := false
+	for _, file := range pkg.files {
+		for _, imp := range file.imports {
+			if imp.path != path {
+				continue
+			}
+			if imp.allow == "" {
+				return false
+			}
+			imported = true
+		}
+	}
+	return imported
+}
+
+// position returns the position of the import in the file, e.g.
+// `foo/foo.go:4`.
+func (imp *goImport) position(file *goFile) string {
+	return fmt.Sprintf("%s:%d", file.name, imp.line)
+}
+
+func (use *goUse) position(file *goFile) string {
+	return fmt.Sprintf("%s:%d", file.name, use.line)
 }
 
 func (pkg *pkg) String() string {
@@ -65,10 +476,12 @@ func (pkg *pkg) String() string {
 // pkgpattern represents a pattern of packages, which you can match a specific
 // package against.
 type pkgpattern struct {
-	goroot         bool
-	thirdParties   bool
-	workingPackage string
-	pattern        *regexp.Regexp
+	goroot          bool
+	thirdParties    bool
+	generatedProtos bool
+	byName          bool
+	workingPackage  string
+	pattern         *regexp.Regexp
 }
 
 // compilePkgpattern compiles a package pattern such as `<fmt>` or `util/.*`
@@ -78,8 +491,15 @@ type pkgpattern struct {
 // - `pattern ` indicates non std lib packages matching `pattern`
 // - `third_parties` is a wildcard to match any third parties (i.e. non std lib,
 // non working package)
+// - `generated_protos` matches any package generated from protos, as per
+// isGeneratedProto
+// - `root` matches the working package itself, and `self_module` the working
+// package along with its subpackages
+// - `name:pattern` indicates non std lib packages whose declared name fully
+// matches `pattern`, regardless of their import path
 func compilePkgpattern(workingPackage, expr string) (*pkgpattern, error) {
 	var p pkgpattern
+	expr = unescapePath(expr)
 
 	if expr == "third_parties" {
 		p.thirdParties = true
@@ -87,6 +507,26 @@ func compilePkgpattern(workingPackage, expr string) (*pkgpattern, error) {
 		return &p, nil
 	}
 
+	if expr == "generated_protos" {
+		p.generatedProtos = true
+		return &p, nil
+	}
+
+	if pattern, ok := workingPattern(workingPackage, expr); ok {
+		p.pattern = pattern
+		return &p, nil
+	}
+
+	if strings.HasPrefix(expr, "name:") {
+		var err error
+		p.byName = true
+		p.pattern, err = regexp.Compile("^" + strings.TrimPrefix(expr, "name:") + "$")
+		if err != nil {
+			return nil, err
+		}
+		return &p, nil
+	}
+
 	pattern := expr
 	if strings.HasPrefix(expr, "<") && strings.HasSuffix(expr, ">") {
 		pattern = expr[1 : len(expr)-1]
@@ -102,6 +542,78 @@ func compilePkgpattern(workingPackage, expr string) (*pkgpattern, error) {
 	return &p, nil
 }
 
+// qualify returns the import path of a package in an expectation, which is
+// relative to the working package unless it is
+//
+// - `<pkg>` indicating std lib package `pkg`;
+// - `root` indicating the working package itself;
+// - `path:pkg` indicating the import path `pkg` as is, e.g. of a module
+// outside the working package without dots, such as `sample_deps/util`; or
+// - a fully qualified import path, i.e. whose first element contains a dot
+// such as `github.com/pkg/errors`
+func qualify(workingPackage, expr string) string {
+	expr = unescapePath(strings.TrimSpace(expr))
+	if strings.HasPrefix(expr, "path:") {
+		return strings.TrimPrefix(expr, "path:")
+	}
+	if expr == "root" {
+		return workingPackage
+	}
+	if strings.HasPrefix(expr, "<") && strings.HasSuffix(expr, ">") {
+		return expr[1 : len(expr)-1]
+	}
+	if first := strings.Split(expr, "/")[0]; strings.Contains(first, ".") && !isPattern(first) {
+		return expr
+	}
+	return workingPackage + "/" + expr
+}
+
+// unescapePath decodes the case encoding of module paths in the module cache,
+// where upper case letters are a `!` followed by the lower case letter, e.g.
+// `github.com/!azure/go-autorest` for `github.com/Azure/go-autorest`, so that
+// paths copied from the cache match import paths. Regular expressions have
+// no use for `!`.
+func unescapePath(path string) string {
+	if !strings.Contains(path, "!") {
+		return path
+	}
+	var unescaped strings.Builder
+	for i := 0; i < len(path); i++ {
+		if path[i] == '!' && i+1 < len(path) && 'a' <= path[i+1] && path[i+1] <= 'z' {
+			unescaped.WriteByte(path[i+1] - 'a' + 'A')
+			i++
+			continue
+		}
+		unescaped.WriteByte(path[i])
+	}
+	return unescaped.String()
+}
+
+// isPattern indicates whether the expression uses regular expression syntax,
+// other than dots which are common in import paths.
+func isPattern(expr string) bool {
+	return strings.ContainsAny(expr, `*+?()[]{}|^$\`)
+}
+
+// compileExpectation compiles one side of an expectation, qualified as
+// per qualify, into a pattern matching whole import paths.
+func compileExpectation(workingPackage, expr string) (*regexp.Regexp, error) {
+	expr = unescapePath(strings.TrimSpace(expr))
+	if !isPattern(expr) {
+		return regexp.Compile("^" + regexp.QuoteMeta(qualify(workingPackage, expr)) + "$")
+	}
+	if strings.HasPrefix(expr, "path:") {
+		return regexp.Compile("^" + strings.TrimPrefix(expr, "path:") + "$")
+	}
+	if strings.HasPrefix(expr, "<") && strings.HasSuffix(expr, ">") {
+		return regexp.Compile("^" + expr[1:len(expr)-1] + "$")
+	}
+	if first := strings.Split(expr, "/")[0]; strings.Contains(first, ".") && !isPattern(first) {
+		return regexp.Compile("^" + expr + "$")
+	}
+	return regexp.Compile("^" + regexp.QuoteMeta(workingPackage) + "/" + expr + "$")
+}
+
 func (p *pkgpattern) match(pkg *pkg) bool {
 	if p.goroot != pkg.goroot {
 		return false
@@ -111,6 +623,14 @@ func (p *pkgpattern) match(pkg *pkg) bool {
 		return !strings.HasPrefix(pkg.name, p.workingPackage)
 	}
 
+	if p.generatedProtos {
+		return isGeneratedProto(pkg)
+	}
+
+	if p.byName {
+		return p.pattern.MatchString(pkg.pkgName)
+	}
+
 	if !p.pattern.MatchString(pkg.name) {
 		return false
 	}
@@ -123,6 +643,11 @@ func (p *pkgpattern) String() string {
 		return fmt.Sprintf("<%s>", p.pattern)
 	} else if p.thirdParties {
 		return "third_parties"
+	} else if p.generatedProtos {
+		return "generated_protos"
+	} else if p.byName {
+		pattern := p.pattern.String()
+		return "name:" + pattern[1:len(pattern)-1]
 	} else {
 		return p.pattern.String()
 	}
@@ -131,238 +656,2410 @@ func (p *pkgpattern) String() string {
 func parse(input []byte) (*defs, error) {
 	// yaml parse
 	var defs defs
+	if err := validateConfig(input); err != nil {
+		return nil, err
+	}
 	err := yaml.Unmarshal([]byte(input), &defs)
 	if err != nil {
 		return nil, err
 	}
-
-	// configuration
-	if strings.HasSuffix(defs.Config.WorkingPackage, "/") {
-		return nil, fmt.Errorf("must be package import path, was %s", defs.Config.WorkingPackage)
+	if err := defs.include("."); err != nil {
+		return nil, err
 	}
 
-	// process all rules
-	for _, rule := range defs.Rules {
-		var err error
-		rule.packagePattern, err = regexp.Compile("^" + defs.Config.WorkingPackage + "/" + rule.Packages + "$")
-		if err != nil {
-			return nil, err
-		}
-		for _, expr := range rule.MayDepend {
-			set, err := compilePkgpattern(defs.Config.WorkingPackage, expr)
-			if err != nil {
-				return nil, err
-			}
-			rule.mayDepends = append(rule.mayDepends, set)
-		}
-		rule.expectedStarToPackage = make(map[string]bool)
-		rule.expectedPackageToPackage = make(map[string]map[string]bool)
-		for _, expected := range rule.Expected {
-			parts := strings.Split(expected, "->")
-			if l := len(parts); l == 1 {
-				rule.expectedStarToPackage[defs.Config.WorkingPackage+"/"+expected] = true
-			} else if l == 2 {
-				parent := defs.Config.WorkingPackage + "/" + strings.TrimSpace(parts[0])
-				child := defs.Config.WorkingPackage + "/" + strings.TrimSpace(parts[1])
-				if _, ok := rule.expectedPackageToPackage[parent]; !ok {
-					rule.expectedPackageToPackage[parent] = make(map[string]bool)
-				}
-				rule.expectedPackageToPackage[parent][child] = true
-			} else {
-				return nil, fmt.Errorf("malformed expectation %s", expected)
-			}
-		}
-		rule.actualPackagesProcessed = make(map[string]bool)
+	if err := defs.compile(); err != nil {
+		return nil, err
 	}
-
 	return &defs, nil
 }
 
-func main() {
-	var configPath string
-	if len(os.Args) == 2 {
-		configPath = os.Args[1]
-	} else {
-		fmt.Println("usage: depper config.yaml")
-		os.Exit(1)
-	}
-
-	bytes, err := ioutil.ReadFile(configPath)
+// parseFile parses the config file at path, along with the rule files of its
+// rules directory if any.
+func parseFile(path string) (*defs, error) {
+	defs, err := readFile(path)
 	if err != nil {
-		panic(err)
+		return nil, err
 	}
-	defs, err := parse(bytes)
-	if err != nil {
-		panic(err)
+	if err := defs.compile(); err != nil {
+		return nil, err
 	}
+	return defs, nil
+}
 
-	// Collect all packages.
-	cwd, err := os.Getwd()
-	if err != nil {
-		panic(err)
+// readFile reads the config file at path, or the standard input if path is
+// `-`, along with the rule files of its rules directory if any. The
+// definitions still need to be compiled.
+func readFile(path string) (*defs, error) {
+	var (
+		input []byte
+		err   error
+		dir   = filepath.Dir(path)
+	)
+	if path == "-" {
+		input, err = ioutil.ReadAll(os.Stdin)
+		dir = "."
+	} else {
+		input, err = ioutil.ReadFile(path)
 	}
-	pkgs, err := defs.collectPackages(cwd)
 	if err != nil {
-		panic(err)
+		return nil, err
 	}
 
-	// Run all packages against rules.
-	for _, pkg := range pkgs {
-		for _, rule := range defs.Rules {
-			if rule.packagePattern.MatchString(pkg.name) {
-				rule.process(pkgs, pkg)
-			}
-		}
+	// yaml parse
+	var defs defs
+	if err := validateConfig(input); err != nil {
+		return nil, fmt.Errorf("%s: %s", path, err)
+	}
+	if err := yaml.Unmarshal(input, &defs); err != nil {
+		return nil, fmt.Errorf("%s: %s", path, err)
+	}
+	source := path
+	if path == "-" {
+		source = "standard input"
 	}
-
-	// Missing packaged?
 	for _, rule := range defs.Rules {
-		rule.processMissingPackages()
+		rule.source = source
 	}
 
-	// Print all violations.
-	ok := true
-	for _, rule := range defs.Rules {
-		if len(rule.violations) != 0 {
-			fmt.Println(rule.Name)
-			for _, violation := range rule.violations {
-				fmt.Println(violation)
-				ok = false
+	// load patterns, relative to the config file
+	for i, pattern := range defs.Config.LoadPatterns {
+		if pattern == "." || strings.HasPrefix(pattern, "./") || strings.HasPrefix(pattern, "../") {
+			if defs.Config.LoadPatterns[i], err = filepath.Abs(filepath.Join(dir, pattern)); err != nil {
+				return nil, err
 			}
 		}
 	}
 
-	// Status code.
-	if !ok {
-		os.Exit(1)
+	// workspace module roots, relative to the config file
+	for i, entry := range defs.Config.Workspace {
+		if !isRemote(entry) && !filepath.IsAbs(entry) {
+			if defs.Config.Workspace[i], err = filepath.Abs(filepath.Join(dir, entry)); err != nil {
+				return nil, err
+			}
+		}
 	}
-	os.Exit(0)
-}
-
-func (rule *rule) process(pkgs map[string]*pkg, pkg *pkg) {
-	var (
-		bads            []string
-		starActuals     = make(map[string]bool)
-		specificActuals = make(map[string]bool)
-	)
 
-	// Process.
-	rule.actualPackagesProcessed[pkg.name] = true
+	// cache directory, relative to the config file
+	if cacheDir := defs.Config.CacheDir; cacheDir != "" && !filepath.IsAbs(cacheDir) {
+		defs.Config.CacheDir = filepath.Join(dir, cacheDir)
+	}
 
-nextPkg:
-	for _, depPkg := range pkg.dependsOn {
-		for _, set := range rule.mayDepends {
-			if set.match(depPkg) {
-				continue nextPkg
-			}
-		}
+	// signing key, relative to the config file
+	if sigs := defs.Config.Signatures; sigs != nil && sigs.Key != "" && !filepath.IsAbs(sigs.Key) {
+		sigs.Key = filepath.Join(dir, sigs.Key)
+	}
 
-		// Exception for whole rule?
-		if rule.expectedStarToPackage[depPkg.name] {
-			starActuals[depPkg.name] = true
-			continue nextPkg
+	// rules directory, relative to the config file
+	if rulesDir := defs.Config.RulesDir; rulesDir != "" {
+		if !filepath.IsAbs(rulesDir) {
+			rulesDir = filepath.Join(dir, rulesDir)
 		}
-
-		// Exception for specific dependency?
-		if _, ok := rule.expectedPackageToPackage[pkg.name]; ok {
-			if rule.expectedPackageToPackage[pkg.name][depPkg.name] {
-				specificActuals[depPkg.name] = true
-				continue nextPkg
-			}
+		if err := defs.loadRulesDir(rulesDir); err != nil {
+			return nil, err
 		}
+	}
 
-		// Bad.
-		bads = append(bads, depPkg.name)
+	// included rule files, relative to the config file, and presets
+	if err := defs.include(dir); err != nil {
+		return nil, err
 	}
 
-	// Handle violations.
-	for _, bad := range bads {
-		rule.violations = append(rule.violations, fmt.Sprintf("- disallowed %s -> %s", pkg, bad))
+	return &defs, nil
+}
+
+// configNames are the names of config files found by findConfig.
+var configNames = []string{"depper.yaml", ".depper.yaml"}
+
+// findConfig searches for a config file in dir and its parents, up to the
+// module root i.e. the directory containing `go.mod`. It returns the empty
+// path if there is none.
+func findConfig(dir string) (string, error) {
+	dir, err := filepath.Abs(dir)
+	if err != nil {
+		return "", err
 	}
-	for expected, _ := range rule.expectedStarToPackage {
-		if expected == pkg.name {
-			continue
-		}
-		if !starActuals[expected] {
-			rule.violations = append(rule.violations, fmt.Sprintf("- expected   %s -> %s", pkg, expected))
+	for {
+		for _, name := range configNames {
+			path := filepath.Join(dir, name)
+			if _, err := os.Stat(path); err == nil {
+				return path, nil
+			} else if !os.IsNotExist(err) {
+				return "", err
+			}
 		}
-	}
-	for expected, _ := range rule.expectedPackageToPackage[pkg.name] {
-		if expected == pkg.name {
-			continue
+		if _, err := os.Stat(filepath.Join(dir, "go.mod")); err == nil {
+			return "", nil
 		}
-		if !specificActuals[expected] {
-			rule.violations = append(rule.violations, fmt.Sprintf("- expected   %s -> %s", pkg, expected))
+		parent := filepath.Dir(dir)
+		if parent == dir {
+			return "", nil
 		}
+		dir = parent
 	}
 }
 
-func (rule *rule) processMissingPackages() {
-	for expected, _ := range rule.expectedPackageToPackage {
-		if !rule.actualPackagesProcessed[expected] {
-			rule.violations = append(rule.violations, fmt.Sprintf("- missing    %s", expected))
+// parseInlineRule parses an ad-hoc rule such as `services/.* !> dal/.*`,
+// where `!>` lists the dependencies packages may not have, and `->` the only
+// dependencies they may have, separated by commas.
+func parseInlineRule(expr string) (*rule, error) {
+	rule := &rule{Name: expr, source: "--rule"}
+	parts := strings.SplitN(expr, "!>", 2)
+	dependencies := &rule.MayNotDepend
+	if len(parts) != 2 {
+		parts = strings.SplitN(expr, "->", 2)
+		dependencies = &rule.MayDepend
+	}
+	if len(parts) != 2 || strings.TrimSpace(parts[0]) == "" {
+		return nil, fmt.Errorf("malformed rule %s, must be packages -> dependencies or packages !> dependencies", expr)
+	}
+	rule.Packages = strings.TrimSpace(parts[0])
+	for _, dependency := range strings.Split(parts[1], ",") {
+		if dependency = strings.TrimSpace(dependency); dependency != "" {
+			*dependencies = append(*dependencies, dependency)
 		}
 	}
+	return rule, nil
 }
 
-func isGoroot(goPkg *packages.Package) bool {
-	return strings.HasPrefix(goPkg.GoFiles[0], runtime.GOROOT())
+// environment is a repeatable flag of `KEY=VALUE` environment variables.
+type environment []string
+
+func (e *environment) String() string {
+	return strings.Join(*e, " ")
 }
 
-func (defs *defs) collectPackages(root string) (map[string]*pkg, error) {
-	pkgs := make(map[string]*pkg)
-	if err := defs._collectPackages(pkgs, root, ".", 0); err != nil {
-		return nil, err
+func (e *environment) Set(value string) error {
+	if !strings.Contains(value, "=") || strings.HasPrefix(value, "=") {
+		return fmt.Errorf("malformed environment variable %s, must be KEY=VALUE", value)
 	}
-	return pkgs, nil
+	*e = append(*e, value)
+	return nil
 }
 
-func (defs *defs) _collectPackages(pkgs map[string]*pkg, root string, pkgName string, level int) error {
-	if level++; level > 256 {
-		return nil
+// inlineRules is a repeatable flag of ad-hoc rules, as per parseInlineRule.
+type inlineRules []*rule
+
+func (r *inlineRules) String() string {
+	var exprs []string
+	for _, rule := range *r {
+		exprs = append(exprs, rule.Name)
+	}
+	return strings.Join(exprs, ", ")
+}
+
+func (r *inlineRules) Set(value string) error {
+	rule, err := parseInlineRule(value)
+	if err != nil {
+		return err
+	}
+	*r = append(*r, rule)
+	return nil
+}
+
+// globs is a repeatable flag of names, e.g. of rules, where `*` matches any
+// characters and `?` any one character.
+type globs []string
+
+func (g *globs) String() string {
+	return strings.Join(*g, ", ")
+}
+
+func (g *globs) Set(value string) error {
+	*g = append(*g, value)
+	return nil
+}
+
+func (g globs) match(name string) bool {
+	for _, glob := range g {
+		if matchGlob(glob, name) {
+			return true
+		}
+	}
+	return false
+}
+
+func matchGlob(glob, name string) bool {
+	expr := regexp.QuoteMeta(glob)
+	expr = strings.Replace(expr, `\*`, ".*", -1)
+	expr = strings.Replace(expr, `\?`, ".", -1)
+	return regexp.MustCompile("^" + expr + "$").MatchString(name)
+}
+
+// filterRules keeps the rules named by any of only, if any, and none of
+// skip, by name or ID. Names of only matching no rule are likely mistaken,
+// and fail.
+func (defs *defs) filterRules(only, skip globs) error {
+	for _, glob := range only {
+		matched := false
+		for _, rule := range defs.Rules {
+			matched = matched || matchGlob(glob, rule.Name) || matchGlob(glob, rule.id())
+		}
+		if !matched {
+			return fmt.Errorf("no rule named %s", glob)
+		}
+	}
+	named := func(names globs, rule *rule) bool {
+		return names.match(rule.Name) || names.match(rule.id())
+	}
+	var rules []*rule
+	for _, rule := range defs.Rules {
+		if (len(only) == 0 || named(only, rule)) && !named(skip, rule) {
+			rules = append(rules, rule)
+		}
+	}
+	defs.Rules = rules
+	return nil
+}
+
+// loadRulesDir adds the rules of every `*.yaml` file in dir, prefixing rule
+// names with the file name, e.g. rule `no db` of `billing.yaml` is named
+// `billing: no db`.
+func (defs *defs) loadRulesDir(dir string) error {
+	paths, err := filepath.Glob(filepath.Join(dir, "*.yaml"))
+	if err != nil {
+		return err
+	}
+	if len(paths) == 0 {
+		return fmt.Errorf("no rule files in %s", dir)
+	}
+	for _, path := range paths {
+		input, err := ioutil.ReadFile(path)
+		if err != nil {
+			return err
+		}
+		if err := defs.loadRules(input, path, strings.TrimSuffix(filepath.Base(path), ".yaml")); err != nil {
+			return err
+		}
+	}
+	return nil
+}
+
+// loadRules adds the rules of the rule file input read from source, prefixing
+// rule names with the namespace.
+func (defs *defs) loadRules(input []byte, source, namespace string) error {
+	var ruleFile struct {
+		Rules []*rule `yaml:"rules"`
+	}
+	if err := validateYAML(input, ruleFile); err != nil {
+		return fmt.Errorf("%s: %s", source, err)
+	}
+	if err := yaml.Unmarshal(input, &ruleFile); err != nil {
+		return fmt.Errorf("%s: %s", source, err)
+	}
+	for _, rule := range ruleFile.Rules {
+		rule.Name = namespace + ": " + rule.Name
+		rule.source = source
+		defs.Rules = append(defs.Rules, rule)
+	}
+	return nil
+}
+
+// writeRules writes the rules, one per line with their ID and where they were
+// read from, e.g. `billing: no db (billing-no-db) from rules/billing.yaml`.
+func writeRules(w io.Writer, defs *defs) {
+	for _, rule := range defs.Rules {
+		line := fmt.Sprintf("%s (%s)", rule.Name, rule.id())
+		if rule.source != "" {
+			line += " from " + rule.source
+		}
+		fmt.Fprintln(w, line)
+	}
+}
+
+// compile validates the definitions, and denormalizes them for processing.
+func (defs *defs) compile() error {
+	// configuration
+	if strings.HasSuffix(defs.Config.WorkingPackage, "/") {
+		return fmt.Errorf("must be package import path, was %s", defs.Config.WorkingPackage)
+	}
+
+	// process all rules
+	ids := make(map[string]*rule)
+	for _, rule := range defs.Rules {
+		rule.ID = rule.id()
+		if !ruleIDRegexp.MatchString(rule.ID) {
+			return fmt.Errorf("rule id %s is malformed, must be lowercase letters, digits, '.', '_' or '-'", rule.ID)
+		}
+		if other, ok := ids[rule.ID]; ok {
+			return fmt.Errorf("rules %s and %s have the same id %s, name them apart or set their id", other.Name, rule.Name, rule.ID)
+		}
+		ids[rule.ID] = rule
+
+		// Rules may override the working package, e.g. in multi-module repos.
+		workingPackage := defs.Config.WorkingPackage
+		if rule.WorkingPackage != "" {
+			if strings.HasSuffix(rule.WorkingPackage, "/") {
+				return fmt.Errorf("must be package import path, was %s", rule.WorkingPackage)
+			}
+			workingPackage = rule.WorkingPackage
+		}
+
+		if rule.Severity == "" {
+			rule.Severity = severityError
+		} else if rule.Severity != severityError && rule.Severity != severityWarn {
+			return fmt.Errorf("rule %s has unknown severity %s", rule.Name, rule.Severity)
+		}
+		if rule.Exclusive && rule.Severity != severityError {
+			return fmt.Errorf("exclusive rule %s must have severity %s", rule.Name, severityError)
+		}
+
+		if err := rule.selector.compile(workingPackage); err != nil {
+			return fmt.Errorf("rule %s %s", rule.Name, err)
+		}
+		var mayDepends, mayNotDepends []*pkgpattern
+		for _, expr := range rule.MayDepend {
+			set, err := compilePkgpattern(workingPackage, expr)
+			if err != nil {
+				return err
+			}
+			mayDepends = append(mayDepends, set)
+		}
+		for _, expr := range rule.MayNotDepend {
+			set, err := compilePkgpattern(workingPackage, expr)
+			if err != nil {
+				return err
+			}
+			mayNotDepends = append(mayNotDepends, set)
+		}
+		rule.mayDepends, rule.mayNotDepends = newPkgpatternSet(mayDepends...), newPkgpatternSet(mayNotDepends...)
+		rule.mustDepends = nil
+		for _, expr := range rule.MustDepend {
+			pattern, err := compilePkgpattern(workingPackage, expr)
+			if err != nil {
+				return err
+			}
+			rule.mustDepends = append(rule.mustDepends, pattern)
+		}
+		rule.expectedStarToPackage = make(map[string]bool)
+		rule.expectedPackageToPackage = make(map[string]map[string]bool)
+		for _, expected := range rule.Expected {
+			parts := strings.Split(expected, "->")
+			if isPattern(expected) {
+				pattern := &expectedPattern{expr: strings.TrimSpace(expected)}
+				var err error
+				if l := len(parts); l == 1 {
+					pattern.to, err = compileExpectation(workingPackage, parts[0])
+				} else if l == 2 {
+					pattern.from, err = compileExpectation(workingPackage, parts[0])
+					if err == nil {
+						pattern.to, err = compileExpectation(workingPackage, parts[1])
+					}
+				} else {
+					return fmt.Errorf("malformed expectation %s", expected)
+				}
+				if err != nil {
+					return err
+				}
+				rule.expectedPatterns = append(rule.expectedPatterns, pattern)
+			} else if l := len(parts); l == 1 {
+				rule.expectedStarToPackage[qualify(workingPackage, expected)] = true
+			} else if l == 2 {
+				parent := qualify(workingPackage, parts[0])
+				child := qualify(workingPackage, parts[1])
+				if _, ok := rule.expectedPackageToPackage[parent]; !ok {
+					rule.expectedPackageToPackage[parent] = make(map[string]bool)
+				}
+				rule.expectedPackageToPackage[parent][child] = true
+			} else {
+				return fmt.Errorf("malformed expectation %s", expected)
+			}
+		}
+		if defs.Config.CaseInsensitive {
+			rule.fold()
+		}
+	}
+
+	// process all equivalence groups
+	for name, packages := range defs.EquivalenceGroups {
+		if len(packages) < 2 {
+			return fmt.Errorf("equivalence group %s must list at least two packages", name)
+		}
+		defs.equivalenceGroups = append(defs.equivalenceGroups, &equivalenceGroup{
+			name:     name,
+			packages: packages,
+		})
+	}
+	sort.Slice(defs.equivalenceGroups, func(i, j int) bool {
+		return defs.equivalenceGroups[i].name < defs.equivalenceGroups[j].name
+	})
+
+	// test only packages
+	if len(defs.TestOnlyMarkers) != 0 {
+		defs.testOnly = &testOnly{markers: defs.TestOnlyMarkers}
+	}
+
+	// blank imports
+	if defs.BlankImports != nil {
+		for _, packages := range defs.BlankImports.Packages {
+			pattern, err := regexp.Compile("^" + defs.Config.WorkingPackage + "/" + packages + "$")
+			if err != nil {
+				return err
+			}
+			defs.BlankImports.packagePatterns = append(defs.BlankImports.packagePatterns, pattern)
+		}
+	}
+
+	// net/http globals
+	if defs.HTTPGlobals != nil {
+		for _, packages := range defs.HTTPGlobals.Packages {
+			pattern, err := regexp.Compile("^" + defs.Config.WorkingPackage + "/" + packages + "$")
+			if err != nil {
+				return err
+			}
+			defs.HTTPGlobals.packagePatterns = append(defs.HTTPGlobals.packagePatterns, pattern)
+		}
+	}
+
+	// embedded files
+	if defs.Embeds != nil {
+		for _, packages := range defs.Embeds.Packages {
+			pattern, err := regexp.Compile("^" + defs.Config.WorkingPackage + "/" + packages + "$")
+			if err != nil {
+				return err
+			}
+			defs.Embeds.packagePatterns = append(defs.Embeds.packagePatterns, pattern)
+		}
+	}
+
+	// weights of the health score
+	if defs.Score != nil {
+		if err := defs.Score.validate(); err != nil {
+			return err
+		}
+	}
+
+	// third parties requiring cgo
+	if defs.NoCgo != nil {
+		for _, except := range defs.NoCgo.Except {
+			pattern, err := regexp.Compile("^" + unescapePath(except) + "$")
+			if err != nil {
+				return err
+			}
+			defs.NoCgo.exceptPatterns = append(defs.NoCgo.exceptPatterns, pattern)
+		}
+	}
+
+	// process all import aliases
+	for _, alias := range defs.ImportAliases {
+		if (alias.Alias == "") == !alias.NoAlias {
+			return fmt.Errorf("import alias for %s must have either an alias or no_alias", alias.Packages)
+		}
+		var err error
+		alias.pattern, err = compilePkgpattern(defs.Config.WorkingPackage, alias.Packages)
+		if err != nil {
+			return err
+		}
+		if defs.Config.CaseInsensitive {
+			foldPkgpatterns(alias.pattern)
+		}
+	}
+
+	// process all layouts
+	for _, layout := range defs.Layouts {
+		if err := layout.selector.compile(defs.Config.WorkingPackage); err != nil {
+			return fmt.Errorf("layout %s %s", layout.Name, err)
+		}
+		if defs.Config.CaseInsensitive {
+			layout.selector.fold()
+		}
+		if len(layout.Parents) == 0 && layout.Depth == 0 {
+			return fmt.Errorf("layout %s must have parents or a depth", layout.Name)
+		}
+		layout.workingPackage = defs.Config.WorkingPackage
+	}
+
+	// process all acyclic groups
+	for _, acyclic := range defs.AcyclicGroups {
+		if len(acyclic.Groups) < 2 {
+			return fmt.Errorf("acyclic groups %s must have at least two groups", acyclic.Name)
+		}
+		acyclic.groupPatterns = make(map[string]*regexp.Regexp)
+		for name, packages := range acyclic.Groups {
+			pattern, err := regexp.Compile("^" + defs.Config.WorkingPackage + "/" + packages + "$")
+			if err != nil {
+				return err
+			}
+			acyclic.groupNames = append(acyclic.groupNames, name)
+			acyclic.groupPatterns[name] = pattern
+		}
+		sort.Strings(acyclic.groupNames)
+	}
+
+	// process all independences
+	for _, independence := range defs.Independent {
+		if len(independence.Groups) < 2 {
+			return fmt.Errorf("independence %s must have at least two groups", independence.name())
+		}
+		for _, packages := range independence.Groups {
+			pattern, err := regexp.Compile("^" + defs.Config.WorkingPackage + "/" + packages + "$")
+			if err != nil {
+				return err
+			}
+			independence.groupPatterns = append(independence.groupPatterns, pattern)
+		}
+	}
+
+	// process all propagations
+	for _, propagation := range defs.Propagate {
+		if propagation.Packages == "" || propagation.Dependency == "" {
+			return fmt.Errorf("propagation %s must have packages and a dependency", propagation.name())
+		}
+		var err error
+		propagation.packagePattern, err = regexp.Compile("^" + defs.Config.WorkingPackage + "/" + propagation.Packages + "$")
+		if err != nil {
+			return err
+		}
+		if propagation.Downstream != "" {
+			propagation.downstreamPattern, err = regexp.Compile("^" + defs.Config.WorkingPackage + "/" + propagation.Downstream + "$")
+			if err != nil {
+				return err
+			}
+		}
+		propagation.dependency, err = compilePkgpattern(defs.Config.WorkingPackage, propagation.Dependency)
+		if err != nil {
+			return err
+		}
+		if defs.Config.CaseInsensitive {
+			foldPkgpatterns(propagation.dependency)
+		}
+	}
+
+	// process all single providers
+	for _, provider := range defs.SingleProviders {
+		if provider.Capability == "" || provider.Provider == "" {
+			return fmt.Errorf("single provider must have a capability and a provider")
+		}
+		var alternatives []*pkgpattern
+		for _, expr := range provider.Alternatives {
+			set, err := compilePkgpattern(defs.Config.WorkingPackage, expr)
+			if err != nil {
+				return err
+			}
+			alternatives = append(alternatives, set)
+		}
+		if defs.Config.CaseInsensitive {
+			foldPkgpatterns(alternatives...)
+		}
+		provider.alternatives = newPkgpatternSet(alternatives...)
+	}
+	defs.ruleIndex = defs.newRuleIndex()
+
+	return nil
+}
+
+// failing indicates whether a run failed, i.e. whether the violations at the
+// fail on level or above exceed the maximum allowed.
+func failing(errors, warnings int, failOn string, maxViolations int) bool {
+	switch failOn {
+	case "never":
+		return false
+	case severityWarn:
+		return errors+warnings > maxViolations
+	default:
+		return errors > maxViolations
+	}
+}
+
+// check runs all rules and checks against the graph, and reports their
+// violations. Rules with build tags are run against the graph collected with
+// those tags, keyed by the comma separated tags. With showExpected, the
+// exercised expectations of rules are reported as well. Options add hooks,
+// as per checkHooks.
+//
+// Checking modifies neither the definitions nor the graphs, and may be done
+// concurrently.
+func (defs *defs) check(g *graph, tagged map[string]*graph, showExpected bool, opts ...checkOption) *report {
+	var report report
+	span := defs.trace.child("check")
+	defer span.finish()
+	hooks := newCheckHooks(opts)
+
+	// Broken packages, with any build tags?
+	var keys []string
+	for key := range tagged {
+		keys = append(keys, key)
+	}
+	sort.Strings(keys)
+	loadErrors := append([]*violation(nil), g.loadErrors...)
+	for _, key := range keys {
+	nextLoadError:
+		for _, loadError := range tagged[key].loadErrors {
+			for _, existing := range loadErrors {
+				if *existing == *loadError {
+					continue nextLoadError
+				}
+			}
+			loadErrors = append(loadErrors, loadError)
+		}
+	}
+	if len(loadErrors) != 0 {
+		hooks.found("package load errors", loadErrors)
+		hooks.complete(nil, report.add("", "package load errors", severityError, loadErrors))
+	}
+
+	// Run all packages against rules, rules concurrently, and report them
+	// in order as they complete.
+	selected := defs.selectPackages(g, tagged)
+	results := make([]*ruleResult, len(defs.Rules))
+	done := make([]chan struct{}, len(defs.Rules))
+	for i := range done {
+		done[i] = make(chan struct{})
+	}
+	go parallel(defs.parallelism, len(defs.Rules), func(i int) {
+		defer close(done[i])
+		rule, ruleGraph := defs.Rules[i], g
+		if len(rule.BuildTags) != 0 {
+			ruleGraph = tagged[strings.Join(rule.BuildTags, ",")]
+		}
+		ruleSpan := span.child("check rule")
+		results[i] = rule.checkPackages(ruleGraph, selected[i], hooks)
+		ruleSpan.set("depper.rule.id", rule.ID)
+		ruleSpan.set("depper.packages", len(selected[i]))
+		ruleSpan.set("depper.violations", len(results[i].violations))
+		ruleSpan.finish()
+	})
+	for i, rule := range defs.Rules {
+		<-done[i]
+		result := results[i]
+		section := report.add(rule.ID, rule.Name, rule.Severity, result.violations)
+		section.Source = rule.source
+		if showExpected {
+			section.Exercised = result.exercised
+			sort.Strings(section.Exercised)
+		}
+		hooks.complete(rule, section)
+	}
+	checks := len(report.Sections)
+
+	// Duplicate libraries?
+	for _, group := range defs.equivalenceGroups {
+		report.add("", "equivalence group "+group.name, severityError, group.process(g))
+	}
+
+	// Alternatives to approved providers?
+	for _, provider := range defs.SingleProviders {
+		report.add("", "single provider for "+provider.Capability, severityError, provider.process(g))
+	}
+
+	// Production code importing test only packages?
+	if defs.testOnly != nil {
+		report.add("", "test only packages", severityError, defs.testOnly.process(g))
+	}
+
+	// Blank imports outside of whitelisted packages?
+	if defs.BlankImports != nil {
+		report.add("", "blank imports", severityError, defs.BlankImports.process(g))
+	}
+
+	// Globals of net/http outside of whitelisted packages?
+	if defs.HTTPGlobals != nil {
+		report.add("", "http globals", severityError, defs.HTTPGlobals.process(g))
+	}
+
+	// Files embedded outside of whitelisted packages, or too large?
+	if defs.Embeds != nil {
+		report.add("", "embeds", severityError, defs.Embeds.process(g))
+	}
+
+	// Third parties requiring cgo?
+	if defs.NoCgo != nil {
+		report.add("", "no cgo", severityError, defs.NoCgo.process(g))
+	}
+
+	// Imports not following alias conventions?
+	for _, alias := range defs.ImportAliases {
+		report.add("", "import aliases for "+alias.Packages, severityError, alias.process(g))
+	}
+
+	// Misplaced packages?
+	for _, layout := range defs.Layouts {
+		report.add("", layout.Name, severityError, layout.process(g))
+	}
+
+	// Cycles among groups?
+	for _, acyclic := range defs.AcyclicGroups {
+		report.add("", acyclic.Name, severityError, acyclic.process(g))
+	}
+
+	// Dependencies among independent groups?
+	for _, independence := range defs.Independent {
+		report.add("", independence.name(), severityError, independence.process(g))
+	}
+
+	// Dependencies swallowed on their way down?
+	for _, propagation := range defs.Propagate {
+		report.add("", propagation.name(), severityError, propagation.process(g, defs.isWorking))
+	}
+
+	for _, section := range report.Sections[checks:] {
+		hooks.found(section.Name, section.Violations)
+		hooks.complete(nil, section)
+	}
+	return &report
+}
+
+// parallel calls do with 0 to n-1, from as many goroutines as workers, or as
+// there are CPUs if workers is not positive.
+func parallel(workers, n int, do func(i int)) {
+	if workers <= 0 {
+		workers = runtime.GOMAXPROCS(0)
+	}
+	if workers > n {
+		workers = n
+	}
+	var (
+		wg   sync.WaitGroup
+		next = make(chan int)
+	)
+	for w := 0; w < workers; w++ {
+		wg.Add(1)
+		go func() {
+			defer wg.Done()
+			for i := range next {
+				do(i)
+			}
+		}()
+	}
+	for i := 0; i < n; i++ {
+		next <- i
+	}
+	close(next)
+	wg.Wait()
+}
+
+func (sel *selector) compile(workingPackage string) error {
+	if sel.Packages == "" && sel.PackageName == "" && sel.Annotation == "" && !sel.GeneratedProtos {
+		return fmt.Errorf("must select packages, a package name, an annotation or generated protos")
+	}
+	if sel.Packages != "" {
+		var err error
+		sel.packagePattern, sel.goroot, sel.external, err = compileSelectorPattern(workingPackage, sel.Packages)
+		if err != nil {
+			return err
+		}
+	}
+	if sel.PackageName != "" {
+		var err error
+		sel.packageNamePattern, err = regexp.Compile("^" + sel.PackageName + "$")
+		if err != nil {
+			return err
+		}
+	}
+	if sel.Annotation != "" {
+		parts := strings.SplitN(sel.Annotation, "=", 2)
+		if len(parts) != 2 || parts[0] == "" {
+			return fmt.Errorf("malformed annotation %s, must be key=value", sel.Annotation)
+		}
+		sel.annotationKey, sel.annotationValue = parts[0], parts[1]
+	}
+	sel.exceptPatterns, sel.exceptGoroots = nil, nil
+	for _, except := range append([]string{sel.Except}, sel.ExceptPackages...) {
+		if except == "" {
+			continue
+		}
+		pattern, goroot, _, err := compileSelectorPattern(workingPackage, except)
+		if err != nil {
+			return err
+		}
+		sel.exceptPatterns = append(sel.exceptPatterns, pattern)
+		sel.exceptGoroots = append(sel.exceptGoroots, goroot)
+	}
+	return nil
+}
+
+// workingPattern returns the pattern of the `root` and `self_module`
+// keywords, which match the working package itself, and along with its
+// subpackages. Patterns relative to the working package are joined to it with
+// a slash, so that they cannot match it otherwise.
+func workingPattern(workingPackage, expr string) (*regexp.Regexp, bool) {
+	switch expr {
+	case "root":
+		return regexp.MustCompile("^" + regexp.QuoteMeta(workingPackage) + "$"), true
+	case "self_module":
+		return regexp.MustCompile("^" + regexp.QuoteMeta(workingPackage) + "(/.*)?$"), true
+	}
+	return nil, false
+}
+
+// compileSelectorPattern compiles the import path pattern of a selector, and
+// indicates whether it selects std lib packages, and non working packages.
+func compileSelectorPattern(workingPackage, expr string) (*regexp.Regexp, bool, bool, error) {
+	expr = unescapePath(expr)
+	if pattern, ok := workingPattern(workingPackage, expr); ok {
+		return pattern, false, false, nil
+	}
+	goroot := strings.HasPrefix(expr, "<") && strings.HasSuffix(expr, ">")
+	external := goroot
+	if goroot {
+		expr = expr[1 : len(expr)-1]
+	} else if first := strings.Split(expr, "/")[0]; strings.Contains(first, ".") && !isPattern(first) {
+		external = true
+	} else {
+		expr = workingPackage + "/" + expr
+	}
+	pattern, err := regexp.Compile("^" + expr + "$")
+	return pattern, goroot, external, err
+}
+
+// matches indicates whether the selector applies to the package, i.e. whether
+// the package matches the packages and package name patterns, carries the
+// annotation, and is generated from protos if need be, but does not match the
+// except patterns.
+func (sel *selector) matches(pkg *pkg) bool {
+	for i, pattern := range sel.exceptPatterns {
+		if sel.exceptGoroots[i] == pkg.goroot && pattern.MatchString(pkg.name) {
+			return false
+		}
+	}
+	if sel.GeneratedProtos && !isGeneratedProto(pkg) {
+		return false
+	}
+	if sel.packagePattern != nil && (sel.goroot != pkg.goroot || !sel.packagePattern.MatchString(pkg.name)) {
+		return false
+	}
+	if sel.packageNamePattern != nil && !sel.packageNamePattern.MatchString(pkg.pkgName) {
+		return false
+	}
+	if sel.annotationKey != "" {
+		value, ok := pkg.annotations[sel.annotationKey]
+		if !ok || value != sel.annotationValue {
+			return false
+		}
+	}
+	return true
+}
+
+// check processes the rule against every package it selects, returning the
+// outcome.
+func (rule *rule) check(g *graph) *ruleResult {
+	var selected []*pkg
+	for _, pkg := range g.nodes() {
+		if rule.matches(pkg) {
+			selected = append(selected, pkg)
+		}
+	}
+	return rule.checkPackages(g, selected, nil)
+}
+
+// checkPackages processes the rule against the packages it selects, in name
+// order, calling the hooks, if any, with each package and its violations as
+// it is judged.
+func (rule *rule) checkPackages(g *graph, selected []*pkg, hooks *checkHooks) *ruleResult {
+	result := newRuleResult()
+	for _, pkg := range selected {
+		hooks.matched(rule, pkg)
+		found := len(result.violations)
+		rule.process(g, pkg, result)
+		hooks.found(rule.Name, result.violations[found:])
+	}
+	found := len(result.violations)
+	rule.processMissingPackages(result)
+	hooks.found(rule.Name, result.violations[found:])
+	return result
+}
+
+// newRuleIndex indexes the selectors of rules, to select the packages of all
+// rules at once.
+func (defs *defs) newRuleIndex() *selectorIndex {
+	var selectors []*selector
+	for _, rule := range defs.Rules {
+		selectors = append(selectors, &rule.selector)
+	}
+	return newSelectorIndex(selectors)
+}
+
+// selectPackages returns the packages each rule selects, in name order, from
+// the graph matching the build tags of the rule. Each package is matched
+// against the rules at once, rather than against every rule in turn.
+func (defs *defs) selectPackages(g *graph, tagged map[string]*graph) [][]*pkg {
+	index := defs.ruleIndex
+	if index == nil || len(index.selectors) != len(defs.Rules) {
+		index = defs.newRuleIndex()
+	}
+	var (
+		selected = make([][]*pkg, len(defs.Rules))
+		keys     = make([]string, len(defs.Rules))
+		graphs   = map[string]*graph{"": g}
+	)
+	for i, rule := range defs.Rules {
+		keys[i] = strings.Join(rule.BuildTags, ",")
+		if keys[i] != "" {
+			graphs[keys[i]] = tagged[keys[i]]
+		}
+	}
+	for key, ruleGraph := range graphs {
+		if ruleGraph == nil {
+			continue
+		}
+		for _, pkg := range ruleGraph.nodes() {
+			for _, i := range index.matching(pkg) {
+				if keys[i] == key {
+					selected[i] = append(selected[i], pkg)
+				}
+			}
+		}
+	}
+	return selected
+}
+
+// Verdicts of rules on dependencies, as per rule.judge.
+const (
+	verdictAllowed = iota
+	verdictExpectedForRule
+	verdictExpectedForPackage
+	verdictExpectedByPattern
+	verdictSuppressed
+	verdictDisallowed
+)
+
+// judge returns the verdict of the rule on the dependency of a package it
+// selects, and the expected pattern exercised by the dependency, if any.
+func (rule *rule) judge(pkg, depPkg *pkg) (int, *expectedPattern) {
+	if !rule.mayNotDepends.match(depPkg) {
+		// Rules listing only what packages may not, or must, depend on
+		// allow everything else, unless exclusive.
+		if !rule.Exclusive && rule.mayDepends.len() == 0 && (rule.mayNotDepends.len() != 0 || len(rule.mustDepends) != 0) {
+			return verdictAllowed, nil
+		}
+		if rule.mayDepends.match(depPkg) {
+			return verdictAllowed, nil
+		}
+		// What packages must depend on, they may.
+		for _, required := range rule.mustDepends {
+			if required.match(depPkg) {
+				return verdictAllowed, nil
+			}
+		}
+	}
+
+	// Exception for whole rule?
+	if rule.expectedStarToPackage[rule.key(depPkg.name)] {
+		return verdictExpectedForRule, nil
+	}
+
+	// Exception for specific dependency?
+	if rule.expectedPackageToPackage[rule.key(pkg.name)][rule.key(depPkg.name)] {
+		return verdictExpectedForPackage, nil
+	}
+
+	// Exception by pattern?
+	for _, pattern := range rule.expectedPatterns {
+		if pattern.from != nil && !pattern.from.MatchString(pkg.name) {
+			continue
+		}
+		if pattern.to.MatchString(depPkg.name) {
+			return verdictExpectedByPattern, pattern
+		}
+	}
+
+	// Suppressed by the importer? Exclusive rules only take the exceptions
+	// they declare.
+	if !rule.Exclusive && pkg.allows(depPkg.name) {
+		return verdictSuppressed, nil
+	}
+
+	// Bad.
+	return verdictDisallowed, nil
+}
+
+func (rule *rule) process(g *graph, pkg *pkg, result *ruleResult) {
+	var (
+		bads            []string
+		starActuals     = make(map[string]bool)
+		specificActuals = make(map[string]bool)
+	)
+
+	// Process.
+	result.processed[rule.key(pkg.name)] = true
+
+	for _, depPkg := range g.dependencies(pkg) {
+		verdict, pattern := rule.judge(pkg, depPkg)
+		switch verdict {
+		case verdictAllowed:
+			continue
+		case verdictDisallowed:
+			bads = append(bads, depPkg.name)
+			continue
+		case verdictExpectedForRule:
+			starActuals[rule.key(depPkg.name)] = true
+		case verdictExpectedForPackage:
+			specificActuals[rule.key(depPkg.name)] = true
+		case verdictExpectedByPattern:
+			result.exercisedPatterns[pattern] = true
+		}
+		result.exercised = append(result.exercised, fmt.Sprintf("%s -> %s", pkg, depPkg))
+	}
+
+	// Handle violations.
+	for _, bad := range bads {
+		result.violations = append(result.violations, &violation{Kind: kindDisallowed, From: pkg.String(), To: bad})
+	}
+nextRequired:
+	for i, required := range rule.mustDepends {
+		for _, depPkg := range g.dependencies(pkg) {
+			if required.match(depPkg) {
+				continue nextRequired
+			}
+		}
+		result.violations = append(result.violations, &violation{Kind: kindRequired, From: pkg.String(), To: rule.MustDepend[i]})
+	}
+	for expected, _ := range rule.expectedStarToPackage {
+		if expected == rule.key(pkg.name) {
+			continue
+		}
+		if !starActuals[expected] {
+			result.violations = append(result.violations, &violation{Kind: kindExpected, From: pkg.String(), To: expected})
+		}
+	}
+	for expected, _ := range rule.expectedPackageToPackage[rule.key(pkg.name)] {
+		if expected == rule.key(pkg.name) {
+			continue
+		}
+		if !specificActuals[expected] {
+			result.violations = append(result.violations, &violation{Kind: kindExpected, From: pkg.String(), To: expected})
+		}
+	}
+}
+
+// fold makes the compiled rule match import paths regardless of case.
+func (rule *rule) fold() {
+	rule.foldCase = true
+	rule.selector.fold()
+	foldPkgpatterns(rule.mayDepends.patterns...)
+	foldPkgpatterns(rule.mayNotDepends.patterns...)
+	foldPkgpatterns(rule.mustDepends...)
+	rule.mayDepends = newPkgpatternSet(rule.mayDepends.patterns...)
+	rule.mayNotDepends = newPkgpatternSet(rule.mayNotDepends.patterns...)
+	for _, pattern := range rule.expectedPatterns {
+		pattern.from, pattern.to = foldPattern(pattern.from), foldPattern(pattern.to)
+	}
+
+	starToPackage := make(map[string]bool)
+	for name := range rule.expectedStarToPackage {
+		starToPackage[strings.ToLower(name)] = true
+	}
+	packageToPackage := make(map[string]map[string]bool)
+	for parent, children := range rule.expectedPackageToPackage {
+		parent = strings.ToLower(parent)
+		if _, ok := packageToPackage[parent]; !ok {
+			packageToPackage[parent] = make(map[string]bool)
+		}
+		for child := range children {
+			packageToPackage[parent][strings.ToLower(child)] = true
+		}
+	}
+	rule.expectedStarToPackage, rule.expectedPackageToPackage = starToPackage, packageToPackage
+}
+
+// fold makes the compiled selector match import paths regardless of case.
+func (sel *selector) fold() {
+	sel.packagePattern = foldPattern(sel.packagePattern)
+	for i, pattern := range sel.exceptPatterns {
+		sel.exceptPatterns[i] = foldPattern(pattern)
+	}
+}
+
+// foldPattern returns the pattern matching regardless of case, if any.
+func foldPattern(pattern *regexp.Regexp) *regexp.Regexp {
+	if pattern == nil {
+		return nil
+	}
+	return regexp.MustCompile("(?i)" + pattern.String())
+}
+
+// foldPkgpatterns makes the package patterns match regardless of case.
+// Package sets need to be built again from them.
+func foldPkgpatterns(patterns ...*pkgpattern) {
+	for _, p := range patterns {
+		if !p.byName {
+			p.pattern = foldPattern(p.pattern)
+		}
+	}
+}
+
+// key returns the name of the package as expectations of the rule are keyed,
+// lower cased when matching regardless of case.
+func (rule *rule) key(name string) string {
+	if rule.foldCase {
+		return strings.ToLower(name)
+	}
+	return name
+}
+
+func (rule *rule) processMissingPackages(result *ruleResult) {
+	for expected, _ := range rule.expectedPackageToPackage {
+		if !result.processed[expected] {
+			result.violations = append(result.violations, &violation{Kind: kindMissing, From: expected})
+		}
+	}
+
+	// Patterns are expected to be exercised by at least one dependency.
+	for _, pattern := range rule.expectedPatterns {
+		if !result.exercisedPatterns[pattern] {
+			result.violations = append(result.violations, &violation{Kind: kindExpected, To: pattern.expr})
+		}
+	}
+}
+
+// process flags the group when more than one of its libraries, or any of
+// their subpackages, is present in the dependency graph.
+func (group *equivalenceGroup) process(g *graph) []*violation {
+	var present []string
+	for _, library := range group.packages {
+		for name := range g.pkgs {
+			if name == library || strings.HasPrefix(name, library+"/") {
+				present = append(present, library)
+				break
+			}
+		}
+	}
+	if len(present) < 2 {
+		return nil
+	}
+	return []*violation{&violation{Kind: kindDuplicate, Message: strings.Join(present, ", ")}}
+}
+
+// process flags every dependency on an alternative to the approved provider.
+// The provider itself, and its subpackages, may use alternatives.
+func (provider *singleProvider) process(g *graph) []*violation {
+	var violations []*violation
+	for _, pkg := range g.nodes() {
+		if pkg.name == provider.Provider || strings.HasPrefix(pkg.name, provider.Provider+"/") {
+			continue
+		}
+		var bads []string
+		for _, depPkg := range g.dependencies(pkg) {
+			if provider.alternatives.match(depPkg) {
+				bads = append(bads, depPkg.String())
+			}
+		}
+		sort.Strings(bads)
+		for _, bad := range bads {
+			violations = append(violations, &violation{Kind: kindDisallowed, From: pkg.String(), To: bad, Message: "use " + provider.Provider})
+		}
+	}
+	return violations
+}
+
+// process flags every import of a test only package by a non-test file.
+// Test only packages may import one another.
+func (testOnly *testOnly) process(g *graph) []*violation {
+	var violations []*violation
+	for _, pkg := range g.nodes() {
+		if testOnly.match(pkg.name) {
+			continue
+		}
+		for _, file := range pkg.files {
+			for _, imp := range file.imports {
+				if testOnly.match(imp.path) && imp.allow == "" {
+					violations = append(violations, &violation{Kind: kindTestOnly, From: pkg.String(), To: imp.path, Position: imp.position(file)})
+				}
+			}
+		}
+	}
+	return violations
+}
+
+func (testOnly *testOnly) match(name string) bool {
+	for _, element := range strings.Split(name, "/") {
+		for _, marker := range testOnly.markers {
+			if element == marker {
+				return true
+			}
+		}
+	}
+	return false
+}
+
+// process flags every blank import in packages which are not whitelisted.
+func (blankImports *blankImports) process(g *graph) []*violation {
+	var violations []*violation
+nextPkg:
+	for _, pkg := range g.nodes() {
+		for _, pattern := range blankImports.packagePatterns {
+			if pattern.MatchString(pkg.name) {
+				continue nextPkg
+			}
+		}
+		for _, file := range pkg.files {
+			for _, imp := range file.imports {
+				if imp.name == "_" && imp.allow == "" {
+					violations = append(violations, &violation{Kind: kindBlank, From: pkg.String(), To: imp.path, Position: imp.position(file)})
+				}
+			}
+		}
+	}
+	return violations
+}
+
+// process flags every use of net/http globals in packages which are not
+// whitelisted, but in files suppressing the violations of net/http.
+func (httpGlobals *httpGlobals) process(g *graph) []*violation {
+	var violations []*violation
+nextPkg:
+	for _, pkg := range g.nodes() {
+		for _, pattern := range httpGlobals.packagePatterns {
+			if pattern.MatchString(pkg.name) {
+				continue nextPkg
+			}
+		}
+	nextFile:
+		for _, file := range pkg.files {
+			for _, imp := range file.imports {
+				if imp.path == "net/http" && imp.allow != "" {
+					continue nextFile
+				}
+			}
+			for _, use := range file.uses {
+				violations = append(violations, &violation{Kind: kindGlobal, From: pkg.String(), To: "<net/http>", Position: use.position(file), Message: "uses http." + use.name})
+			}
+		}
+	}
+	return violations
+}
+
+// process flags every file embedded by packages which are not whitelisted,
+// if any are, and every embedded file larger than the maximum size, if set.
+func (embeds *embeds) process(g *graph) []*violation {
+	var violations []*violation
+	for _, pkg := range g.nodes() {
+		whitelisted := len(embeds.packagePatterns) == 0
+		for _, pattern := range embeds.packagePatterns {
+			whitelisted = whitelisted || pattern.MatchString(pkg.name)
+		}
+		for _, embed := range pkg.embeds {
+			if !whitelisted {
+				violations = append(violations, &violation{Kind: kindEmbed, From: pkg.String(), To: embed.path, Message: "embedded outside of the packages which may embed files"})
+			} else if embeds.MaxBytes > 0 && embed.size > int64(embeds.MaxBytes) {
+				violations = append(violations, &violation{Kind: kindEmbed, From: pkg.String(), To: embed.path, Message: fmt.Sprintf("of %s, above %s", formatBytes(embed.size), formatBytes(int64(embeds.MaxBytes)))})
+			}
+		}
+	}
+	return violations
+}
+
+// process flags every third party package requiring cgo which is not
+// excepted, along with its importers.
+func (noCgo *noCgo) process(g *graph) []*violation {
+	var violations []*violation
+nextPkg:
+	for _, pkg := range g.nodes() {
+		if !pkg.cgo {
+			continue
+		}
+		for _, pattern := range noCgo.exceptPatterns {
+			if pattern.MatchString(pkg.name) {
+				continue nextPkg
+			}
+		}
+		message := "requires cgo"
+		var importers []string
+		for _, importer := range g.importersOf(pkg.name) {
+			importers = append(importers, importer.String())
+		}
+		if len(importers) != 0 {
+			message += ", imported by " + strings.Join(importers, ", ")
+		}
+		violations = append(violations, &violation{Kind: kindCgo, From: pkg.String(), Message: message})
+	}
+	return violations
+}
+
+// process flags every import of a matching package which does not follow the
+// alias convention. Blank imports are not subject to alias conventions.
+func (alias *importAlias) process(g *graph) []*violation {
+	var violations []*violation
+	for _, pkg := range g.nodes() {
+		for _, file := range pkg.files {
+			for _, imp := range file.imports {
+				if imp.name == "_" || imp.allow != "" {
+					continue
+				}
+				depPkg, ok := g.pkgs[imp.path]
+				if !ok || !alias.pattern.match(depPkg) {
+					continue
+				}
+				if alias.NoAlias && imp.name != "" {
+					violations = append(violations, &violation{Kind: kindAlias, From: pkg.String(), To: depPkg.String(), Position: imp.position(file), Message: "must not be aliased as " + imp.name})
+				} else if !alias.NoAlias && imp.name != alias.Alias {
+					violations = append(violations, &violation{Kind: kindAlias, From: pkg.String(), To: depPkg.String(), Position: imp.position(file), Message: "must be imported as " + alias.Alias})
+				}
+			}
+		}
+	}
+	return violations
+}
+
+// process flags every selected working package which does not live under
+// one of the expected parents, or not at the expected depth.
+func (layout *layout) process(g *graph) []*violation {
+	var violations []*violation
+	for _, pkg := range g.nodes() {
+		if !strings.HasPrefix(pkg.name, layout.workingPackage+"/") || !layout.matches(pkg) {
+			continue
+		}
+		rel := strings.TrimPrefix(pkg.name, layout.workingPackage+"/")
+
+		if len(layout.Parents) != 0 {
+			underParent := false
+			for _, parent := range layout.Parents {
+				if strings.HasPrefix(rel, strings.TrimSuffix(parent, "/")+"/") {
+					underParent = true
+					break
+				}
+			}
+			if !underParent {
+				violations = append(violations, &violation{Kind: kindMisplaced, From: pkg.String(), Message: "expected under " + strings.Join(layout.Parents, ", ")})
+			}
+		}
+
+		if layout.Depth != 0 {
+			if depth := len(strings.Split(rel, "/")); depth != layout.Depth {
+				violations = append(violations, &violation{Kind: kindMisplaced, From: pkg.String(), Message: fmt.Sprintf("expected at depth %d but was %d", layout.Depth, depth)})
+			}
+		}
+	}
+	return violations
+}
+
+// group returns the name of the group the package belongs to, and false if
+// it belongs to none. Packages matching several groups belong to the first,
+// in name order.
+func (acyclic *acyclicGroups) group(pkg *pkg) (string, bool) {
+	for _, name := range acyclic.groupNames {
+		if acyclic.groupPatterns[name].MatchString(pkg.name) {
+			return name, true
+		}
+	}
+	return "", false
+}
+
+// process flags every cycle among groups, reporting each of the package
+// dependencies forming the cycle. Each group is reported in at most one
+// cycle, the shortest starting from it.
+func (acyclic *acyclicGroups) process(g *graph) []*violation {
+	var violations []*violation
+	// group graph, along with the package dependencies behind every edge
+	edges := make(map[string]map[string][][2]string)
+	for _, pkg := range g.nodes() {
+		from, ok := acyclic.group(pkg)
+		if !ok {
+			continue
+		}
+		for _, depPkg := range g.dependencies(pkg) {
+			to, ok := acyclic.group(depPkg)
+			if !ok || to == from {
+				continue
+			}
+			if _, ok := edges[from]; !ok {
+				edges[from] = make(map[string][][2]string)
+			}
+			edges[from][to] = append(edges[from][to], [2]string{pkg.String(), depPkg.name})
+		}
+	}
+
+	reported := make(map[string]bool)
+	for _, start := range acyclic.groupNames {
+		if reported[start] {
+			continue
+		}
+
+		// breadth first search for the shortest path back to start
+		var (
+			cycle    []string
+			previous = map[string]string{start: ""}
+			queue    = []string{start}
+		)
+	search:
+		for len(queue) != 0 {
+			current := queue[0]
+			queue = queue[1:]
+			for _, next := range acyclic.groupNames {
+				if _, ok := edges[current][next]; !ok {
+					continue
+				}
+				if next == start {
+					cycle = []string{start}
+					for at := current; at != start; at = previous[at] {
+						cycle = append([]string{at}, cycle...)
+					}
+					cycle = append([]string{start}, cycle...)
+					break search
+				}
+				if _, ok := previous[next]; !ok && !reported[next] {
+					previous[next] = current
+					queue = append(queue, next)
+				}
+			}
+		}
+		if cycle == nil {
+			continue
+		}
+
+		for i := 0; i < len(cycle)-1; i++ {
+			reported[cycle[i]] = true
+			for _, edge := range edges[cycle[i]][cycle[i+1]] {
+				violations = append(violations, &violation{Kind: kindCycle, From: edge[0], To: edge[1], Message: "along " + strings.Join(cycle, " -> ")})
+			}
+		}
+	}
+	return violations
+}
+
+// name returns the name of the propagation, defaulting to its dependency and packages.
+func (propagation *propagation) name() string {
+	if propagation.Name != "" {
+		return propagation.Name
+	}
+	return "propagation of " + propagation.Dependency + " by " + propagation.Packages
+}
+
+// process flags, for every package not importing the dependency, each of its
+// downstream dependencies which does, as isWorking tells by default.
+func (propagation *propagation) process(g *graph, isWorking func(string) bool) []*violation {
+	imports := func(pkg *pkg) bool {
+		for _, depPkg := range g.dependencies(pkg) {
+			if propagation.dependency.match(depPkg) {
+				return true
+			}
+		}
+		return false
+	}
+	var violations []*violation
+	for _, pkg := range g.nodes() {
+		if !propagation.packagePattern.MatchString(pkg.name) || imports(pkg) {
+			continue
+		}
+		for _, depPkg := range g.dependencies(pkg) {
+			downstream := !depPkg.goroot && isWorking(depPkg.name)
+			if propagation.downstreamPattern != nil {
+				downstream = propagation.downstreamPattern.MatchString(depPkg.name)
+			}
+			if downstream && imports(depPkg) {
+				violations = append(violations, &violation{Kind: kindSwallowed, From: pkg.String(), To: depPkg.String(), Message: "which imports " + propagation.Dependency})
+			}
+		}
+	}
+	return violations
+}
+
+func (independence *independence) name() string {
+	if independence.Name != "" {
+		return independence.Name
+	}
+	return "independence of " + strings.Join(independence.Groups, ", ")
+}
+
+// group returns the index of the group the package belongs to, and -1 if it
+// belongs to none. Packages matching several groups belong to the first.
+func (independence *independence) group(pkg *pkg) int {
+	for i, pattern := range independence.groupPatterns {
+		if pattern.MatchString(pkg.name) {
+			return i
+		}
+	}
+	return -1
+}
+
+// process flags, for every package of a group, the closest package of each
+// other group it depends on, reporting the packages in between. Paths are
+// only followed through packages of no group, as packages of a group are
+// reported on their own.
+func (independence *independence) process(g *graph) []*violation {
+	var violations []*violation
+	for _, start := range g.nodes() {
+		from := independence.group(start)
+		if from < 0 {
+			continue
+		}
+
+		// breadth first search for the closest package of every other group
+		var (
+			previous = map[string]*pkg{start.name: nil}
+			queue    = []*pkg{start}
+			reached  = make(map[int]bool)
+		)
+		for len(queue) != 0 {
+			current := queue[0]
+			queue = queue[1:]
+			for _, depPkg := range g.dependencies(current) {
+				if _, ok := previous[depPkg.name]; ok {
+					continue
+				}
+				previous[depPkg.name] = current
+				to := independence.group(depPkg)
+				if to < 0 {
+					queue = append(queue, depPkg)
+					continue
+				}
+				if to == from || reached[to] {
+					continue
+				}
+				reached[to] = true
+
+				v := &violation{Kind: kindDependent, From: start.String(), To: depPkg.String()}
+				var via []string
+				for at := current; at != start; at = previous[at.name] {
+					via = append([]string{at.String()}, via...)
+				}
+				if len(via) != 0 {
+					v.Message = "via " + strings.Join(via, " -> ")
+				}
+				violations = append(violations, v)
+			}
+		}
+	}
+	return violations
+}
+
+func sortedNames(pkgs map[string]*pkg) []string {
+	var names []string
+	for name := range pkgs {
+		names = append(names, name)
+	}
+	sort.Strings(names)
+	return names
+}
+
+// isGoroot indicates whether the package is part of the standard library.
+//
+// Rather than matching file paths against GOROOT, which breaks with relocated
+// toolchains, this relies on standard library packages not belonging to any
+// module, and their import paths not starting with a domain name. As no
+// package belongs to a module in GOPATH mode, working packages are told apart
+// by callers.
+func isGoroot(goPkg *packages.Package) bool {
+	if goPkg.Module != nil {
+		return false
+	}
+	first := strings.SplitN(goPkg.PkgPath, "/", 2)[0]
+	return !strings.Contains(first, ".")
+}
+
+// isStd indicates whether the package is part of the standard library, as per
+// isGoroot, rather than a working package without a domain name, e.g. in
+// GOPATH mode.
+func (defs *defs) isStd(goPkg *packages.Package) bool {
+	if !isGoroot(goPkg) {
+		return false
+	}
+	return defs.Config.WorkingPackage == "" || !defs.isWorking(goPkg.PkgPath)
+}
+
+// inGopath indicates whether dir is within a pre-modules project, i.e. outside
+// of any module but within the GOPATH, as reported by go env run with env on
+// top of the environment. Packages of such projects, and their vendor
+// directories, are only found in GOPATH mode.
+func inGopath(dir string, env []string) bool {
+	cmd := exec.Command("go", "env", "GOMOD", "GOPATH")
+	cmd.Dir = dir
+	if len(env) != 0 {
+		cmd.Env = append(os.Environ(), env...)
+	}
+	out, err := cmd.Output()
+	if err != nil {
+		return false
+	}
+	lines := strings.Split(string(out), "\n")
+	if len(lines) < 2 || lines[0] != "" && lines[0] != os.DevNull {
+		return false
+	}
+	abs, err := filepath.Abs(dir)
+	if err != nil {
+		return false
+	}
+	for _, gopath := range filepath.SplitList(lines[1]) {
+		if gopath != "" && strings.HasPrefix(abs, filepath.Join(gopath, "src")+string(filepath.Separator)) {
+			return true
+		}
+	}
+	return false
+}
+
+// selectsExternal indicates whether any rule selects the std lib or third
+// party package, whose dependencies are then collected too.
+func (defs *defs) selectsExternal(pkg *pkg) bool {
+	for _, rule := range defs.Rules {
+		if rule.external && rule.matches(pkg) {
+			return true
+		}
+	}
+	return false
+}
+
+// inspects indicates whether the imports of the third party package, depth
+// third party packages away from working packages, are collected, i.e.
+// whether its module is inspected and it is within the inspect_depth.
+func (defs *defs) inspects(goPkg *packages.Package, depth int) bool {
+	if goPkg.Module == nil || !defs.Config.Inspect.match(goPkg.Module.Path) {
+		return false
+	}
+	return defs.Config.InspectDepth == 0 || depth <= defs.Config.InspectDepth
+}
+
+// isWorking indicates whether the package belongs to the working package, or
+// to any of the working packages of rules overriding it.
+func (defs *defs) isWorking(pkgName string) bool {
+	for _, workingPackage := range defs.workingPackages() {
+		if strings.HasPrefix(pkgName, workingPackage) {
+			return true
+		}
+	}
+	return false
+}
+
+// workingPackages returns the working package, followed by those of rules
+// overriding it.
+func (defs *defs) workingPackages() []string {
+	working := []string{defs.Config.WorkingPackage}
+	for _, rule := range defs.Rules {
+		if rule.WorkingPackage != "" {
+			working = append(working, rule.WorkingPackage)
+		}
+	}
+	return working
+}
+
+// relative returns the path relative to root when within root, and the path
+// as is otherwise.
+func relative(root, path string) string {
+	if rel, err := filepath.Rel(root, path); err == nil && !strings.HasPrefix(rel, "..") {
+		return rel
+	}
+	return path
+}
+
+// rootPackage returns the import path of the package in root, which is the
+// working package unless configured otherwise.
+func (defs *defs) rootPackage(root string) (string, error) {
+	cfg := defs.loadConfig(root, nil)
+	cfg.Mode = packages.NeedName | packages.NeedFiles | packages.NeedModule
+	goPkg, err := loadRoot(cfg)
+	if err != nil {
+		return "", err
+	}
+	return goPkg.PkgPath, nil
+}
+
+// loadRoot loads the package in the configured directory.
+//
+// Packages without Go files, e.g. holding only assets or files excluded by
+// build constraints, are loaded without an import path nor module. Those are
+// recovered from the enclosing module instead.
+func loadRoot(cfg *packages.Config) (*packages.Package, error) {
+	goPkgs, err := packages.Load(cfg, ".")
+	if err != nil {
+		return nil, fmt.Errorf("failed to import .: %s", err)
+	}
+	goPkg := goPkgs[0]
+	if goPkg.Module != nil || len(goPkg.GoFiles) != 0 {
+		return goPkg, nil
+	}
+
+	module, err := enclosingModule(cfg.Dir, cfg.Env)
+	if err != nil {
+		return nil, fmt.Errorf("failed to import .: %s", err)
+	}
+	dir, err := filepath.Abs(cfg.Dir)
+	if err != nil {
+		return nil, fmt.Errorf("failed to import .: %s", err)
+	}
+	rel, err := filepath.Rel(module.Dir, dir)
+	if err != nil {
+		return nil, fmt.Errorf("failed to import .: %s", err)
+	}
+	goPkg.PkgPath = path.Join(module.Path, filepath.ToSlash(rel))
+	goPkg.ID = goPkg.PkgPath
+	goPkg.Module = module
+	return goPkg, nil
+}
+
+// enclosingModule returns the main module of dir, as reported by go list run
+// with env, or the environment if nil.
+func enclosingModule(dir string, env []string) (*packages.Module, error) {
+	cmd := exec.Command("go", "list", "-m", "-json")
+	cmd.Dir, cmd.Env = dir, env
+	out, err := cmd.Output()
+	if err != nil {
+		return nil, fmt.Errorf("no module found from %s: %s", dir, err)
+	}
+	var module packages.Module
+	if err := json.Unmarshal(out, &module); err != nil {
+		return nil, fmt.Errorf("malformed go list -m output: %s", err)
+	}
+	return &module, nil
+}
+
+// buildList returns the paths of the modules in the build list of the main
+// module, as reported by go list run with the config.
+func buildList(cfg *packages.Config) ([]string, error) {
+	args := append([]string{"list", "-m", "-f", "{{.Path}}"}, cfg.BuildFlags...)
+	cmd := exec.Command("go", append(args, "all")...)
+	cmd.Dir, cmd.Env = cfg.Dir, cfg.Env
+	out, err := cmd.Output()
+	if err != nil {
+		return nil, fmt.Errorf("failed to list the modules of %s: %s", cfg.Dir, err)
+	}
+	return strings.Fields(string(out)), nil
+}
+
+// requirementPath returns the shortest chain of module requirements from
+// the main module to the module of the path, as reported by go mod graph run
+// with the config, e.g. `example.com/app`, `github.com/aws/sdk@v1.2.0`,
+// `github.com/jmespath/go-jmespath@v0.4.0`. It returns nil if the module is
+// not required. Build flags do not apply to go mod graph.
+func requirementPath(cfg *packages.Config, module string) ([]string, error) {
+	cmd := exec.Command("go", "mod", "graph")
+	cmd.Dir, cmd.Env = cfg.Dir, cfg.Env
+	out, err := cmd.Output()
+	if err != nil {
+		return nil, fmt.Errorf("failed to graph the modules of %s: %s", cfg.Dir, err)
+	}
+	var (
+		main  string
+		edges = make(map[string][]string)
+	)
+	for _, line := range strings.Split(string(out), "\n") {
+		fields := strings.Fields(line)
+		if len(fields) != 2 {
+			continue
+		}
+		if main == "" {
+			main = fields[0]
+		}
+		edges[fields[0]] = append(edges[fields[0]], fields[1])
+	}
+	var (
+		previous = map[string]string{main: ""}
+		queue    = []string{main}
+	)
+	for len(queue) != 0 {
+		current := queue[0]
+		queue = queue[1:]
+		if strings.SplitN(current, "@", 2)[0] == module {
+			path := []string{current}
+			for at := previous[current]; at != ""; at = previous[at] {
+				path = append([]string{at}, path...)
+			}
+			return path, nil
+		}
+		for _, next := range edges[current] {
+			if _, ok := previous[next]; !ok {
+				previous[next] = current
+				queue = append(queue, next)
+			}
+		}
+	}
+	return nil, nil
+}
+
+// isNoGoError indicates whether the error only reports that the package has
+// no Go files to build, which is not a reason to consider it broken.
+func isNoGoError(err packages.Error) bool {
+	return strings.Contains(err.Msg, "no Go files in") ||
+		strings.Contains(err.Msg, "build constraints exclude all Go files in")
+}
+
+// collectPackages collects the dependency graph rooted at the package in
+// root, or at the packages matching the patterns relative to root if any,
+// building with the given tags.
+//
+// The whole graph is loaded at once, and traversed breadth first. Only the
+// dependencies of working packages are followed.
+func (defs *defs) collectPackages(root string, patterns, tags []string) (*graph, error) {
+	cfg := defs.loadConfig(root, tags)
+
+	var (
+		g        *graph
+		rootPkgs []*packages.Package
+		err      error
+	)
+	if len(patterns) == 0 {
+		rootPkg, err := loadRoot(cfg)
+		if err != nil {
+			return nil, err
+		}
+		g, rootPkgs = newGraph(rootPkg.ID), []*packages.Package{rootPkg}
+	} else {
+		rootPkgs, err = packages.Load(cfg, patterns...)
+		if err != nil {
+			return nil, fmt.Errorf("failed to import %s: %s", strings.Join(patterns, ", "), err)
+		}
+		rootName, err := defs.rootPackage(root)
+		if err != nil {
+			return nil, err
+		}
+		g = newGraph(rootName)
+	}
+	for _, rootPkg := range rootPkgs {
+		g.roots = append(g.roots, rootPkg.ID)
 	}
 
+	if err := defs.expand(g, cfg, rootPkgs, len(patterns) == 0); err != nil {
+		return nil, err
+	}
+	return g, nil
+}
+
+// loadConfig returns the config loading packages in root, building with the
+// given tags. The go command inherits the environment, e.g. GOFLAGS, GOPRIVATE
+// or GONOSUMDB, along with the build flags and environment variables set.
+//
+// Unless checking needs to know more of third party packages than their
+// import path, dependencies are not loaded along with packages. Working
+// packages are then loaded as they are reached, and others are leaves of the
+// graph, which is much cheaper than loading every dependency.
+func (defs *defs) loadConfig(root string, tags []string) *packages.Config {
 	cfg := &packages.Config{
-		Mode: packages.NeedName | packages.NeedImports | packages.NeedFiles,
+		Mode: packages.NeedName | packages.NeedFiles | packages.NeedModule,
 		Dir:  root,
 	}
+	if defs.needsThirdParties() {
+		cfg.Mode |= packages.NeedImports | packages.NeedDeps
+	}
+	if defs.Embeds != nil {
+		cfg.Mode |= packages.NeedEmbedFiles
+	}
+	if len(defs.env) != 0 {
+		cfg.Env = append(os.Environ(), defs.env...)
+	}
+	cfg.BuildFlags = append(cfg.BuildFlags, defs.buildFlags...)
+	if len(tags) != 0 {
+		cfg.BuildFlags = append(cfg.BuildFlags, "-tags="+strings.Join(tags, ","))
+	}
+	return cfg
+}
+
+// needsThirdParties indicates whether checking needs the declared names of
+// third party packages, i.e. whether any package pattern matches by name, or
+// the imports of non working packages, i.e. whether any rule selects them or
+// their modules are inspected, or their files, to tell whether they require
+// cgo.
+func (defs *defs) needsThirdParties() bool {
+	if len(defs.Config.Inspect) != 0 || defs.NoCgo != nil {
+		return true
+	}
+	for _, rule := range defs.Rules {
+		if rule.external {
+			return true
+		}
+	}
+	var sets []*pkgpattern
+	for _, rule := range defs.Rules {
+		if rule.mayDepends != nil {
+			sets = append(sets, rule.mayDepends.patterns...)
+		}
+		if rule.mayNotDepends != nil {
+			sets = append(sets, rule.mayNotDepends.patterns...)
+		}
+		sets = append(sets, rule.mustDepends...)
+	}
+	for _, provider := range defs.SingleProviders {
+		if provider.alternatives != nil {
+			sets = append(sets, provider.alternatives.patterns...)
+		}
+	}
+	for _, alias := range defs.ImportAliases {
+		sets = append(sets, alias.pattern)
+	}
+	for _, set := range sets {
+		if set != nil && set.byName {
+			return true
+		}
+	}
+	return false
+}
 
-	goPkgs, err := packages.Load(cfg, pkgName)
+// loadWorking loads the working packages of the main module at once, for
+// lazy expansion.
+func (defs *defs) loadWorking(cfg *packages.Config) map[string]*packages.Package {
+	loaded := make(map[string]*packages.Package)
+	module, err := enclosingModule(cfg.Dir, cfg.Env)
 	if err != nil {
-		return fmt.Errorf("failed to import %s: %s", pkgName, err)
+		return loaded
 	}
-	goPkg := goPkgs[0]
-	if pkgName == "." {
-		pkgName = goPkg.ID
+	var patterns []string
+	for _, workingPackage := range defs.workingPackages() {
+		if workingPackage == module.Path || strings.HasPrefix(workingPackage, module.Path+"/") {
+			patterns = append(patterns, workingPackage+"/...")
+		} else if strings.HasPrefix(module.Path, workingPackage+"/") {
+			patterns = append(patterns, module.Path+"/...")
+		}
+	}
+	if len(patterns) == 0 {
+		return loaded
+	}
+	goPkgs, err := packages.Load(cfg, patterns...)
+	if err != nil {
+		return loaded
+	}
+	for _, goPkg := range goPkgs {
+		loaded[goPkg.ID] = goPkg
+	}
+	return loaded
+}
+
+// expand adds the loaded packages to the graph, along with the packages they
+// transitively depend on. Packages already in the graph are depended on as
+// they are, rather than added again.
+//
+// Without dependencies loaded, the imports of packages are those of their
+// files, and working packages are loaded as they are reached. With preload,
+// the working packages of the main module are loaded at once instead, which
+// is faster unless most of them are not reached.
+func (defs *defs) expand(g *graph, cfg *packages.Config, goPkgs []*packages.Package, preload bool) error {
+	var (
+		root    = cfg.Dir
+		lazy    = cfg.Mode&packages.NeedDeps == 0
+		imports = make(map[string][]string)
+		visited = make(map[string]*packages.Package)
+		queue   []string
+
+		// number of third party packages from working packages to those
+		// reached, when inspecting
+		depths = make(map[string]int)
+
+		// working packages reached but not loaded yet, when lazy
+		loaded  map[string]*packages.Package
+		missing []string
+	)
+	for _, goPkg := range goPkgs {
+		if _, ok := visited[goPkg.ID]; !ok {
+			visited[goPkg.ID] = goPkg
+			queue = append(queue, goPkg.ID)
+		}
+	}
+	for len(queue) != 0 || len(missing) != 0 {
+		if len(queue) == 0 {
+			if loaded == nil {
+				loaded = make(map[string]*packages.Package)
+				if preload {
+					loaded = defs.loadWorking(cfg)
+				}
+			}
+			var batch []string
+			for _, imp := range missing {
+				if _, ok := loaded[imp]; !ok {
+					batch = append(batch, imp)
+				}
+			}
+			if len(batch) != 0 {
+				batchPkgs, err := packages.Load(cfg, batch...)
+				if err != nil {
+					return fmt.Errorf("failed to import %s: %s", strings.Join(batch, ", "), err)
+				}
+				for _, goPkg := range batchPkgs {
+					loaded[goPkg.ID] = goPkg
+				}
+			}
+			for _, imp := range missing {
+				goPkg, ok := loaded[imp]
+				if !ok {
+					goPkg = &packages.Package{ID: imp, PkgPath: imp}
+				}
+				visited[imp] = goPkg
+				queue = append(queue, imp)
+			}
+			missing = nil
+			continue
+		}
+
+		pkgName := queue[0]
+		queue = queue[1:]
+		goPkg := visited[pkgName]
+
+		pkg := g.add(&pkg{
+			name:    pkgName,
+			pkgName: goPkg.Name,
+			goroot:  defs.isStd(goPkg),
+		})
+
+		// Broken packages are reported, but don't prevent analyzing the
+		// rest of the graph.
+		for _, err := range goPkg.Errors {
+			if isNoGoError(err) {
+				continue
+			}
+			position := err.Pos
+			if position == "-" {
+				position = ""
+			} else if position != "" {
+				position = relative(root, position)
+			}
+			g.addLoadError(&violation{Kind: kindBroken, From: pkgName, Position: position, Message: err.Msg})
+		}
+
+		// Don't worry about dependencies for stdlib and non working
+		// packages, unless rules select them or their modules are
+		// inspected.
+		working := !pkg.goroot && defs.isWorking(pkgName)
+
+		if !working && !pkg.goroot && defs.NoCgo != nil {
+			pkg.cgo = usesCgo(goPkg)
+		}
+		if !working && !defs.selectsExternal(pkg) && !defs.inspects(goPkg, depths[pkgName]) {
+			continue
+		}
+
+		pkgImports := getImports(goPkg)
+		if working {
+			var err error
+			pkg.files, pkg.annotations, err = parseFiles(root, goPkg)
+			if err != nil {
+				g.addLoadError(&violation{Kind: kindBroken, From: pkgName, Message: err.Error()})
+			}
+			if !hasTags(cfg.BuildFlags) {
+				pkg.files, pkg.tools = defs.splitTools(pkg.files)
+				pkg.tools = append(pkg.tools, defs.ignoredTools(root, goPkg)...)
+			}
+			if defs.Embeds != nil {
+				pkg.embeds = embeddedFiles(root, goPkg)
+			}
+			if dir := packageDir(goPkg); dir != "" {
+				pkg.dir = relative(root, dir)
+				pkg.hash, _ = hashPackage(root, dir, pkg.embeds)
+			}
+			if lazy || len(pkg.tools) != 0 {
+				pkgImports = fileImports(pkg)
+			}
+		}
+		for _, imp := range pkgImports {
+			imports[pkgName] = append(imports[pkgName], imp)
+			if _, ok := visited[imp]; ok {
+				continue
+			}
+			if _, ok := g.pkgs[imp]; ok {
+				continue
+			}
+			if !defs.isWorking(imp) {
+				depths[imp] = depths[pkgName] + 1
+			}
+			switch {
+			case !lazy:
+				visited[imp] = goPkg.Imports[imp]
+			case defs.isWorking(imp):
+				visited[imp] = nil
+				missing = append(missing, imp)
+				continue
+			default:
+				visited[imp] = &packages.Package{ID: imp, PkgPath: imp}
+			}
+			queue = append(queue, imp)
+		}
 	}
 
-	pkg := pkg{
-		name:      pkgName,
-		goroot:    isGoroot(goPkg),
-		dependsOn: make(map[string]*pkg),
+	for pkgName, imps := range imports {
+		for _, imp := range imps {
+			g.depend(g.pkgs[pkgName], g.pkgs[imp])
+		}
 	}
-	pkgs[pkgName] = &pkg
+	return nil
+}
 
-	// Don't worry about dependencies for stdlib packages
-	if pkg.goroot {
-		return nil
+// defaultToolsFile is the conventional name of files pinning the versions of
+// tools in go.mod, e.g.
+//
+//	//go:build tools
+//
+//	package tools
+//
+//	import _ "golang.org/x/tools/cmd/stringer"
+const defaultToolsFile = "tools.go"
+
+// splitTools separates the tools files of a package, i.e. the files named
+// as the tools file of the config which only have blank imports, from its
+// other files.
+func (defs *defs) splitTools(files []*goFile) ([]*goFile, []*goFile) {
+	toolsFile := defs.Config.ToolsFile
+	if toolsFile == "" {
+		toolsFile = defaultToolsFile
+	}
+	var others, tools []*goFile
+	for _, file := range files {
+		blank := len(file.imports) != 0
+		for _, imp := range file.imports {
+			blank = blank && imp.name == "_"
+		}
+		if blank && filepath.Base(file.name) == toolsFile {
+			tools = append(tools, file)
+		} else {
+			others = append(others, file)
+		}
 	}
+	return others, tools
+}
 
-	// Don't worry about dependencies for non working packages
-	if !strings.HasPrefix(pkgName, defs.Config.WorkingPackage) {
+// ignoredTools returns the tools files of the package which build
+// constraints exclude, e.g. by the conventional `//go:build tools`, so that
+// the tools they import are known without the tag.
+func (defs *defs) ignoredTools(root string, goPkg *packages.Package) []*goFile {
+	toolsFile := defs.Config.ToolsFile
+	if toolsFile == "" {
+		toolsFile = defaultToolsFile
+	}
+	ignored := &packages.Package{}
+	for _, filename := range goPkg.IgnoredFiles {
+		if filepath.Base(filename) == toolsFile {
+			ignored.GoFiles = append(ignored.GoFiles, filename)
+		}
+	}
+	if len(ignored.GoFiles) == 0 {
 		return nil
 	}
+	// Errors are those of files the package is built without.
+	files, _, _ := parseFiles(root, ignored)
+	_, tools := defs.splitTools(files)
+	return tools
+}
 
-	for _, imp := range getImports(goPkg) {
-		if _, ok := pkgs[imp]; !ok {
-			if err := defs._collectPackages(pkgs, root, imp, level); err != nil {
-				return err
+// embeddedFiles returns the files the package embeds with `//go:embed`, in
+// name order, with their sizes.
+func embeddedFiles(root string, goPkg *packages.Package) []*embed {
+	var embeds []*embed
+	for _, filename := range goPkg.EmbedFiles {
+		embed := &embed{path: filepath.ToSlash(relative(root, filename))}
+		if info, err := os.Stat(filename); err == nil {
+			embed.size = info.Size()
+		}
+		embeds = append(embeds, embed)
+	}
+	sort.Slice(embeds, func(i, j int) bool {
+		return embeds[i].path < embeds[j].path
+	})
+	return embeds
+}
+
+// hasTags indicates whether the build flags set build tags.
+func hasTags(buildFlags []string) bool {
+	for _, flag := range buildFlags {
+		if strings.HasPrefix(flag, "-tags") || strings.HasPrefix(flag, "--tags") {
+			return true
+		}
+	}
+	return false
+}
+
+// toolPackages returns the packages the tools files of working packages
+// import, which are not part of the graph otherwise, in name order.
+func (g *graph) toolPackages() []string {
+	found := make(map[string]bool)
+	for _, node := range g.nodes() {
+		for _, file := range node.tools {
+			for _, imp := range file.imports {
+				if _, ok := g.pkgs[imp.path]; !ok {
+					found[imp.path] = true
+				}
 			}
 		}
-		pkg.dependsOn[imp] = pkgs[imp]
 	}
+	return sortedKeys(found)
+}
 
-	return nil
+// parseFiles parses the imports of the package's files, and collects the
+// `depper:key=value` directives found in the package documentation, e.g.
+//
+//	// Package billing handles invoices.
+//	//
+//	// depper:layer=domain
+//	package billing
+//
+// along with the reasons of `//depper:allow` comments on imports, either on
+// the line of the import or just above it, e.g.
+//
+//	import (
+//		//depper:allow reporting predates the dal
+//		"database/sql"
+//	)
+//
+// File names are made relative to root when possible. Errors do not stop
+// parsing: the files and imports which parse are returned along with them,
+// so that the edges of broken packages are kept.
+func parseFiles(root string, goPkg *packages.Package) ([]*goFile, map[string]string, error) {
+	var (
+		files       []*goFile
+		annotations = make(map[string]string)
+		fset        = token.NewFileSet()
+		errs        []string
+	)
+	for _, filename := range goPkg.GoFiles {
+		file, err := parser.ParseFile(fset, filename, nil, parser.ImportsOnly|parser.ParseComments)
+		if err != nil {
+			// The go command reports syntax errors itself.
+			if len(goPkg.Errors) == 0 {
+				errs = append(errs, fmt.Sprintf("failed to parse %s: %s", filename, err))
+			}
+			continue
+		}
+
+		// The comment above single imports documents their declaration.
+		declDocs := make(map[*ast.ImportSpec]*ast.CommentGroup)
+		for _, decl := range file.Decls {
+			if gen, ok := decl.(*ast.GenDecl); ok && gen.Tok == token.IMPORT && !gen.Lparen.IsValid() && len(gen.Specs) == 1 {
+				declDocs[gen.Specs[0].(*ast.ImportSpec)] = gen.Doc
+			}
+		}
+
+		goFile := &goFile{name: relative(root, filename)}
+		for _, spec := range file.Imports {
+			path, err := strconv.Unquote(spec.Path.Value)
+			if err != nil {
+				errs = append(errs, fmt.Sprintf("%s: malformed import %s", fset.Position(spec.Pos()), spec.Path.Value))
+				continue
+			}
+			imp := &goImport{
+				path: path,
+				line: fset.Position(spec.Pos()).Line,
+			}
+			if spec.Name != nil {
+				imp.name = spec.Name.Name
+			}
+			for _, group := range []*ast.CommentGroup{spec.Doc, declDocs[spec], spec.Comment} {
+				if group == nil {
+					continue
+				}
+				for _, comment := range group.List {
+					text := strings.TrimSpace(strings.TrimPrefix(comment.Text, "//"))
+					if text != allowDirective && !strings.HasPrefix(text, allowDirective+" ") {
+						continue
+					}
+					imp.allow = strings.TrimSpace(strings.TrimPrefix(text, allowDirective))
+					if imp.allow == "" {
+						errs = append(errs, fmt.Sprintf("%s: %s must give a reason", fset.Position(comment.Pos()), allowDirective))
+					}
+				}
+			}
+			goFile.imports = append(goFile.imports, imp)
+			if path == "net/http" && imp.name != "_" && imp.name != "." {
+				name := imp.name
+				if name == "" {
+					name = "http"
+				}
+				if goFile.uses, err = httpUses(fset, filename, name); err != nil {
+					errs = append(errs, err.Error())
+				}
+			}
+		}
+		files = append(files, goFile)
+
+		if file.Doc == nil {
+			continue
+		}
+		for _, comment := range file.Doc.List {
+			text := strings.TrimSpace(strings.TrimPrefix(comment.Text, "//"))
+			if !strings.HasPrefix(text, "depper:") {
+				continue
+			}
+			parts := strings.SplitN(strings.TrimPrefix(text, "depper:"), "=", 2)
+			if len(parts) != 2 || parts[0] == "" {
+				errs = append(errs, fmt.Sprintf("%s: malformed annotation %s, must be depper:key=value", fset.Position(comment.Pos()), text))
+				continue
+			}
+			annotations[parts[0]] = strings.TrimSpace(parts[1])
+		}
+	}
+	if len(errs) != 0 {
+		return files, annotations, errors.New(strings.Join(errs, "; "))
+	}
+	return files, annotations, nil
+}
+
+// netHTTPGlobals are the globals of net/http, and the functions using them,
+// which share state across the program, e.g. the timeouts of the default
+// client, or the handlers registered on the default mux.
+var netHTTPGlobals = map[string]bool{
+	"DefaultClient":    true,
+	"DefaultServeMux":  true,
+	"DefaultTransport": true,
+	"Get":              true,
+	"Head":             true,
+	"Post":             true,
+	"PostForm":         true,
+	"Handle":           true,
+	"HandleFunc":       true,
+}
+
+// httpUses returns the uses of net/http globals in the file, which imports
+// net/http under name. Only files importing net/http are parsed beyond their
+// imports.
+func httpUses(fset *token.FileSet, filename, name string) ([]*goUse, error) {
+	file, err := parser.ParseFile(fset, filename, nil, 0)
+	if err != nil {
+		return nil, fmt.Errorf("failed to parse %s: %s", filename, err)
+	}
+	var uses []*goUse
+	ast.Inspect(file, func(node ast.Node) bool {
+		sel, ok := node.(*ast.SelectorExpr)
+		if !ok {
+			return true
+		}
+		// Identifiers declared in the file, e.g. a variable shadowing the
+		// package, are resolved, unlike package names.
+		if x, ok := sel.X.(*ast.Ident); ok && x.Name == name && x.Obj == nil && netHTTPGlobals[sel.Sel.Name] {
+			uses = append(uses, &goUse{name: sel.Sel.Name, line: fset.Position(sel.Pos()).Line})
+		}
+		return true
+	})
+	return uses, nil
+}
+
+// taggedOnly returns the graph of dependencies present in the tagged graph,
+// but not in the untagged one, i.e. the dependencies introduced by files
+// requiring build tags.
+func taggedOnly(g, tagged *graph) *graph {
+	taggedOnly := newGraph(tagged.root)
+	taggedOnly.roots = tagged.roots
+	taggedOnly.loadErrors = tagged.loadErrors
+	for _, taggedPkg := range tagged.nodes() {
+		taggedOnly.add(&pkg{
+			name:        taggedPkg.name,
+			pkgName:     taggedPkg.pkgName,
+			goroot:      taggedPkg.goroot,
+			annotations: taggedPkg.annotations,
+			cgo:         taggedPkg.cgo,
+		})
+	}
+	for _, taggedPkg := range tagged.nodes() {
+		for _, depPkg := range tagged.dependencies(taggedPkg) {
+			if !g.hasDependency(taggedPkg.name, depPkg.name) {
+				taggedOnly.depend(taggedOnly.pkgs[taggedPkg.name], taggedOnly.pkgs[depPkg.name])
+			}
+		}
+	}
+	return taggedOnly
+}
+
+// fileImports returns the packages imported by the files of the package, once.
+// The `C` pseudo package of cgo is not a dependency.
+func fileImports(pkg *pkg) []string {
+	var imports []string
+	found := map[string]bool{pkg.name: true, "C": true}
+	for _, file := range pkg.files {
+		for _, imp := range file.imports {
+			if !found[imp.path] {
+				found[imp.path] = true
+				imports = append(imports, imp.path)
+			}
+		}
+	}
+	return imports
+}
+
+// usesCgo indicates whether any Go file of the package imports "C", which
+// go/packages leaves out of imports.
+func usesCgo(goPkg *packages.Package) bool {
+	fset := token.NewFileSet()
+	for _, filename := range goPkg.GoFiles {
+		file, err := parser.ParseFile(fset, filename, nil, parser.ImportsOnly)
+		if err != nil {
+			continue
+		}
+		for _, spec := range file.Imports {
+			if spec.Path.Value == `"C"` {
+				return true
+			}
+		}
+	}
+	return false
 }
 
 func getImports(goPkg *packages.Package) []string {
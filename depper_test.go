@@ -13,19 +13,27 @@
 package main
 
 import (
+	"bytes"
 	"fmt"
+	"io/ioutil"
 	"os"
+	"path/filepath"
 	"regexp"
+	"sort"
+	"strings"
+	"sync"
 	"testing"
 
 	"github.com/stretchr/testify/require"
 	"github.com/stretchr/testify/suite"
+	"golang.org/x/tools/go/packages"
 )
 
 func (s *Zuite) TestCollectPackages() {
 	var defs defs
-	deps, err := defs.collectPackages(s.cwd)
+	g, err := defs.collectPackages(s.cwd, nil, nil)
 	require.NoError(s.T(), err)
+	deps := g.pkgs
 
 	// Check dependency graph.
 
@@ -33,23 +41,19 @@ func (s *Zuite) TestCollectPackages() {
 
 	sample_deps := deps[p("sample_deps")]
 	require.NotNil(s.T(), sample_deps)
-	require.Len(s.T(), sample_deps.dependsOn, 2)
-	require.NotNil(s.T(), sample_deps.dependsOn[p("sample_deps/a")])
-	require.NotNil(s.T(), sample_deps.dependsOn[p("sample_deps/b")])
+	require.Equal(s.T(), []string{p("sample_deps/a"), p("sample_deps/b")}, names(g.dependencies(sample_deps)))
 
 	a := deps[p("sample_deps/a")]
 	require.NotNil(s.T(), a)
-	require.Len(s.T(), a.dependsOn, 1)
-	require.NotNil(s.T(), a.dependsOn["fmt"])
+	require.Equal(s.T(), []string{"fmt"}, names(g.dependencies(a)))
 
 	b := deps[p("sample_deps/b")]
 	require.NotNil(s.T(), b)
-	require.Len(s.T(), b.dependsOn, 1)
-	require.NotNil(s.T(), sample_deps.dependsOn[p("sample_deps/a")])
+	require.Equal(s.T(), []string{p("sample_deps/a")}, names(g.dependencies(b)))
 
 	fmtpkg := deps["fmt"]
 	require.NotNil(s.T(), fmtpkg)
-	require.Len(s.T(), fmtpkg.dependsOn, 0)
+	require.Empty(s.T(), g.dependencies(fmtpkg))
 
 	// Check goroot'ness.
 
@@ -57,6 +61,469 @@ func (s *Zuite) TestCollectPackages() {
 	require.False(s.T(), deps[p("sample_deps/a")].goroot)
 	require.False(s.T(), deps[p("sample_deps/b")].goroot)
 	require.True(s.T(), deps["fmt"].goroot)
+
+	// Check package names.
+
+	require.Equal(s.T(), "sample_deps", deps[p("sample_deps")].pkgName)
+	require.Equal(s.T(), "a", deps[p("sample_deps/a")].pkgName)
+	require.Equal(s.T(), "fmt", deps["fmt"].pkgName)
+
+	// Check annotations.
+
+	require.Equal(s.T(), map[string]string{"layer": "domain"}, deps[p("sample_deps/a")].annotations)
+	require.Empty(s.T(), deps[p("sample_deps/b")].annotations)
+
+	// Check files.
+
+	b = deps[p("sample_deps/b")]
+	require.Len(s.T(), b.files, 1)
+	require.Equal(s.T(), "b/b.go", b.files[0].name)
+	require.Equal(s.T(), []*goImport{
+		&goImport{path: p("sample_deps/a"), line: 15},
+	}, b.files[0].imports)
+	require.Empty(s.T(), deps["fmt"].files)
+}
+
+func (s *Zuite) TestCollectPackages_withTags() {
+	var defs defs
+	defs.Config.WorkingPackage = p("sample_deps")
+	g, err := defs.collectPackages(s.cwd, nil, nil)
+	require.NoError(s.T(), err)
+	taggedGraph, err := defs.collectPackages(s.cwd, nil, []string{"tools"})
+	require.NoError(s.T(), err)
+	taggedDeps := taggedGraph.pkgs
+
+	require.Len(s.T(), taggedDeps, 5)
+	require.Equal(s.T(), []string{"fmt", "strings"}, names(taggedGraph.dependenciesOf(p("sample_deps/a"))))
+
+	// Only the dependency introduced by the tagged file remains.
+	tagged := taggedOnly(g, taggedGraph)
+	require.Len(s.T(), tagged.pkgs, 5)
+	require.Empty(s.T(), tagged.dependenciesOf(p("sample_deps")))
+	require.Empty(s.T(), tagged.dependenciesOf(p("sample_deps/b")))
+	require.Equal(s.T(), []string{"strings"}, names(tagged.dependenciesOf(p("sample_deps/a"))))
+}
+
+func (s *Zuite) TestCollectPackages_lazy() {
+	var defs defs
+	defs.Config.WorkingPackage = p("sample_deps")
+	require.False(s.T(), defs.needsThirdParties())
+	lazy, err := defs.collectPackages(s.cwd, nil, nil)
+	require.NoError(s.T(), err)
+
+	// Third parties are leaves, known by their import path only.
+	require.True(s.T(), lazy.pkgs["fmt"].goroot)
+	require.Empty(s.T(), lazy.pkgs["fmt"].pkgName)
+	require.Equal(s.T(), "a", lazy.pkgs[p("sample_deps/a")].pkgName)
+
+	// Matching by name loads them, and the graph is otherwise the same.
+	defs.Rules = []*rule{&rule{mayDepends: newPkgpatternSet(&pkgpattern{byName: true, pattern: regexp.MustCompile("^fmt$")})}}
+	require.True(s.T(), defs.needsThirdParties())
+	full, err := defs.collectPackages(s.cwd, nil, nil)
+	require.NoError(s.T(), err)
+	require.Equal(s.T(), "fmt", full.pkgs["fmt"].pkgName)
+	require.Equal(s.T(), names(full.nodes()), names(lazy.nodes()))
+	for _, pkg := range full.nodes() {
+		require.Equal(s.T(), pkg.goroot, lazy.pkgs[pkg.name].goroot)
+		require.Equal(s.T(), names(full.dependencies(pkg)), names(lazy.dependenciesOf(pkg.name)))
+	}
+}
+
+func (s *Zuite) TestCollectPackages_deepChain() {
+	dir, err := ioutil.TempDir("", "depper")
+	require.NoError(s.T(), err)
+	defer os.RemoveAll(dir)
+
+	// example.com/deep -> p0 -> p1 -> ... -> p299 -> fmt
+	const depth = 300
+	files := map[string]string{
+		"go.mod":  "module example.com/deep\n",
+		"main.go": "package main\n\nimport _ \"example.com/deep/p0\"\n\nfunc main() {}\n",
+	}
+	for i := 0; i < depth; i++ {
+		imp := fmt.Sprintf("example.com/deep/p%d", i+1)
+		if i == depth-1 {
+			imp = "fmt"
+		}
+		files[fmt.Sprintf("p%d/p.go", i)] = fmt.Sprintf("package p%d\n\nimport _ %q\n", i, imp)
+	}
+	s.writeFiles(dir, files)
+
+	var defs defs
+	defs.Config.WorkingPackage = "example.com/deep"
+	g, err := defs.collectPackages(dir, nil, nil)
+	require.NoError(s.T(), err)
+	deps := g.pkgs
+	require.Empty(s.T(), g.loadErrors)
+	require.Len(s.T(), deps, depth+2)
+
+	last := deps[fmt.Sprintf("example.com/deep/p%d", depth-1)]
+	require.NotNil(s.T(), last)
+	require.Equal(s.T(), []string{"fmt"}, names(g.dependencies(last)))
+	require.True(s.T(), g.dependencies(last)[0].goroot)
+}
+
+func (s *Zuite) TestCollectPackages_externalSubjects() {
+	defs, g := s.collectFixture(map[string]string{
+		"go.mod":  "module example.com/ext\n",
+		"main.go": "package main\n\nimport _ \"net/url\"\n\nfunc main() {}\n",
+	}, `
+config:
+  working_package: example.com/ext
+rules:
+  - name: url
+    packages: <net/url>
+    may_depend:
+      - <errors>
+`)
+
+	// The dependencies of selected std lib packages are collected, but not
+	// those of others.
+	require.Contains(s.T(), names(g.dependenciesOf("net/url")), "errors")
+	require.Contains(s.T(), names(g.dependenciesOf("net/url")), "strings")
+	require.Empty(s.T(), g.dependenciesOf("strings"))
+
+	report := defs.check(g, nil, false)
+	require.Contains(s.T(), lines(report.Sections[0].Violations), "- disallowed <net/url> -> strings")
+	require.NotContains(s.T(), lines(report.Sections[0].Violations), "- disallowed <net/url> -> errors")
+}
+
+func (s *Zuite) TestCheck_fixtures() {
+	files := map[string]string{
+		"go.mod":         "module example.com/fix\n",
+		"main.go":        "package main\n\nimport (\n\t_ \"example.com/fix/api\"\n\t_ \"example.com/fix/dal\"\n)\n\nfunc main() {}\n",
+		"api/api.go":     "package api\n\nimport (\n\t_ \"database/sql\"\n\n\t_ \"example.com/fix/service\"\n)\n",
+		"service/svc.go": "package service\n\nimport _ \"example.com/fix/dal\"\n",
+		"dal/dal.go":     "package dal\n\nimport _ \"database/sql\"\n",
+	}
+	for _, tc := range []struct {
+		rule     string
+		expected []string
+	}{
+		{"packages: api\n    may_depend:\n      - service", []string{"- disallowed example.com/fix/api -> database/sql"}},
+		{"packages: (api|service)\n    may_not_depend:\n      - dal", []string{"- disallowed example.com/fix/service -> example.com/fix/dal"}},
+		{"packages: (api|service)\n    must_depend:\n      - <database/sql>", []string{"- required   example.com/fix/service -> <database/sql>"}},
+		{"packages: .*\n    may_depend:\n      - <.*>\n      - .*", nil},
+	} {
+		defs, g := s.collectFixture(files, "config:\n  working_package: example.com/fix\nrules:\n  - name: fixture\n    "+tc.rule+"\n")
+		require.Equal(s.T(), tc.expected, lines(defs.check(g, nil, false).violations()), tc.rule)
+	}
+}
+
+func (s *Zuite) TestCollectPackages_tools() {
+	dir, err := ioutil.TempDir("", "depper")
+	require.NoError(s.T(), err)
+	defer os.RemoveAll(dir)
+	s.writeFiles(dir, map[string]string{
+		"go.mod":       "module example.com/fix\n",
+		"main.go":      "package main\n\nimport (\n\t_ \"example.com/fix/api\"\n\t_ \"example.com/fix/cli\"\n)\n\nfunc main() {}\n",
+		"tools.go":     "package main\n\nimport (\n\t_ \"example.com/fix/gen\"\n\t_ \"text/template\"\n)\n",
+		"api/api.go":   "package api\n",
+		"api/tools.go": "package api\n\nimport \"fmt\"\n\nvar _ = fmt.Sprint\n",
+		"gen/gen.go":   "package main\n\nfunc main() {}\n",
+		"cli/cli.go":   "package cli\n",
+		"cli/tools.go": "//go:build tools\n// +build tools\n\npackage cli\n\nimport _ \"example.com/fix/lint\"\n",
+		"lint/lint.go": "package main\n\nfunc main() {}\n",
+	})
+	defs, err := parse([]byte(`
+config:
+  working_package: example.com/fix
+rules:
+  - name: root
+    packages: root
+    may_depend:
+      - api
+      - cli
+`))
+	require.NoError(s.T(), err)
+
+	// Imports of tools files are not dependencies, but files with other
+	// imports are not tools files.
+	g, err := defs.collectPackages(dir, nil, nil)
+	require.NoError(s.T(), err)
+	require.Equal(s.T(), []string{"example.com/fix/api", "example.com/fix/cli"}, names(g.dependenciesOf("example.com/fix")))
+	require.Equal(s.T(), []string{"fmt"}, names(g.dependenciesOf("example.com/fix/api")))
+	require.Len(s.T(), g.pkgs["example.com/fix"].files, 1)
+	require.Len(s.T(), g.pkgs["example.com/fix"].tools, 1)
+	require.Empty(s.T(), defs.check(g, nil, false).violations())
+	require.Equal(s.T(), []string{"example.com/fix/gen", "example.com/fix/lint", "text/template"}, g.toolPackages())
+
+	// Tools files with the conventional build tag are known without it.
+	require.Len(s.T(), g.pkgs["example.com/fix/cli"].files, 1)
+	require.Len(s.T(), g.pkgs["example.com/fix/cli"].tools, 1)
+
+	// Rules with build tags see them.
+	tagged, err := defs.collectPackages(dir, nil, []string{"tools"})
+	require.NoError(s.T(), err)
+	require.Equal(s.T(), []string{"example.com/fix/gen", "text/template"}, names(taggedOnly(g, tagged).dependenciesOf("example.com/fix")))
+	require.Equal(s.T(), []string{"example.com/fix/lint"}, names(taggedOnly(g, tagged).dependenciesOf("example.com/fix/cli")))
+}
+
+func (s *Zuite) TestCollectPackages_inspect() {
+	dir, err := ioutil.TempDir("", "depper")
+	require.NoError(s.T(), err)
+	defer os.RemoveAll(dir)
+	files := map[string]string{
+		"app/go.mod":     "module example.com/app\n\nrequire (\n\texample.com/lib v0.1.0\n\texample.com/other v0.1.0\n)\n\nreplace example.com/lib => ../lib\n\nreplace example.com/other => ../other\n",
+		"app/main.go":    "package main\n\nimport (\n\t_ \"example.com/lib/a\"\n\t_ \"example.com/other\"\n)\n\nfunc main() {}\n",
+		"lib/go.mod":     "module example.com/lib\n",
+		"lib/a/a.go":     "package a\n\nimport _ \"example.com/lib/b\"\n",
+		"lib/b/b.go":     "package b\n\nimport _ \"example.com/lib/c\"\n",
+		"lib/c/c.go":     "package c\n\nimport _ \"net/url\"\n",
+		"other/go.mod":   "module example.com/other\n",
+		"other/other.go": "package other\n\nimport _ \"net/url\"\n",
+	}
+	s.writeFiles(dir, files)
+
+	// The imports of inspected modules are collected, up to the depth, but
+	// not those of others.
+	defs, err := parse([]byte(`
+config:
+  working_package: example.com/app
+  inspect:
+    - example.com/l*
+  inspect_depth: 2
+`))
+	require.NoError(s.T(), err)
+	g, err := defs.collectPackages(filepath.Join(dir, "app"), nil, nil)
+	require.NoError(s.T(), err)
+	require.Empty(s.T(), g.loadErrors)
+	require.Equal(s.T(), []string{"example.com/lib/b"}, names(g.dependenciesOf("example.com/lib/a")))
+	require.Equal(s.T(), []string{"example.com/lib/c"}, names(g.dependenciesOf("example.com/lib/b")))
+	require.Empty(s.T(), g.dependenciesOf("example.com/lib/c"))
+	require.Empty(s.T(), g.dependenciesOf("example.com/other"))
+	require.Empty(s.T(), g.pkgs["example.com/lib/a"].files)
+
+	defs.Config.InspectDepth = 0
+	g, err = defs.collectPackages(filepath.Join(dir, "app"), nil, nil)
+	require.NoError(s.T(), err)
+	require.Equal(s.T(), []string{"net/url"}, names(g.dependenciesOf("example.com/lib/c")))
+	require.Empty(s.T(), g.dependenciesOf("net/url"))
+}
+
+func (s *Zuite) TestNoCgo() {
+	dir, err := ioutil.TempDir("", "depper")
+	require.NoError(s.T(), err)
+	defer os.RemoveAll(dir)
+	files := map[string]string{
+		"app/go.mod":           "module example.com/app\n\nrequire example.com/lib v0.1.0\n\nreplace example.com/lib => ../lib\n",
+		"app/main.go":          "package main\n\nimport (\n\t_ \"example.com/lib/db\"\n\t_ \"example.com/lib/sqlite\"\n)\n\nfunc main() {}\n",
+		"lib/go.mod":           "module example.com/lib\n",
+		"lib/db/db.go":         "package db\n\nimport _ \"example.com/lib/cgo\"\n",
+		"lib/cgo/cgo.go":       "package cgo\n\nimport \"C\"\n",
+		"lib/sqlite/sqlite.go": "package sqlite\n\n// #include <stdlib.h>\nimport \"C\"\n",
+	}
+	s.writeFiles(dir, files)
+
+	// Third parties requiring cgo are flagged once collected, e.g. by
+	// inspecting the modules importing them.
+	defs, err := parse([]byte(`
+config:
+  working_package: example.com/app
+  inspect:
+    - example.com/lib
+no_cgo:
+  except:
+    - example\.com/lib/sqlite
+`))
+	require.NoError(s.T(), err)
+	defs.env = []string{"CGO_ENABLED=1"}
+	g, err := defs.collectPackages(filepath.Join(dir, "app"), nil, nil)
+	require.NoError(s.T(), err)
+	require.True(s.T(), g.pkgs["example.com/lib/sqlite"].cgo)
+	require.False(s.T(), g.pkgs["example.com/lib/db"].cgo)
+	report := defs.check(g, nil, false)
+	require.Equal(s.T(), []string{
+		"- cgo        example.com/lib/cgo, requires cgo, imported by example.com/lib/db",
+	}, lines(report.violations()))
+}
+
+func (s *Zuite) TestCollectPackages_gopath() {
+	gopath, err := ioutil.TempDir("", "depper")
+	require.NoError(s.T(), err)
+	defer os.RemoveAll(gopath)
+
+	files := map[string]string{
+		"src/legacy/svc/main.go":                                "package main\n\nimport (\n\t_ \"fmt\"\n\n\t_ \"github.com/pkg/errors\"\n\t_ \"legacy/svc/store\"\n)\n\nfunc main() {}\n",
+		"src/legacy/svc/store/store.go":                         "package store\n",
+		"src/legacy/svc/vendor/github.com/pkg/errors/errors.go": "package errors\n",
+		"module/go.mod":                                         "module example.com/module\n",
+	}
+	s.writeFiles(gopath, files)
+
+	// Pre-modules projects are told apart from modules.
+	root := filepath.Join(gopath, "src/legacy/svc")
+	env := []string{"GOPATH=" + gopath}
+	require.True(s.T(), inGopath(filepath.Join(root, "store"), env))
+	require.False(s.T(), inGopath(filepath.Join(gopath, "module"), env))
+	require.False(s.T(), inGopath(gopath, env))
+
+	// Working packages are not mistaken for standard ones, and vendored
+	// packages are known by their import path.
+	var defs defs
+	defs.Config.WorkingPackage = "legacy/svc"
+	defs.env = append(env, "GO111MODULE=off")
+	g, err := defs.collectPackages(root, nil, nil)
+	require.NoError(s.T(), err)
+	require.Empty(s.T(), g.loadErrors)
+	require.Equal(s.T(), []string{"fmt", "github.com/pkg/errors", "legacy/svc/store"}, names(g.dependenciesOf("legacy/svc")))
+	require.True(s.T(), g.pkgs["fmt"].goroot)
+	require.False(s.T(), g.pkgs["legacy/svc/store"].goroot)
+	require.False(s.T(), g.pkgs["github.com/pkg/errors"].goroot)
+}
+
+func (s *Zuite) TestCollectPackages_noGoFiles() {
+	dir, err := ioutil.TempDir("", "depper")
+	require.NoError(s.T(), err)
+	defer os.RemoveAll(dir)
+
+	files := map[string]string{
+		"go.mod":             "module example.com/nogo\n",
+		"main.go":            "package main\n\nimport _ \"example.com/nogo/ignored\"\n\nfunc main() {}\n",
+		"ignored/ignored.go": "// +build never\n\npackage ignored\n",
+		"assets/index.html":  "<html></html>\n",
+	}
+	s.writeFiles(dir, files)
+
+	// Packages excluded by build constraints are part of the graph, but
+	// neither broken nor standard.
+	var defs defs
+	defs.Config.WorkingPackage = "example.com/nogo"
+	g, err := defs.collectPackages(dir, nil, nil)
+	require.NoError(s.T(), err)
+	deps := g.pkgs
+	require.Empty(s.T(), g.loadErrors)
+	require.Equal(s.T(), []string{"example.com/nogo/ignored"}, names(g.dependenciesOf("example.com/nogo")))
+	ignored := deps["example.com/nogo/ignored"]
+	require.False(s.T(), ignored.goroot)
+	require.Empty(s.T(), ignored.files)
+
+	// Packages with assets only are named after their import path.
+	assets := filepath.Join(dir, "assets")
+	root, err := defs.rootPackage(assets)
+	require.NoError(s.T(), err)
+	require.Equal(s.T(), "example.com/nogo/assets", root)
+
+	defs.Config.WorkingPackage = root
+	g, err = defs.collectPackages(assets, nil, nil)
+	require.NoError(s.T(), err)
+	deps = g.pkgs
+	require.Empty(s.T(), g.loadErrors)
+	require.Len(s.T(), deps, 1)
+	require.False(s.T(), deps["example.com/nogo/assets"].goroot)
+}
+
+func (s *Zuite) TestIsGoroot() {
+	module := &packages.Module{Path: "github.com/helloeave/depper"}
+
+	require.True(s.T(), isGoroot(&packages.Package{PkgPath: "fmt"}))
+	require.True(s.T(), isGoroot(&packages.Package{PkgPath: "net/http"}))
+	require.True(s.T(), isGoroot(&packages.Package{PkgPath: "vendor/golang.org/x/net/http2/hpack"}))
+
+	// Regardless of where the toolchain is installed.
+	require.True(s.T(), isGoroot(&packages.Package{PkgPath: "fmt", GoFiles: []string{"/opt/asdf/installs/golang/1.20/go/src/fmt/print.go"}}))
+
+	require.False(s.T(), isGoroot(&packages.Package{PkgPath: "github.com/helloeave/depper/sample_deps", Module: module}))
+	require.False(s.T(), isGoroot(&packages.Package{PkgPath: "sample_deps", Module: module}))
+	require.False(s.T(), isGoroot(&packages.Package{PkgPath: "github.com/missing/pkg"}))
+}
+
+func (s *Zuite) TestCollectPackages_loadErrors() {
+	dir, err := ioutil.TempDir("", "depper")
+	require.NoError(s.T(), err)
+	defer os.RemoveAll(dir)
+
+	files := map[string]string{
+		"go.mod":       "module example.com/broken\n",
+		"main.go":      "package main\n\nimport (\n\t_ \"example.com/broken/bad\"\n\t_ \"example.com/broken/good\"\n)\n\nfunc main() {}\n",
+		"bad/bad.go":   "package bad\n\nimport (\n\t\"fmt\"\n\t\"strings\n)\n",
+		"good/good.go": "package good\n\nimport \"strings\"\n\nvar _ = strings.ToUpper\n",
+	}
+	s.writeFiles(dir, files)
+
+	var defs defs
+	defs.Config.WorkingPackage = "example.com/broken"
+	g, err := defs.collectPackages(dir, nil, nil)
+	require.NoError(s.T(), err)
+	deps := g.pkgs
+
+	// The rest of the graph is analyzed.
+	require.NotNil(s.T(), deps["example.com/broken"])
+	require.NotNil(s.T(), deps["example.com/broken/good"])
+	require.True(s.T(), g.hasDependency("example.com/broken/good", "strings"))
+	require.NotNil(s.T(), deps["example.com/broken/bad"])
+
+	require.Len(s.T(), g.loadErrors, 1)
+	require.Equal(s.T(), kindBroken, g.loadErrors[0].Kind)
+	require.Equal(s.T(), "example.com/broken/bad", g.loadErrors[0].From)
+	require.Equal(s.T(), filepath.Join("bad", "bad.go")+":5:2", g.loadErrors[0].Position)
+	require.Empty(s.T(), deps["example.com/broken/bad"].files)
+}
+
+func (s *Zuite) TestCollectPackages_parseErrors() {
+	files := map[string]string{
+		"go.mod":  "module example.com/t\n",
+		"main.go": "package main\n\nimport (\n\t_ \"example.com/t/a\"\n\t_ \"example.com/t/c\"\n)\n\nfunc main() {}\n",
+		"a/a.go":  "package a\n\nimport _ \"example.com/t/b\"\n",
+		"a/d.go":  "package a\n\nimport _ \"strings\" //depper:allow\n",
+		"b/b.go":  "package b\n",
+		"c/c.go":  "package c\n\nimport _ \"example.com/t/b\"\n",
+		"c/d.go":  "package c\n\nimport (\n\t\"fmt\"\n",
+	}
+	defs, g := s.collectFixture(files, `
+config:
+  working_package: example.com/t
+rules:
+  - name: no b
+    packages: (a|c)
+    may_not_depend:
+      - b
+`)
+
+	// Files which parse keep their edges, and errors are reported
+	// whether or not the go command reports any.
+	require.Equal(s.T(), []string{"example.com/t/b", "strings"}, names(g.dependenciesOf("example.com/t/a")))
+	require.Equal(s.T(), []string{"example.com/t/b"}, names(g.dependenciesOf("example.com/t/c")))
+	violations := lines(defs.check(g, nil, false).violations())
+	require.Contains(s.T(), violations, "- disallowed example.com/t/a -> example.com/t/b")
+	require.Contains(s.T(), violations, "- disallowed example.com/t/c -> example.com/t/b")
+	var broken []string
+	for _, v := range g.loadErrors {
+		broken = append(broken, v.From)
+	}
+	require.Equal(s.T(), []string{"example.com/t/a", "example.com/t/c"}, broken)
+	require.Contains(s.T(), g.loadErrors[0].Message, "depper:allow must give a reason")
+}
+
+func (s *Zuite) TestRuleMatches() {
+	domain := &pkg{name: "wp/billing", annotations: map[string]string{"layer": "domain"}}
+	infra := &pkg{name: "wp/billing/db", annotations: map[string]string{"layer": "infra"}}
+	plain := &pkg{name: "wp/lending"}
+
+	defs, err := parse([]byte(`
+config:
+  working_package: wp
+rules:
+  - name: by path
+    packages: billing.*
+  - name: by annotation
+    annotation: layer=domain
+  - name: by both
+    packages: billing/.*
+    annotation: layer=infra
+`))
+	require.NoError(s.T(), err)
+
+	byPath, byAnnotation, byBoth := defs.Rules[0], defs.Rules[1], defs.Rules[2]
+	require.True(s.T(), byPath.matches(domain))
+	require.True(s.T(), byPath.matches(infra))
+	require.False(s.T(), byPath.matches(plain))
+	require.True(s.T(), byAnnotation.matches(domain))
+	require.False(s.T(), byAnnotation.matches(infra))
+	require.False(s.T(), byAnnotation.matches(plain))
+	require.False(s.T(), byBoth.matches(domain))
+	require.True(s.T(), byBoth.matches(infra))
+	require.False(s.T(), byBoth.matches(plain))
 }
 
 // graph returns fixture dependency graph:
@@ -64,31 +531,37 @@ func (s *Zuite) TestCollectPackages() {
 // dependencies:
 // - foo -> bar
 // - bar -> baz
-func graph() map[string]*pkg {
-	foo := pkg{name: "foo", dependsOn: make(map[string]*pkg)}
-	bar := pkg{name: "bar", dependsOn: make(map[string]*pkg)}
-	baz := pkg{name: "baz", dependsOn: make(map[string]*pkg)}
-
-	foo.dependsOn["bar"] = &bar
-	bar.dependsOn["baz"] = &baz
+func sampleGraph() *graph {
+	return graphOf(map[string]*pkg{
+		"foo": &pkg{name: "foo"},
+		"bar": &pkg{name: "bar"},
+		"baz": &pkg{name: "baz"},
+	}, "foo -> bar", "bar -> baz")
+}
 
-	pkgs := map[string]*pkg{
-		"foo": &foo,
-		"bar": &bar,
-		"baz": &baz,
+// graphOf returns a graph of the packages, and the dependencies among them
+// written `from -> to`.
+func graphOf(pkgs map[string]*pkg, deps ...string) *graph {
+	g := newGraph("wp")
+	for _, name := range sortedNames(pkgs) {
+		g.add(pkgs[name])
 	}
-
-	return pkgs
+	for _, dep := range deps {
+		parts := strings.Split(dep, " -> ")
+		g.depend(g.pkgs[parts[0]], g.pkgs[parts[1]])
+	}
+	return g
 }
 
-func (s *Zuite) requireProcessRuleFullyAndCheck(r *rule, pkgs map[string]*pkg, pkgName string, expectedViolations []string) {
-	r.process(pkgs, pkgs[pkgName])
-	r.processMissingPackages()
-	require.Equalf(s.T(), expectedViolations, r.violations, "for package %s", pkgName)
+func (s *Zuite) requireProcessRuleFullyAndCheck(r *rule, g *graph, pkgName string, expectedViolations []string) {
+	result := newRuleResult()
+	r.process(g, g.pkgs[pkgName], result)
+	r.processMissingPackages(result)
+	require.Equalf(s.T(), expectedViolations, lines(result.violations), "for package %s", pkgName)
 }
 
 func (s *Zuite) TestProcessRule_mayDependOnNothing() {
-	pkgs := graph()
+	g := sampleGraph()
 
 	cases := map[string][]string{
 		"foo": []string{
@@ -101,15 +574,14 @@ func (s *Zuite) TestProcessRule_mayDependOnNothing() {
 	}
 	for pkgName, expectedViolations := range cases {
 		r := &rule{
-			mayDepends:              nil,
-			actualPackagesProcessed: make(map[string]bool),
+			mayDepends: nil,
 		}
-		s.requireProcessRuleFullyAndCheck(r, pkgs, pkgName, expectedViolations)
+		s.requireProcessRuleFullyAndCheck(r, g, pkgName, expectedViolations)
 	}
 }
 
 func (s *Zuite) TestProcessRule_mayDependOnBar() {
-	pkgs := graph()
+	g := sampleGraph()
 
 	cases := map[string][]string{
 		"foo": nil,
@@ -120,17 +592,16 @@ func (s *Zuite) TestProcessRule_mayDependOnBar() {
 	}
 	for pkgName, expectedViolations := range cases {
 		r := &rule{
-			mayDepends: []*pkgpattern{
+			mayDepends: newPkgpatternSet(
 				&pkgpattern{pattern: regexp.MustCompile("bar")},
-			},
-			actualPackagesProcessed: make(map[string]bool),
+			),
 		}
-		s.requireProcessRuleFullyAndCheck(r, pkgs, pkgName, expectedViolations)
+		s.requireProcessRuleFullyAndCheck(r, g, pkgName, expectedViolations)
 	}
 }
 
 func (s *Zuite) TestProcessRule_mayDependOnNothingExpectedToDependOnBar() {
-	pkgs := graph()
+	g := sampleGraph()
 
 	cases := map[string][]string{
 		"foo": nil,
@@ -147,14 +618,13 @@ func (s *Zuite) TestProcessRule_mayDependOnNothingExpectedToDependOnBar() {
 			expectedStarToPackage: map[string]bool{
 				"bar": true,
 			},
-			actualPackagesProcessed: make(map[string]bool),
 		}
-		s.requireProcessRuleFullyAndCheck(r, pkgs, pkgName, expectedViolations)
+		s.requireProcessRuleFullyAndCheck(r, g, pkgName, expectedViolations)
 	}
 }
 
 func (s *Zuite) TestProcessRule_mayDependOnNothingExpectedToHaveFooDependingOnBar() {
-	pkgs := graph()
+	g := sampleGraph()
 
 	cases := map[string][]string{
 		"foo": nil,
@@ -174,14 +644,13 @@ func (s *Zuite) TestProcessRule_mayDependOnNothingExpectedToHaveFooDependingOnBa
 					"bar": true,
 				},
 			},
-			actualPackagesProcessed: make(map[string]bool),
 		}
-		s.requireProcessRuleFullyAndCheck(r, pkgs, pkgName, expectedViolations)
+		s.requireProcessRuleFullyAndCheck(r, g, pkgName, expectedViolations)
 	}
 }
 
 func (s *Zuite) TestProcessRule_mayDependOnBazExpectedToHaveFooDependingOnBar() {
-	pkgs := graph()
+	g := sampleGraph()
 
 	cases := map[string][]string{
 		"foo": nil,
@@ -194,22 +663,21 @@ func (s *Zuite) TestProcessRule_mayDependOnBazExpectedToHaveFooDependingOnBar()
 	}
 	for pkgName, expectedViolations := range cases {
 		r := &rule{
-			mayDepends: []*pkgpattern{
+			mayDepends: newPkgpatternSet(
 				&pkgpattern{pattern: regexp.MustCompile("baz")},
-			},
+			),
 			expectedPackageToPackage: map[string]map[string]bool{
 				"foo": map[string]bool{
 					"bar": true,
 				},
 			},
-			actualPackagesProcessed: make(map[string]bool),
 		}
-		s.requireProcessRuleFullyAndCheck(r, pkgs, pkgName, expectedViolations)
+		s.requireProcessRuleFullyAndCheck(r, g, pkgName, expectedViolations)
 	}
 }
 
 func (s *Zuite) TestProcessRule_mayDependOnBarAndBazExpectedToHaveQuxDependingOnBar() {
-	pkgs := graph()
+	g := sampleGraph()
 
 	cases := map[string][]string{
 		"foo": []string{
@@ -224,19 +692,1476 @@ func (s *Zuite) TestProcessRule_mayDependOnBarAndBazExpectedToHaveQuxDependingOn
 	}
 	for pkgName, expectedViolations := range cases {
 		r := &rule{
-			mayDepends: []*pkgpattern{
+			mayDepends: newPkgpatternSet(
 				&pkgpattern{pattern: regexp.MustCompile("bar")},
 				&pkgpattern{pattern: regexp.MustCompile("baz")},
-			},
+			),
 			expectedPackageToPackage: map[string]map[string]bool{
 				"qux": map[string]bool{
 					"bar": true,
 				},
 			},
-			actualPackagesProcessed: make(map[string]bool),
 		}
-		s.requireProcessRuleFullyAndCheck(r, pkgs, pkgName, expectedViolations)
+		s.requireProcessRuleFullyAndCheck(r, g, pkgName, expectedViolations)
+	}
+}
+
+func (s *Zuite) TestProcessEquivalenceGroup() {
+	g := graphOf(map[string]*pkg{
+		"foo":                          &pkg{name: "foo"},
+		"github.com/google/uuid":       &pkg{name: "github.com/google/uuid"},
+		"github.com/gofrs/uuid/v3":     &pkg{name: "github.com/gofrs/uuid/v3"},
+		"github.com/rogpeppe/fastuuid": &pkg{name: "github.com/rogpeppe/fastuuid"},
+	})
+
+	cases := map[string][]string{
+		"github.com/google/uuid":    nil,
+		"github.com/satori/go.uuid": nil,
+		"github.com/google/uuid github.com/gofrs/uuid": []string{
+			"- duplicate  github.com/google/uuid, github.com/gofrs/uuid",
+		},
+		"github.com/google/uuid github.com/gofrs/uuid/v3 github.com/rogpeppe/fastuuid": []string{
+			"- duplicate  github.com/google/uuid, github.com/gofrs/uuid/v3, github.com/rogpeppe/fastuuid",
+		},
+		"github.com/google/uuid github.com/satori/go.uuid": nil,
+		"github.com/gofrs/uuid github.com/rogpeppe/fast":   nil,
+	}
+	for packages, expectedViolations := range cases {
+		group := &equivalenceGroup{
+			name:     "uuid",
+			packages: strings.Fields(packages),
+		}
+		require.Equalf(s.T(), expectedViolations, lines(group.process(g)), "for packages %s", packages)
+	}
+}
+
+func (s *Zuite) TestParse_equivalenceGroups() {
+	defs, err := parse([]byte(`
+equivalence_groups:
+  uuid:
+    - github.com/google/uuid
+    - github.com/gofrs/uuid
+  json:
+    - encoding/json
+    - github.com/json-iterator/go
+`))
+	require.NoError(s.T(), err)
+	require.Len(s.T(), defs.equivalenceGroups, 2)
+	require.Equal(s.T(), "json", defs.equivalenceGroups[0].name)
+	require.Equal(s.T(), "uuid", defs.equivalenceGroups[1].name)
+
+	_, err = parse([]byte(`
+equivalence_groups:
+  uuid:
+    - github.com/google/uuid
+`))
+	require.EqualError(s.T(), err, "equivalence group uuid must list at least two packages")
+}
+
+func (s *Zuite) TestProcessSingleProvider() {
+	g := sampleGraph()
+	g.add(&pkg{name: "log", goroot: true})
+	g.add(&pkg{name: "go.uber.org/zap"})
+	g.depend(g.pkgs["go.uber.org/zap"], g.pkgs["log"])
+	g.depend(g.pkgs["foo"], g.pkgs["log"])
+	g.depend(g.pkgs["bar"], g.pkgs["log"])
+	g.depend(g.pkgs["bar"], g.pkgs["go.uber.org/zap"])
+
+	provider := &singleProvider{
+		Capability: "logging",
+		Provider:   "go.uber.org/zap",
+		alternatives: newPkgpatternSet(
+			&pkgpattern{goroot: true, pattern: regexp.MustCompile("^log$")},
+			&pkgpattern{pattern: regexp.MustCompile("^baz$")},
+		),
+	}
+	require.Equal(s.T(), []string{
+		"- disallowed bar -> <log>, use go.uber.org/zap",
+		"- disallowed bar -> baz, use go.uber.org/zap",
+		"- disallowed foo -> <log>, use go.uber.org/zap",
+	}, lines(provider.process(g)))
+}
+
+func (s *Zuite) TestProcessTestOnly() {
+	g := graphOf(map[string]*pkg{
+		"wp/foo": &pkg{name: "wp/foo", files: []*goFile{
+			&goFile{name: "foo/foo.go", imports: []*goImport{
+				&goImport{path: "fmt", line: 3},
+				&goImport{path: "wp/internal/testutil", line: 4},
+				&goImport{path: "wp/bar/mocks", line: 5},
+				&goImport{path: "wp/mockserver", line: 6},
+			}},
+		}},
+		"wp/bar/mocks": &pkg{name: "wp/bar/mocks", files: []*goFile{
+			&goFile{name: "bar/mocks/mocks.go", imports: []*goImport{
+				&goImport{path: "wp/internal/testutil", line: 3},
+			}},
+		}},
+	})
+
+	testOnly := &testOnly{markers: []string{"testutil", "mocks"}}
+	require.Equal(s.T(), []string{
+		"- test only  foo/foo.go:4: wp/foo -> wp/internal/testutil",
+		"- test only  foo/foo.go:5: wp/foo -> wp/bar/mocks",
+	}, lines(testOnly.process(g)))
+}
+
+func (s *Zuite) TestProcessBlankImports() {
+	g := graphOf(map[string]*pkg{
+		"wp/foo": &pkg{name: "wp/foo", files: []*goFile{
+			&goFile{name: "foo/foo.go", imports: []*goImport{
+				&goImport{path: "database/sql", line: 3},
+				&goImport{path: "github.com/lib/pq", name: "_", line: 4},
+				&goImport{path: "image/png", name: "png", line: 5},
+			}},
+		}},
+		"wp/cmd/server": &pkg{name: "wp/cmd/server", files: []*goFile{
+			&goFile{name: "cmd/server/main.go", imports: []*goImport{
+				&goImport{path: "github.com/lib/pq", name: "_", line: 3},
+			}},
+		}},
+	})
+
+	defs, err := parse([]byte(`
+config:
+  working_package: wp
+blank_imports:
+  packages:
+    - cmd/.*
+`))
+	require.NoError(s.T(), err)
+	require.Equal(s.T(), []string{
+		"- blank      foo/foo.go:4: wp/foo -> github.com/lib/pq",
+	}, lines(defs.BlankImports.process(g)))
+}
+
+func (s *Zuite) TestProcessEmbeds() {
+	files := map[string]string{
+		"go.mod":                "module example.com/fix\n\ngo 1.16\n",
+		"main.go":               "package main\n\nimport (\n\t_ \"example.com/fix/api\"\n\t_ \"example.com/fix/assets\"\n)\n\nfunc main() {}\n",
+		"assets/assets.go":      "package assets\n\nimport _ \"embed\"\n\n//go:embed logo.png icon.png\nvar logo []byte\n",
+		"assets/logo.png":       "a logo larger than allowed\n",
+		"assets/icon.png":       "icon\n",
+		"api/api.go":            "package api\n\nimport \"embed\"\n\n//go:embed static\nvar static embed.FS\n",
+		"api/static/index.html": "<html></html>\n",
+	}
+	defs, g := s.collectFixture(files, `
+config:
+  working_package: example.com/fix
+embeds:
+  packages:
+    - assets
+  max_bytes: 10
+`)
+	require.Len(s.T(), g.pkgs["example.com/fix/assets"].embeds, 2)
+	require.Equal(s.T(), &embed{path: "assets/icon.png", size: 5}, g.pkgs["example.com/fix/assets"].embeds[0])
+
+	report := defs.check(g, nil, false)
+	require.Equal(s.T(), []string{
+		"- embed      example.com/fix/api -> api/static/index.html, embedded outside of the packages which may embed files",
+		"- embed      example.com/fix/assets -> assets/logo.png, of 27 B, above 10 B",
+	}, lines(report.violations()))
+}
+
+func (s *Zuite) TestProcessHTTPGlobals() {
+	dir, err := ioutil.TempDir("", "depper")
+	require.NoError(s.T(), err)
+	defer os.RemoveAll(dir)
+	files := map[string]string{
+		"client.go": `package foo
+
+import "net/http"
+
+func get() {
+	http.DefaultClient.Do(nil)
+	http.NewRequest("GET", "/", nil)
+	http.Get("/")
+	http := struct{ Get func(string) }{}
+	http.Get("/")
+}
+`,
+		"server.go": `package foo
+
+import web "net/http"
+
+func init() {
+	web.HandleFunc("/", nil)
+}
+`,
+		"legacy.go": `package foo
+
+//depper:allow predates the http client package
+import "net/http"
+
+var client = http.DefaultClient
+`,
+	}
+	goPkg := &packages.Package{}
+	for _, name := range []string{"client.go", "legacy.go", "server.go"} {
+		path := filepath.Join(dir, name)
+		require.NoError(s.T(), ioutil.WriteFile(path, []byte(files[name]), 0644))
+		goPkg.GoFiles = append(goPkg.GoFiles, path)
+	}
+	fooFiles, _, err := parseFiles(dir, goPkg)
+	require.NoError(s.T(), err)
+
+	g := graphOf(map[string]*pkg{
+		"wp/foo": &pkg{name: "wp/foo", files: fooFiles},
+		"wp/platform/http": &pkg{name: "wp/platform/http", files: []*goFile{
+			&goFile{name: "platform/http/client.go", imports: []*goImport{
+				&goImport{path: "net/http", line: 3},
+			}, uses: []*goUse{
+				&goUse{name: "DefaultTransport", line: 5},
+			}},
+		}},
+	})
+
+	defs, err := parse([]byte(`
+config:
+  working_package: wp
+http_globals:
+  packages:
+    - platform/http
+`))
+	require.NoError(s.T(), err)
+	require.Equal(s.T(), []string{
+		"- global     client.go:6: wp/foo -> <net/http>, uses http.DefaultClient",
+		"- global     client.go:8: wp/foo -> <net/http>, uses http.Get",
+		"- global     server.go:6: wp/foo -> <net/http>, uses http.HandleFunc",
+	}, lines(defs.HTTPGlobals.process(g)))
+}
+
+func (s *Zuite) TestProcessImportAliases() {
+	g := graphOf(map[string]*pkg{
+		"wp/foo": &pkg{name: "wp/foo", files: []*goFile{
+			&goFile{name: "foo/foo.go", imports: []*goImport{
+				&goImport{path: "wp/api/proto", name: "pb", line: 3},
+				&goImport{path: "wp/billing/proto", line: 4},
+				&goImport{path: "wp/lending/proto", name: "_", line: 5},
+				&goImport{path: "errors", name: "stderrors", line: 6},
+			}},
+		}},
+		"wp/api/proto":     &pkg{name: "wp/api/proto"},
+		"wp/billing/proto": &pkg{name: "wp/billing/proto"},
+		"wp/lending/proto": &pkg{name: "wp/lending/proto"},
+		"errors":           &pkg{name: "errors", goroot: true},
+	})
+
+	defs, err := parse([]byte(`
+config:
+  working_package: wp
+import_aliases:
+  - packages: /proto$
+    alias: pb
+  - packages: <errors>
+    no_alias: true
+`))
+	require.NoError(s.T(), err)
+	require.Equal(s.T(), []string{
+		"- alias      foo/foo.go:4: wp/foo -> wp/billing/proto, must be imported as pb",
+	}, lines(defs.ImportAliases[0].process(g)))
+	require.Equal(s.T(), []string{
+		"- alias      foo/foo.go:6: wp/foo -> <errors>, must not be aliased as stderrors",
+	}, lines(defs.ImportAliases[1].process(g)))
+
+	_, err = parse([]byte(`
+import_aliases:
+  - packages: /proto$
+    alias: pb
+    no_alias: true
+`))
+	require.EqualError(s.T(), err, "import alias for /proto$ must have either an alias or no_alias")
+}
+
+func (s *Zuite) TestParse_exceptPackages() {
+	defs, err := parse([]byte(`
+config:
+  working_package: wp
+rules:
+  - packages: services/.*
+    except: services/internal/.*
+    except_packages:
+      - services/legacy(/.*)?
+      - services/.*/mocks
+`))
+	require.NoError(s.T(), err)
+
+	rule := defs.Rules[0]
+	require.Equal(s.T(), "packages-services-.-except-services-internal-.-except-services-legacy-.-except-services-.-mocks", rule.id())
+	require.True(s.T(), rule.matches(&pkg{name: "wp/services/user"}))
+	require.True(s.T(), rule.matches(&pkg{name: "wp/services/legacyish"}))
+	for _, name := range []string{"wp/services/internal/auth", "wp/services/legacy", "wp/services/legacy/db", "wp/services/user/mocks"} {
+		require.False(s.T(), rule.matches(&pkg{name: name}), name)
+	}
+}
+
+func (s *Zuite) TestParse_caseInsensitive() {
+	config := `
+config:
+  working_package: wp
+  case_insensitive: %t
+rules:
+  - name: vendors
+    packages: services/.*
+    may_not_depend:
+      - ^github.com/azure/
+    deprecated_dependencies:
+      - services/Legacy -> github.com/!azure/go-autorest
+`
+	g := graphOf(map[string]*pkg{
+		"wp/services/legacy":           &pkg{name: "wp/services/legacy"},
+		"wp/services/user":             &pkg{name: "wp/services/user"},
+		"github.com/Azure/go-autorest": &pkg{name: "github.com/Azure/go-autorest"},
+		"github.com/AZURE/sdk":         &pkg{name: "github.com/AZURE/sdk"},
+	},
+		"wp/services/legacy -> github.com/Azure/go-autorest",
+		"wp/services/user -> github.com/AZURE/sdk",
+	)
+
+	defs, err := parse([]byte(fmt.Sprintf(config, true)))
+	require.NoError(s.T(), err)
+	rule := defs.Rules[0]
+	require.True(s.T(), rule.matches(&pkg{name: "wp/Services/user"}))
+	s.requireProcessRuleFullyAndCheck(rule, g, "wp/services/legacy", nil)
+	s.requireProcessRuleFullyAndCheck(rule, g, "wp/services/user", []string{
+		"- disallowed wp/services/user -> github.com/AZURE/sdk",
+		"- missing    wp/services/legacy",
+	})
+
+	// Paths are case sensitive by default, but decoded from the case
+	// encoding of the module cache.
+	defs, err = parse([]byte(fmt.Sprintf(config, false)))
+	require.NoError(s.T(), err)
+	rule = defs.Rules[0]
+	require.False(s.T(), rule.matches(&pkg{name: "wp/Services/user"}))
+	require.Equal(s.T(), map[string]map[string]bool{
+		"wp/services/Legacy": {"github.com/Azure/go-autorest": true},
+	}, rule.expectedPackageToPackage)
+	s.requireProcessRuleFullyAndCheck(rule, g, "wp/services/user", []string{
+		"- missing    wp/services/Legacy",
+	})
+
+	// Layouts and propagations match regardless of case too.
+	defs, err = parse([]byte(`
+config:
+  working_package: wp
+  case_insensitive: true
+layouts:
+  - name: vendors live in clients
+    packages: .*/azure
+    parents:
+      - clients
+propagate:
+  - packages: services/.*
+    dependency: github.com/azure/go-autorest
+`))
+	require.NoError(s.T(), err)
+	g = graphOf(map[string]*pkg{
+		"wp/services/Azure":            &pkg{name: "wp/services/Azure"},
+		"wp/services/user":             &pkg{name: "wp/services/user"},
+		"github.com/Azure/go-autorest": &pkg{name: "github.com/Azure/go-autorest"},
+	},
+		"wp/services/Azure -> github.com/Azure/go-autorest",
+		"wp/services/user -> wp/services/Azure",
+	)
+	require.Equal(s.T(), []string{
+		"- misplaced  wp/services/Azure, expected under clients",
+	}, lines(defs.Layouts[0].process(g)))
+	require.Equal(s.T(), []string{
+		"- swallowed  wp/services/user -> wp/services/Azure, which imports github.com/azure/go-autorest",
+	}, lines(defs.Propagate[0].process(g, defs.isWorking)))
+}
+
+func (s *Zuite) TestUnescapePath() {
+	require.Equal(s.T(), "github.com/Azure/go-autorest", unescapePath("github.com/!azure/go-autorest"))
+	require.Equal(s.T(), "github.com/BurntSushi/toml", unescapePath("github.com/!burnt!sushi/toml"))
+	require.Equal(s.T(), "github.com/pkg/errors", unescapePath("github.com/pkg/errors"))
+	require.Equal(s.T(), "foo!", unescapePath("foo!"))
+	require.Equal(s.T(), "foo!1", unescapePath("foo!1"))
+}
+
+func (s *Zuite) TestParse_rootKeywords() {
+	defs, err := parse([]byte(`
+config:
+  working_package: wp
+rules:
+  - name: main
+    packages: root
+    may_depend:
+      - root
+    deprecated_dependencies:
+      - root -> legacy
+  - name: everything
+    packages: self_module
+    except: root
+    may_not_depend:
+      - self_module
+`))
+	require.NoError(s.T(), err)
+
+	main, everything := defs.Rules[0], defs.Rules[1]
+	require.True(s.T(), main.matches(&pkg{name: "wp"}))
+	require.False(s.T(), main.matches(&pkg{name: "wp/foo"}))
+	require.True(s.T(), main.mayDepends.match(&pkg{name: "wp"}))
+	require.False(s.T(), main.mayDepends.match(&pkg{name: "wpx"}))
+	require.Equal(s.T(), map[string]map[string]bool{"wp": {"wp/legacy": true}}, main.expectedPackageToPackage)
+
+	require.False(s.T(), everything.matches(&pkg{name: "wp"}))
+	require.True(s.T(), everything.matches(&pkg{name: "wp/foo/bar"}))
+	require.False(s.T(), everything.matches(&pkg{name: "wpx/foo"}))
+	require.True(s.T(), everything.mayNotDepends.match(&pkg{name: "wp"}))
+	require.True(s.T(), everything.mayNotDepends.match(&pkg{name: "wp/foo"}))
+	require.False(s.T(), everything.mayNotDepends.match(&pkg{name: "github.com/wp/foo"}))
+}
+
+func (s *Zuite) TestParse_externalSubjects() {
+	defs, err := parse([]byte(`
+config:
+  working_package: wp
+rules:
+  - name: http
+    packages: <net/http(/.*)?>
+    except: <net/http/pprof>
+  - name: fork
+    packages: github.com/org/fork/.*
+  - name: services
+    packages: services/.*
+`))
+	require.NoError(s.T(), err)
+
+	http, fork, services := defs.Rules[0], defs.Rules[1], defs.Rules[2]
+	require.True(s.T(), http.matches(&pkg{name: "net/http/httptest", goroot: true}))
+	require.False(s.T(), http.matches(&pkg{name: "net/http/pprof", goroot: true}))
+	require.False(s.T(), http.matches(&pkg{name: "net/http"}))
+	require.False(s.T(), http.matches(&pkg{name: "wp/net/http"}))
+	require.True(s.T(), fork.matches(&pkg{name: "github.com/org/fork/foo"}))
+	require.False(s.T(), fork.matches(&pkg{name: "wp/github.com/org/fork/foo"}))
+	require.True(s.T(), services.matches(&pkg{name: "wp/services/user"}))
+
+	require.True(s.T(), defs.selectsExternal(&pkg{name: "net/http", goroot: true}))
+	require.True(s.T(), defs.selectsExternal(&pkg{name: "github.com/org/fork/foo"}))
+	require.False(s.T(), defs.selectsExternal(&pkg{name: "wp/services/user"}))
+	require.True(s.T(), defs.needsThirdParties())
+}
+
+func (s *Zuite) TestParse_ruleWorkingPackage() {
+	defs, err := parse([]byte(`
+config:
+  working_package: github.com/org/app
+rules:
+  - name: app
+    packages: .*
+    deprecated_dependencies:
+      - foo -> bar
+  - name: tools
+    working_package: github.com/org/tools
+    packages: .*
+    may_depend:
+      - third_parties
+    deprecated_dependencies:
+      - foo -> bar
+`))
+	require.NoError(s.T(), err)
+
+	app, tools := defs.Rules[0], defs.Rules[1]
+	require.True(s.T(), app.matches(&pkg{name: "github.com/org/app/foo"}))
+	require.False(s.T(), app.matches(&pkg{name: "github.com/org/tools/foo"}))
+	require.Contains(s.T(), app.expectedPackageToPackage, "github.com/org/app/foo")
+	require.False(s.T(), tools.matches(&pkg{name: "github.com/org/app/foo"}))
+	require.True(s.T(), tools.matches(&pkg{name: "github.com/org/tools/foo"}))
+	require.Contains(s.T(), tools.expectedPackageToPackage, "github.com/org/tools/foo")
+	require.False(s.T(), tools.mayDepends.match(&pkg{name: "github.com/org/tools/bar"}))
+	require.True(s.T(), tools.mayDepends.match(&pkg{name: "github.com/org/app/bar"}))
+
+	require.True(s.T(), defs.isWorking("github.com/org/app/foo"))
+	require.True(s.T(), defs.isWorking("github.com/org/tools/foo"))
+	require.False(s.T(), defs.isWorking("github.com/org/lib"))
+}
+
+func (s *Zuite) TestParseFile_rulesDir() {
+	dir, err := ioutil.TempDir("", "depper")
+	require.NoError(s.T(), err)
+	defer os.RemoveAll(dir)
+
+	files := map[string]string{
+		"depper.yaml": `
+config:
+  working_package: wp
+  rules_dir: archrules
+rules:
+  - name: main
+    packages: cmd/.*
+`,
+		"archrules/billing.yaml": `
+rules:
+  - name: no lending
+    packages: billing/.*
+`,
+		"archrules/lending.yaml": `
+rules:
+  - name: no billing
+    packages: lending/.*
+`,
+		"archrules/README.md": `not a rule file`,
 	}
+	s.writeFiles(dir, files)
+
+	defs, err := parseFile(filepath.Join(dir, "depper.yaml"))
+	require.NoError(s.T(), err)
+	require.Len(s.T(), defs.Rules, 3)
+	require.Equal(s.T(), "main", defs.Rules[0].Name)
+	require.Equal(s.T(), "billing: no lending", defs.Rules[1].Name)
+	require.Equal(s.T(), "lending: no billing", defs.Rules[2].Name)
+	require.True(s.T(), defs.Rules[1].matches(&pkg{name: "wp/billing/invoices"}))
+
+	// Rules tell which file they were read from.
+	var buf bytes.Buffer
+	writeRules(&buf, defs)
+	require.Equal(s.T(), "main (main) from "+filepath.Join(dir, "depper.yaml")+"\n"+
+		"billing: no lending (billing-no-lending) from "+filepath.Join(dir, "archrules/billing.yaml")+"\n"+
+		"lending: no billing (lending-no-billing) from "+filepath.Join(dir, "archrules/lending.yaml")+"\n", buf.String())
+
+	defs.Rules[1].MayNotDepend = []string{"lending/.*"}
+	require.NoError(s.T(), defs.compile())
+	report := defs.check(graphOf(map[string]*pkg{
+		"wp/billing/invoices": &pkg{name: "wp/billing/invoices"},
+		"wp/lending/loans":    &pkg{name: "wp/lending/loans"},
+	}, "wp/billing/invoices -> wp/lending/loans"), nil, false)
+	require.Equal(s.T(), filepath.Join(dir, "archrules/billing.yaml"), report.Sections[1].Source)
+	buf.Reset()
+	require.NoError(s.T(), writeText(&buf, report, false, true))
+	require.Equal(s.T(), "billing: no lending (1 violation, from "+filepath.Join(dir, "archrules/billing.yaml")+")\n"+
+		"- disallowed wp/billing/invoices -> wp/lending/loans\n", buf.String())
+}
+
+func (s *Zuite) TestParseFile_loadPatterns() {
+	path := filepath.Join(s.cwd, "depper.yaml")
+	require.NoError(s.T(), ioutil.WriteFile(path, []byte(`
+config:
+  working_package: `+p("sample_deps")+`
+  load_patterns:
+    - ./b/...
+    - `+p("sample_deps/a")+`
+`), 0644))
+	defer os.Remove(path)
+
+	// Relative patterns are relative to the config file.
+	defs, err := parseFile(path)
+	require.NoError(s.T(), err)
+	require.Equal(s.T(), []string{filepath.Join(s.cwd, "b") + "/...", p("sample_deps/a")}, defs.Config.LoadPatterns)
+
+	// Only packages reached from the patterns are loaded.
+	g, err := defs.collectPackages(filepath.Join(s.cwd, "a"), defs.Config.LoadPatterns, nil)
+	require.NoError(s.T(), err)
+	require.Equal(s.T(), []string{p("sample_deps/b"), p("sample_deps/a")}, g.roots)
+	require.Nil(s.T(), g.pkgs[p("sample_deps")])
+	require.Equal(s.T(), []string{p("sample_deps/a")}, names(g.dependenciesOf(p("sample_deps/b"))))
+}
+
+func (s *Zuite) TestPackageNames() {
+	userModel := &pkg{name: "wp/user/model", pkgName: "model"}
+	userService := &pkg{name: "wp/user/service", pkgName: "service"}
+	billingModel := &pkg{name: "wp/billing/model", pkgName: "model"}
+	legacy := &pkg{name: "wp/legacy/service_v1", pkgName: "service"}
+
+	defs, err := parse([]byte(`
+config:
+  working_package: wp
+rules:
+  - name: models
+    package_name: model
+    may_depend:
+      - name:model
+`))
+	require.NoError(s.T(), err)
+
+	rule := defs.Rules[0]
+	require.True(s.T(), rule.matches(userModel))
+	require.True(s.T(), rule.matches(billingModel))
+	require.False(s.T(), rule.matches(userService))
+	require.True(s.T(), rule.mayDepends.patterns[0].match(billingModel))
+	require.False(s.T(), rule.mayDepends.patterns[0].match(legacy))
+	require.False(s.T(), rule.mayDepends.patterns[0].match(&pkg{name: "wp/models", pkgName: "models"}))
+	require.Equal(s.T(), "name:model", rule.mayDepends.patterns[0].String())
+}
+
+func (s *Zuite) TestProcessLayouts() {
+	g := graphOf(map[string]*pkg{
+		"wp/dal/user_repo":          &pkg{name: "wp/dal/user_repo", pkgName: "user_repo"},
+		"wp/dal/billing/card_repo":  &pkg{name: "wp/dal/billing/card_repo", pkgName: "card_repo"},
+		"wp/services/invoice_repo":  &pkg{name: "wp/services/invoice_repo", pkgName: "invoice_repo"},
+		"wp/services/invoice":       &pkg{name: "wp/services/invoice", pkgName: "invoice"},
+		"github.com/org/other_repo": &pkg{name: "github.com/org/other_repo", pkgName: "other_repo"},
+	})
+
+	defs, err := parse([]byte(`
+config:
+  working_package: wp
+layouts:
+  - name: repositories live in the data access layer
+    package_name: .*_repo
+    parents:
+      - dal
+    depth: 2
+`))
+	require.NoError(s.T(), err)
+	layout := defs.Layouts[0]
+	require.Equal(s.T(), []string{
+		"- misplaced  wp/dal/billing/card_repo, expected at depth 2 but was 3",
+		"- misplaced  wp/services/invoice_repo, expected under dal",
+	}, lines(layout.process(g)))
+
+	_, err = parse([]byte(`
+layouts:
+  - name: nothing expected
+    packages: .*
+`))
+	require.EqualError(s.T(), err, "layout nothing expected must have parents or a depth")
+}
+
+func (s *Zuite) TestProcessAcyclicGroups() {
+	layers := func(deps ...string) *graph {
+		pkgs := make(map[string]*pkg)
+		for _, name := range []string{"wp/api/users", "wp/api/util", "wp/service/users", "wp/dal/users", "wp/util"} {
+			pkgs[name] = &pkg{name: name}
+		}
+		return graphOf(pkgs, deps...)
+	}
+	deps := []string{
+		"wp/api/users -> wp/service/users",
+		"wp/service/users -> wp/dal/users",
+		"wp/service/users -> wp/util",
+		"wp/api/users -> wp/api/util",
+		"wp/dal/users -> wp/api/util",
+	}
+
+	defs, err := parse([]byte(`
+config:
+  working_package: wp
+acyclic_groups:
+  - name: layers
+    groups:
+      api: api/.*
+      service: service/.*
+      dal: dal/.*
+`))
+	require.NoError(s.T(), err)
+	acyclic := defs.AcyclicGroups[0]
+	require.Equal(s.T(), []string{
+		"- cycle      wp/api/users -> wp/service/users, along api -> service -> dal -> api",
+		"- cycle      wp/service/users -> wp/dal/users, along api -> service -> dal -> api",
+		"- cycle      wp/dal/users -> wp/api/util, along api -> service -> dal -> api",
+	}, lines(acyclic.process(layers(deps...))))
+
+	// Without the dal -> api edge, there is no cycle.
+	require.Empty(s.T(), acyclic.process(layers(deps[:len(deps)-1]...)))
+}
+
+func (s *Zuite) TestProcessIndependence() {
+	g := graphOf(map[string]*pkg{
+		"wp/billing/invoices": &pkg{name: "wp/billing/invoices"},
+		"wp/billing/payments": &pkg{name: "wp/billing/payments"},
+		"wp/lending/loans":    &pkg{name: "wp/lending/loans"},
+		"wp/lending/rates":    &pkg{name: "wp/lending/rates"},
+		"wp/shared/money":     &pkg{name: "wp/shared/money"},
+		"wp/shared/ledger":    &pkg{name: "wp/shared/ledger"},
+	},
+		"wp/billing/invoices -> wp/billing/payments",
+		"wp/billing/invoices -> wp/shared/money",
+		"wp/billing/payments -> wp/shared/ledger",
+		"wp/shared/ledger -> wp/lending/rates",
+		"wp/lending/loans -> wp/billing/payments",
+		"wp/lending/loans -> wp/lending/rates",
+		"wp/lending/rates -> wp/shared/money",
+	)
+
+	defs, err := parse([]byte(`
+config:
+  working_package: wp
+independent:
+  - groups:
+      - billing/.*
+      - lending/.*
+`))
+	require.NoError(s.T(), err)
+	independence := defs.Independent[0]
+	require.Equal(s.T(), "independence of billing/.*, lending/.*", independence.name())
+
+	// Dependencies are reported in either direction, from the package of the
+	// group closest to the other group.
+	require.Equal(s.T(), []string{
+		"- dependent  wp/billing/payments -> wp/lending/rates, via wp/shared/ledger",
+		"- dependent  wp/lending/loans -> wp/billing/payments",
+	}, lines(independence.process(g)))
+
+	_, err = parse([]byte(`
+independent:
+  - name: alone
+    groups:
+      - billing/.*
+`))
+	require.EqualError(s.T(), err, "independence alone must have at least two groups")
+}
+
+func (s *Zuite) TestProcessPropagation() {
+	g := graphOf(map[string]*pkg{
+		"wp/api/users":     &pkg{name: "wp/api/users"},
+		"wp/api/health":    &pkg{name: "wp/api/health"},
+		"wp/api/billing":   &pkg{name: "wp/api/billing"},
+		"wp/service/users": &pkg{name: "wp/service/users"},
+		"wp/service/money": &pkg{name: "wp/service/money"},
+		"wp/dal":           &pkg{name: "wp/dal"},
+		"context":          &pkg{name: "context", goroot: true},
+		"net/http":         &pkg{name: "net/http", goroot: true},
+	},
+		"wp/api/users -> wp/service/users",
+		"wp/api/users -> net/http",
+		"wp/api/health -> net/http",
+		"wp/api/billing -> wp/service/money",
+		"wp/api/billing -> context",
+		"wp/service/users -> wp/dal",
+		"wp/service/money -> wp/dal",
+		"wp/dal -> context",
+		"net/http -> context",
+	)
+
+	defs, err := parse([]byte(`
+config:
+  working_package: wp
+propagate:
+  - packages: (api|service)/.*
+    dependency: <context>
+  - name: handlers
+    packages: api/.*
+    downstream: dal
+    dependency: <context>
+`))
+	require.NoError(s.T(), err)
+	require.Equal(s.T(), "propagation of <context> by (api|service)/.*", defs.Propagate[0].name())
+
+	// Only downstream working packages importing the dependency are
+	// reported, rather than third parties or the standard library.
+	require.Equal(s.T(), []string{
+		"- swallowed  wp/service/money -> wp/dal, which imports <context>",
+		"- swallowed  wp/service/users -> wp/dal, which imports <context>",
+	}, lines(defs.Propagate[0].process(g, defs.isWorking)))
+	require.Empty(s.T(), defs.Propagate[1].process(g, defs.isWorking))
+
+	_, err = parse([]byte(`
+propagate:
+  - name: contexts
+    packages: api/.*
+`))
+	require.EqualError(s.T(), err, "propagation contexts must have packages and a dependency")
+}
+
+func (s *Zuite) TestParse_externalExpectations() {
+	defs, err := parse([]byte(`
+config:
+  working_package: github.com/org/app
+rules:
+  - name: legacy
+    packages: legacy/.*
+    deprecated_dependencies:
+      - <net/rpc>
+      - github.com/pkg/errors
+      - util
+      - legacy/server -> <log>
+      - legacy/server -> gopkg.in/yaml.v2
+`))
+	require.NoError(s.T(), err)
+
+	rule := defs.Rules[0]
+	require.Equal(s.T(), map[string]bool{
+		"net/rpc":                 true,
+		"github.com/pkg/errors":   true,
+		"github.com/org/app/util": true,
+	}, rule.expectedStarToPackage)
+	require.Equal(s.T(), map[string]map[string]bool{
+		"github.com/org/app/legacy/server": map[string]bool{
+			"log":              true,
+			"gopkg.in/yaml.v2": true,
+		},
+	}, rule.expectedPackageToPackage)
+
+	g := graphOf(map[string]*pkg{
+		"github.com/org/app/legacy/server": &pkg{name: "github.com/org/app/legacy/server"},
+		"log":                              &pkg{name: "log", goroot: true},
+		"gopkg.in/yaml.v2":                 &pkg{name: "gopkg.in/yaml.v2"},
+		"net/rpc":                          &pkg{name: "net/rpc", goroot: true},
+	},
+		"github.com/org/app/legacy/server -> log",
+		"github.com/org/app/legacy/server -> gopkg.in/yaml.v2",
+		"github.com/org/app/legacy/server -> net/rpc",
+	)
+	result := newRuleResult()
+	rule.process(g, g.pkgs["github.com/org/app/legacy/server"], result)
+	require.Equal(s.T(), []string{
+		"- expected   github.com/org/app/legacy/server -> github.com/org/app/util",
+		"- expected   github.com/org/app/legacy/server -> github.com/pkg/errors",
+	}, sortedStrings(lines(result.violations)))
+}
+
+func (s *Zuite) TestParse_explicitExpectations() {
+	defs, err := parse([]byte(`
+config:
+  working_package: github.com/org/app
+rules:
+  - name: legacy
+    packages: legacy/.*
+    deprecated_dependencies:
+      - path:sample_deps/util
+      - legacy/server -> path:api.v2
+      - legacy/server -> path:github\.com/(pkg|go-errors)/errors
+      - path:github.com/org/.*/legacy/.* -> path:gopkg\.in/.*
+`))
+	require.NoError(s.T(), err)
+
+	rule := defs.Rules[0]
+	require.Equal(s.T(), map[string]bool{"sample_deps/util": true}, rule.expectedStarToPackage)
+	require.Equal(s.T(), map[string]map[string]bool{
+		"github.com/org/app/legacy/server": map[string]bool{"api.v2": true},
+	}, rule.expectedPackageToPackage)
+	require.Len(s.T(), rule.expectedPatterns, 2)
+	errors, yaml := rule.expectedPatterns[0], rule.expectedPatterns[1]
+	require.True(s.T(), errors.from.MatchString("github.com/org/app/legacy/server"))
+	require.True(s.T(), errors.to.MatchString("github.com/go-errors/errors"))
+	require.False(s.T(), errors.to.MatchString("github.com/org/app/github.com/pkg/errors"))
+	require.True(s.T(), yaml.from.MatchString("github.com/org/lib/legacy/server"))
+	require.True(s.T(), yaml.to.MatchString("gopkg.in/yaml.v2"))
+}
+
+func (s *Zuite) TestProcessRule_exercised() {
+	g := sampleGraph()
+	r := &rule{
+		expectedStarToPackage: map[string]bool{
+			"bar": true,
+		},
+		expectedPackageToPackage: map[string]map[string]bool{
+			"bar": map[string]bool{
+				"baz": true,
+			},
+		},
+	}
+	require.Equal(s.T(), []string{"bar -> baz", "foo -> bar"}, sortedStrings(r.check(g).exercised))
+}
+
+func (s *Zuite) TestProcessRule_expectedPatterns() {
+	g := sampleGraph()
+	g.depend(g.pkgs["foo"], g.add(&pkg{name: "qux"}))
+
+	cases := map[string][]string{
+		"foo": []string{
+			"- disallowed foo -> bar",
+			"- expected   ba.* -> ba.*",
+		},
+		"bar": []string{
+			"- expected   qu.*",
+		},
+		"baz": []string{
+			"- expected   qu.*",
+			"- expected   ba.* -> ba.*",
+		},
+	}
+	for pkgName, expectedViolations := range cases {
+		r := &rule{
+			expectedPatterns: []*expectedPattern{
+				&expectedPattern{expr: "qu.*", to: regexp.MustCompile("^qu.*$")},
+				&expectedPattern{expr: "ba.* -> ba.*", from: regexp.MustCompile("^ba.*$"), to: regexp.MustCompile("^ba.*$")},
+			},
+		}
+		s.requireProcessRuleFullyAndCheck(r, g, pkgName, expectedViolations)
+	}
+}
+
+func (s *Zuite) TestParse_expectedPatterns() {
+	defs, err := parse([]byte(`
+config:
+  working_package: github.com/org/app
+rules:
+  - name: legacy
+    packages: legacy(/.*)?
+    deprecated_dependencies:
+      - server/.*
+      - legacy/.* -> <net/.*>
+      - legacy -> github.com/gorilla/.*
+      - legacy/old
+`))
+	require.NoError(s.T(), err)
+
+	rule := defs.Rules[0]
+	require.Equal(s.T(), map[string]bool{"github.com/org/app/legacy/old": true}, rule.expectedStarToPackage)
+	require.Len(s.T(), rule.expectedPatterns, 3)
+
+	star, std, gorilla := rule.expectedPatterns[0], rule.expectedPatterns[1], rule.expectedPatterns[2]
+	require.Nil(s.T(), star.from)
+	require.True(s.T(), star.to.MatchString("github.com/org/app/server/users"))
+	require.False(s.T(), star.to.MatchString("github.com/org/app/legacy/server/users"))
+	require.True(s.T(), std.from.MatchString("github.com/org/app/legacy/a"))
+	require.False(s.T(), std.from.MatchString("github.com/org/app/legacy"))
+	require.True(s.T(), std.to.MatchString("net/http"))
+	require.True(s.T(), gorilla.from.MatchString("github.com/org/app/legacy"))
+	require.False(s.T(), gorilla.from.MatchString("github.com/org/app/legacy/a"))
+	require.True(s.T(), gorilla.to.MatchString("github.com/gorilla/mux"))
+}
+
+func (s *Zuite) TestCheck() {
+	defs, err := parse([]byte(`
+config:
+  working_package: wp
+rules:
+  - name: services
+    packages: services/.*
+    may_depend:
+      - util
+    deprecated_dependencies:
+      - <log>
+      - legacy/.*
+equivalence_groups:
+  uuid:
+    - github.com/google/uuid
+    - github.com/gofrs/uuid
+`))
+	require.NoError(s.T(), err)
+
+	servicesGraph := func(service string) *graph {
+		g := graphOf(map[string]*pkg{
+			"wp/services/" + service: &pkg{name: "wp/services/" + service},
+			"wp/util":                &pkg{name: "wp/util"},
+			"wp/legacy/db":           &pkg{name: "wp/legacy/db"},
+			"wp/dal":                 &pkg{name: "wp/dal"},
+			"log":                    &pkg{name: "log", goroot: true},
+			"github.com/google/uuid": &pkg{name: "github.com/google/uuid"},
+		})
+		for _, dep := range []string{"wp/util", "wp/legacy/db", "wp/dal", "log", "github.com/google/uuid"} {
+			g.depend(g.pkgs["wp/services/"+service], g.pkgs[dep])
+		}
+		return g
+	}
+
+	expected := func(service string) *report {
+		report := &report{
+			Sections: []*section{
+				&section{
+					ID:       "services",
+					Name:     "services",
+					Severity: severityError,
+					Violations: []*violation{
+						&violation{Rule: "services", RuleID: "services", Kind: kindDisallowed, From: "wp/services/" + service, To: "github.com/google/uuid"},
+						&violation{Rule: "services", RuleID: "services", Kind: kindDisallowed, From: "wp/services/" + service, To: "wp/dal"},
+					},
+					Exercised: []string{
+						"wp/services/" + service + " -> <log>",
+						"wp/services/" + service + " -> wp/legacy/db",
+					},
+				},
+				&section{
+					ID:         "equivalence-group-uuid",
+					Name:       "equivalence group uuid",
+					Severity:   severityError,
+					Violations: []*violation{},
+				},
+			},
+			Errors: 2,
+		}
+		for _, v := range report.violations() {
+			v.ID = v.fingerprint()
+		}
+		return report
+	}
+
+	// Checking repeatedly, and concurrently, does not carry results over.
+	var wg sync.WaitGroup
+	reports := make([]*report, 10)
+	for i := range reports {
+		wg.Add(1)
+		go func(i int) {
+			defer wg.Done()
+			reports[i] = defs.check(servicesGraph(fmt.Sprint(i)), nil, true)
+		}(i)
+	}
+	wg.Wait()
+	for i, report := range reports {
+		violations := report.Sections[0].Violations
+		sort.Slice(violations, func(i, j int) bool { return violations[i].To < violations[j].To })
+		require.Equal(s.T(), expected(fmt.Sprint(i)), report)
+	}
+}
+
+func (s *Zuite) TestCheck_parallel() {
+	var defs defs
+	defs.Config.WorkingPackage = "wp"
+	pkgs := make(map[string]*pkg)
+	var deps []string
+	for i := 0; i < 20; i++ {
+		name := fmt.Sprintf("wp/services/s%d", i)
+		pkgs[name] = &pkg{name: name}
+		defs.Rules = append(defs.Rules, &rule{
+			Name:      fmt.Sprintf("services %d", i),
+			selector:  selector{Packages: fmt.Sprintf("services/s%d", i)},
+			MayDepend: []string{fmt.Sprintf("services/s%d", i+1)},
+		})
+		if i != 0 {
+			deps = append(deps, fmt.Sprintf("wp/services/s%d -> wp/services/s%d", i, i-1))
+		}
+		if i != 19 {
+			deps = append(deps, fmt.Sprintf("wp/services/s%d -> wp/services/s%d", i, i+1))
+		}
+	}
+	require.NoError(s.T(), defs.compile())
+	g := graphOf(pkgs, deps...)
+
+	// Rules are reported in order, however many are checked concurrently.
+	defs.parallelism = 1
+	sequential := defs.check(g, nil, true)
+	require.Len(s.T(), sequential.Sections, 20)
+	require.Equal(s.T(), 19, sequential.Errors)
+	for i, section := range sequential.Sections {
+		require.Equal(s.T(), fmt.Sprintf("services %d", i), section.Name)
+	}
+	for _, parallelism := range []int{0, 4, 100} {
+		defs.parallelism = parallelism
+		require.Equal(s.T(), sequential, defs.check(g, nil, true))
+	}
+}
+
+func (s *Zuite) TestParallel() {
+	for _, workers := range []int{0, 1, 3, 100} {
+		var (
+			mu     sync.Mutex
+			called = make(map[int]int)
+		)
+		parallel(workers, 10, func(i int) {
+			mu.Lock()
+			defer mu.Unlock()
+			called[i]++
+		})
+		require.Len(s.T(), called, 10)
+		for i := 0; i < 10; i++ {
+			require.Equal(s.T(), 1, called[i])
+		}
+	}
+	parallel(0, 0, func(i int) {
+		s.T().Fatal("called without anything to do")
+	})
+}
+
+func (s *Zuite) TestFailing() {
+	cases := []struct {
+		errors, warnings int
+		failOn           string
+		maxViolations    int
+		expected         bool
+	}{
+		{0, 0, "error", 0, false},
+		{1, 0, "error", 0, true},
+		{0, 1, "error", 0, false},
+		{0, 1, "warn", 0, true},
+		{2, 1, "error", 2, false},
+		{2, 1, "warn", 2, true},
+		{3, 0, "error", 2, true},
+		{3, 3, "never", 0, false},
+	}
+	for _, c := range cases {
+		require.Equalf(s.T(), c.expected, failing(c.errors, c.warnings, c.failOn, c.maxViolations), "%+v", c)
+	}
+}
+
+func (s *Zuite) TestParse_severity() {
+	defs, err := parse([]byte(`
+rules:
+  - name: default
+    packages: .*
+  - name: warn
+    packages: .*
+    severity: warn
+`))
+	require.NoError(s.T(), err)
+	require.Equal(s.T(), "error", defs.Rules[0].Severity)
+	require.Equal(s.T(), "warn", defs.Rules[1].Severity)
+
+	_, err = parse([]byte(`
+rules:
+  - name: unknown
+    packages: .*
+    severity: fatal
+`))
+	require.EqualError(s.T(), err, "invalid config, rules[0].severity: must be one of error, warn")
+	defs.Rules = []*rule{&rule{Name: "unknown", selector: selector{Packages: ".*"}, Severity: "fatal"}}
+	require.EqualError(s.T(), defs.compile(), "rule unknown has unknown severity fatal")
+}
+
+func (s *Zuite) TestProcessRule_mayNotDependOnBaz() {
+	g := sampleGraph()
+
+	cases := map[string][]string{
+		"foo": nil,
+		"bar": []string{
+			"- disallowed bar -> baz",
+		},
+		"baz": nil,
+	}
+	for pkgName, expectedViolations := range cases {
+		r := &rule{
+			mayNotDepends: newPkgpatternSet(
+				&pkgpattern{pattern: regexp.MustCompile("baz")},
+			),
+		}
+		s.requireProcessRuleFullyAndCheck(r, g, pkgName, expectedViolations)
+	}
+}
+
+func (s *Zuite) TestProcessRule_mayDependOnBaMayNotDependOnBaz() {
+	g := sampleGraph()
+
+	cases := map[string][]string{
+		"foo": nil,
+		"bar": []string{
+			"- disallowed bar -> baz",
+		},
+		"baz": nil,
+	}
+	for pkgName, expectedViolations := range cases {
+		r := &rule{
+			mayDepends: newPkgpatternSet(
+				&pkgpattern{pattern: regexp.MustCompile("ba")},
+			),
+			mayNotDepends: newPkgpatternSet(
+				&pkgpattern{pattern: regexp.MustCompile("baz")},
+			),
+		}
+		s.requireProcessRuleFullyAndCheck(r, g, pkgName, expectedViolations)
+	}
+}
+
+func (s *Zuite) TestProcessRule_exclusive() {
+	g := sampleGraph()
+
+	// Exclusive rules only allow what they may depend on, even when only
+	// listing what they may not depend on.
+	cases := map[string][]string{
+		"foo": []string{
+			"- disallowed foo -> bar",
+		},
+		"bar": []string{
+			"- disallowed bar -> baz",
+		},
+		"baz": nil,
+	}
+	for pkgName, expectedViolations := range cases {
+		r := &rule{
+			Exclusive: true,
+			mayNotDepends: newPkgpatternSet(
+				&pkgpattern{pattern: regexp.MustCompile("baz")},
+			),
+		}
+		s.requireProcessRuleFullyAndCheck(r, g, pkgName, expectedViolations)
+	}
+
+	// They are never mere warnings.
+	defs := &defs{Rules: []*rule{&rule{Name: "crypto", selector: selector{Packages: "crypto"}, Exclusive: true, Severity: severityWarn}}}
+	require.EqualError(s.T(), defs.compile(), "exclusive rule crypto must have severity error")
+}
+
+func (s *Zuite) TestProcessRule_allowComments() {
+	g := graphOf(map[string]*pkg{
+		"foo": &pkg{name: "foo", files: []*goFile{
+			&goFile{name: "foo/foo.go", imports: []*goImport{
+				&goImport{path: "bar", line: 3, allow: "reporting predates the dal"},
+				&goImport{path: "baz", line: 4},
+			}},
+			&goFile{name: "foo/other.go", imports: []*goImport{
+				&goImport{path: "baz", line: 3, allow: "only in this file"},
+			}},
+		}},
+		"bar": &pkg{name: "bar"},
+		"baz": &pkg{name: "baz"},
+	}, "foo -> bar", "foo -> baz")
+
+	// Dependencies are suppressed when all of their imports are.
+	r := &rule{}
+	s.requireProcessRuleFullyAndCheck(r, g, "foo", []string{
+		"- disallowed foo -> baz",
+	})
+
+	// Exclusive rules take no suppressions.
+	r = &rule{Exclusive: true}
+	s.requireProcessRuleFullyAndCheck(r, g, "foo", []string{
+		"- disallowed foo -> bar",
+		"- disallowed foo -> baz",
+	})
+}
+
+func (s *Zuite) TestProcessRule_mustDepend() {
+	g := graphOf(map[string]*pkg{
+		"wp/cmd/api":                 &pkg{name: "wp/cmd/api"},
+		"wp/cmd/worker":              &pkg{name: "wp/cmd/worker"},
+		"wp/platform/telemetry/init": &pkg{name: "wp/platform/telemetry/init"},
+		"wp/util":                    &pkg{name: "wp/util"},
+	}, "wp/cmd/api -> wp/platform/telemetry/init", "wp/cmd/api -> wp/util", "wp/cmd/worker -> wp/util")
+
+	defs, err := parse([]byte(`
+config:
+  working_package: wp
+rules:
+  - name: mains
+    packages: cmd/.*
+    must_depend:
+      - platform/telemetry/init
+  - name: exclusive mains
+    packages: cmd/.*
+    may_depend:
+      - util
+    must_depend:
+      - platform/telemetry/init
+    exclusive: true
+`))
+	require.NoError(s.T(), err)
+
+	// Rules only listing requirements allow everything else, and
+	// requirements are allowed even when not listed in may_depend.
+	for _, rule := range defs.Rules {
+		require.Equal(s.T(), []string{
+			"- required   wp/cmd/worker -> platform/telemetry/init",
+		}, lines(rule.check(g).violations), rule.Name)
+	}
+}
+
+func (s *Zuite) TestProcessRule_generatedProtos() {
+	g := graphOf(map[string]*pkg{
+		"wp/billing/adapters": &pkg{name: "wp/billing/adapters"},
+		"wp/billing/service":  &pkg{name: "wp/billing/service"},
+		"wp/billing/billingpb": &pkg{name: "wp/billing/billingpb", files: []*goFile{
+			{name: "billing/billingpb/billing.pb.go", imports: []*goImport{{path: "google.golang.org/protobuf/runtime/protoimpl"}}},
+		}},
+		"google.golang.org/genproto/googleapis/type/money": &pkg{name: "google.golang.org/genproto/googleapis/type/money"},
+		"google.golang.org/protobuf/runtime/protoimpl":     &pkg{name: "google.golang.org/protobuf/runtime/protoimpl"},
+	},
+		"wp/billing/adapters -> wp/billing/billingpb",
+		"wp/billing/adapters -> google.golang.org/genproto/googleapis/type/money",
+		"wp/billing/service -> wp/billing/adapters",
+		"wp/billing/service -> google.golang.org/genproto/googleapis/type/money",
+		"wp/billing/billingpb -> google.golang.org/protobuf/runtime/protoimpl",
+	)
+
+	defs, err := parse([]byte(`
+config:
+  working_package: wp
+rules:
+  - name: only adapters import protos
+    packages: .*
+    except: .*/adapters
+    may_not_depend:
+      - generated_protos
+  - name: protos only import the runtime
+    generated_protos: true
+    may_depend:
+      - google.golang.org/protobuf/.*
+`))
+	require.NoError(s.T(), err)
+
+	require.Equal(s.T(), []string{
+		"- disallowed wp/billing/service -> google.golang.org/genproto/googleapis/type/money",
+	}, lines(defs.Rules[0].check(g).violations))
+	require.Empty(s.T(), lines(defs.Rules[1].check(g).violations))
+	require.Equal(s.T(), "generated_protos", defs.Rules[0].mayNotDepends.patterns[0].String())
+}
+
+func (s *Zuite) TestParseInlineRule() {
+	rule, err := parseInlineRule("services/.* !> dal/.*, <database/sql>")
+	require.NoError(s.T(), err)
+	require.Equal(s.T(), "services/.* !> dal/.*, <database/sql>", rule.Name)
+	require.Equal(s.T(), "services/.*", rule.Packages)
+	require.Equal(s.T(), []string{"dal/.*", "<database/sql>"}, rule.MayNotDepend)
+	require.Empty(s.T(), rule.MayDepend)
+
+	rule, err = parseInlineRule("util/.* -> <.*>")
+	require.NoError(s.T(), err)
+	require.Equal(s.T(), "util/.*", rule.Packages)
+	require.Equal(s.T(), []string{"<.*>"}, rule.MayDepend)
+	require.Empty(s.T(), rule.MayNotDepend)
+
+	rule, err = parseInlineRule("util/.* ->")
+	require.NoError(s.T(), err)
+	require.Empty(s.T(), rule.MayDepend)
+
+	_, err = parseInlineRule("util/.*")
+	require.EqualError(s.T(), err, "malformed rule util/.*, must be packages -> dependencies or packages !> dependencies")
+	_, err = parseInlineRule(" !> dal")
+	require.Error(s.T(), err)
+}
+
+func (s *Zuite) TestFilterRules() {
+	names := func(only, skip globs) []string {
+		defs := &defs{}
+		for _, name := range []string{"services", "services/user", "dal", "dal/mongo", "util"} {
+			defs.Rules = append(defs.Rules, &rule{Name: name})
+		}
+		require.NoError(s.T(), defs.filterRules(only, skip))
+		var names []string
+		for _, rule := range defs.Rules {
+			names = append(names, rule.Name)
+		}
+		return names
+	}
+	require.Equal(s.T(), []string{"services", "services/user", "dal", "dal/mongo", "util"}, names(nil, nil))
+	require.Equal(s.T(), []string{"services", "services/user"}, names(globs{"services*"}, nil))
+	require.Equal(s.T(), []string{"services/user", "dal/mongo"}, names(globs{"*/*"}, nil))
+	require.Equal(s.T(), []string{"services/user", "dal/mongo"}, names(globs{"????????/user", "dal/*"}, nil))
+	require.Equal(s.T(), []string{"services", "dal", "util"}, names(nil, globs{"*/*"}))
+	require.Equal(s.T(), []string{"dal"}, names(globs{"dal*"}, globs{"*/*"}))
+
+	// Names matching no rule are likely mistaken.
+	defs := &defs{Rules: []*rule{&rule{Name: "services"}}}
+	require.EqualError(s.T(), defs.filterRules(globs{"service"}, nil), "no rule named service")
+	require.NoError(s.T(), defs.filterRules(nil, globs{"service"}))
+
+	// Rules are also named by ID.
+	defs.Rules = []*rule{&rule{Name: "Services", ID: "svc"}, &rule{Name: "billing: no db"}}
+	require.NoError(s.T(), defs.filterRules(globs{"svc", "billing-*"}, nil))
+	require.Len(s.T(), defs.Rules, 2)
+	require.NoError(s.T(), defs.filterRules(nil, globs{"billing-no-db"}))
+	require.Equal(s.T(), "Services", defs.Rules[0].Name)
+}
+
+func (s *Zuite) TestRuleIDs() {
+	for input, expected := range map[string]string{
+		"services":                        "services",
+		"billing: no db":                  "billing-no-db",
+		"Sample_deps/a -> sample_deps/b ": "sample_deps-a-sample_deps-b",
+		"  v1.2 API!":                     "v1.2-api",
+		"._hidden":                        "hidden",
+	} {
+		require.Equal(s.T(), expected, slugify(input), input)
+	}
+	require.Equal(s.T(), "packages-services-.-package_name-repo", (&rule{selector: selector{Packages: "services/.*", PackageName: "repo"}}).id())
+
+	compile := func(rules ...*rule) error {
+		return (&defs{Rules: rules}).compile()
+	}
+	services := &rule{Name: "Services", selector: selector{Packages: "services"}}
+	require.NoError(s.T(), compile(services))
+	require.Equal(s.T(), "services", services.ID)
+	require.EqualError(s.T(),
+		compile(&rule{Name: "services", selector: selector{Packages: "services"}}, &rule{Name: "Services!", selector: selector{Packages: "services"}}),
+		"rules services and Services! have the same id services, name them apart or set their id")
+	require.NoError(s.T(),
+		compile(&rule{Name: "services", selector: selector{Packages: "services"}}, &rule{ID: "services-again", Name: "services", selector: selector{Packages: "services"}}))
+	require.EqualError(s.T(),
+		compile(&rule{ID: "Services", selector: selector{Packages: "services"}}),
+		"rule id Services is malformed, must be lowercase letters, digits, '.', '_' or '-'")
+}
+
+func (s *Zuite) TestFindRule() {
+	nodb := &rule{Name: "billing: no db", selector: selector{Packages: "billing/.*"}}
+	api := &rule{ID: "api", Name: "API layering", selector: selector{Packages: "api/.*"}}
+	defs := &defs{Rules: []*rule{nodb, api}}
+	for name, expected := range map[string]*rule{
+		"billing: no db": nodb,
+		"billing-no-db":  nodb,
+		"api":            api,
+		"api-layering":   api,
+		"API layering":   api,
+		"billing":        nil,
+	} {
+		require.Equal(s.T(), expected, defs.findRule(name), name)
+	}
+}
+
+func (s *Zuite) TestRequirementPath() {
+	dir, err := ioutil.TempDir("", "depper")
+	require.NoError(s.T(), err)
+	defer os.RemoveAll(dir)
+
+	files := map[string]string{
+		"app/go.mod": "module example.com/app\n\nrequire example.com/lib v0.1.0\n\nreplace example.com/lib => ../lib\n\nreplace example.com/dep => ../dep\n",
+		"lib/go.mod": "module example.com/lib\n\nrequire example.com/dep v0.2.0\n",
+		"dep/go.mod": "module example.com/dep\n",
+	}
+	s.writeFiles(dir, files)
+
+	var defs defs
+	cfg := defs.loadConfig(filepath.Join(dir, "app"), nil)
+	path, err := requirementPath(cfg, "example.com/dep")
+	require.NoError(s.T(), err)
+	require.Equal(s.T(), []string{"example.com/app", "example.com/lib@v0.1.0", "example.com/dep@v0.2.0"}, path)
+	path, err = requirementPath(cfg, "example.com/other")
+	require.NoError(s.T(), err)
+	require.Nil(s.T(), path)
+}
+
+func (s *Zuite) TestFindConfig() {
+	dir, err := ioutil.TempDir("", "depper")
+	require.NoError(s.T(), err)
+	defer os.RemoveAll(dir)
+
+	for _, name := range []string{"outer/depper.yaml", "outer/module/go.mod", "outer/module/a/b/README.md"} {
+		path := filepath.Join(dir, name)
+		require.NoError(s.T(), os.MkdirAll(filepath.Dir(path), 0755))
+		require.NoError(s.T(), ioutil.WriteFile(path, nil, 0644))
+	}
+
+	// The search stops at the module root.
+	path, err := findConfig(filepath.Join(dir, "outer/module/a/b"))
+	require.NoError(s.T(), err)
+	require.Equal(s.T(), "", path)
+
+	require.NoError(s.T(), ioutil.WriteFile(filepath.Join(dir, "outer/module/.depper.yaml"), nil, 0644))
+	path, err = findConfig(filepath.Join(dir, "outer/module/a/b"))
+	require.NoError(s.T(), err)
+	require.Equal(s.T(), filepath.Join(dir, "outer/module/.depper.yaml"), path)
+
+	require.NoError(s.T(), ioutil.WriteFile(filepath.Join(dir, "outer/module/a/depper.yaml"), nil, 0644))
+	path, err = findConfig(filepath.Join(dir, "outer/module/a/b"))
+	require.NoError(s.T(), err)
+	require.Equal(s.T(), filepath.Join(dir, "outer/module/a/depper.yaml"), path)
+
+	// Without a module, the search goes up.
+	path, err = findConfig(filepath.Join(dir, "outer"))
+	require.NoError(s.T(), err)
+	require.Equal(s.T(), filepath.Join(dir, "outer/depper.yaml"), path)
+}
+
+func (s *Zuite) TestRootPackage() {
+	var defs defs
+	root, err := defs.rootPackage(s.cwd)
+	require.NoError(s.T(), err)
+	require.Equal(s.T(), p("sample_deps"), root)
+}
+
+func (s *Zuite) TestLoadConfig() {
+	var defs defs
+	cfg := defs.loadConfig(s.cwd, nil)
+	require.Nil(s.T(), cfg.Env)
+	require.Empty(s.T(), cfg.BuildFlags)
+
+	defs.buildFlags = []string{"-mod=readonly"}
+	defs.env = []string{"GOPRIVATE=github.com/org"}
+	cfg = defs.loadConfig(s.cwd, []string{"tools"})
+	require.Equal(s.T(), []string{"-mod=readonly", "-tags=tools"}, cfg.BuildFlags)
+	require.Equal(s.T(), "GOPRIVATE=github.com/org", cfg.Env[len(cfg.Env)-1])
+	require.Equal(s.T(), len(os.Environ())+1, len(cfg.Env))
+
+	// Collection honors both.
+	defs.Config.WorkingPackage = p("sample_deps")
+	for _, settings := range [][2][]string{
+		{{"-tags=tools"}, nil},
+		{nil, {"GOFLAGS=-tags=tools"}},
+	} {
+		defs.buildFlags, defs.env = settings[0], settings[1]
+		g, err := defs.collectPackages(s.cwd, nil, nil)
+		require.NoError(s.T(), err)
+		require.True(s.T(), g.hasDependency(p("sample_deps/a"), "strings"))
+	}
+}
+
+func (s *Zuite) TestEnvironment() {
+	var env environment
+	require.NoError(s.T(), env.Set("GOPRIVATE=github.com/org"))
+	require.NoError(s.T(), env.Set("GOFLAGS="))
+	require.EqualError(s.T(), env.Set("GOPRIVATE"), "malformed environment variable GOPRIVATE, must be KEY=VALUE")
+	require.EqualError(s.T(), env.Set("=foo"), "malformed environment variable =foo, must be KEY=VALUE")
+	require.Equal(s.T(), environment{"GOPRIVATE=github.com/org", "GOFLAGS="}, env)
 }
 
 type Zuite struct {
@@ -254,6 +2179,30 @@ func TestRunAllTheTests(t *testing.T) {
 	suite.Run(t, s)
 }
 
+// lines formats violations as in the text format, for comparison.
+func lines(violations []*violation) []string {
+	var lines []string
+	for _, v := range violations {
+		lines = append(lines, v.String())
+	}
+	return lines
+}
+
+// errorStrings returns the errors of violations, for comparison.
+func errorStrings(violations []*violation) []string {
+	var errors []string
+	for _, v := range violations {
+		errors = append(errors, v.Error())
+	}
+	return errors
+}
+
+func sortedStrings(strs []string) []string {
+	sorted := append([]string(nil), strs...)
+	sort.Strings(sorted)
+	return sorted
+}
+
 func p(name string) string {
 	return fmt.Sprintf("github.com/helloeave/depper/%s", name)
 }
@@ -0,0 +1,130 @@
+// Licensed under the Apache License, Version 2.0 (the "License");
+// you may not use this file except in compliance with the License.
+// You may obtain a copy of the License at
+//
+// http://www.apache.org/licenses/LICENSE-2.0
+//
+// Unless required by applicable law or agreed to in writing, software
+// distributed under the License is distributed on an "AS IS" BASIS,
+// WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+// See the License for the specific language governing permissions and
+// limitations under the License.
+
+package main
+
+import (
+	"fmt"
+	"io"
+	"os"
+	"os/exec"
+	"path/filepath"
+	"strings"
+
+	"golang.org/x/tools/go/packages"
+)
+
+// diagnostic is a check of the doctor subcommand. It returns details on
+// success, and an actionable error otherwise.
+type diagnostic struct {
+	name string
+	run  func() (string, error)
+}
+
+// doctor runs diagnostics of the environment depper runs in, from dir and
+// with the config at configPath, or the discovered one if empty. It returns
+// whether all diagnostics passed.
+func doctor(w io.Writer, dir, configPath string) bool {
+	env := make(map[string]string)
+	diagnostics := []diagnostic{
+		{"depper", func() (string, error) {
+			build := currentBuild()
+			return fmt.Sprintf("%s built with %s", build.Version, build.GoVersion), nil
+		}},
+		{"go", func() (string, error) {
+			out, err := exec.Command("go", "version").CombinedOutput()
+			if err != nil {
+				return "", fmt.Errorf("go toolchain not usable, make sure go is on the PATH: %s", err)
+			}
+			return strings.TrimSpace(string(out)), nil
+		}},
+		{"go env", func() (string, error) {
+			names := []string{"GO111MODULE", "GOFLAGS", "GOPROXY", "GOPRIVATE", "GONOSUMDB", "GOMOD"}
+			out, err := exec.Command("go", append([]string{"env"}, names...)...).Output()
+			if err != nil {
+				return "", fmt.Errorf("failed to run go env: %s", err)
+			}
+			var details []string
+			for i, value := range strings.Split(strings.TrimRight(string(out), "\n"), "\n") {
+				if i < len(names) {
+					env[names[i]] = value
+					details = append(details, fmt.Sprintf("%s=%s", names[i], value))
+				}
+			}
+			if env["GO111MODULE"] == "off" {
+				return "", fmt.Errorf("GO111MODULE=off disables module mode, unset it to analyze modules")
+			}
+			if strings.Contains(env["GOFLAGS"], "-mod=vendor") {
+				if _, err := os.Stat(filepath.Join(dir, "vendor")); os.IsNotExist(err) {
+					return "", fmt.Errorf("GOFLAGS has -mod=vendor but there is no vendor directory, run go mod vendor or unset it")
+				}
+			}
+			if env["GOPRIVATE"] == "" && env["GONOSUMDB"] != "" {
+				details = append(details, "(GONOSUMDB without GOPRIVATE, private modules may still be fetched through GOPROXY)")
+			}
+			return strings.Join(details, " "), nil
+		}},
+		{"module", func() (string, error) {
+			if env["GOMOD"] == "" || env["GOMOD"] == os.DevNull {
+				return "", fmt.Errorf("no go.mod found from %s, run depper from within a module", dir)
+			}
+			cfg := &packages.Config{
+				Mode: packages.NeedName | packages.NeedFiles | packages.NeedImports,
+				Dir:  dir,
+			}
+			goPkgs, err := packages.Load(cfg, ".")
+			if err != nil {
+				return "", fmt.Errorf("failed to load the package in %s: %s", dir, err)
+			}
+			var errs []string
+			packages.Visit(goPkgs, nil, func(goPkg *packages.Package) {
+				for _, err := range goPkg.Errors {
+					errs = append(errs, err.Error())
+				}
+			})
+			if len(errs) != 0 {
+				return "", fmt.Errorf("%s, fix them or run go mod tidy", strings.Join(errs, "; "))
+			}
+			return fmt.Sprintf("%s loads (%s)", goPkgs[0].PkgPath, env["GOMOD"]), nil
+		}},
+		{"config", func() (string, error) {
+			path := configPath
+			if path == "" {
+				var err error
+				path, err = findConfig(dir)
+				if err != nil {
+					return "", err
+				}
+				if path == "" {
+					return "", fmt.Errorf("no depper.yaml or .depper.yaml found up to the module root, create one or pass its path")
+				}
+			}
+			defs, err := parseFile(path)
+			if err != nil {
+				return "", fmt.Errorf("%s does not parse: %s", path, err)
+			}
+			return fmt.Sprintf("%s parses, %s", path, plural(len(defs.Rules), "rule")), nil
+		}},
+	}
+
+	ok := true
+	for _, diagnostic := range diagnostics {
+		details, err := diagnostic.run()
+		if err != nil {
+			ok = false
+			fmt.Fprintf(w, "FAIL %-8s %s\n", diagnostic.name, err)
+		} else {
+			fmt.Fprintf(w, "ok   %-8s %s\n", diagnostic.name, details)
+		}
+	}
+	return ok
+}
@@ -0,0 +1,38 @@
+// Licensed under the Apache License, Version 2.0 (the "License");
+// you may not use this file except in compliance with the License.
+// You may obtain a copy of the License at
+//
+// http://www.apache.org/licenses/LICENSE-2.0
+//
+// Unless required by applicable law or agreed to in writing, software
+// distributed under the License is distributed on an "AS IS" BASIS,
+// WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+// See the License for the specific language governing permissions and
+// limitations under the License.
+
+package main
+
+import (
+	"bytes"
+	"path/filepath"
+	"strings"
+
+	"github.com/stretchr/testify/require"
+)
+
+func (s *Zuite) TestDoctor() {
+	var buf bytes.Buffer
+	ok := doctor(&buf, s.cwd, filepath.Join(s.cwd, "../sample_config.yaml"))
+	require.Truef(s.T(), ok, "%s", buf.String())
+
+	lines := strings.Split(strings.TrimSpace(buf.String()), "\n")
+	require.Len(s.T(), lines, 5)
+	require.True(s.T(), strings.HasPrefix(lines[1], "ok   go       go version"))
+	require.Contains(s.T(), lines[3], p("sample_deps")+" loads")
+	require.Contains(s.T(), lines[4], "sample_config.yaml parses, 2 rules")
+
+	buf.Reset()
+	ok = doctor(&buf, s.cwd, filepath.Join(s.cwd, "missing.yaml"))
+	require.False(s.T(), ok)
+	require.Contains(s.T(), buf.String(), "FAIL config   ")
+}
@@ -0,0 +1,154 @@
+// Licensed under the Apache License, Version 2.0 (the "License");
+// you may not use this file except in compliance with the License.
+// You may obtain a copy of the License at
+//
+// http://www.apache.org/licenses/LICENSE-2.0
+//
+// Unless required by applicable law or agreed to in writing, software
+// distributed under the License is distributed on an "AS IS" BASIS,
+// WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+// See the License for the specific language governing permissions and
+// limitations under the License.
+
+package main
+
+import (
+	"fmt"
+	"io"
+	"sort"
+	"strings"
+)
+
+// explainMatch writes how every rule evaluates the package, written as in
+// rules or by import path: whether the rule selects it, and if so, which
+// entry of the rule decides each of its dependencies, along with the
+// requirements and expectations it leaves unmet. Rules with build tags judge
+// the dependencies of their graph.
+func (defs *defs) explainMatch(w io.Writer, g *graph, tagged map[string]*graph, expr string) error {
+	name := expr
+	if _, ok := g.pkgs[name]; !ok {
+		name = qualify(defs.Config.WorkingPackage, expr)
+	}
+	pkg, ok := g.pkgs[name]
+	if !ok {
+		return fmt.Errorf("%s is not part of the graph", name)
+	}
+
+	fmt.Fprintln(w, pkg)
+	for _, rule := range defs.Rules {
+		if reason := rule.mismatch(pkg); reason != "" {
+			fmt.Fprintf(w, "rule %s: not selected, %s\n", rule.Name, reason)
+			continue
+		}
+		ruleGraph := g
+		if key := strings.Join(rule.BuildTags, ","); key != "" {
+			ruleGraph = tagged[key]
+			if ruleGraph == nil || ruleGraph.pkgs[name] == nil {
+				fmt.Fprintf(w, "rule %s: selected, no dependencies introduced by files with build tags %s\n", rule.Name, key)
+				continue
+			}
+		}
+		fmt.Fprintf(w, "rule %s: selected\n", rule.Name)
+		var lines []string
+		deps := ruleGraph.dependencies(ruleGraph.pkgs[name])
+		for _, depPkg := range deps {
+			verdict, reason := rule.explainDependency(pkg, depPkg)
+			lines = append(lines, fmt.Sprintf("- %-10s %s -> %s, %s", verdict, pkg, depPkg, reason))
+		}
+	nextRequired:
+		for i, required := range rule.mustDepends {
+			for _, depPkg := range deps {
+				if required.match(depPkg) {
+					continue nextRequired
+				}
+			}
+			lines = append(lines, fmt.Sprintf("- %-10s %s -> %s, no dependency matches must_depend", kindRequired, pkg, rule.MustDepend[i]))
+		}
+		exercised := make(map[string]bool)
+		for _, depPkg := range deps {
+			exercised[rule.key(depPkg.name)] = true
+		}
+		var unexercised []string
+		for expected := range rule.expectedPackageToPackage[rule.key(pkg.name)] {
+			if !exercised[expected] && expected != rule.key(pkg.name) {
+				unexercised = append(unexercised, expected)
+			}
+		}
+		sort.Strings(unexercised)
+		for _, expected := range unexercised {
+			lines = append(lines, fmt.Sprintf("- %-10s %s -> %s, not exercised", kindExpected, pkg, expected))
+		}
+		for _, line := range align(lines) {
+			fmt.Fprintf(w, "  %s\n", line)
+		}
+	}
+	return nil
+}
+
+// mismatch returns why the selector does not apply to the package, or
+// nothing when it does, as per matches.
+func (sel *selector) mismatch(pkg *pkg) string {
+	var excepts []string
+	for _, except := range append([]string{sel.Except}, sel.ExceptPackages...) {
+		if except != "" {
+			excepts = append(excepts, except)
+		}
+	}
+	for i, pattern := range sel.exceptPatterns {
+		if sel.exceptGoroots[i] == pkg.goroot && pattern.MatchString(pkg.name) {
+			return fmt.Sprintf("excepted by %s", excepts[i])
+		}
+	}
+	if sel.GeneratedProtos && !isGeneratedProto(pkg) {
+		return "not generated from protos"
+	}
+	if sel.packagePattern != nil && (sel.goroot != pkg.goroot || !sel.packagePattern.MatchString(pkg.name)) {
+		return fmt.Sprintf("packages %s does not match", sel.Packages)
+	}
+	if sel.packageNamePattern != nil && !sel.packageNamePattern.MatchString(pkg.pkgName) {
+		return fmt.Sprintf("package_name %s does not match %s", sel.PackageName, pkg.pkgName)
+	}
+	if sel.annotationKey != "" {
+		if value, ok := pkg.annotations[sel.annotationKey]; !ok || value != sel.annotationValue {
+			return fmt.Sprintf("not annotated %s", sel.Annotation)
+		}
+	}
+	return ""
+}
+
+// explainDependency returns the verdict of the rule on the dependency of a
+// package it selects, as per judge, and the entry of the rule deciding it.
+func (rule *rule) explainDependency(pkg, depPkg *pkg) (string, string) {
+	verdict, pattern := rule.judge(pkg, depPkg)
+	switch verdict {
+	case verdictAllowed:
+		for i, p := range rule.mayDepends.patterns {
+			if p.match(depPkg) {
+				return "allowed", "by may_depend " + rule.MayDepend[i]
+			}
+		}
+		for i, p := range rule.mustDepends {
+			if p.match(depPkg) {
+				return "allowed", "by must_depend " + rule.MustDepend[i]
+			}
+		}
+		return "allowed", "as the rule only lists may_not_depend or must_depend entries"
+	case verdictExpectedForRule:
+		return "expected", "by deprecated_dependencies " + rule.key(depPkg.name)
+	case verdictExpectedForPackage:
+		return "expected", fmt.Sprintf("by deprecated_dependencies %s -> %s", rule.key(pkg.name), rule.key(depPkg.name))
+	case verdictExpectedByPattern:
+		return "expected", "by deprecated_dependencies " + pattern.expr
+	case verdictSuppressed:
+		return "suppressed", "by //" + allowDirective + " comments on every import"
+	}
+	for i, p := range rule.mayNotDepends.patterns {
+		if p.match(depPkg) {
+			return kindDisallowed, "by may_not_depend " + rule.MayNotDepend[i]
+		}
+	}
+	if rule.Exclusive {
+		return kindDisallowed, "matching no may_depend nor must_depend entry of the exclusive rule"
+	}
+	return kindDisallowed, "matching no may_depend entry"
+}
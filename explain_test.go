@@ -0,0 +1,82 @@
+// Licensed under the Apache License, Version 2.0 (the "License");
+// you may not use this file except in compliance with the License.
+// You may obtain a copy of the License at
+//
+// http://www.apache.org/licenses/LICENSE-2.0
+//
+// Unless required by applicable law or agreed to in writing, software
+// distributed under the License is distributed on an "AS IS" BASIS,
+// WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+// See the License for the specific language governing permissions and
+// limitations under the License.
+
+package main
+
+import (
+	"bytes"
+
+	"github.com/stretchr/testify/require"
+)
+
+func (s *Zuite) TestExplainMatch() {
+	defs, err := parse([]byte(`
+config:
+  working_package: wp
+rules:
+  - name: services
+    packages: services/.*
+    may_depend:
+      - <.*>
+      - models/.*
+    deprecated_dependencies:
+      - services/user -> dal/legacy
+      - services/user -> dal/gone
+  - name: no db
+    packages: services/.*
+    except_packages:
+      - services/user
+    may_not_depend:
+      - dal/.*
+  - name: api
+    packages: api/.*
+    may_depend:
+      - services/.*
+  - name: telemetry
+    packages: .*
+    must_depend:
+      - platform/telemetry
+`))
+	require.NoError(s.T(), err)
+	g := graphOf(map[string]*pkg{
+		"wp/services/user": &pkg{name: "wp/services/user"},
+		"wp/models/user":   &pkg{name: "wp/models/user"},
+		"wp/dal/legacy":    &pkg{name: "wp/dal/legacy"},
+		"wp/dal/sql":       &pkg{name: "wp/dal/sql"},
+		"fmt":              &pkg{name: "fmt", goroot: true},
+	}, "wp/services/user -> wp/models/user", "wp/services/user -> wp/dal/legacy", "wp/services/user -> wp/dal/sql", "wp/services/user -> fmt")
+
+	var buf bytes.Buffer
+	require.NoError(s.T(), defs.explainMatch(&buf, g, nil, "services/user"))
+	require.Equal(s.T(), `wp/services/user
+rule services: selected
+  - allowed    wp/services/user -> <fmt>, by may_depend <.*>
+  - expected   wp/services/user -> wp/dal/legacy, by deprecated_dependencies wp/services/user -> wp/dal/legacy
+  - disallowed wp/services/user -> wp/dal/sql, matching no may_depend entry
+  - allowed    wp/services/user -> wp/models/user, by may_depend models/.*
+  - expected   wp/services/user -> wp/dal/gone, not exercised
+rule no db: not selected, excepted by services/user
+rule api: not selected, packages api/.* does not match
+rule telemetry: selected
+  - allowed    wp/services/user -> <fmt>, as the rule only lists may_not_depend or must_depend entries
+  - allowed    wp/services/user -> wp/dal/legacy, as the rule only lists may_not_depend or must_depend entries
+  - allowed    wp/services/user -> wp/dal/sql, as the rule only lists may_not_depend or must_depend entries
+  - allowed    wp/services/user -> wp/models/user, as the rule only lists may_not_depend or must_depend entries
+  - required   wp/services/user -> platform/telemetry, no dependency matches must_depend
+`, buf.String())
+
+	// The package is written as in rules, or by import path.
+	buf.Reset()
+	require.NoError(s.T(), defs.explainMatch(&buf, g, nil, "wp/dal/sql"))
+	require.Contains(s.T(), buf.String(), "rule services: not selected, packages services/.* does not match\n")
+	require.EqualError(s.T(), defs.explainMatch(&buf, g, nil, "services/order"), "wp/services/order is not part of the graph")
+}
@@ -0,0 +1,363 @@
+// Licensed under the Apache License, Version 2.0 (the "License");
+// you may not use this file except in compliance with the License.
+// You may obtain a copy of the License at
+//
+// http://www.apache.org/licenses/LICENSE-2.0
+//
+// Unless required by applicable law or agreed to in writing, software
+// distributed under the License is distributed on an "AS IS" BASIS,
+// WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+// See the License for the specific language governing permissions and
+// limitations under the License.
+
+package main
+
+import (
+	"bufio"
+	"encoding/xml"
+	"fmt"
+	"io"
+	"strconv"
+	"strings"
+)
+
+// exporters write the graph, annotated, in the formats of the graph command.
+var exporters = map[string]func(w io.Writer, g *graph, a *annotations) error{
+	"dot":     writeDOT,
+	"mermaid": writeMermaid,
+	"graphml": writeGraphML,
+}
+
+// Statuses of dependencies in graph exports. Dependencies of packages no rule
+// selects are unconstrained.
+const (
+	statusUnconstrained = "unconstrained"
+	statusAllowed       = "allowed"
+	statusExpected      = "expected"
+	statusDisallowed    = "disallowed"
+)
+
+// statuses are the statuses of dependencies, in legend order, with the color
+// of their edges.
+var statuses = []struct{ name, color string }{
+	{statusAllowed, "#2ca02c"},
+	{statusExpected, "#ff7f0e"},
+	{statusDisallowed, "#d62728"},
+	{statusUnconstrained, "#7f7f7f"},
+}
+
+// palette colors the packages selected by rules, in turn.
+var palette = []string{
+	"#8dd3c7", "#ffffb3", "#bebada", "#fb8072", "#80b1d3", "#fdb462",
+	"#b3de69", "#fccde5", "#d9d9d9", "#bc80bd", "#ccebc5", "#ffed6f",
+}
+
+// annotations are the policy layer of graph exports: the rule selecting each
+// package, and the status of each dependency as per the rules.
+type annotations struct {
+	rules    []*rule
+	ruleOf   map[string]int // first of the rules selecting each package
+	statuses map[[2]string]string
+}
+
+// annotate annotates the graph with the rules, but for those with build tags
+// whose dependencies are not part of the graph. The status of a dependency is
+// the worst of those of the rules selecting its importer.
+func (defs *defs) annotate(g *graph) *annotations {
+	a := &annotations{
+		ruleOf:   make(map[string]int),
+		statuses: make(map[[2]string]string),
+	}
+	for _, rule := range defs.Rules {
+		if len(rule.BuildTags) == 0 {
+			a.rules = append(a.rules, rule)
+		}
+	}
+	for _, pkg := range g.nodes() {
+		for i, rule := range a.rules {
+			if !rule.matches(pkg) {
+				continue
+			}
+			if _, ok := a.ruleOf[pkg.name]; !ok {
+				a.ruleOf[pkg.name] = i
+			}
+			for _, dep := range g.dependencies(pkg) {
+				status := statusExpected
+				switch verdict, _ := rule.judge(pkg, dep); verdict {
+				case verdictAllowed:
+					status = statusAllowed
+				case verdictDisallowed:
+					status = statusDisallowed
+				}
+				a.worsen(pkg.name, dep.name, status)
+			}
+		}
+	}
+	return a
+}
+
+// statusRank orders statuses from the most to the least lenient.
+var statusRank = map[string]int{statusAllowed: 1, statusExpected: 2, statusDisallowed: 3}
+
+// worsen records the status of the dependency, unless it already has a worse
+// one.
+func (a *annotations) worsen(from, to, status string) {
+	edge := [2]string{from, to}
+	if statusRank[status] > statusRank[a.statuses[edge]] {
+		a.statuses[edge] = status
+	}
+}
+
+// color returns the color of the package, as per the rule selecting it.
+func (a *annotations) color(pkg *pkg) (string, bool) {
+	i, ok := a.ruleOf[pkg.name]
+	if !ok {
+		return "", false
+	}
+	return palette[i%len(palette)], true
+}
+
+// status returns the status of the dependency.
+func (a *annotations) status(from, to *pkg) string {
+	if status, ok := a.statuses[[2]string{from.name, to.name}]; ok {
+		return status
+	}
+	return statusUnconstrained
+}
+
+func statusColor(status string) string {
+	for _, s := range statuses {
+		if s.name == status {
+			return s.color
+		}
+	}
+	return ""
+}
+
+// groupModules collapses the packages of each module into one package named
+// by the module path, but for the modules to expand, and carries the
+// annotations over. Packages without a module, e.g. working ones, are kept.
+// Dependencies among the packages of a module are dropped, and the status of
+// a dependency on a module is the worst of those on its packages.
+func groupModules(g *graph, a *annotations, moduleOf func(pkg *pkg) string, expand globs) (*graph, *annotations) {
+	var (
+		grouped   = newGraph(g.root)
+		groups    = make(map[string]*pkg)
+		regrouped = &annotations{rules: a.rules, ruleOf: make(map[string]int), statuses: make(map[[2]string]string)}
+	)
+	grouped.roots = g.roots
+	grouped.loadErrors = g.loadErrors
+	for _, node := range g.nodes() {
+		var group *pkg
+		if module := moduleOf(node); module != "" && !expand.match(module) {
+			group = grouped.add(&pkg{name: module})
+		} else {
+			copied := *node
+			group = grouped.add(&copied)
+		}
+		groups[node.name] = group
+		if rule, ok := a.ruleOf[node.name]; ok {
+			if _, ok := regrouped.ruleOf[group.name]; !ok {
+				regrouped.ruleOf[group.name] = rule
+			}
+		}
+	}
+	for _, node := range g.nodes() {
+		from := groups[node.name]
+		for _, dep := range g.dependencies(node) {
+			to := groups[dep.name]
+			if from == to {
+				continue
+			}
+			grouped.depend(from, to)
+			if status, ok := a.statuses[[2]string{node.name, dep.name}]; ok {
+				regrouped.worsen(from.name, to.name, status)
+			}
+		}
+	}
+	return grouped, regrouped
+}
+
+// moduleOf returns the module of the package, as the longest of the module
+// paths prefixing its import path. Packages of other modules, e.g. of saved
+// graphs, belong to their repository on well known hosts, or to the first two
+// elements of their import path otherwise.
+func moduleOf(modules []string, name string) string {
+	var module string
+	for _, m := range modules {
+		if (name == m || strings.HasPrefix(name, m+"/")) && len(m) > len(module) {
+			module = m
+		}
+	}
+	if module != "" {
+		return module
+	}
+	parts := strings.Split(name, "/")
+	n := 2
+	switch parts[0] {
+	case "github.com", "gitlab.com", "bitbucket.org", "golang.org":
+		n = 3
+	}
+	if len(parts) < n {
+		return name
+	}
+	return strings.Join(parts[:n], "/")
+}
+
+// dotEdgeStyle returns the DOT attributes of dependencies with the status.
+func dotEdgeStyle(status string) string {
+	style := fmt.Sprintf("color=%q", statusColor(status))
+	switch status {
+	case statusExpected:
+		style += ", style=dashed"
+	case statusDisallowed:
+		style += ", penwidth=2"
+	}
+	return style
+}
+
+// writeDOT writes the graph in the DOT language of Graphviz, with a legend of
+// the rules and statuses of dependencies.
+func writeDOT(w io.Writer, g *graph, a *annotations) error {
+	bw := bufio.NewWriter(w)
+	fmt.Fprintln(bw, "digraph depper {")
+	fmt.Fprintln(bw, "  rankdir=LR;")
+	fmt.Fprintln(bw, "  node [shape=box, style=filled, fillcolor=white];")
+	for _, pkg := range g.nodes() {
+		if color, ok := a.color(pkg); ok {
+			fmt.Fprintf(bw, "  %s [fillcolor=%q, tooltip=%s];\n", strconv.Quote(pkg.String()), color, strconv.Quote(a.rules[a.ruleOf[pkg.name]].Name))
+		} else {
+			fmt.Fprintf(bw, "  %s;\n", strconv.Quote(pkg.String()))
+		}
+	}
+	for _, pkg := range g.nodes() {
+		for _, dep := range g.dependencies(pkg) {
+			fmt.Fprintf(bw, "  %s -> %s [%s];\n", strconv.Quote(pkg.String()), strconv.Quote(dep.String()), dotEdgeStyle(a.status(pkg, dep)))
+		}
+	}
+	if len(a.rules) != 0 {
+		fmt.Fprintln(bw, "  subgraph cluster_legend {")
+		fmt.Fprintln(bw, `    label="legend";`)
+		for i, rule := range a.rules {
+			fmt.Fprintf(bw, "    \"legend rule %d\" [label=%s, fillcolor=%q];\n", i, strconv.Quote(rule.Name), palette[i%len(palette)])
+		}
+		for _, s := range statuses {
+			fmt.Fprintf(bw, "    \"legend %s\" [label=\"\", shape=point];\n", s.name)
+			fmt.Fprintf(bw, "    \"legend %s to\" [label=\"\", shape=point];\n", s.name)
+			fmt.Fprintf(bw, "    \"legend %s\" -> \"legend %s to\" [label=%q, %s];\n", s.name, s.name, s.name, dotEdgeStyle(s.name))
+		}
+		fmt.Fprintln(bw, "  }")
+	}
+	fmt.Fprintln(bw, "}")
+	return bw.Flush()
+}
+
+// mermaidArrows are the Mermaid links of dependencies, by status.
+var mermaidArrows = map[string]string{
+	statusAllowed:       "-->",
+	statusExpected:      "-.->",
+	statusDisallowed:    "==>",
+	statusUnconstrained: "-->",
+}
+
+// writeMermaid writes the graph as a Mermaid flowchart, with a legend of the
+// rules and statuses of dependencies. Nodes are numbered in name order, and
+// labelled with their import path.
+func writeMermaid(w io.Writer, g *graph, a *annotations) error {
+	bw := bufio.NewWriter(w)
+	fmt.Fprintln(bw, "flowchart LR")
+	var (
+		ids     = make(map[string]string)
+		classes = make([][]string, len(a.rules))
+		links   []string // colors, in link order
+	)
+	for i, pkg := range g.nodes() {
+		ids[pkg.name] = fmt.Sprintf("n%d", i)
+		fmt.Fprintf(bw, "  %s[\"%s\"]\n", ids[pkg.name], strings.Replace(pkg.String(), `"`, "#quot;", -1))
+		if rule, ok := a.ruleOf[pkg.name]; ok {
+			classes[rule] = append(classes[rule], ids[pkg.name])
+		}
+	}
+	for _, pkg := range g.nodes() {
+		for _, dep := range g.dependencies(pkg) {
+			status := a.status(pkg, dep)
+			fmt.Fprintf(bw, "  %s %s %s\n", ids[pkg.name], mermaidArrows[status], ids[dep.name])
+			links = append(links, statusColor(status))
+		}
+	}
+	if len(a.rules) != 0 {
+		fmt.Fprintln(bw, "  subgraph legend")
+		for i, rule := range a.rules {
+			fmt.Fprintf(bw, "    legend_rule%d[\"%s\"]\n", i, strings.Replace(rule.Name, `"`, "#quot;", -1))
+			classes[i] = append(classes[i], fmt.Sprintf("legend_rule%d", i))
+		}
+		for _, s := range statuses {
+			fmt.Fprintf(bw, "    legend_%s_from[\" \"] %s|%s| legend_%s_to[\" \"]\n", s.name, mermaidArrows[s.name], s.name, s.name)
+			links = append(links, s.color)
+		}
+		fmt.Fprintln(bw, "  end")
+	}
+	for i := range a.rules {
+		fmt.Fprintf(bw, "  classDef rule%d fill:%s\n", i, palette[i%len(palette)])
+		fmt.Fprintf(bw, "  class %s rule%d\n", strings.Join(classes[i], ","), i)
+	}
+	if len(a.rules) != 0 {
+		for i, color := range links {
+			fmt.Fprintf(bw, "  linkStyle %d stroke:%s\n", i, color)
+		}
+	}
+	return bw.Flush()
+}
+
+// writeGraphML writes the graph in GraphML, with packages labelled with their
+// import path, whether they belong to the standard library, and the rule
+// selecting them, and dependencies with their status. Colors of rules and
+// statuses are data of packages and dependencies, and the legend is data of
+// the graph.
+func writeGraphML(w io.Writer, g *graph, a *annotations) error {
+	bw := bufio.NewWriter(w)
+	fmt.Fprintln(bw, xml.Header+`<graphml xmlns="http://graphml.graphdrawing.org/xmlns">`)
+	fmt.Fprintln(bw, `  <key id="legend" for="graph" attr.name="legend" attr.type="string"/>`)
+	fmt.Fprintln(bw, `  <key id="label" for="node" attr.name="label" attr.type="string"/>`)
+	fmt.Fprintln(bw, `  <key id="goroot" for="node" attr.name="goroot" attr.type="boolean"/>`)
+	fmt.Fprintln(bw, `  <key id="rule" for="node" attr.name="rule" attr.type="string"/>`)
+	fmt.Fprintln(bw, `  <key id="color" for="all" attr.name="color" attr.type="string"/>`)
+	fmt.Fprintln(bw, `  <key id="status" for="edge" attr.name="status" attr.type="string"/>`)
+	fmt.Fprintln(bw, `  <graph id="depper" edgedefault="directed">`)
+	var legend []string
+	for i, rule := range a.rules {
+		legend = append(legend, fmt.Sprintf("%s: %s", palette[i%len(palette)], rule.Name))
+	}
+	for _, s := range statuses {
+		legend = append(legend, fmt.Sprintf("%s: %s", s.color, s.name))
+	}
+	fmt.Fprintf(bw, "    <data key=\"legend\">%s</data>\n", escapeXML(strings.Join(legend, "\n")))
+	for _, pkg := range g.nodes() {
+		fmt.Fprintf(bw, "    <node id=\"%s\">\n", escapeXML(pkg.name))
+		fmt.Fprintf(bw, "      <data key=\"label\">%s</data>\n", escapeXML(pkg.String()))
+		fmt.Fprintf(bw, "      <data key=\"goroot\">%t</data>\n", pkg.goroot)
+		if color, ok := a.color(pkg); ok {
+			fmt.Fprintf(bw, "      <data key=\"rule\">%s</data>\n", escapeXML(a.rules[a.ruleOf[pkg.name]].Name))
+			fmt.Fprintf(bw, "      <data key=\"color\">%s</data>\n", color)
+		}
+		fmt.Fprintln(bw, "    </node>")
+	}
+	for _, pkg := range g.nodes() {
+		for _, dep := range g.dependencies(pkg) {
+			status := a.status(pkg, dep)
+			fmt.Fprintf(bw, "    <edge source=\"%s\" target=\"%s\">\n", escapeXML(pkg.name), escapeXML(dep.name))
+			fmt.Fprintf(bw, "      <data key=\"status\">%s</data>\n", status)
+			fmt.Fprintf(bw, "      <data key=\"color\">%s</data>\n", statusColor(status))
+			fmt.Fprintln(bw, "    </edge>")
+		}
+	}
+	fmt.Fprintln(bw, "  </graph>")
+	fmt.Fprintln(bw, "</graphml>")
+	return bw.Flush()
+}
+
+func escapeXML(s string) string {
+	var b strings.Builder
+	xml.EscapeText(&b, []byte(s))
+	return b.String()
+}
@@ -0,0 +1,224 @@
+// Licensed under the Apache License, Version 2.0 (the "License");
+// you may not use this file except in compliance with the License.
+// You may obtain a copy of the License at
+//
+// http://www.apache.org/licenses/LICENSE-2.0
+//
+// Unless required by applicable law or agreed to in writing, software
+// distributed under the License is distributed on an "AS IS" BASIS,
+// WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+// See the License for the specific language governing permissions and
+// limitations under the License.
+
+package main
+
+import (
+	"bytes"
+	"encoding/xml"
+	"strings"
+
+	"github.com/stretchr/testify/require"
+)
+
+func exportGraph() *graph {
+	return graphOf(map[string]*pkg{
+		"wp/foo": &pkg{name: "wp/foo"},
+		"wp/bar": &pkg{name: "wp/bar"},
+		"log":    &pkg{name: "log", goroot: true},
+	}, "wp/foo -> wp/bar", "wp/foo -> log", "wp/bar -> log")
+}
+
+// exportDefs lets foo only depend on fmt, expecting it to depend on log, and
+// any other package on anything.
+func (s *Zuite) exportDefs() *defs {
+	defs, err := parse([]byte(`
+config:
+  working_package: wp
+rules:
+  - name: foo
+    packages: foo
+    may_depend:
+      - <fmt>
+    deprecated_dependencies:
+      - <log>
+  - name: all
+    packages: .*
+    may_depend:
+      - .*
+      - <.*>
+`))
+	require.NoError(s.T(), err)
+	require.NoError(s.T(), defs.compile())
+	return defs
+}
+
+func (s *Zuite) TestAnnotate() {
+	g := exportGraph()
+	a := s.exportDefs().annotate(g)
+	require.Equal(s.T(), map[string]int{"wp/foo": 0, "wp/bar": 1}, a.ruleOf)
+	require.Equal(s.T(), statusExpected, a.status(g.pkgs["wp/foo"], g.pkgs["log"]))
+	require.Equal(s.T(), statusDisallowed, a.status(g.pkgs["wp/foo"], g.pkgs["wp/bar"]))
+	require.Equal(s.T(), statusAllowed, a.status(g.pkgs["wp/bar"], g.pkgs["log"]))
+
+	plain := (&defs{}).annotate(g)
+	require.Empty(s.T(), plain.ruleOf)
+	require.Equal(s.T(), statusUnconstrained, plain.status(g.pkgs["wp/foo"], g.pkgs["log"]))
+}
+
+func (s *Zuite) TestWriteDOT() {
+	var buf bytes.Buffer
+	require.NoError(s.T(), writeDOT(&buf, exportGraph(), (&defs{}).annotate(exportGraph())))
+	require.Equal(s.T(), `digraph depper {
+  rankdir=LR;
+  node [shape=box, style=filled, fillcolor=white];
+  "<log>";
+  "wp/bar";
+  "wp/foo";
+  "wp/bar" -> "<log>" [color="#7f7f7f"];
+  "wp/foo" -> "<log>" [color="#7f7f7f"];
+  "wp/foo" -> "wp/bar" [color="#7f7f7f"];
+}
+`, buf.String())
+
+	buf.Reset()
+	require.NoError(s.T(), writeDOT(&buf, exportGraph(), s.exportDefs().annotate(exportGraph())))
+	require.Contains(s.T(), buf.String(), `  "wp/foo" [fillcolor="#8dd3c7", tooltip="foo"];
+  "wp/bar" -> "<log>" [color="#2ca02c"];
+  "wp/foo" -> "<log>" [color="#ff7f0e", style=dashed];
+  "wp/foo" -> "wp/bar" [color="#d62728", penwidth=2];
+  subgraph cluster_legend {
+    label="legend";
+    "legend rule 0" [label="foo", fillcolor="#8dd3c7"];
+    "legend rule 1" [label="all", fillcolor="#ffffb3"];
+`)
+}
+
+func (s *Zuite) TestWriteMermaid() {
+	var buf bytes.Buffer
+	require.NoError(s.T(), writeMermaid(&buf, exportGraph(), (&defs{}).annotate(exportGraph())))
+	require.Equal(s.T(), `flowchart LR
+  n0["<log>"]
+  n1["wp/bar"]
+  n2["wp/foo"]
+  n1 --> n0
+  n2 --> n0
+  n2 --> n1
+`, buf.String())
+
+	buf.Reset()
+	require.NoError(s.T(), writeMermaid(&buf, exportGraph(), s.exportDefs().annotate(exportGraph())))
+	require.Contains(s.T(), buf.String(), `  n1 --> n0
+  n2 -.-> n0
+  n2 ==> n1
+  subgraph legend
+    legend_rule0["foo"]
+    legend_rule1["all"]
+`)
+	require.Contains(s.T(), buf.String(), `  classDef rule0 fill:#8dd3c7
+  class n2,legend_rule0 rule0
+  classDef rule1 fill:#ffffb3
+  class n1,legend_rule1 rule1
+  linkStyle 0 stroke:#2ca02c
+  linkStyle 1 stroke:#ff7f0e
+  linkStyle 2 stroke:#d62728
+`)
+}
+
+func (s *Zuite) TestWriteGraphML() {
+	var buf bytes.Buffer
+	require.NoError(s.T(), writeGraphML(&buf, exportGraph(), s.exportDefs().annotate(exportGraph())))
+
+	var doc struct {
+		Graph struct {
+			Nodes []struct {
+				ID   string `xml:"id,attr"`
+				Data []struct {
+					Key   string `xml:"key,attr"`
+					Value string `xml:",chardata"`
+				} `xml:"data"`
+			} `xml:"node"`
+			Edges []struct {
+				Source string `xml:"source,attr"`
+				Target string `xml:"target,attr"`
+				Data   []struct {
+					Value string `xml:",chardata"`
+				} `xml:"data"`
+			} `xml:"edge"`
+		} `xml:"graph"`
+	}
+	require.NoError(s.T(), xml.Unmarshal(buf.Bytes(), &doc))
+	require.Len(s.T(), doc.Graph.Nodes, 3)
+	require.Equal(s.T(), "log", doc.Graph.Nodes[0].ID)
+	require.Equal(s.T(), "<log>", doc.Graph.Nodes[0].Data[0].Value)
+	require.Equal(s.T(), "true", doc.Graph.Nodes[0].Data[1].Value)
+	require.Equal(s.T(), "foo", doc.Graph.Nodes[2].Data[2].Value)
+	require.Len(s.T(), doc.Graph.Edges, 3)
+	require.Equal(s.T(), "wp/foo", doc.Graph.Edges[2].Source)
+	require.Equal(s.T(), "wp/bar", doc.Graph.Edges[2].Target)
+	require.Equal(s.T(), "disallowed", doc.Graph.Edges[2].Data[0].Value)
+}
+
+func (s *Zuite) TestGroupModules() {
+	g := graphOf(map[string]*pkg{
+		"wp/foo":                     &pkg{name: "wp/foo"},
+		"wp/bar":                     &pkg{name: "wp/bar"},
+		"github.com/aws/sdk/s3":      &pkg{name: "github.com/aws/sdk/s3"},
+		"github.com/aws/sdk/sqs":     &pkg{name: "github.com/aws/sdk/sqs"},
+		"github.com/aws/sdk/private": &pkg{name: "github.com/aws/sdk/private"},
+		"github.com/pkg/errors":      &pkg{name: "github.com/pkg/errors"},
+	},
+		"wp/foo -> wp/bar",
+		"wp/foo -> github.com/aws/sdk/s3",
+		"wp/foo -> github.com/aws/sdk/sqs",
+		"wp/bar -> github.com/aws/sdk/sqs",
+		"wp/bar -> github.com/pkg/errors",
+		"github.com/aws/sdk/s3 -> github.com/aws/sdk/private",
+		"github.com/aws/sdk/sqs -> github.com/aws/sdk/private",
+		"github.com/aws/sdk/sqs -> github.com/pkg/errors",
+	)
+	a := &annotations{
+		ruleOf: map[string]int{"wp/foo": 0},
+		statuses: map[[2]string]string{
+			{"wp/foo", "wp/bar"}:                 statusAllowed,
+			{"wp/foo", "github.com/aws/sdk/s3"}:  statusAllowed,
+			{"wp/foo", "github.com/aws/sdk/sqs"}: statusDisallowed,
+		},
+	}
+	module := func(pkg *pkg) string {
+		if strings.HasPrefix(pkg.name, "wp/") {
+			return ""
+		}
+		return moduleOf([]string{"github.com/aws/sdk", "github.com/pkg/errors"}, pkg.name)
+	}
+
+	// Dependencies on any package of a module are on the module, as bad as
+	// the worst of them.
+	grouped, regrouped := groupModules(g, a, module, nil)
+	require.Equal(s.T(), []string{"github.com/aws/sdk", "github.com/pkg/errors", "wp/bar", "wp/foo"}, names(grouped.nodes()))
+	require.Equal(s.T(), []string{"github.com/aws/sdk", "wp/bar"}, names(grouped.dependenciesOf("wp/foo")))
+	require.Equal(s.T(), []string{"github.com/pkg/errors"}, names(grouped.dependenciesOf("github.com/aws/sdk")))
+	require.Equal(s.T(), statusDisallowed, regrouped.status(grouped.pkgs["wp/foo"], grouped.pkgs["github.com/aws/sdk"]))
+	require.Equal(s.T(), statusAllowed, regrouped.status(grouped.pkgs["wp/foo"], grouped.pkgs["wp/bar"]))
+	require.Equal(s.T(), map[string]int{"wp/foo": 0}, regrouped.ruleOf)
+
+	// Expanded modules keep their packages.
+	grouped, _ = groupModules(g, a, module, globs{"github.com/aws/*"})
+	require.Equal(s.T(), []string{"github.com/aws/sdk/private", "github.com/aws/sdk/s3", "github.com/aws/sdk/sqs", "github.com/pkg/errors", "wp/bar", "wp/foo"}, names(grouped.nodes()))
+	require.Equal(s.T(), []string{"github.com/aws/sdk/private", "github.com/pkg/errors"}, names(grouped.dependenciesOf("github.com/aws/sdk/sqs")))
+}
+
+func (s *Zuite) TestModuleOf() {
+	modules := []string{"example.com/app", "cloud.google.com/go", "cloud.google.com/go/storage", "github.com/pkg/errors"}
+	for name, expected := range map[string]string{
+		"cloud.google.com/go/storage/internal": "cloud.google.com/go/storage",
+		"cloud.google.com/go/pubsub":           "cloud.google.com/go",
+		"github.com/pkg/errors":                "github.com/pkg/errors",
+		"github.com/pkg/errorsx/foo":           "github.com/pkg/errorsx",
+		"golang.org/x/net/http2":               "golang.org/x/net",
+		"gopkg.in/yaml.v2":                     "gopkg.in/yaml.v2",
+		"go.uber.org/zap/zapcore":              "go.uber.org/zap",
+		"vanity":                               "vanity",
+	} {
+		require.Equal(s.T(), expected, moduleOf(modules, name), name)
+	}
+}
@@ -4,6 +4,6 @@ go 1.13
 
 require (
 	github.com/stretchr/testify v1.4.0
-	golang.org/x/tools v0.0.0-20190628153133-6cdbf07be9d0
+	golang.org/x/tools v0.1.12
 	gopkg.in/yaml.v2 v2.2.2
 )
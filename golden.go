@@ -0,0 +1,176 @@
+// Licensed under the Apache License, Version 2.0 (the "License");
+// you may not use this file except in compliance with the License.
+// You may obtain a copy of the License at
+//
+// http://www.apache.org/licenses/LICENSE-2.0
+//
+// Unless required by applicable law or agreed to in writing, software
+// distributed under the License is distributed on an "AS IS" BASIS,
+// WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+// See the License for the specific language governing permissions and
+// limitations under the License.
+
+package main
+
+import (
+	"fmt"
+	"io"
+	"io/ioutil"
+	"os"
+	"path/filepath"
+	"sort"
+	"strings"
+)
+
+// expectedFile lists the violations expected of a fixture tree, one per line
+// as they are reported, e.g. `services: disallowed wp/services -> wp/dal`.
+// Blank lines and lines starting with `#` are ignored.
+const expectedFile = "expected.txt"
+
+// testFixtures checks the config against every fixture tree of dir, i.e.
+// every subdirectory holding a go.mod, and compares the violations with
+// those of the expected file of the fixture, or writes them there when
+// updating. Each fixture is reported to w, and whether all passed is
+// returned.
+//
+// The config is read again for each fixture, as loadDefs does from cwd, and
+// the working package defaults to the module of the fixture. Every package of
+// the fixture is collected, regardless of load patterns.
+func testFixtures(w io.Writer, cwd, configPath, dir string, update bool) (bool, error) {
+	entries, err := ioutil.ReadDir(dir)
+	if err != nil {
+		return false, err
+	}
+	passed, found := true, false
+	for _, entry := range entries {
+		fixture := filepath.Join(dir, entry.Name())
+		if _, err := os.Stat(filepath.Join(fixture, "go.mod")); !entry.IsDir() || err != nil {
+			continue
+		}
+		found = true
+
+		actual, err := checkFixture(cwd, configPath, fixture)
+		if err != nil {
+			fmt.Fprintf(w, "FAIL %s\n    %s\n", fixture, err)
+			passed = false
+			continue
+		}
+		expectedPath := filepath.Join(fixture, expectedFile)
+		if update {
+			var contents string
+			if len(actual) != 0 {
+				contents = strings.Join(actual, "\n") + "\n"
+			}
+			if err := ioutil.WriteFile(expectedPath, []byte(contents), 0644); err != nil {
+				return false, err
+			}
+			fmt.Fprintf(w, "updated %s\n", expectedPath)
+			continue
+		}
+		expected, err := readExpected(expectedPath)
+		if err != nil {
+			return false, err
+		}
+		missing, unexpected := diffLines(expected, actual)
+		if len(missing) == 0 && len(unexpected) == 0 {
+			fmt.Fprintf(w, "ok   %s\n", fixture)
+			continue
+		}
+		passed = false
+		fmt.Fprintf(w, "FAIL %s\n", fixture)
+		for _, line := range missing {
+			fmt.Fprintf(w, "    missing    %s\n", line)
+		}
+		for _, line := range unexpected {
+			fmt.Fprintf(w, "    unexpected %s\n", line)
+		}
+	}
+	if !found {
+		return false, fmt.Errorf("no fixture trees with a go.mod found in %s", dir)
+	}
+	return passed, nil
+}
+
+// checkFixture returns the violations of the config against the fixture
+// tree, sorted.
+func checkFixture(cwd, configPath, fixture string) ([]string, error) {
+	defs, err := loadDefs(cwd, configPath, true)
+	if err != nil {
+		return nil, err
+	}
+	if defs.Config.WorkingPackage == "" {
+		if defs.Config.WorkingPackage, err = defs.rootPackage(fixture); err != nil {
+			return nil, err
+		}
+	}
+	if err := defs.compile(); err != nil {
+		return nil, err
+	}
+
+	patterns := []string{"./..."}
+	g, err := defs.collectPackages(fixture, patterns, nil)
+	if err != nil {
+		return nil, err
+	}
+	tagged := make(map[string]*graph)
+	for _, rule := range defs.Rules {
+		key := strings.Join(rule.BuildTags, ",")
+		if _, ok := tagged[key]; ok || key == "" {
+			continue
+		}
+		taggedGraph, err := defs.collectPackages(fixture, patterns, rule.BuildTags)
+		if err != nil {
+			return nil, err
+		}
+		tagged[key] = taggedOnly(g, taggedGraph)
+	}
+
+	var actual []string
+	for _, v := range defs.check(g, tagged, false).violations() {
+		actual = append(actual, v.Error())
+	}
+	sort.Strings(actual)
+	return actual, nil
+}
+
+// readExpected returns the violations listed in the expected file, sorted.
+// A missing file expects no violations.
+func readExpected(path string) ([]string, error) {
+	data, err := ioutil.ReadFile(path)
+	if os.IsNotExist(err) {
+		return nil, nil
+	}
+	if err != nil {
+		return nil, err
+	}
+	var expected []string
+	for _, line := range strings.Split(string(data), "\n") {
+		line = strings.TrimSpace(line)
+		if line != "" && !strings.HasPrefix(line, "#") {
+			expected = append(expected, line)
+		}
+	}
+	sort.Strings(expected)
+	return expected, nil
+}
+
+// diffLines returns the sorted lines of expected missing from actual, and
+// those of actual not expected.
+func diffLines(expected, actual []string) ([]string, []string) {
+	var missing, unexpected []string
+	i, j := 0, 0
+	for i < len(expected) || j < len(actual) {
+		switch {
+		case j == len(actual) || i < len(expected) && expected[i] < actual[j]:
+			missing = append(missing, expected[i])
+			i++
+		case i == len(expected) || actual[j] < expected[i]:
+			unexpected = append(unexpected, actual[j])
+			j++
+		default:
+			i++
+			j++
+		}
+	}
+	return missing, unexpected
+}
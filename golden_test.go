@@ -0,0 +1,69 @@
+// Licensed under the Apache License, Version 2.0 (the "License");
+// you may not use this file except in compliance with the License.
+// You may obtain a copy of the License at
+//
+// http://www.apache.org/licenses/LICENSE-2.0
+//
+// Unless required by applicable law or agreed to in writing, software
+// distributed under the License is distributed on an "AS IS" BASIS,
+// WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+// See the License for the specific language governing permissions and
+// limitations under the License.
+
+package main
+
+import (
+	"bytes"
+	"io/ioutil"
+	"os"
+	"path/filepath"
+
+	"github.com/stretchr/testify/require"
+)
+
+func (s *Zuite) TestFixtures() {
+	dir, err := ioutil.TempDir("", "depper")
+	require.NoError(s.T(), err)
+	defer os.RemoveAll(dir)
+	s.writeFiles(dir, map[string]string{
+		"depper.yaml": "rules:\n  - name: services\n    packages: services/.*\n    may_not_depend:\n      - dal\n",
+
+		"testdata/clean/go.mod":            "module example.com/app\n",
+		"testdata/clean/services/a/a.go":   "package a\n",
+		"testdata/leaky/go.mod":            "module example.com/app\n",
+		"testdata/leaky/services/a/a.go":   "package a\n\nimport _ \"example.com/app/dal\"\n",
+		"testdata/leaky/dal/dal.go":        "package dal\n",
+		"testdata/leaky/expected.txt":      "# services must not reach the dal\nservices: disallowed example.com/app/services/a -> example.com/app/dal\n",
+		"testdata/stale/go.mod":            "module example.com/app\n",
+		"testdata/stale/services/b/b.go":   "package b\n\nimport _ \"example.com/app/dal\"\n",
+		"testdata/stale/dal/dal.go":        "package dal\n",
+		"testdata/stale/expected.txt":      "services: disallowed example.com/app/services/a -> example.com/app/dal\n",
+		"testdata/not-a-fixture/README.md": "notes\n",
+	})
+	configPath := filepath.Join(dir, "depper.yaml")
+	testdata := filepath.Join(dir, "testdata")
+
+	var out bytes.Buffer
+	passed, err := testFixtures(&out, dir, configPath, testdata, false)
+	require.NoError(s.T(), err)
+	require.False(s.T(), passed)
+	require.Equal(s.T(), "ok   "+filepath.Join(testdata, "clean")+"\n"+
+		"ok   "+filepath.Join(testdata, "leaky")+"\n"+
+		"FAIL "+filepath.Join(testdata, "stale")+"\n"+
+		"    missing    services: disallowed example.com/app/services/a -> example.com/app/dal\n"+
+		"    unexpected services: disallowed example.com/app/services/b -> example.com/app/dal\n", out.String())
+
+	// Updating writes the violations of every fixture.
+	out.Reset()
+	_, err = testFixtures(&out, dir, configPath, testdata, true)
+	require.NoError(s.T(), err)
+	data, err := ioutil.ReadFile(filepath.Join(testdata, "stale", expectedFile))
+	require.NoError(s.T(), err)
+	require.Equal(s.T(), "services: disallowed example.com/app/services/b -> example.com/app/dal\n", string(data))
+	passed, err = testFixtures(&out, dir, configPath, testdata, false)
+	require.NoError(s.T(), err)
+	require.True(s.T(), passed)
+
+	_, err = testFixtures(&out, dir, configPath, filepath.Join(testdata, "clean", "services"), false)
+	require.Error(s.T(), err)
+}
@@ -0,0 +1,552 @@
+// Licensed under the Apache License, Version 2.0 (the "License");
+// you may not use this file except in compliance with the License.
+// You may obtain a copy of the License at
+//
+// http://www.apache.org/licenses/LICENSE-2.0
+//
+// Unless required by applicable law or agreed to in writing, software
+// distributed under the License is distributed on an "AS IS" BASIS,
+// WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+// See the License for the specific language governing permissions and
+// limitations under the License.
+
+package main
+
+import (
+	"encoding/json"
+	"fmt"
+	"io"
+	"io/ioutil"
+	"sort"
+	"sync"
+)
+
+// graph is a collected dependency graph, along with the errors collecting it.
+// Only working packages have their dependencies, and files, collected.
+//
+// Packages are interned, i.e. identified by their index in ids, and their
+// dependencies are kept in compressed sparse rows: the dependencies of the
+// package with id i are targets[offsets[i]:offsets[i+1]], in name order.
+// Dependencies are added pending, and compacted into rows on first read, so
+// that large graphs are cheap to hold.
+type graph struct {
+	root  string
+	roots []string        // packages the graph was collected from
+	pkgs  map[string]*pkg // by name, added with add
+	ids   []*pkg
+
+	mu      sync.Mutex
+	offsets []int32
+	targets []int32
+	pending [][2]int32
+
+	// loadErrors are gathered during collection
+	loadErrors []*violation
+}
+
+func newGraph(root string) *graph {
+	return &graph{
+		root: root,
+		pkgs: make(map[string]*pkg),
+	}
+}
+
+// add adds the package to the graph, and returns it. If the graph already has
+// a package by that name, that package is returned instead.
+func (g *graph) add(node *pkg) *pkg {
+	if existing, ok := g.pkgs[node.name]; ok {
+		return existing
+	}
+	node.id = int32(len(g.ids))
+	g.pkgs[node.name] = node
+	g.ids = append(g.ids, node)
+	return node
+}
+
+// depend adds a dependency between two packages of the graph, once.
+func (g *graph) depend(from, to *pkg) {
+	g.mu.Lock()
+	g.pending = append(g.pending, [2]int32{from.id, to.id})
+	g.mu.Unlock()
+}
+
+// compact merges the pending dependencies into the rows.
+func (g *graph) compact() {
+	g.mu.Lock()
+	defer g.mu.Unlock()
+	if len(g.pending) == 0 && len(g.offsets) == len(g.ids)+1 {
+		return
+	}
+
+	edges := g.pending
+	for from := 0; from+1 < len(g.offsets); from++ {
+		for _, to := range g.targets[g.offsets[from]:g.offsets[from+1]] {
+			edges = append(edges, [2]int32{int32(from), to})
+		}
+	}
+	sort.Slice(edges, func(i, j int) bool {
+		if edges[i][0] != edges[j][0] {
+			return edges[i][0] < edges[j][0]
+		}
+		return g.ids[edges[i][1]].name < g.ids[edges[j][1]].name
+	})
+
+	g.offsets = make([]int32, len(g.ids)+1)
+	g.targets = make([]int32, 0, len(edges))
+	for i, edge := range edges {
+		if i != 0 && edge == edges[i-1] {
+			continue
+		}
+		g.offsets[edge[0]+1]++
+		g.targets = append(g.targets, edge[1])
+	}
+	for i := 1; i < len(g.offsets); i++ {
+		g.offsets[i] += g.offsets[i-1]
+	}
+	g.pending = nil
+}
+
+// row returns the ids of the dependencies of the package.
+func (g *graph) row(node *pkg) []int32 {
+	g.compact()
+	return g.targets[g.offsets[node.id]:g.offsets[node.id+1]]
+}
+
+// addLoadError records an error loading a package, once.
+func (g *graph) addLoadError(loadError *violation) {
+	for _, existing := range g.loadErrors {
+		if *existing == *loadError {
+			return
+		}
+	}
+	g.loadErrors = append(g.loadErrors, loadError)
+}
+
+// nodes returns all packages of the graph, in name order.
+func (g *graph) nodes() []*pkg {
+	var nodes []*pkg
+	for _, name := range sortedNames(g.pkgs) {
+		nodes = append(nodes, g.pkgs[name])
+	}
+	return nodes
+}
+
+// dependencies returns the packages the package directly depends on, in name
+// order.
+func (g *graph) dependencies(node *pkg) []*pkg {
+	var deps []*pkg
+	for _, id := range g.row(node) {
+		deps = append(deps, g.ids[id])
+	}
+	return deps
+}
+
+// dependenciesOf returns the packages the package directly depends on, in
+// name order. It returns nil for unknown packages.
+func (g *graph) dependenciesOf(name string) []*pkg {
+	node, ok := g.pkgs[name]
+	if !ok {
+		return nil
+	}
+	return g.dependencies(node)
+}
+
+// hasDependency indicates whether the package directly depends on the other.
+func (g *graph) hasDependency(from, to string) bool {
+	node, ok := g.pkgs[from]
+	if !ok {
+		return false
+	}
+	row := g.row(node)
+	i := sort.Search(len(row), func(i int) bool { return g.ids[row[i]].name >= to })
+	return i < len(row) && g.ids[row[i]].name == to
+}
+
+// importersOf returns the packages directly depending on the package, in
+// name order.
+func (g *graph) importersOf(name string) []*pkg {
+	var importers []*pkg
+	for _, node := range g.nodes() {
+		if g.hasDependency(node.name, name) {
+			importers = append(importers, node)
+		}
+	}
+	return importers
+}
+
+// walk visits the packages reachable from the package breadth first, each
+// once, along with their distance to it. Dependencies of a package are not
+// visited through it when visit returns false.
+func (g *graph) walk(from string, visit func(pkg *pkg, depth int) bool) {
+	start, ok := g.pkgs[from]
+	if !ok {
+		return
+	}
+	var (
+		depths = make([]int, len(g.ids))
+		queue  = []*pkg{start}
+	)
+	for i := range depths {
+		depths[i] = -1
+	}
+	depths[start.id] = 0
+	for len(queue) != 0 {
+		node := queue[0]
+		queue = queue[1:]
+		if !visit(node, depths[node.id]) {
+			continue
+		}
+		for _, id := range g.row(node) {
+			if depths[id] != -1 {
+				continue
+			}
+			depths[id] = depths[node.id] + 1
+			queue = append(queue, g.ids[id])
+		}
+	}
+}
+
+// path returns the shortest chain of dependencies from a package to another,
+// both included, the first in name order if there are several. It returns
+// nil if the package does not depend on the other.
+func (g *graph) path(from, to string) []*pkg {
+	return g.pathTo(from, func(pkg *pkg) bool {
+		return pkg.name == to
+	})
+}
+
+// pathTo returns the shortest chain of dependencies from a package to any
+// package reached, as per path.
+func (g *graph) pathTo(from string, reached func(pkg *pkg) bool) []*pkg {
+	start, ok := g.pkgs[from]
+	if !ok {
+		return nil
+	}
+	var (
+		parents = make([]int32, len(g.ids))
+		queue   = []*pkg{start}
+	)
+	for i := range parents {
+		parents[i] = -1
+	}
+	parents[start.id] = start.id
+	for len(queue) != 0 {
+		node := queue[0]
+		queue = queue[1:]
+		if reached(node) {
+			path := []*pkg{node}
+			for node != start {
+				node = g.ids[parents[node.id]]
+				path = append([]*pkg{node}, path...)
+			}
+			return path
+		}
+		for _, id := range g.row(node) {
+			if parents[id] == -1 {
+				parents[id] = node.id
+				queue = append(queue, g.ids[id])
+			}
+		}
+	}
+	return nil
+}
+
+// subgraph returns a copy of the graph with only the packages to keep, and
+// the dependencies among them.
+func (g *graph) subgraph(keep func(pkg *pkg) bool) *graph {
+	sub := newGraph(g.root)
+	sub.roots = g.roots
+	sub.loadErrors = g.loadErrors
+	for _, node := range g.nodes() {
+		if keep(node) {
+			copied := *node
+			sub.add(&copied)
+		}
+	}
+	for _, node := range g.nodes() {
+		from, ok := sub.pkgs[node.name]
+		if !ok {
+			continue
+		}
+		for _, dep := range g.dependencies(node) {
+			if to, ok := sub.pkgs[dep.name]; ok {
+				sub.depend(from, to)
+			}
+		}
+	}
+	return sub
+}
+
+// jsonGraph is the serialized form of graphs. Packages are listed in name
+// order, and refer to their dependencies by name, so that serializing a graph
+// is stable.
+type jsonGraph struct {
+	Root       string       `json:"root"`
+	Roots      []string     `json:"roots,omitempty"`
+	Packages   []*jsonPkg   `json:"packages"`
+	LoadErrors []*violation `json:"load_errors,omitempty"`
+}
+
+type jsonPkg struct {
+	Name        string            `json:"name"`
+	PackageName string            `json:"package_name,omitempty"`
+	Goroot      bool              `json:"goroot,omitempty"`
+	Annotations map[string]string `json:"annotations,omitempty"`
+	Files       []*jsonFile       `json:"files,omitempty"`
+	Tools       []*jsonFile       `json:"tools,omitempty"`
+	DependsOn   []string          `json:"depends_on,omitempty"`
+	Dir         string            `json:"dir,omitempty"`
+	Hash        string            `json:"hash,omitempty"`
+	Cgo         bool              `json:"cgo,omitempty"`
+	Embeds      []*jsonEmbed      `json:"embeds,omitempty"`
+}
+
+type jsonEmbed struct {
+	Path string `json:"path"`
+	Size int64  `json:"size"`
+}
+
+type jsonFile struct {
+	Name    string        `json:"name"`
+	Imports []*jsonImport `json:"imports,omitempty"`
+	Uses    []*jsonUse    `json:"uses,omitempty"`
+}
+
+type jsonUse struct {
+	Name string `json:"name"`
+	Line int    `json:"line"`
+}
+
+type jsonImport struct {
+	Path  string `json:"path"`
+	Name  string `json:"name,omitempty"`
+	Line  int    `json:"line"`
+	Allow string `json:"allow,omitempty"`
+}
+
+func (g *graph) MarshalJSON() ([]byte, error) {
+	serialized := jsonGraph{
+		Root:       g.root,
+		Roots:      g.roots,
+		Packages:   []*jsonPkg{},
+		LoadErrors: g.loadErrors,
+	}
+	for _, pkg := range g.nodes() {
+		jsonPkg := &jsonPkg{
+			Name:        pkg.name,
+			PackageName: pkg.pkgName,
+			Goroot:      pkg.goroot,
+			Dir:         pkg.dir,
+			Hash:        pkg.hash,
+			Cgo:         pkg.cgo,
+		}
+		if len(pkg.annotations) != 0 {
+			jsonPkg.Annotations = pkg.annotations
+		}
+		for _, dep := range g.dependencies(pkg) {
+			jsonPkg.DependsOn = append(jsonPkg.DependsOn, dep.name)
+		}
+		jsonPkg.Files, jsonPkg.Tools = jsonFiles(pkg.files), jsonFiles(pkg.tools)
+		for _, embed := range pkg.embeds {
+			jsonPkg.Embeds = append(jsonPkg.Embeds, &jsonEmbed{Path: embed.path, Size: embed.size})
+		}
+		serialized.Packages = append(serialized.Packages, jsonPkg)
+	}
+	return json.Marshal(serialized)
+}
+
+func (g *graph) UnmarshalJSON(data []byte) error {
+	var serialized jsonGraph
+	if err := json.Unmarshal(data, &serialized); err != nil {
+		return err
+	}
+
+	g.root, g.roots, g.loadErrors = serialized.Root, serialized.Roots, serialized.LoadErrors
+	g.pkgs, g.ids = make(map[string]*pkg), nil
+	g.offsets, g.targets, g.pending = nil, nil, nil
+	for _, jsonPkg := range serialized.Packages {
+		pkg := &pkg{
+			name:        jsonPkg.Name,
+			pkgName:     jsonPkg.PackageName,
+			goroot:      jsonPkg.Goroot,
+			annotations: jsonPkg.Annotations,
+			dir:         jsonPkg.Dir,
+			hash:        jsonPkg.Hash,
+			cgo:         jsonPkg.Cgo,
+		}
+		pkg.files, pkg.tools = goFiles(jsonPkg.Files), goFiles(jsonPkg.Tools)
+		for _, jsonEmbed := range jsonPkg.Embeds {
+			pkg.embeds = append(pkg.embeds, &embed{path: jsonEmbed.Path, size: jsonEmbed.Size})
+		}
+		g.add(pkg)
+	}
+	for _, jsonPkg := range serialized.Packages {
+		for _, depName := range jsonPkg.DependsOn {
+			depPkg, ok := g.pkgs[depName]
+			if !ok {
+				return fmt.Errorf("package %s depends on unknown package %s", jsonPkg.Name, depName)
+			}
+			g.depend(g.pkgs[jsonPkg.Name], depPkg)
+		}
+	}
+	return nil
+}
+
+func jsonFiles(files []*goFile) []*jsonFile {
+	var serialized []*jsonFile
+	for _, file := range files {
+		jsonFile := &jsonFile{Name: file.name}
+		for _, imp := range file.imports {
+			jsonFile.Imports = append(jsonFile.Imports, &jsonImport{
+				Path:  imp.path,
+				Name:  imp.name,
+				Line:  imp.line,
+				Allow: imp.allow,
+			})
+		}
+		for _, use := range file.uses {
+			jsonFile.Uses = append(jsonFile.Uses, &jsonUse{Name: use.name, Line: use.line})
+		}
+		serialized = append(serialized, jsonFile)
+	}
+	return serialized
+}
+
+func goFiles(serialized []*jsonFile) []*goFile {
+	var files []*goFile
+	for _, jsonFile := range serialized {
+		file := &goFile{name: jsonFile.Name}
+		for _, jsonImport := range jsonFile.Imports {
+			file.imports = append(file.imports, &goImport{
+				path:  jsonImport.Path,
+				name:  jsonImport.Name,
+				line:  jsonImport.Line,
+				allow: jsonImport.Allow,
+			})
+		}
+		for _, jsonUse := range jsonFile.Uses {
+			file.uses = append(file.uses, &goUse{name: jsonUse.Name, line: jsonUse.Line})
+		}
+		files = append(files, file)
+	}
+	return files
+}
+
+// snapshot is a saved graph, along with the graphs for the build tags of
+// rules, so that checking can be done without collecting again.
+type snapshot struct {
+	Graph  *graph            `json:"graph"`
+	Tagged map[string]*graph `json:"tagged,omitempty"`
+}
+
+// saveSnapshot writes the graphs to path, where `-` is the standard output.
+func saveSnapshot(path string, g *graph, tagged map[string]*graph) error {
+	return writeTo(path, func(w io.Writer) error {
+		return json.NewEncoder(w).Encode(&snapshot{Graph: g, Tagged: tagged})
+	})
+}
+
+// loadSnapshot reads the graphs saved to path by saveSnapshot.
+func loadSnapshot(path string) (*graph, map[string]*graph, error) {
+	data, err := ioutil.ReadFile(path)
+	if err != nil {
+		return nil, nil, err
+	}
+	var snapshot snapshot
+	if err := json.Unmarshal(data, &snapshot); err != nil {
+		return nil, nil, fmt.Errorf("malformed graph snapshot %s: %s", path, err)
+	}
+	if snapshot.Graph == nil {
+		return nil, nil, fmt.Errorf("malformed graph snapshot %s: no graph", path)
+	}
+	if snapshot.Tagged == nil {
+		snapshot.Tagged = make(map[string]*graph)
+	}
+	return snapshot.Graph, snapshot.Tagged, nil
+}
+
+// mergeGraphs merges graphs collected from the same root, e.g. by shards
+// collecting some of the packages each. Packages collected by several graphs
+// have the union of their dependencies.
+func mergeGraphs(graphs []*graph) (*graph, error) {
+	if len(graphs) == 0 {
+		return nil, fmt.Errorf("no graphs to merge")
+	}
+	merged := newGraph(graphs[0].root)
+	for _, g := range graphs {
+		if g.root != merged.root {
+			return nil, fmt.Errorf("cannot merge graphs rooted at %s and %s", merged.root, g.root)
+		}
+		merged.merge(g)
+	}
+	return merged, nil
+}
+
+// merge adds the packages of the other graph, and the dependencies among
+// them, along with its roots and load errors. Packages without files in the
+// graph, e.g. leaves, take those of the other graph.
+func (g *graph) merge(other *graph) {
+	g.roots = append(g.roots, other.roots...)
+	for _, loadError := range other.loadErrors {
+		g.addLoadError(loadError)
+	}
+	for _, node := range other.nodes() {
+		merged := g.add(&pkg{
+			name:        node.name,
+			pkgName:     node.pkgName,
+			goroot:      node.goroot,
+			annotations: node.annotations,
+		})
+		merged.cgo = merged.cgo || node.cgo
+		if len(merged.files) == 0 && len(node.files) != 0 {
+			merged.pkgName, merged.annotations = node.pkgName, node.annotations
+			merged.files, merged.tools, merged.dir, merged.hash = node.files, node.tools, node.dir, node.hash
+			merged.embeds = node.embeds
+		}
+	}
+	for _, node := range other.nodes() {
+		for _, dep := range other.dependencies(node) {
+			g.depend(g.pkgs[node.name], g.pkgs[dep.name])
+		}
+	}
+}
+
+// mergeSnapshots loads and merges the snapshots at paths, along with their
+// graphs for build tags, which must be the same in all snapshots.
+func mergeSnapshots(paths []string) (*graph, map[string]*graph, error) {
+	var (
+		graphs []*graph
+		tagged = make(map[string][]*graph)
+	)
+	for i, path := range paths {
+		g, snapshotTagged, err := loadSnapshot(path)
+		if err != nil {
+			return nil, nil, err
+		}
+		graphs = append(graphs, g)
+		for key, taggedGraph := range snapshotTagged {
+			if i != 0 && len(tagged[key]) != i {
+				return nil, nil, fmt.Errorf("graph snapshot %s has build tags %s which %s lacks", path, key, paths[0])
+			}
+			tagged[key] = append(tagged[key], taggedGraph)
+		}
+		for key := range tagged {
+			if len(tagged[key]) != i+1 {
+				return nil, nil, fmt.Errorf("graph snapshot %s lacks build tags %s", path, key)
+			}
+		}
+	}
+
+	merged, err := mergeGraphs(graphs)
+	if err != nil {
+		return nil, nil, err
+	}
+	mergedTagged := make(map[string]*graph)
+	for key, graphs := range tagged {
+		mergedTagged[key], err = mergeGraphs(graphs)
+		if err != nil {
+			return nil, nil, err
+		}
+	}
+	return merged, mergedTagged, nil
+}
@@ -0,0 +1,242 @@
+// Licensed under the Apache License, Version 2.0 (the "License");
+// you may not use this file except in compliance with the License.
+// You may obtain a copy of the License at
+//
+// http://www.apache.org/licenses/LICENSE-2.0
+//
+// Unless required by applicable law or agreed to in writing, software
+// distributed under the License is distributed on an "AS IS" BASIS,
+// WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+// See the License for the specific language governing permissions and
+// limitations under the License.
+
+package main
+
+import (
+	"encoding/json"
+	"io/ioutil"
+	"os"
+	"path/filepath"
+	"strings"
+
+	"github.com/stretchr/testify/require"
+)
+
+// writeFiles writes the files of a fixture, e.g. a go.mod and the Go files
+// of its packages, by slash separated path relative to dir.
+func (s *Zuite) writeFiles(dir string, files map[string]string) {
+	for name, contents := range files {
+		path := filepath.Join(dir, filepath.FromSlash(name))
+		require.NoError(s.T(), os.MkdirAll(filepath.Dir(path), 0755))
+		require.NoError(s.T(), ioutil.WriteFile(path, []byte(contents), 0644))
+	}
+}
+
+// collectFixture collects the graph of a fixture module, with its go.mod at
+// the root of the files, checked with the config. Fixtures are written to a
+// temporary directory for the go command, and removed once collected, so
+// that tests, e.g. table driven ones, need no committed packages.
+func (s *Zuite) collectFixture(files map[string]string, config string) (*defs, *graph) {
+	dir, err := ioutil.TempDir("", "depper")
+	require.NoError(s.T(), err)
+	defer os.RemoveAll(dir)
+	s.writeFiles(dir, files)
+
+	defs, err := parse([]byte(config))
+	require.NoError(s.T(), err)
+	g, err := defs.collectPackages(dir, nil, nil)
+	require.NoError(s.T(), err)
+	return defs, g
+}
+
+func names(pkgs []*pkg) []string {
+	var names []string
+	for _, pkg := range pkgs {
+		names = append(names, pkg.name)
+	}
+	return names
+}
+
+func (s *Zuite) TestGraph() {
+	g := sampleGraph()
+	qux := g.add(&pkg{name: "qux"})
+	g.depend(g.pkgs["foo"], qux)
+	g.depend(qux, g.pkgs["baz"])
+	g.depend(qux, g.pkgs["baz"])
+
+	require.Equal(s.T(), []string{"bar", "baz", "foo", "qux"}, names(g.nodes()))
+	require.Equal(s.T(), []string{"bar", "qux"}, names(g.dependenciesOf("foo")))
+	require.Nil(s.T(), g.dependenciesOf("baz"))
+	require.Nil(s.T(), g.dependenciesOf("unknown"))
+	require.Equal(s.T(), []string{"bar", "qux"}, names(g.importersOf("baz")))
+	require.Nil(s.T(), g.importersOf("foo"))
+	require.True(s.T(), g.hasDependency("qux", "baz"))
+	require.False(s.T(), g.hasDependency("baz", "qux"))
+	require.False(s.T(), g.hasDependency("unknown", "baz"))
+
+	// Each package is visited once, at its shortest distance.
+	var visited []string
+	g.walk("foo", func(pkg *pkg, depth int) bool {
+		visited = append(visited, pkg.name)
+		require.Equal(s.T(), map[string]int{"foo": 0, "bar": 1, "qux": 1, "baz": 2}[pkg.name], depth)
+		return true
+	})
+	require.Equal(s.T(), []string{"foo", "bar", "qux", "baz"}, visited)
+
+	// Not visiting through a package.
+	visited = nil
+	g.walk("foo", func(pkg *pkg, depth int) bool {
+		visited = append(visited, pkg.name)
+		return pkg.name != "bar"
+	})
+	require.Equal(s.T(), []string{"foo", "bar", "qux", "baz"}, visited)
+	visited = nil
+	g.walk("foo", func(pkg *pkg, depth int) bool {
+		visited = append(visited, pkg.name)
+		return pkg.name == "foo"
+	})
+	require.Equal(s.T(), []string{"foo", "bar", "qux"}, visited)
+
+	// Shortest chains go through the first dependencies in name order.
+	require.Equal(s.T(), []string{"foo", "bar", "baz"}, names(g.path("foo", "baz")))
+	require.Equal(s.T(), []string{"qux"}, names(g.path("qux", "qux")))
+	require.Nil(s.T(), g.path("baz", "foo"))
+	require.Nil(s.T(), g.path("unknown", "foo"))
+	require.Equal(s.T(), []string{"foo", "bar"}, names(g.pathTo("foo", func(pkg *pkg) bool {
+		return strings.HasPrefix(pkg.name, "ba")
+	})))
+
+	// Subgraphs keep the dependencies among their packages.
+	sub := g.subgraph(func(pkg *pkg) bool {
+		return pkg.name != "bar"
+	})
+	require.Equal(s.T(), []string{"baz", "foo", "qux"}, names(sub.nodes()))
+	require.Equal(s.T(), []string{"qux"}, names(sub.dependenciesOf("foo")))
+	require.Equal(s.T(), []string{"baz"}, names(sub.dependenciesOf("qux")))
+	require.Equal(s.T(), []string{"bar", "qux"}, names(g.dependenciesOf("foo")))
+
+	// Packages are added once.
+	require.Equal(s.T(), qux, g.add(&pkg{name: "qux"}))
+	require.Len(s.T(), g.nodes(), 4)
+}
+
+func (s *Zuite) TestGraph_json() {
+	var defs defs
+	g, err := defs.collectPackages(s.cwd, nil, nil)
+	require.NoError(s.T(), err)
+	g.addLoadError(&violation{Kind: kindBroken, From: p("sample_deps/c"), Message: "no such package"})
+	g.pkgs["fmt"].cgo = true
+	g.pkgs[p("sample_deps/a")].tools = []*goFile{{name: "a/tools.go", imports: []*goImport{{path: "golang.org/x/tools/cmd/stringer", name: "_", line: 3}}}}
+	g.pkgs[p("sample_deps/a")].embeds = []*embed{{path: "a/logo.png", size: 1024}}
+
+	data, err := json.Marshal(g)
+	require.NoError(s.T(), err)
+
+	var loaded graph
+	require.NoError(s.T(), json.Unmarshal(data, &loaded))
+	require.Equal(s.T(), g.root, loaded.root)
+	require.Equal(s.T(), g.loadErrors, loaded.loadErrors)
+	require.Equal(s.T(), names(g.nodes()), names(loaded.nodes()))
+	for _, pkg := range g.nodes() {
+		loadedPkg := loaded.pkgs[pkg.name]
+		require.Equal(s.T(), pkg.pkgName, loadedPkg.pkgName)
+		require.Equal(s.T(), pkg.goroot, loadedPkg.goroot)
+		require.Equal(s.T(), pkg.cgo, loadedPkg.cgo)
+		require.Equal(s.T(), len(pkg.annotations), len(loadedPkg.annotations))
+		require.Equal(s.T(), pkg.files, loadedPkg.files)
+		require.Equal(s.T(), pkg.tools, loadedPkg.tools)
+		require.Equal(s.T(), pkg.embeds, loadedPkg.embeds)
+		require.Equal(s.T(), names(g.dependenciesOf(pkg.name)), names(loaded.dependenciesOf(pkg.name)))
+	}
+	require.Equal(s.T(), "domain", loaded.pkgs[p("sample_deps/a")].annotations["layer"])
+
+	// Serializing is stable.
+	again, err := json.Marshal(&loaded)
+	require.NoError(s.T(), err)
+	require.Equal(s.T(), string(data), string(again))
+
+	require.EqualError(s.T(), json.Unmarshal([]byte(`{"packages": [{"name": "foo", "depends_on": ["bar"]}]}`), &loaded),
+		"package foo depends on unknown package bar")
+}
+
+func (s *Zuite) TestSnapshot() {
+	dir, err := ioutil.TempDir("", "depper")
+	require.NoError(s.T(), err)
+	defer os.RemoveAll(dir)
+
+	var defs defs
+	defs.Config.WorkingPackage = p("sample_deps")
+	g, err := defs.collectPackages(s.cwd, nil, nil)
+	require.NoError(s.T(), err)
+	taggedGraph, err := defs.collectPackages(s.cwd, nil, []string{"tools"})
+	require.NoError(s.T(), err)
+	tagged := map[string]*graph{"tools": taggedOnly(g, taggedGraph)}
+
+	path := filepath.Join(dir, "graph.json")
+	require.NoError(s.T(), saveSnapshot(path, g, tagged))
+	loaded, loadedTagged, err := loadSnapshot(path)
+	require.NoError(s.T(), err)
+	require.Equal(s.T(), names(g.nodes()), names(loaded.nodes()))
+	require.Equal(s.T(), []string{"strings"}, names(loadedTagged["tools"].dependenciesOf(p("sample_deps/a"))))
+
+	// Checking either graph gives the same report.
+	require.Equal(s.T(), defs.check(g, tagged, true), defs.check(loaded, loadedTagged, true))
+
+	require.NoError(s.T(), ioutil.WriteFile(path, []byte(`{}`), 0644))
+	_, _, err = loadSnapshot(path)
+	require.EqualError(s.T(), err, "malformed graph snapshot "+path+": no graph")
+}
+
+func (s *Zuite) TestMergeGraphs() {
+	var defs defs
+	defs.Config.WorkingPackage = p("sample_deps")
+	full, err := defs.collectPackages(s.cwd, []string{"./a", "./b"}, nil)
+	require.NoError(s.T(), err)
+	require.Equal(s.T(), p("sample_deps"), full.root)
+	require.Nil(s.T(), full.pkgs[p("sample_deps")])
+
+	shardA, err := defs.collectPackages(s.cwd, []string{"./a"}, nil)
+	require.NoError(s.T(), err)
+	shardB, err := defs.collectPackages(s.cwd, []string{"./b"}, nil)
+	require.NoError(s.T(), err)
+	require.NotEqual(s.T(), names(full.nodes()), names(shardA.nodes()))
+
+	merged, err := mergeGraphs([]*graph{shardA, shardB})
+	require.NoError(s.T(), err)
+	expected, err := json.Marshal(full)
+	require.NoError(s.T(), err)
+	actual, err := json.Marshal(merged)
+	require.NoError(s.T(), err)
+	require.Equal(s.T(), string(expected), string(actual))
+
+	_, err = mergeGraphs([]*graph{shardA, newGraph("other")})
+	require.EqualError(s.T(), err, "cannot merge graphs rooted at "+p("sample_deps")+" and other")
+}
+
+func (s *Zuite) TestMergeSnapshots() {
+	dir, err := ioutil.TempDir("", "depper")
+	require.NoError(s.T(), err)
+	defer os.RemoveAll(dir)
+
+	shard := func(name string, tags ...string) string {
+		g := newGraph("wp")
+		g.add(&pkg{name: name})
+		tagged := make(map[string]*graph)
+		for _, key := range tags {
+			tagged[key] = newGraph("wp")
+		}
+		path := filepath.Join(dir, name+".json")
+		require.NoError(s.T(), saveSnapshot(path, g, tagged))
+		return path
+	}
+
+	g, tagged, err := mergeSnapshots([]string{shard("foo", "tools"), shard("bar", "tools")})
+	require.NoError(s.T(), err)
+	require.Equal(s.T(), []string{"bar", "foo"}, names(g.nodes()))
+	require.Len(s.T(), tagged, 1)
+
+	_, _, err = mergeSnapshots([]string{shard("foo", "tools"), shard("bar")})
+	require.EqualError(s.T(), err, "graph snapshot "+filepath.Join(dir, "bar.json")+" lacks build tags tools")
+	_, _, err = mergeSnapshots([]string{shard("foo"), shard("bar", "tools")})
+	require.EqualError(s.T(), err, "graph snapshot "+filepath.Join(dir, "bar.json")+" has build tags tools which "+filepath.Join(dir, "foo.json")+" lacks")
+}
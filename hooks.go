@@ -0,0 +1,126 @@
+// Licensed under the Apache License, Version 2.0 (the "License");
+// you may not use this file except in compliance with the License.
+// You may obtain a copy of the License at
+//
+// http://www.apache.org/licenses/LICENSE-2.0
+//
+// Unless required by applicable law or agreed to in writing, software
+// distributed under the License is distributed on an "AS IS" BASIS,
+// WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+// See the License for the specific language governing permissions and
+// limitations under the License.
+
+package main
+
+import (
+	"fmt"
+	"io"
+	"sync"
+)
+
+// checkHooks are the callbacks of check, to stream its progress or collect
+// metrics. Packages and violations of rules are streamed as each package is
+// judged, from the goroutines rules are run in, while rules complete once
+// reported, in order. Checks stream their violations once they all are run.
+// Calls are serialized, so that callbacks need no locking of their own.
+type checkHooks struct {
+	mu             sync.Mutex
+	packageMatched []func(rule *rule, pkg *pkg)
+	violation      []func(name string, v *violation)
+	ruleComplete   []func(rule *rule, section *section)
+}
+
+// checkOption adds hooks to check.
+type checkOption func(hooks *checkHooks)
+
+// onPackageMatched calls f with every package a rule selects, as it is
+// judged.
+func onPackageMatched(f func(rule *rule, pkg *pkg)) checkOption {
+	return func(hooks *checkHooks) {
+		hooks.packageMatched = append(hooks.packageMatched, f)
+	}
+}
+
+// onViolation calls f with every violation, along with the name of its rule
+// or check, as it is found.
+func onViolation(f func(name string, v *violation)) checkOption {
+	return func(hooks *checkHooks) {
+		hooks.violation = append(hooks.violation, f)
+	}
+}
+
+// onRuleComplete calls f with the section of every rule or check once
+// reported, where rule is nil for checks.
+func onRuleComplete(f func(rule *rule, section *section)) checkOption {
+	return func(hooks *checkHooks) {
+		hooks.ruleComplete = append(hooks.ruleComplete, f)
+	}
+}
+
+func newCheckHooks(opts []checkOption) *checkHooks {
+	hooks := &checkHooks{}
+	for _, opt := range opts {
+		opt(hooks)
+	}
+	return hooks
+}
+
+// matched calls the hooks with the package the rule selects. Hooks may be
+// nil, for no hooks.
+func (hooks *checkHooks) matched(rule *rule, pkg *pkg) {
+	if hooks == nil || len(hooks.packageMatched) == 0 {
+		return
+	}
+	hooks.mu.Lock()
+	defer hooks.mu.Unlock()
+	for _, f := range hooks.packageMatched {
+		f(rule, pkg)
+	}
+}
+
+// found calls the hooks with the violations of the rule or check of the
+// name.
+func (hooks *checkHooks) found(name string, violations []*violation) {
+	if hooks == nil || len(hooks.violation) == 0 || len(violations) == 0 {
+		return
+	}
+	hooks.mu.Lock()
+	defer hooks.mu.Unlock()
+	for _, f := range hooks.violation {
+		for _, v := range violations {
+			f(name, v)
+		}
+	}
+}
+
+// complete calls the hooks with the section of the rule, or check if rule is
+// nil.
+func (hooks *checkHooks) complete(rule *rule, section *section) {
+	if hooks == nil || len(hooks.ruleComplete) == 0 {
+		return
+	}
+	hooks.mu.Lock()
+	defer hooks.mu.Unlock()
+	for _, f := range hooks.ruleComplete {
+		f(rule, section)
+	}
+}
+
+// progress returns the hooks writing a line to w for every rule or check
+// once checked, with the number of packages rules selected, e.g.
+// `checked services: 12 packages, 1 violation`.
+func progress(w io.Writer) []checkOption {
+	matched := make(map[*rule]int)
+	return []checkOption{
+		onPackageMatched(func(rule *rule, pkg *pkg) {
+			matched[rule]++
+		}),
+		onRuleComplete(func(rule *rule, section *section) {
+			if rule != nil {
+				fmt.Fprintf(w, "checked %s: %s, %s\n", section.Name, plural(matched[rule], "package"), plural(len(section.Violations), "violation"))
+			} else {
+				fmt.Fprintf(w, "checked %s: %s\n", section.Name, plural(len(section.Violations), "violation"))
+			}
+		}),
+	}
+}
@@ -0,0 +1,81 @@
+// Licensed under the Apache License, Version 2.0 (the "License");
+// you may not use this file except in compliance with the License.
+// You may obtain a copy of the License at
+//
+// http://www.apache.org/licenses/LICENSE-2.0
+//
+// Unless required by applicable law or agreed to in writing, software
+// distributed under the License is distributed on an "AS IS" BASIS,
+// WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+// See the License for the specific language governing permissions and
+// limitations under the License.
+
+package main
+
+import (
+	"bytes"
+	"fmt"
+
+	"github.com/stretchr/testify/require"
+)
+
+func (s *Zuite) TestCheckHooks() {
+	defs, err := parse([]byte(`
+config:
+  working_package: wp
+rules:
+  - name: api
+    packages: api/.*
+    may_not_depend:
+      - dal/.*
+  - name: dal
+    packages: dal/.*
+    may_depend:
+      - dal/.*
+acyclic_groups:
+  - name: layers are acyclic
+    groups:
+      api: api/.*
+      dal: dal/.*
+`))
+	require.NoError(s.T(), err)
+	defs.parallelism = 4
+	g := graphOf(map[string]*pkg{
+		"wp/api/user": &pkg{name: "wp/api/user"},
+		"wp/api/base": &pkg{name: "wp/api/base"},
+		"wp/dal/user": &pkg{name: "wp/dal/user"},
+	}, "wp/api/user -> wp/dal/user", "wp/api/base -> wp/dal/user")
+
+	// Packages and violations are streamed as each package is judged, and
+	// rules complete in order.
+	var (
+		streamed  = make(map[string][]string)
+		completed []string
+	)
+	report := defs.check(g, nil, false,
+		onPackageMatched(func(rule *rule, pkg *pkg) {
+			streamed[rule.Name] = append(streamed[rule.Name], "matched "+pkg.name)
+		}),
+		onViolation(func(name string, v *violation) {
+			streamed[name] = append(streamed[name], fmt.Sprintf("violated by %s -> %s", v.From, v.To))
+		}),
+		onRuleComplete(func(rule *rule, section *section) {
+			completed = append(completed, fmt.Sprintf("%s, rule %t", section.Name, rule != nil))
+		}),
+	)
+	require.Equal(s.T(), 2, report.Errors)
+	require.Equal(s.T(), map[string][]string{
+		"api": {
+			"matched wp/api/base",
+			"violated by wp/api/base -> wp/dal/user",
+			"matched wp/api/user",
+			"violated by wp/api/user -> wp/dal/user",
+		},
+		"dal": {"matched wp/dal/user"},
+	}, streamed)
+	require.Equal(s.T(), []string{"api, rule true", "dal, rule true", "layers are acyclic, rule false"}, completed)
+
+	var buf bytes.Buffer
+	defs.check(g, nil, false, progress(&buf)...)
+	require.Equal(s.T(), "checked api: 2 packages, 2 violations\nchecked dal: 1 package, 0 violations\nchecked layers are acyclic: 0 violations\n", buf.String())
+}
@@ -0,0 +1,345 @@
+// Licensed under the Apache License, Version 2.0 (the "License");
+// you may not use this file except in compliance with the License.
+// You may obtain a copy of the License at
+//
+// http://www.apache.org/licenses/LICENSE-2.0
+//
+// Unless required by applicable law or agreed to in writing, software
+// distributed under the License is distributed on an "AS IS" BASIS,
+// WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+// See the License for the specific language governing permissions and
+// limitations under the License.
+
+package main
+
+import (
+	"crypto/sha256"
+	"encoding/hex"
+	"encoding/json"
+	"fmt"
+	"io"
+	"io/ioutil"
+	"os"
+	"path/filepath"
+	"sort"
+	"strings"
+
+	"golang.org/x/tools/go/packages"
+)
+
+// cache holds the graphs collected by a previous run, per build tags, so that
+// only the packages which changed since are collected again.
+type cache struct {
+	// Key identifies what the graphs were collected for, i.e. the working
+	// packages and the patterns collected from. ModHash is the hash of the
+	// module's go.mod and go.sum files, which determine third parties.
+	Key     string            `json:"key"`
+	ModHash string            `json:"mod_hash"`
+	Graphs  map[string]*graph `json:"graphs"`
+}
+
+// loadCache reads the cache at path, and returns an empty cache if there is
+// none or it is unusable.
+func loadCache(path string) *cache {
+	cache := &cache{Graphs: make(map[string]*graph)}
+	data, err := ioutil.ReadFile(path)
+	if err != nil {
+		return cache
+	}
+	if err := json.Unmarshal(data, cache); err != nil || cache.Graphs == nil {
+		cache.Graphs = make(map[string]*graph)
+	}
+	return cache
+}
+
+func (cache *cache) save(path string) error {
+	if err := os.MkdirAll(filepath.Dir(path), 0755); err != nil {
+		return err
+	}
+	return writeTo(path, func(w io.Writer) error {
+		return json.NewEncoder(w).Encode(cache)
+	})
+}
+
+// graphCachePath returns the path of the cache of the graphs collected from
+// dir in the cache directory, so that cleaning the cache removes it too.
+func (defs *defs) graphCachePath(dir string) (string, error) {
+	cacheDir, err := defs.cacheDir()
+	if err != nil {
+		return "", err
+	}
+	dir, err = filepath.Abs(dir)
+	if err != nil {
+		return "", err
+	}
+	sum := sha256.Sum256([]byte(dir))
+	return filepath.Join(cacheDir, "graphs", hex.EncodeToString(sum[:8])+".json"), nil
+}
+
+// cacheKey identifies what graphs are collected for, as the working packages
+// and inspected modules determine which dependencies are followed, and what
+// is known of third parties, while the build flags and the environment of the
+// go command determine which files are.
+func (defs *defs) cacheKey(patterns []string) string {
+	working := defs.workingPackages()
+	sort.Strings(working)
+	key := fmt.Sprintf("working=%s patterns=%s third_parties=%t", strings.Join(working, ","), strings.Join(patterns, ","), defs.needsThirdParties())
+	if len(defs.Config.Inspect) != 0 {
+		key += fmt.Sprintf(" inspect=%s depth=%d", strings.Join(defs.Config.Inspect, ","), defs.Config.InspectDepth)
+	}
+	if defs.Embeds != nil {
+		key += " embeds"
+	}
+	if defs.Config.ToolsFile != "" {
+		key += " tools=" + defs.Config.ToolsFile
+	}
+	if len(defs.buildFlags) != 0 {
+		key += " buildflags=" + strings.Join(defs.buildFlags, " ")
+	}
+	for _, name := range goEnv {
+		if value := defs.getenv(name); value != "" {
+			key += fmt.Sprintf(" %s=%s", name, value)
+		}
+	}
+	return key
+}
+
+// goEnv are the variables of the environment of the go command which change
+// which files are collected, and so the key of the cache.
+var goEnv = []string{"GOOS", "GOARCH", "CGO_ENABLED", "GOFLAGS", "GO111MODULE"}
+
+// collectIncrementally collects the graph as collectPackages does, reusing
+// the graph cached for the same tags where possible. Only the working
+// packages whose Go files changed, and the packages importing them, are
+// collected again, along with any dependency new to the graph. The cache is
+// updated with the collected graph.
+func (defs *defs) collectIncrementally(root string, patterns, tags []string, cache *cache) (*graph, error) {
+	key := strings.Join(tags, ",")
+	modHash, err := hashModule(defs.loadConfig(root, tags))
+	if err != nil {
+		return nil, err
+	}
+	if cacheKey := defs.cacheKey(patterns); cache.Key != cacheKey || cache.ModHash != modHash {
+		cache.Key, cache.ModHash, cache.Graphs = cacheKey, modHash, make(map[string]*graph)
+	}
+
+	cached, ok := cache.Graphs[key]
+	if !ok {
+		g, err := defs.collectPackages(root, patterns, tags)
+		if err != nil {
+			return nil, err
+		}
+		cache.Graphs[key] = g
+		return g, nil
+	}
+
+	// Which working packages changed?
+	var changed []string
+	for _, pkg := range cached.nodes() {
+		if !defs.isWorking(pkg.name) || pkg.goroot {
+			continue
+		}
+		if pkg.dir == "" {
+			changed = append(changed, pkg.name)
+			continue
+		}
+		if hash, err := hashPackage(root, filepath.Join(root, pkg.dir), pkg.embeds); err != nil || hash != pkg.hash {
+			changed = append(changed, pkg.name)
+		}
+	}
+	if len(changed) == 0 {
+		return cached, nil
+	}
+
+	// Collect them again, along with their importers, whose imports may
+	// have broken. Packages which no longer exist are only collected again
+	// if they are still imported.
+	reload := make(map[string]bool)
+	var reloadPatterns []string
+	for _, name := range changed {
+		for _, importer := range cached.importersOf(name) {
+			reload[importer.name] = true
+		}
+		reload[name] = true
+	}
+	for _, name := range sortedKeys(reload) {
+		if dir := cached.pkgs[name].dir; dir != "" {
+			if _, err := os.Stat(filepath.Join(root, dir)); os.IsNotExist(err) {
+				continue
+			}
+		}
+		reloadPatterns = append(reloadPatterns, name)
+	}
+	g := cached.subgraph(func(pkg *pkg) bool {
+		return !reload[pkg.name]
+	})
+
+	// Packages which are not collected again keep depending on those which
+	// are.
+	var kept [][2]string
+	for _, node := range cached.nodes() {
+		if reload[node.name] {
+			continue
+		}
+		for _, dep := range cached.dependencies(node) {
+			if reload[dep.name] {
+				kept = append(kept, [2]string{node.name, dep.name})
+			}
+		}
+	}
+
+	// Patterns may match packages new to the graph.
+	if len(patterns) != 0 {
+		cfg := defs.loadConfig(root, tags)
+		cfg.Mode = packages.NeedName
+		rootPkgs, err := packages.Load(cfg, patterns...)
+		if err != nil {
+			return nil, fmt.Errorf("failed to import %s: %s", strings.Join(patterns, ", "), err)
+		}
+		g.roots = nil
+		for _, rootPkg := range rootPkgs {
+			g.roots = append(g.roots, rootPkg.ID)
+			if _, ok := g.pkgs[rootPkg.ID]; !ok && !reload[rootPkg.ID] {
+				reloadPatterns = append(reloadPatterns, rootPkg.ID)
+			}
+		}
+	}
+	g.loadErrors = filterViolations(g.loadErrors, func(v *violation) bool {
+		return !reload[v.From]
+	})
+
+	cfg := defs.loadConfig(root, tags)
+	goPkgs, err := packages.Load(cfg, reloadPatterns...)
+	if err != nil {
+		return nil, fmt.Errorf("failed to import %s: %s", strings.Join(reloadPatterns, ", "), err)
+	}
+	if err := defs.expand(g, cfg, goPkgs, len(patterns) == 0); err != nil {
+		return nil, err
+	}
+	for _, dep := range kept {
+		if to, ok := g.pkgs[dep[1]]; ok {
+			g.depend(g.pkgs[dep[0]], to)
+		}
+	}
+	g = g.prune()
+	g.loadErrors = filterViolations(g.loadErrors, func(v *violation) bool {
+		_, ok := g.pkgs[v.From]
+		return ok
+	})
+
+	cache.Graphs[key] = g
+	return g, nil
+}
+
+// prune returns the graph without the packages no longer reachable from its
+// roots, e.g. dependencies which were removed.
+func (g *graph) prune() *graph {
+	reachable := make(map[string]bool)
+	for _, root := range g.roots {
+		g.walk(root, func(pkg *pkg, depth int) bool {
+			if reachable[pkg.name] {
+				return false
+			}
+			reachable[pkg.name] = true
+			return true
+		})
+	}
+	return g.subgraph(func(pkg *pkg) bool {
+		return reachable[pkg.name]
+	})
+}
+
+func sortedKeys(set map[string]bool) []string {
+	var keys []string
+	for key := range set {
+		keys = append(keys, key)
+	}
+	sort.Strings(keys)
+	return keys
+}
+
+// packageDir returns the directory of the package, and the empty path if it
+// has no files at all.
+func packageDir(goPkg *packages.Package) string {
+	for _, files := range [][]string{goPkg.GoFiles, goPkg.OtherFiles, goPkg.IgnoredFiles} {
+		if len(files) != 0 {
+			return filepath.Dir(files[0])
+		}
+	}
+	return ""
+}
+
+// hashDir hashes the names and contents of the non-test Go files in dir,
+// including those excluded by build constraints.
+func hashDir(dir string) (string, error) {
+	infos, err := ioutil.ReadDir(dir)
+	if err != nil {
+		return "", err
+	}
+	hash := sha256.New()
+	for _, info := range infos {
+		name := info.Name()
+		if info.IsDir() || !strings.HasSuffix(name, ".go") || strings.HasSuffix(name, "_test.go") {
+			continue
+		}
+		contents, err := ioutil.ReadFile(filepath.Join(dir, name))
+		if err != nil {
+			return "", err
+		}
+		fmt.Fprintf(hash, "%s %d\n", name, len(contents))
+		hash.Write(contents)
+	}
+	return hex.EncodeToString(hash.Sum(nil)), nil
+}
+
+// hashPackage hashes the Go files of the package in dir as hashDir does, and
+// the files it embeds, relative to root, along with the names of the files in
+// their directories, which embed patterns may match once added.
+func hashPackage(root, dir string, embeds []*embed) (string, error) {
+	hash, err := hashDir(dir)
+	if err != nil || len(embeds) == 0 {
+		return hash, err
+	}
+	h := sha256.New()
+	fmt.Fprintln(h, hash)
+	listed := make(map[string]bool)
+	for _, embed := range embeds {
+		path := filepath.Join(root, filepath.FromSlash(embed.path))
+		contents, err := ioutil.ReadFile(path)
+		if err != nil {
+			return "", err
+		}
+		fmt.Fprintf(h, "%s %d\n", embed.path, len(contents))
+		h.Write(contents)
+		if embedDir := filepath.Dir(path); !listed[embedDir] {
+			listed[embedDir] = true
+			infos, err := ioutil.ReadDir(embedDir)
+			if err != nil {
+				return "", err
+			}
+			for _, info := range infos {
+				fmt.Fprintln(h, info.Name())
+			}
+		}
+	}
+	return hex.EncodeToString(h.Sum(nil)), nil
+}
+
+// hashModule hashes the go.mod and go.sum files of the module packages are
+// loaded from.
+func hashModule(cfg *packages.Config) (string, error) {
+	module, err := enclosingModule(cfg.Dir, cfg.Env)
+	if err != nil {
+		return "", err
+	}
+	hash := sha256.New()
+	for _, path := range []string{module.GoMod, filepath.Join(filepath.Dir(module.GoMod), "go.sum")} {
+		contents, err := ioutil.ReadFile(path)
+		if err != nil && !os.IsNotExist(err) {
+			return "", err
+		}
+		fmt.Fprintf(hash, "%s %d\n", filepath.Base(path), len(contents))
+		hash.Write(contents)
+	}
+	return hex.EncodeToString(hash.Sum(nil)), nil
+}
@@ -0,0 +1,204 @@
+// Licensed under the Apache License, Version 2.0 (the "License");
+// you may not use this file except in compliance with the License.
+// You may obtain a copy of the License at
+//
+// http://www.apache.org/licenses/LICENSE-2.0
+//
+// Unless required by applicable law or agreed to in writing, software
+// distributed under the License is distributed on an "AS IS" BASIS,
+// WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+// See the License for the specific language governing permissions and
+// limitations under the License.
+
+package main
+
+import (
+	"io/ioutil"
+	"os"
+	"path/filepath"
+
+	"github.com/stretchr/testify/require"
+)
+
+func (s *Zuite) TestCollectIncrementally() {
+	dir, err := ioutil.TempDir("", "depper")
+	require.NoError(s.T(), err)
+	defer os.RemoveAll(dir)
+
+	write := func(name, contents string) {
+		path := filepath.Join(dir, name)
+		require.NoError(s.T(), os.MkdirAll(filepath.Dir(path), 0755))
+		require.NoError(s.T(), ioutil.WriteFile(path, []byte(contents), 0644))
+	}
+	write("go.mod", "module example.com/inc\n")
+	write("main.go", "package main\n\nimport _ \"example.com/inc/a\"\n\nfunc main() {}\n")
+	write("a/a.go", "package a\n\nimport _ \"example.com/inc/b\"\n")
+	write("b/b.go", "package b\n")
+	write("c/c.go", "package c\n\nimport _ \"strings\"\n")
+
+	var defs defs
+	defs.Config.WorkingPackage = "example.com/inc"
+	path := filepath.Join(dir, "cache.json")
+	collect := func() *graph {
+		cache := loadCache(path)
+		g, err := defs.collectIncrementally(dir, nil, nil, cache)
+		require.NoError(s.T(), err)
+		require.NoError(s.T(), cache.save(path))
+		return g
+	}
+	deps := func(g *graph, name string) []string {
+		return names(g.dependenciesOf("example.com/inc/" + name))
+	}
+
+	g := collect()
+	require.Equal(s.T(), []string{"example.com/inc/b"}, deps(g, "a"))
+	require.Nil(s.T(), g.pkgs["example.com/inc/c"])
+
+	// Unchanged packages, and changed tests, are not collected again.
+	write("a/a_test.go", "package a\n\nimport _ \"example.com/inc/c\"\n")
+	cached := collect()
+	require.Equal(s.T(), names(g.nodes()), names(cached.nodes()))
+	require.Nil(s.T(), cached.pkgs["example.com/inc/c"])
+
+	// Changed packages are, along with new dependencies, and dependencies
+	// no longer imported are pruned.
+	write("a/a.go", "package a\n\nimport _ \"example.com/inc/c\"\n")
+	g = collect()
+	require.Equal(s.T(), []string{"example.com/inc/c"}, deps(g, "a"))
+	require.Equal(s.T(), []string{"strings"}, deps(g, "c"))
+	require.Nil(s.T(), g.pkgs["example.com/inc/b"])
+
+	// Importers of deleted packages are collected again, and broken as when
+	// collecting everything.
+	require.NoError(s.T(), os.RemoveAll(filepath.Join(dir, "c")))
+	g = collect()
+	full, err := defs.collectPackages(dir, nil, nil)
+	require.NoError(s.T(), err)
+	require.NotEmpty(s.T(), g.loadErrors)
+	require.Equal(s.T(), full.loadErrors, g.loadErrors)
+	require.Equal(s.T(), names(full.nodes()), names(g.nodes()))
+	require.Equal(s.T(), []string{"example.com/inc/a"}, names(g.dependenciesOf("example.com/inc")))
+	require.NoError(s.T(), ioutil.WriteFile(filepath.Join(dir, "a/a.go"), []byte("package a\n"), 0644))
+	g = collect()
+	require.Empty(s.T(), g.loadErrors)
+	require.Nil(s.T(), deps(g, "a"))
+
+	// Changing the module collects everything again.
+	cache := loadCache(path)
+	write("go.mod", "module example.com/inc\n\ngo 1.13\n")
+	_, err = defs.collectIncrementally(dir, nil, nil, cache)
+	require.NoError(s.T(), err)
+	modHash, err := hashModule(defs.loadConfig(dir, nil))
+	require.NoError(s.T(), err)
+	require.Equal(s.T(), modHash, cache.ModHash)
+}
+
+func (s *Zuite) TestCollectIncrementally_embeds() {
+	dir, err := ioutil.TempDir("", "depper")
+	require.NoError(s.T(), err)
+	defer os.RemoveAll(dir)
+	s.writeFiles(dir, map[string]string{
+		"go.mod":           "module example.com/inc\n\ngo 1.16\n",
+		"main.go":          "package main\n\nimport _ \"example.com/inc/assets\"\n\nfunc main() {}\n",
+		"assets/assets.go": "package assets\n\nimport _ \"embed\"\n\n//go:embed logo.png\nvar logo []byte\n",
+		"assets/logo.png":  "logo\n",
+	})
+
+	defs, err := parse([]byte(`
+config:
+  working_package: example.com/inc
+embeds:
+  max_bytes: 10
+`))
+	require.NoError(s.T(), err)
+	path := filepath.Join(dir, "cache.json")
+	collect := func() []*violation {
+		cache := loadCache(path)
+		g, err := defs.collectIncrementally(dir, nil, nil, cache)
+		require.NoError(s.T(), err)
+		require.NoError(s.T(), cache.save(path))
+		return defs.Embeds.process(g)
+	}
+	require.Empty(s.T(), collect())
+
+	// Packages whose embedded files changed are collected again.
+	s.writeFiles(dir, map[string]string{"assets/logo.png": "a logo larger than allowed\n"})
+	require.Equal(s.T(), []string{
+		"- embed      example.com/inc/assets -> assets/logo.png, of 27 B, above 10 B",
+	}, lines(collect()))
+}
+
+func (s *Zuite) TestCollectIncrementally_buildFlags() {
+	dir, err := ioutil.TempDir("", "depper")
+	require.NoError(s.T(), err)
+	defer os.RemoveAll(dir)
+	s.writeFiles(dir, map[string]string{
+		"go.mod":           "module example.com/inc\n",
+		"main.go":          "package main\n\nimport _ \"example.com/inc/a\"\n\nfunc main() {}\n",
+		"a/a.go":           "package a\n",
+		"a/integration.go": "// +build integration\n\npackage a\n\nimport _ \"example.com/inc/b\"\n",
+		"b/b.go":           "package b\n",
+	})
+
+	var defs defs
+	defs.Config.WorkingPackage = "example.com/inc"
+	cache := loadCache(filepath.Join(dir, "cache.json"))
+	g, err := defs.collectIncrementally(dir, nil, nil, cache)
+	require.NoError(s.T(), err)
+	require.Nil(s.T(), g.pkgs["example.com/inc/b"])
+
+	// Changing the build flags, or the environment, collects everything
+	// again.
+	defs.buildFlags = []string{"-tags=integration"}
+	g, err = defs.collectIncrementally(dir, nil, nil, cache)
+	require.NoError(s.T(), err)
+	require.Equal(s.T(), []string{"example.com/inc/b"}, names(g.dependenciesOf("example.com/inc/a")))
+	key := cache.Key
+	defs.env = []string{"GOOS=plan9"}
+	_, err = defs.collectIncrementally(dir, nil, nil, cache)
+	require.NoError(s.T(), err)
+	require.NotEqual(s.T(), key, cache.Key)
+}
+
+func (s *Zuite) TestGraphCachePath() {
+	dir, err := ioutil.TempDir("", "depper")
+	require.NoError(s.T(), err)
+	defer os.RemoveAll(dir)
+
+	// Graphs are cached in the cache directory, by the directory they are
+	// collected from.
+	defs := &defs{env: []string{"DEPPER_CACHE=" + filepath.Join(dir, "cache")}}
+	path, err := defs.graphCachePath(filepath.Join(dir, "repo"))
+	require.NoError(s.T(), err)
+	require.Equal(s.T(), filepath.Join(dir, "cache", "graphs"), filepath.Dir(path))
+	other, err := defs.graphCachePath(filepath.Join(dir, "other"))
+	require.NoError(s.T(), err)
+	require.NotEqual(s.T(), path, other)
+
+	require.NoError(s.T(), loadCache(path).save(path))
+	require.FileExists(s.T(), path)
+	require.NoError(s.T(), cleanCache(filepath.Join(dir, "cache"), dir))
+	require.Empty(s.T(), loadCache(path).Graphs)
+}
+
+func (s *Zuite) TestHashDir() {
+	dir, err := ioutil.TempDir("", "depper")
+	require.NoError(s.T(), err)
+	defer os.RemoveAll(dir)
+
+	hash := func() string {
+		hash, err := hashDir(dir)
+		require.NoError(s.T(), err)
+		return hash
+	}
+	require.NoError(s.T(), ioutil.WriteFile(filepath.Join(dir, "a.go"), []byte("package a\n"), 0644))
+	before := hash()
+	require.NoError(s.T(), ioutil.WriteFile(filepath.Join(dir, "a_test.go"), []byte("package a\n"), 0644))
+	require.NoError(s.T(), ioutil.WriteFile(filepath.Join(dir, "a.txt"), []byte("notes\n"), 0644))
+	require.Equal(s.T(), before, hash())
+	require.NoError(s.T(), ioutil.WriteFile(filepath.Join(dir, "a.go"), []byte("package a // changed\n"), 0644))
+	require.NotEqual(s.T(), before, hash())
+
+	_, err = hashDir(filepath.Join(dir, "missing"))
+	require.Error(s.T(), err)
+}
@@ -0,0 +1,201 @@
+// Licensed under the Apache License, Version 2.0 (the "License");
+// you may not use this file except in compliance with the License.
+// You may obtain a copy of the License at
+//
+// http://www.apache.org/licenses/LICENSE-2.0
+//
+// Unless required by applicable law or agreed to in writing, software
+// distributed under the License is distributed on an "AS IS" BASIS,
+// WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+// See the License for the specific language governing permissions and
+// limitations under the License.
+
+package main
+
+import (
+	"regexp"
+	"regexp/syntax"
+	"sort"
+	"strings"
+)
+
+// patternSet matches strings against several patterns at once. Literal
+// patterns are looked up, or searched for, rather than evaluated as regular
+// expressions.
+type patternSet struct {
+	exact      map[string]bool
+	substrings []string
+	patterns   []*regexp.Regexp
+}
+
+func newPatternSet() *patternSet {
+	return &patternSet{exact: make(map[string]bool)}
+}
+
+func (set *patternSet) add(pattern *regexp.Regexp) {
+	literal, exact, ok := literalOf(pattern)
+	switch {
+	case !ok:
+		set.patterns = append(set.patterns, pattern)
+	case exact:
+		set.exact[literal] = true
+	default:
+		set.substrings = append(set.substrings, literal)
+	}
+}
+
+// match indicates whether any of the patterns matches s.
+func (set *patternSet) match(s string) bool {
+	if set.exact[s] {
+		return true
+	}
+	for _, substring := range set.substrings {
+		if strings.Contains(s, substring) {
+			return true
+		}
+	}
+	for _, pattern := range set.patterns {
+		if pattern.MatchString(s) {
+			return true
+		}
+	}
+	return false
+}
+
+// literalOf returns the literal matched by the pattern, and whether the
+// pattern matches it exactly, i.e. `^foo$`, rather than anywhere, i.e. `foo`.
+// It returns false if the pattern is not a literal.
+func literalOf(pattern *regexp.Regexp) (string, bool, bool) {
+	re, err := syntax.Parse(pattern.String(), syntax.Perl)
+	if err != nil {
+		return "", false, false
+	}
+	re = uncapture(re.Simplify())
+	if isLiteral(re) {
+		return string(re.Rune), false, true
+	}
+	if re.Op == syntax.OpConcat && len(re.Sub) == 3 && re.Sub[0].Op == syntax.OpBeginText && re.Sub[2].Op == syntax.OpEndText {
+		if literal := uncapture(re.Sub[1]); isLiteral(literal) {
+			return string(literal.Rune), true, true
+		}
+	}
+	return "", false, false
+}
+
+func uncapture(re *syntax.Regexp) *syntax.Regexp {
+	for re.Op == syntax.OpCapture {
+		re = re.Sub[0]
+	}
+	return re
+}
+
+func isLiteral(re *syntax.Regexp) bool {
+	return re.Op == syntax.OpLiteral && re.Flags&syntax.FoldCase == 0
+}
+
+// pkgpatternSet is a list of package patterns, e.g. the may_depend list of a
+// rule, matched at once.
+type pkgpatternSet struct {
+	patterns []*pkgpattern
+
+	// paths of non standard and standard library packages, and the
+	// patterns not matching paths, i.e. `third_parties`, `generated_protos`
+	// or by name
+	paths   [2]*patternSet
+	special []*pkgpattern
+}
+
+func newPkgpatternSet(patterns ...*pkgpattern) *pkgpatternSet {
+	set := &pkgpatternSet{
+		patterns: patterns,
+		paths:    [2]*patternSet{newPatternSet(), newPatternSet()},
+	}
+	for _, p := range patterns {
+		if p.thirdParties || p.generatedProtos || p.byName {
+			set.special = append(set.special, p)
+		} else {
+			set.paths[gorootIndex(p.goroot)].add(p.pattern)
+		}
+	}
+	return set
+}
+
+func gorootIndex(goroot bool) int {
+	if goroot {
+		return 1
+	}
+	return 0
+}
+
+// len returns the number of patterns, none for nil sets.
+func (set *pkgpatternSet) len() int {
+	if set == nil {
+		return 0
+	}
+	return len(set.patterns)
+}
+
+// match indicates whether any of the patterns matches the package.
+func (set *pkgpatternSet) match(pkg *pkg) bool {
+	if set == nil {
+		return false
+	}
+	for _, p := range set.special {
+		if p.match(pkg) {
+			return true
+		}
+	}
+	return set.paths[gorootIndex(pkg.goroot)].match(pkg.name)
+}
+
+// selectorIndex finds the selectors matching a package at once. Selectors are
+// indexed by the literal prefix of their packages pattern, so that only those
+// whose prefix the package starts with are evaluated.
+type selectorIndex struct {
+	selectors  []*selector
+	byPrefix   map[string][]int
+	prefixLens []int // distinct lengths of the prefixes, ascending
+}
+
+func newSelectorIndex(selectors []*selector) *selectorIndex {
+	index := &selectorIndex{
+		selectors: selectors,
+		byPrefix:  make(map[string][]int),
+	}
+	for i, sel := range selectors {
+		var prefix string
+		if sel.packagePattern != nil {
+			// Patterns of selectors are anchored, so that packages
+			// matching them start with their literal prefix.
+			prefix, _ = sel.packagePattern.LiteralPrefix()
+		}
+		index.byPrefix[prefix] = append(index.byPrefix[prefix], i)
+	}
+	lens := make(map[int]bool)
+	for prefix := range index.byPrefix {
+		if !lens[len(prefix)] {
+			lens[len(prefix)] = true
+			index.prefixLens = append(index.prefixLens, len(prefix))
+		}
+	}
+	sort.Ints(index.prefixLens)
+	return index
+}
+
+// matching returns the indices of the selectors matching the package, in
+// order.
+func (index *selectorIndex) matching(pkg *pkg) []int {
+	var matching []int
+	for _, l := range index.prefixLens {
+		if l > len(pkg.name) {
+			break
+		}
+		for _, i := range index.byPrefix[pkg.name[:l]] {
+			if index.selectors[i].matches(pkg) {
+				matching = append(matching, i)
+			}
+		}
+	}
+	sort.Ints(matching)
+	return matching
+}
@@ -0,0 +1,94 @@
+// Licensed under the Apache License, Version 2.0 (the "License");
+// you may not use this file except in compliance with the License.
+// You may obtain a copy of the License at
+//
+// http://www.apache.org/licenses/LICENSE-2.0
+//
+// Unless required by applicable law or agreed to in writing, software
+// distributed under the License is distributed on an "AS IS" BASIS,
+// WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+// See the License for the specific language governing permissions and
+// limitations under the License.
+
+package main
+
+import (
+	"regexp"
+
+	"github.com/stretchr/testify/require"
+)
+
+func (s *Zuite) TestLiteralOf() {
+	for pattern, expected := range map[string]struct {
+		literal   string
+		exact, ok bool
+	}{
+		"util":              {"util", false, true},
+		"^log$":             {"log", true, true},
+		"^github.com/x$":    {"", false, false},
+		`^github\.com/x$`:   {"github.com/x", true, true},
+		"(?i)^log$":         {"", false, false},
+		"^log":              {"", false, false},
+		"foo|bar":           {"", false, false},
+		"^(encoding/json)$": {"encoding/json", true, true},
+	} {
+		literal, exact, ok := literalOf(regexp.MustCompile(pattern))
+		require.Equal(s.T(), expected.ok, ok, pattern)
+		require.Equal(s.T(), expected.literal, literal, pattern)
+		require.Equal(s.T(), expected.exact, exact, pattern)
+	}
+}
+
+func (s *Zuite) TestPkgpatternSet() {
+	set := newPkgpatternSet(
+		&pkgpattern{goroot: true, pattern: regexp.MustCompile("^log$")},
+		&pkgpattern{pattern: regexp.MustCompile("util")},
+		&pkgpattern{pattern: regexp.MustCompile("^wp/(foo|bar)$")},
+		&pkgpattern{byName: true, pattern: regexp.MustCompile("^model$")},
+		&pkgpattern{thirdParties: true, workingPackage: "wp"},
+	)
+	require.Equal(s.T(), 5, set.len())
+	for _, pkg := range []*pkg{
+		&pkg{name: "log", goroot: true},
+		&pkg{name: "wp/util/strings"},
+		&pkg{name: "wp/bar"},
+		&pkg{name: "wp/billing/models", pkgName: "model"},
+		&pkg{name: "github.com/lib/pq"},
+	} {
+		require.True(s.T(), set.match(pkg), pkg.name)
+	}
+	for _, pkg := range []*pkg{
+		&pkg{name: "wp/log"},
+		&pkg{name: "log/syslog", goroot: true},
+		&pkg{name: "wp/baz"},
+		&pkg{name: "wp/models", pkgName: "models"},
+	} {
+		require.False(s.T(), set.match(pkg), pkg.name)
+	}
+
+	var none *pkgpatternSet
+	require.Equal(s.T(), 0, none.len())
+	require.False(s.T(), none.match(&pkg{name: "log", goroot: true}))
+}
+
+func (s *Zuite) TestSelectorIndex() {
+	var selectors []*selector
+	for _, sel := range []selector{
+		{Packages: "app/.*"},
+		{Packages: ".*"},
+		{Packages: "app/foo"},
+		{PackageName: "main"},
+		{Packages: "lib/.*"},
+	} {
+		sel := sel
+		require.NoError(s.T(), sel.compile("wp"))
+		selectors = append(selectors, &sel)
+	}
+	index := newSelectorIndex(selectors)
+
+	require.Equal(s.T(), []int{0, 1, 2}, index.matching(&pkg{name: "wp/app/foo"}))
+	require.Equal(s.T(), []int{0, 1, 3}, index.matching(&pkg{name: "wp/app/cmd", pkgName: "main"}))
+	require.Equal(s.T(), []int{1, 4}, index.matching(&pkg{name: "wp/lib/bar"}))
+	require.Equal(s.T(), []int{3}, index.matching(&pkg{name: "other", pkgName: "main"}))
+	require.Nil(s.T(), index.matching(&pkg{name: "w"}))
+}
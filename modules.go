@@ -0,0 +1,89 @@
+// Licensed under the Apache License, Version 2.0 (the "License");
+// you may not use this file except in compliance with the License.
+// You may obtain a copy of the License at
+//
+// http://www.apache.org/licenses/LICENSE-2.0
+//
+// Unless required by applicable law or agreed to in writing, software
+// distributed under the License is distributed on an "AS IS" BASIS,
+// WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+// See the License for the specific language governing permissions and
+// limitations under the License.
+
+package main
+
+import (
+	"encoding/json"
+	"fmt"
+	"io"
+	"os/exec"
+
+	"golang.org/x/tools/go/packages"
+)
+
+// requirement is a module the go.mod of the main module requires, and
+// whether any working package reaches any of its packages.
+type requirement struct {
+	Path      string `json:"path"`
+	Version   string `json:"version"`
+	Indirect  bool   `json:"indirect,omitempty"`
+	Reachable bool   `json:"reachable"`
+}
+
+// requirements returns the requirements of the main module of the config, in
+// go.mod order. Requirements are reachable when any package of their module
+// is imported, directly or transitively, by the packages of the main module,
+// or by their tests. Others are candidates for go mod tidy, or only needed to
+// select the versions of other modules.
+func (defs *defs) requirements(cfg *packages.Config) ([]*requirement, error) {
+	cmd := exec.Command("go", "mod", "edit", "-json")
+	cmd.Dir, cmd.Env = cfg.Dir, cfg.Env
+	out, err := cmd.Output()
+	if err != nil {
+		return nil, fmt.Errorf("failed to read the go.mod of %s: %s", cfg.Dir, err)
+	}
+	var modFile struct {
+		Module struct {
+			Path string
+		}
+		Require []*requirement
+	}
+	if err := json.Unmarshal(out, &modFile); err != nil {
+		return nil, fmt.Errorf("malformed go mod edit output: %s", err)
+	}
+
+	cfg.Mode |= packages.NeedName | packages.NeedImports | packages.NeedDeps | packages.NeedModule
+	cfg.Tests = true
+	goPkgs, err := packages.Load(cfg, modFile.Module.Path+"/...")
+	if err != nil {
+		return nil, err
+	}
+	reached := make(map[string]bool)
+	packages.Visit(goPkgs, nil, func(goPkg *packages.Package) {
+		if goPkg.Module != nil {
+			reached[goPkg.Module.Path] = true
+		}
+	})
+	for _, requirement := range modFile.Require {
+		requirement.Reachable = reached[requirement.Path]
+	}
+	return modFile.Require, nil
+}
+
+// writeRequirements writes the requirements, one per line with their
+// version, marking the indirect ones and those no working package reaches,
+// e.g. `github.com/pkg/errors v0.9.1 // indirect, unreachable`.
+func writeRequirements(w io.Writer, requirements []*requirement) {
+	for _, requirement := range requirements {
+		var marks string
+		switch {
+		case requirement.Indirect && !requirement.Reachable:
+			marks = " // indirect, unreachable"
+		case requirement.Indirect:
+			marks = " // indirect"
+		case !requirement.Reachable:
+			marks = " // unreachable"
+		}
+		fmt.Fprintf(w, "%s %s%s\n", requirement.Path, requirement.Version, marks)
+	}
+}
@@ -0,0 +1,67 @@
+// Licensed under the Apache License, Version 2.0 (the "License");
+// you may not use this file except in compliance with the License.
+// You may obtain a copy of the License at
+//
+// http://www.apache.org/licenses/LICENSE-2.0
+//
+// Unless required by applicable law or agreed to in writing, software
+// distributed under the License is distributed on an "AS IS" BASIS,
+// WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+// See the License for the specific language governing permissions and
+// limitations under the License.
+
+package main
+
+import (
+	"bytes"
+	"io/ioutil"
+	"os"
+	"path/filepath"
+
+	"github.com/stretchr/testify/require"
+)
+
+func (s *Zuite) TestRequirements() {
+	dir, err := ioutil.TempDir("", "depper")
+	require.NoError(s.T(), err)
+	defer os.RemoveAll(dir)
+
+	s.writeFiles(dir, map[string]string{
+		"app/go.mod": "module example.com/app\n\ngo 1.17\n\n" +
+			"require (\n\texample.com/lib v0.1.0\n\texample.com/testlib v0.1.0\n\texample.com/gone v0.1.0\n)\n\n" +
+			"require example.com/deep v0.1.0 // indirect\n\n" +
+			"replace example.com/lib => ../lib\n\nreplace example.com/testlib => ../testlib\n\n" +
+			"replace example.com/gone => ../gone\n\nreplace example.com/deep => ../deep\n",
+		"app/server/server.go":      "package server\n\nimport _ \"example.com/lib/http\"\n",
+		"app/server/server_test.go": "package server\n\nimport _ \"example.com/testlib/assert\"\n",
+		"lib/go.mod":                "module example.com/lib\n\ngo 1.17\n\nrequire example.com/deep v0.1.0\n\nreplace example.com/deep => ../deep\n",
+		"lib/http/http.go":          "package http\n\nimport _ \"example.com/deep/wire\"\n",
+		"testlib/go.mod":            "module example.com/testlib\n",
+		"testlib/assert/assert.go":  "package assert\n",
+		"gone/go.mod":               "module example.com/gone\n",
+		"gone/gone.go":              "package gone\n",
+		"deep/go.mod":               "module example.com/deep\n",
+		"deep/wire/wire.go":         "package wire\n",
+	})
+
+	// Modules imported transitively, or by tests, are reachable.
+	var defs defs
+	defs.Config.WorkingPackage = "example.com/app"
+	requirements, err := defs.requirements(defs.loadConfig(filepath.Join(dir, "app"), nil))
+	require.NoError(s.T(), err)
+	require.Equal(s.T(), []*requirement{
+		{Path: "example.com/lib", Version: "v0.1.0", Reachable: true},
+		{Path: "example.com/testlib", Version: "v0.1.0", Reachable: true},
+		{Path: "example.com/gone", Version: "v0.1.0"},
+		{Path: "example.com/deep", Version: "v0.1.0", Indirect: true, Reachable: true},
+	}, requirements)
+
+	var buf bytes.Buffer
+	requirements[3].Reachable = false
+	writeRequirements(&buf, requirements)
+	require.Equal(s.T(), `example.com/lib v0.1.0
+example.com/testlib v0.1.0
+example.com/gone v0.1.0 // unreachable
+example.com/deep v0.1.0 // indirect, unreachable
+`, buf.String())
+}
@@ -0,0 +1,128 @@
+// Licensed under the Apache License, Version 2.0 (the "License");
+// you may not use this file except in compliance with the License.
+// You may obtain a copy of the License at
+//
+// http://www.apache.org/licenses/LICENSE-2.0
+//
+// Unless required by applicable law or agreed to in writing, software
+// distributed under the License is distributed on an "AS IS" BASIS,
+// WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+// See the License for the specific language governing permissions and
+// limitations under the License.
+
+package main
+
+import (
+	"bytes"
+	"encoding/json"
+	"fmt"
+	"io/ioutil"
+	"os"
+	"strings"
+)
+
+// maxNotified is the number of violations listed in notifications, beyond
+// which they are only counted.
+const maxNotified = 20
+
+// loadReport loads the report written by the json format at path. A missing
+// report is empty, e.g. on the first run, as is no report at all.
+func loadReport(path string) (*report, error) {
+	if path == "" {
+		return &report{}, nil
+	}
+	data, err := ioutil.ReadFile(path)
+	if os.IsNotExist(err) {
+		return &report{}, nil
+	} else if err != nil {
+		return nil, err
+	}
+	var report report
+	if err := json.Unmarshal(data, &report); err != nil {
+		return nil, fmt.Errorf("malformed report %s: %s", path, err)
+	}
+	return &report, nil
+}
+
+// Ways violations of the report are matched with those of the baseline.
+const (
+	matchID     = "id"
+	matchTarget = "target"
+)
+
+// newViolations returns the violations of the report which the baseline
+// lacks, as told apart by their fingerprints. When matching by target,
+// violations left are further matched by rule, kind and dependency target, so
+// that violations whose importer was renamed or moved are not new. Each
+// violation of the baseline matches at most one, so that new importers of the
+// same target remain new.
+func newViolations(report, baseline *report, match string) []*violation {
+	known := make(map[string]bool)
+	for _, v := range baseline.violations() {
+		known[v.fingerprint()] = true
+	}
+	var fresh []*violation
+	for _, v := range report.violations() {
+		if !known[v.fingerprint()] {
+			fresh = append(fresh, v)
+		}
+	}
+	if match != matchTarget {
+		return fresh
+	}
+
+	current := make(map[string]bool)
+	for _, v := range report.violations() {
+		current[v.fingerprint()] = true
+	}
+	unmatched := make(map[string]int)
+	for _, v := range baseline.violations() {
+		if !current[v.fingerprint()] {
+			unmatched[v.target()]++
+		}
+	}
+	var renamed []*violation
+	for _, v := range fresh {
+		if unmatched[v.target()] != 0 {
+			unmatched[v.target()]--
+			continue
+		}
+		renamed = append(renamed, v)
+	}
+	return renamed
+}
+
+// notify posts a summary of the new violations to the Slack compatible
+// webhook, if any.
+func notify(webhook string, report *report, fresh []*violation) error {
+	if len(fresh) == 0 {
+		return nil
+	}
+	var text strings.Builder
+	fmt.Fprintf(&text, "depper found %s (%s, %s in total)", plural(len(fresh), "new violation"),
+		plural(report.Errors, "error"), plural(report.Warnings, "warning"))
+	if report.DryRun {
+		text.WriteString(", dry run")
+	}
+	for i, v := range fresh {
+		if i == maxNotified {
+			fmt.Fprintf(&text, "\nand %d more", len(fresh)-maxNotified)
+			break
+		}
+		fmt.Fprintf(&text, "\n%s: %s", v.Rule, v.String())
+	}
+
+	payload, err := json.Marshal(map[string]string{"text": text.String()})
+	if err != nil {
+		return err
+	}
+	resp, err := httpClient.Post(webhook, "application/json", bytes.NewReader(payload))
+	if err != nil {
+		return err
+	}
+	defer resp.Body.Close()
+	if resp.StatusCode/100 != 2 {
+		return fmt.Errorf("failed to notify %s: %s", webhook, resp.Status)
+	}
+	return nil
+}
@@ -0,0 +1,113 @@
+// Licensed under the Apache License, Version 2.0 (the "License");
+// you may not use this file except in compliance with the License.
+// You may obtain a copy of the License at
+//
+// http://www.apache.org/licenses/LICENSE-2.0
+//
+// Unless required by applicable law or agreed to in writing, software
+// distributed under the License is distributed on an "AS IS" BASIS,
+// WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+// See the License for the specific language governing permissions and
+// limitations under the License.
+
+package main
+
+import (
+	"encoding/json"
+	"io/ioutil"
+	"net/http"
+	"net/http/httptest"
+	"os"
+	"path/filepath"
+
+	"github.com/stretchr/testify/require"
+)
+
+func (s *Zuite) TestNotify() {
+	var payloads []map[string]string
+	server := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		var payload map[string]string
+		require.NoError(s.T(), json.NewDecoder(r.Body).Decode(&payload))
+		payloads = append(payloads, payload)
+	}))
+	defer server.Close()
+
+	baseline := &report{}
+	baseline.add("", "services", severityError, []*violation{
+		{Kind: kindDisallowed, From: "services/user", To: "dal/user", Position: "services/user/user.go:4"},
+	})
+	current := &report{}
+	current.add("", "services", severityError, []*violation{
+		{Kind: kindDisallowed, From: "services/user", To: "dal/user", Position: "services/user/user.go:5"},
+		{Kind: kindDisallowed, From: "services/billing", To: "dal/billing"},
+	})
+	current.add("", "dal", severityWarn, []*violation{
+		{Kind: kindDisallowed, From: "dal/user", To: "services/user"},
+	})
+
+	// Violations which moved are not new.
+	fresh := newViolations(current, baseline, matchID)
+	require.Equal(s.T(), []string{
+		"- disallowed services/billing -> dal/billing",
+		"- disallowed dal/user -> services/user",
+	}, lines(fresh))
+
+	require.NoError(s.T(), notify(server.URL, current, fresh))
+	require.NoError(s.T(), notify(server.URL, current, nil))
+	require.Equal(s.T(), []map[string]string{{
+		"text": "depper found 2 new violations (2 errors, 1 warning in total)\n" +
+			"services: - disallowed services/billing -> dal/billing\n" +
+			"dal: - disallowed dal/user -> services/user",
+	}}, payloads)
+
+	failing := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		w.WriteHeader(http.StatusForbidden)
+	}))
+	defer failing.Close()
+	require.EqualError(s.T(), notify(failing.URL, current, fresh), "failed to notify "+failing.URL+": 403 Forbidden")
+}
+
+func (s *Zuite) TestNewViolations_target() {
+	baseline := &report{}
+	baseline.add("", "services", severityError, []*violation{
+		{Kind: kindDisallowed, From: "services/user", To: "dal/user"},
+		{Kind: kindDisallowed, From: "services/billing", To: "dal/billing"},
+		{Kind: kindDisallowed, From: "services/gone", To: "dal/gone"},
+	})
+	current := &report{}
+	current.add("", "services", severityError, []*violation{
+		{Kind: kindDisallowed, From: "services/user", To: "dal/user"},
+		{Kind: kindDisallowed, From: "platform/billing", To: "dal/billing"},
+		{Kind: kindDisallowed, From: "platform/invoice", To: "dal/billing"},
+		{Kind: kindDisallowed, From: "platform/user", To: "dal/user"},
+	})
+
+	require.Equal(s.T(), []string{
+		"- disallowed platform/billing -> dal/billing",
+		"- disallowed platform/invoice -> dal/billing",
+		"- disallowed platform/user -> dal/user",
+	}, lines(newViolations(current, baseline, matchID)))
+
+	// A moved importer takes over its violation, but only once, and not one
+	// still reported where it was.
+	require.Equal(s.T(), []string{
+		"- disallowed platform/invoice -> dal/billing",
+		"- disallowed platform/user -> dal/user",
+	}, lines(newViolations(current, baseline, matchTarget)))
+}
+
+func (s *Zuite) TestLoadReport() {
+	dir, err := ioutil.TempDir("", "depper")
+	require.NoError(s.T(), err)
+	defer os.RemoveAll(dir)
+
+	// Missing reports are empty.
+	report, err := loadReport(filepath.Join(dir, "report.json"))
+	require.NoError(s.T(), err)
+	require.Empty(s.T(), report.violations())
+
+	require.NoError(s.T(), ioutil.WriteFile(filepath.Join(dir, "report.json"), []byte(`{"sections":[{"id":"services","name":"services","severity":"error","violations":[{"rule":"services","rule_id":"services","kind":"disallowed","from":"a","to":"b"}]}],"errors":1,"warnings":0}`), 0644))
+	report, err = loadReport(filepath.Join(dir, "report.json"))
+	require.NoError(s.T(), err)
+	require.Equal(s.T(), []string{"- disallowed a -> b"}, lines(report.violations()))
+}
@@ -0,0 +1,251 @@
+// Licensed under the Apache License, Version 2.0 (the "License");
+// you may not use this file except in compliance with the License.
+// You may obtain a copy of the License at
+//
+// http://www.apache.org/licenses/LICENSE-2.0
+//
+// Unless required by applicable law or agreed to in writing, software
+// distributed under the License is distributed on an "AS IS" BASIS,
+// WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+// See the License for the specific language governing permissions and
+// limitations under the License.
+
+package main
+
+import (
+	"crypto/sha256"
+	"encoding/json"
+	"fmt"
+	"io/ioutil"
+	"net/http"
+	"os"
+	"os/exec"
+	"path"
+	"path/filepath"
+	"sort"
+	"strings"
+	"time"
+)
+
+// presets are rule files shipped with depper for common policies, by name.
+// They assume common layouts, e.g. a `dal` data access layer, and can be
+// copied into configs to be adapted.
+var presets = map[string]string{
+	"db-confinement": `
+rules:
+  - name: only the data access layer accesses databases
+    packages: .*
+    except: dal(/.*)?
+    may_not_depend:
+      - <^database/sql(/.*)?$>
+      - ^github.com/jmoiron/sqlx(/|$)
+      - ^gorm.io/
+      - ^github.com/jinzhu/gorm(/|$)
+      - ^github.com/jackc/pgx(/|$)
+      - ^github.com/lib/pq(/|$)
+      - ^github.com/go-sql-driver/mysql(/|$)
+      - ^github.com/mattn/go-sqlite3(/|$)
+`,
+	"http-client-confinement": `
+rules:
+  - name: only the clients packages use http client libraries
+    packages: .*
+    except: clients(/.*)?
+    may_not_depend:
+      - ^github.com/go-resty/resty(/|$)
+      - ^github.com/hashicorp/go-retryablehttp(/|$)
+      - ^github.com/parnurzeal/gorequest(/|$)
+      - ^github.com/imroc/req(/|$)
+`,
+	"deprecated-std": `
+rules:
+  - name: no deprecated or frozen standard library packages
+    packages: .*
+    may_not_depend:
+      - <^io/ioutil$>
+      - <^net/rpc(/jsonrpc)?$>
+      - <^crypto/dsa$>
+      - <^net/http/cgi$>
+    severity: warn
+`,
+}
+
+// include adds the rules of the included rule files, and presets. Rule names
+// are prefixed by the file or preset name. Entries are
+//
+// - shipped presets, e.g. `preset:db-confinement`;
+// - files of a module version, e.g.
+// `module:github.com/org/depper-rules@v1.2.0/platform.yaml`, downloaded with
+// the go command and so verified against the checksum database;
+// - URLs pinned to the SHA-256 checksum of the file, e.g.
+// `https://example.com/platform.yaml@sha256:...`, cached once fetched, along
+// with their signature, in the cache directory, by default the user's; or
+// - paths relative to dir.
+//
+// When signatures are configured, included files other than presets must have
+// a valid signature.
+func (defs *defs) include(dir string) error {
+	for _, entry := range defs.Include {
+		var (
+			input    []byte
+			name     string
+			source   = entry
+			cacheDir string
+			err      error
+		)
+		switch {
+		case strings.HasPrefix(entry, "preset:"):
+			name = strings.TrimPrefix(entry, "preset:")
+			preset, ok := presets[name]
+			if !ok {
+				var names []string
+				for name := range presets {
+					names = append(names, name)
+				}
+				sort.Strings(names)
+				return fmt.Errorf("unknown preset %s, must be one of %s", name, strings.Join(names, ", "))
+			}
+			input = []byte(preset)
+		case strings.HasPrefix(entry, "module:"):
+			input, err = moduleFile(strings.TrimPrefix(entry, "module:"), dir, nil)
+		case strings.HasPrefix(entry, "https://") || strings.HasPrefix(entry, "http://"):
+			if cacheDir, err = defs.cacheDir(); err != nil {
+				return err
+			}
+			cacheDir = filepath.Join(cacheDir, "include")
+			input, err = fetchPinned(entry, cacheDir)
+		default:
+			path := entry
+			if !filepath.IsAbs(path) {
+				path = filepath.Join(dir, path)
+			}
+			input, err = ioutil.ReadFile(path)
+			source = path
+		}
+		if err != nil {
+			return err
+		}
+		if name == "" {
+			name = includeName(entry)
+			if err := defs.Config.Signatures.verifyInclude(entry, dir, cacheDir, input); err != nil {
+				return err
+			}
+		}
+		if err := defs.loadRules(input, source, name); err != nil {
+			return err
+		}
+	}
+	return nil
+}
+
+// includeName returns the name of the included file, without directory,
+// extension or pin, e.g. `platform` for `https://example.com/platform.yaml@sha256:...`.
+func includeName(entry string) string {
+	entry, _ = splitPin(entry)
+	entry = strings.SplitN(entry, "?", 2)[0]
+	base := path.Base(filepath.ToSlash(entry))
+	return strings.TrimSuffix(base, path.Ext(base))
+}
+
+// splitPin splits the `@sha256:` or `#sha256=` pin off the entry, if any.
+func splitPin(entry string) (string, string) {
+	for _, separator := range []string{"@sha256:", "#sha256="} {
+		if i := strings.LastIndex(entry, separator); i >= 0 {
+			return entry[:i], strings.ToLower(entry[i+len(separator):])
+		}
+	}
+	return entry, ""
+}
+
+// checkPin verifies that the input has the pinned checksum, if any.
+func checkPin(source string, input []byte, pin string) error {
+	if pin == "" {
+		return nil
+	}
+	if sum := fmt.Sprintf("%x", sha256.Sum256(input)); sum != pin {
+		return fmt.Errorf("checksum mismatch for %s, sha256 is %s rather than %s", source, sum, pin)
+	}
+	return nil
+}
+
+// fetchPinned returns the file at the pinned URL, from cacheDir if fetched
+// already.
+func fetchPinned(entry, cacheDir string) ([]byte, error) {
+	url, pin := splitPin(entry)
+	if pin == "" {
+		return nil, fmt.Errorf("%s must be pinned with @sha256:<checksum of the file>", url)
+	}
+	cached := filepath.Join(cacheDir, pin+".yaml")
+	if input, err := ioutil.ReadFile(cached); err == nil && checkPin(url, input, pin) == nil {
+		return input, nil
+	}
+
+	input, err := fetch(url)
+	if err != nil {
+		return nil, err
+	}
+	if err := checkPin(url, input, pin); err != nil {
+		return nil, err
+	}
+
+	// Caching is best effort.
+	if err := os.MkdirAll(cacheDir, 0755); err == nil {
+		ioutil.WriteFile(cached, input, 0644)
+	}
+	return input, nil
+}
+
+// httpClient fetches included files and posts notifications, giving up on
+// unresponsive servers rather than hanging the run.
+var httpClient = &http.Client{Timeout: 30 * time.Second}
+
+// fetch returns the file at the URL.
+func fetch(url string) ([]byte, error) {
+	resp, err := httpClient.Get(url)
+	if err != nil {
+		return nil, err
+	}
+	defer resp.Body.Close()
+	if resp.StatusCode != http.StatusOK {
+		return nil, fmt.Errorf("failed to fetch %s: %s", url, resp.Status)
+	}
+	return ioutil.ReadAll(resp.Body)
+}
+
+// moduleFile returns the file of the module version, e.g.
+// `github.com/org/depper-rules@v1.2.0/platform.yaml`, downloading the module
+// from dir with the environment.
+func moduleFile(entry, dir string, env []string) ([]byte, error) {
+	entry, pin := splitPin(entry)
+	at := strings.Index(entry, "@")
+	if at < 0 {
+		return nil, fmt.Errorf("module include %s must be module@version/file", entry)
+	}
+	slash := strings.Index(entry[at:], "/")
+	if slash < 0 {
+		return nil, fmt.Errorf("module include %s must be module@version/file", entry)
+	}
+	modVersion, file := entry[:at+slash], entry[at+slash+1:]
+
+	cmd := exec.Command("go", "mod", "download", "-json", modVersion)
+	cmd.Dir = dir
+	if len(env) != 0 {
+		cmd.Env = append(os.Environ(), env...)
+	}
+	out, err := cmd.Output()
+	var download struct {
+		Dir   string
+		Error string
+	}
+	if jsonErr := json.Unmarshal(out, &download); jsonErr != nil || download.Error != "" || err != nil {
+		if download.Error == "" && err != nil {
+			download.Error = err.Error()
+		}
+		return nil, fmt.Errorf("failed to download %s: %s", modVersion, download.Error)
+	}
+	input, err := ioutil.ReadFile(filepath.Join(download.Dir, filepath.FromSlash(file)))
+	if err != nil {
+		return nil, err
+	}
+	return input, checkPin(entry, input, pin)
+}
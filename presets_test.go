@@ -0,0 +1,198 @@
+// Licensed under the Apache License, Version 2.0 (the "License");
+// you may not use this file except in compliance with the License.
+// You may obtain a copy of the License at
+//
+// http://www.apache.org/licenses/LICENSE-2.0
+//
+// Unless required by applicable law or agreed to in writing, software
+// distributed under the License is distributed on an "AS IS" BASIS,
+// WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+// See the License for the specific language governing permissions and
+// limitations under the License.
+
+package main
+
+import (
+	"archive/zip"
+	"bytes"
+	"crypto/sha256"
+	"fmt"
+	"io/ioutil"
+	"net/http"
+	"net/http/httptest"
+	"os"
+	"path/filepath"
+	"strings"
+
+	"github.com/stretchr/testify/require"
+)
+
+func (s *Zuite) TestPresets() {
+	// Every preset compiles.
+	for name := range presets {
+		_, err := parse([]byte("config:\n  working_package: wp\ninclude:\n  - preset:" + name + "\n"))
+		require.NoError(s.T(), err, name)
+	}
+
+	g := graphOf(map[string]*pkg{
+		"wp/dal/users":               &pkg{name: "wp/dal/users"},
+		"wp/services/billing":        &pkg{name: "wp/services/billing"},
+		"database/sql":               &pkg{name: "database/sql", goroot: true},
+		"gorm.io/gorm":               &pkg{name: "gorm.io/gorm"},
+		"github.com/jackc/pgx/v5":    &pkg{name: "github.com/jackc/pgx/v5"},
+		"github.com/jackc/pgxlisten": &pkg{name: "github.com/jackc/pgxlisten"},
+	},
+		"wp/dal/users -> database/sql",
+		"wp/dal/users -> github.com/jackc/pgx/v5",
+		"wp/services/billing -> database/sql",
+		"wp/services/billing -> gorm.io/gorm",
+		"wp/services/billing -> github.com/jackc/pgxlisten",
+	)
+	defs, err := parse([]byte(`
+config:
+  working_package: wp
+include:
+  - preset:db-confinement
+`))
+	require.NoError(s.T(), err)
+	require.Len(s.T(), defs.Rules, 1)
+	require.Equal(s.T(), "db-confinement: only the data access layer accesses databases", defs.Rules[0].Name)
+	require.Equal(s.T(), []string{
+		"- disallowed wp/services/billing -> database/sql",
+		"- disallowed wp/services/billing -> gorm.io/gorm",
+	}, lines(defs.Rules[0].check(g).violations))
+
+	_, err = parse([]byte("include:\n  - preset:orm\n"))
+	require.EqualError(s.T(), err, "unknown preset orm, must be one of db-confinement, deprecated-std, http-client-confinement")
+}
+
+func (s *Zuite) TestInclude() {
+	dir, err := ioutil.TempDir("", "depper")
+	require.NoError(s.T(), err)
+	defer os.RemoveAll(dir)
+
+	require.NoError(s.T(), ioutil.WriteFile(filepath.Join(dir, "depper.yaml"), []byte(`
+config:
+  working_package: wp
+include:
+  - shared/platform.yaml
+  - preset:deprecated-std
+rules:
+  - name: own
+    packages: .*
+    may_not_depend:
+      - legacy
+`), 0644))
+	require.NoError(s.T(), os.MkdirAll(filepath.Join(dir, "shared"), 0755))
+	require.NoError(s.T(), ioutil.WriteFile(filepath.Join(dir, "shared/platform.yaml"), []byte(`
+rules:
+  - name: no vendored sdk
+    packages: .*
+    may_not_depend:
+      - sdk
+`), 0644))
+
+	// Included rules come after the config's own.
+	defs, err := parseFile(filepath.Join(dir, "depper.yaml"))
+	require.NoError(s.T(), err)
+	var names []string
+	for _, rule := range defs.Rules {
+		names = append(names, rule.Name)
+	}
+	require.Equal(s.T(), []string{"own", "platform: no vendored sdk", "deprecated-std: no deprecated or frozen standard library packages"}, names)
+	require.Equal(s.T(), filepath.Join(dir, "shared/platform.yaml"), defs.Rules[1].source)
+	require.Equal(s.T(), "preset:deprecated-std", defs.Rules[2].source)
+
+	// Remote files are cached in the cache directory, relative to the
+	// config.
+	rules := "rules:\n  - name: no sdk\n    packages: .*\n    may_not_depend:\n      - sdk\n"
+	server := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		w.Write([]byte(rules))
+	}))
+	defer server.Close()
+	pin := fmt.Sprintf("%x", sha256.Sum256([]byte(rules)))
+	require.NoError(s.T(), ioutil.WriteFile(filepath.Join(dir, "depper.yaml"), []byte(`
+config:
+  working_package: wp
+  cache_dir: .depper
+include:
+  - `+server.URL+`/org-rules.yaml@sha256:`+pin+`
+`), 0644))
+	defs, err = parseFile(filepath.Join(dir, "depper.yaml"))
+	require.NoError(s.T(), err)
+	require.Equal(s.T(), "org-rules: no sdk", defs.Rules[0].Name)
+	require.FileExists(s.T(), filepath.Join(dir, ".depper/include", pin+".yaml"))
+}
+
+func (s *Zuite) TestFetchPinned() {
+	dir, err := ioutil.TempDir("", "depper")
+	require.NoError(s.T(), err)
+	defer os.RemoveAll(dir)
+
+	rules := "rules:\n  - name: no sdk\n    packages: .*\n    may_not_depend:\n      - sdk\n"
+	fetched := 0
+	server := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		fetched++
+		w.Write([]byte(rules))
+	}))
+	defer server.Close()
+	pin := fmt.Sprintf("%x", sha256.Sum256([]byte(rules)))
+
+	// Pinned files are fetched once.
+	for i := 0; i < 2; i++ {
+		input, err := fetchPinned(server.URL+"/platform.yaml#sha256="+pin, dir)
+		require.NoError(s.T(), err)
+		require.Equal(s.T(), rules, string(input))
+	}
+	require.Equal(s.T(), 1, fetched)
+	require.Equal(s.T(), "platform", includeName(server.URL+"/platform.yaml#sha256="+pin))
+	input, err := fetchPinned(server.URL+"/platform.yaml@sha256:"+strings.ToUpper(pin), dir)
+	require.NoError(s.T(), err)
+	require.Equal(s.T(), rules, string(input))
+	require.Equal(s.T(), "platform", includeName(server.URL+"/platform.yaml@sha256:"+pin))
+
+	_, err = fetchPinned(server.URL+"/platform.yaml", dir)
+	require.EqualError(s.T(), err, server.URL+"/platform.yaml must be pinned with @sha256:<checksum of the file>")
+	_, err = fetchPinned(server.URL+"/platform.yaml#sha256=00", dir)
+	require.EqualError(s.T(), err, "checksum mismatch for "+server.URL+"/platform.yaml, sha256 is "+pin+" rather than 00")
+}
+
+func (s *Zuite) TestModuleFile() {
+	dir, err := ioutil.TempDir("", "depper")
+	require.NoError(s.T(), err)
+	defer os.RemoveAll(dir)
+
+	// The module is served by a file system proxy.
+	rules := "rules:\n  - name: no sdk\n    packages: .*\n    may_not_depend:\n      - sdk\n"
+	versions := filepath.Join(dir, "proxy/example.com/rules/@v")
+	require.NoError(s.T(), os.MkdirAll(versions, 0755))
+	require.NoError(s.T(), ioutil.WriteFile(filepath.Join(versions, "list"), []byte("v1.0.0\n"), 0644))
+	require.NoError(s.T(), ioutil.WriteFile(filepath.Join(versions, "v1.0.0.info"), []byte(`{"Version":"v1.0.0"}`), 0644))
+	require.NoError(s.T(), ioutil.WriteFile(filepath.Join(versions, "v1.0.0.mod"), []byte("module example.com/rules\n"), 0644))
+	var zipped bytes.Buffer
+	archive := zip.NewWriter(&zipped)
+	for name, contents := range map[string]string{"go.mod": "module example.com/rules\n", "platform.yaml": rules} {
+		w, err := archive.Create("example.com/rules@v1.0.0/" + name)
+		require.NoError(s.T(), err)
+		_, err = w.Write([]byte(contents))
+		require.NoError(s.T(), err)
+	}
+	require.NoError(s.T(), archive.Close())
+	require.NoError(s.T(), ioutil.WriteFile(filepath.Join(versions, "v1.0.0.zip"), zipped.Bytes(), 0644))
+
+	env := []string{
+		"GOPROXY=file://" + filepath.ToSlash(filepath.Join(dir, "proxy")),
+		"GOSUMDB=off",
+		"GOFLAGS=-modcacherw",
+		"GOMODCACHE=" + filepath.Join(dir, "cache"),
+	}
+	input, err := moduleFile("example.com/rules@v1.0.0/platform.yaml", dir, env)
+	require.NoError(s.T(), err)
+	require.Equal(s.T(), rules, string(input))
+	_, err = moduleFile("example.com/rules@v1.0.0/platform.yaml#sha256=00", dir, env)
+	require.Error(s.T(), err)
+	_, err = moduleFile("example.com/rules@v2.0.0/platform.yaml", dir, env)
+	require.Error(s.T(), err)
+	_, err = moduleFile("example.com/rules/platform.yaml", dir, env)
+	require.EqualError(s.T(), err, "module include example.com/rules/platform.yaml must be module@version/file")
+}
@@ -0,0 +1,62 @@
+// Licensed under the Apache License, Version 2.0 (the "License");
+// you may not use this file except in compliance with the License.
+// You may obtain a copy of the License at
+//
+// http://www.apache.org/licenses/LICENSE-2.0
+//
+// Unless required by applicable law or agreed to in writing, software
+// distributed under the License is distributed on an "AS IS" BASIS,
+// WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+// See the License for the specific language governing permissions and
+// limitations under the License.
+
+package main
+
+import (
+	"strings"
+)
+
+// protoRuntimes are imported by generated proto code only, unlike e.g.
+// `github.com/golang/protobuf/proto` which hand written code uses too.
+var protoRuntimes = []string{
+	"google.golang.org/protobuf/runtime/protoimpl",
+	"github.com/gogo/protobuf/protoc-gen-gogo/descriptor",
+}
+
+// isGeneratedProto indicates whether the package is generated from protos,
+// e.g. by protoc-gen-go or protoc-gen-go-grpc.
+//
+// Packages whose files were collected are told by their gencode markers, i.e.
+// `.pb.go` files or imports of the runtime of generated code. Others, e.g.
+// third parties, are told by path convention: an element `genproto`, as in
+// `google.golang.org/genproto/googleapis/rpc/status`, or a last element
+// ending in `pb` or `_proto`, as in `cloud.google.com/go/pubsub/apiv1/pubsubpb`
+// or Bazel's `billing_go_proto`.
+func isGeneratedProto(pkg *pkg) bool {
+	if pkg.goroot {
+		return false
+	}
+	if len(pkg.files) != 0 {
+		for _, file := range pkg.files {
+			if strings.HasSuffix(file.name, ".pb.go") {
+				return true
+			}
+			for _, imp := range file.imports {
+				for _, runtime := range protoRuntimes {
+					if imp.path == runtime {
+						return true
+					}
+				}
+			}
+		}
+		return false
+	}
+	elements := strings.Split(pkg.name, "/")
+	for _, element := range elements[:len(elements)-1] {
+		if element == "genproto" {
+			return true
+		}
+	}
+	last := elements[len(elements)-1]
+	return strings.HasSuffix(last, "pb") || strings.HasSuffix(last, "_proto")
+}
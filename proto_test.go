@@ -0,0 +1,37 @@
+// Licensed under the Apache License, Version 2.0 (the "License");
+// you may not use this file except in compliance with the License.
+// You may obtain a copy of the License at
+//
+// http://www.apache.org/licenses/LICENSE-2.0
+//
+// Unless required by applicable law or agreed to in writing, software
+// distributed under the License is distributed on an "AS IS" BASIS,
+// WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+// See the License for the specific language governing permissions and
+// limitations under the License.
+
+package main
+
+import (
+	"github.com/stretchr/testify/require"
+)
+
+func (s *Zuite) TestIsGeneratedProto() {
+	// Collected packages, by gencode markers.
+	require.True(s.T(), isGeneratedProto(&pkg{name: "wp/api", files: []*goFile{{name: "api/doc.go"}, {name: "api/api.pb.go"}}}))
+	require.True(s.T(), isGeneratedProto(&pkg{name: "wp/api", files: []*goFile{{name: "api/api.go", imports: []*goImport{{path: "google.golang.org/protobuf/runtime/protoimpl"}}}}}))
+	require.False(s.T(), isGeneratedProto(&pkg{name: "wp/billingpb", files: []*goFile{{name: "billingpb/billing.go", imports: []*goImport{{path: "github.com/golang/protobuf/proto"}}}}}))
+
+	// Others, by path convention.
+	for _, name := range []string{
+		"google.golang.org/genproto/googleapis/rpc/status",
+		"cloud.google.com/go/pubsub/apiv1/pubsubpb",
+		"wp/proto/billing_go_proto",
+	} {
+		require.True(s.T(), isGeneratedProto(&pkg{name: name}), name)
+	}
+	for _, name := range []string{"github.com/golang/protobuf/proto", "wp/genproto", "wp/services/billing"} {
+		require.False(s.T(), isGeneratedProto(&pkg{name: name}), name)
+	}
+	require.False(s.T(), isGeneratedProto(&pkg{name: "pb", goroot: true}))
+}
@@ -0,0 +1,878 @@
+// Licensed under the Apache License, Version 2.0 (the "License");
+// you may not use this file except in compliance with the License.
+// You may obtain a copy of the License at
+//
+// http://www.apache.org/licenses/LICENSE-2.0
+//
+// Unless required by applicable law or agreed to in writing, software
+// distributed under the License is distributed on an "AS IS" BASIS,
+// WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+// See the License for the specific language governing permissions and
+// limitations under the License.
+
+package main
+
+import (
+	"encoding/json"
+	"fmt"
+	"io"
+	"os"
+	"path/filepath"
+	"strconv"
+	"strings"
+	"text/template"
+)
+
+// report gathers the outcome of a run, for writing in any of the formats.
+type report struct {
+	Sections []*section `json:"sections"`
+	Errors   int        `json:"errors"`
+	Warnings int        `json:"warnings"`
+
+	// DryRun reports violations which do not fail the run, e.g. while
+	// socializing new rules before enforcing them.
+	DryRun bool `json:"dry_run,omitempty"`
+
+	// Score is the health score of the architecture, when configured.
+	Score *health `json:"score,omitempty"`
+
+	// ThirdParties are the third party modules working packages depend on,
+	// when asked.
+	ThirdParties []string `json:"third_parties,omitempty"`
+}
+
+// section is the outcome of a rule, or of any other check.
+type section struct {
+	ID         string       `json:"id"`
+	Name       string       `json:"name"`
+	Severity   string       `json:"severity"`
+	Violations []*violation `json:"violations"`
+
+	// Exercised lists the expected dependencies actually seen, when asked.
+	Exercised []string `json:"exercised,omitempty"`
+
+	// Source is where the rule of the section was read from, for sections
+	// of rules, e.g. a file of the rules directory of the config.
+	Source string `json:"source,omitempty"`
+}
+
+// add adds a section with the violations, counting them by severity. The
+// violations are attributed to the section. The id defaults to the slug of
+// the name, see slugify.
+func (report *report) add(id, name, severity string, violations []*violation) *section {
+	if id == "" {
+		id = slugify(name)
+	}
+	section := &section{
+		ID:         id,
+		Name:       name,
+		Severity:   severity,
+		Violations: make([]*violation, 0, len(violations)),
+	}
+	for _, v := range violations {
+		attributed := *v
+		attributed.Rule, attributed.RuleID = name, id
+		attributed.ID = attributed.fingerprint()
+		section.Violations = append(section.Violations, &attributed)
+	}
+	if severity == severityWarn {
+		report.Warnings += len(violations)
+	} else {
+		report.Errors += len(violations)
+	}
+	report.Sections = append(report.Sections, section)
+	return section
+}
+
+// violations returns the violations of all sections, in order.
+func (report *report) violations() []*violation {
+	var violations []*violation
+	for _, section := range report.Sections {
+		violations = append(violations, section.Violations...)
+	}
+	return violations
+}
+
+// reporter writes a report in one of the formats, violation by violation:
+// start is called with the report, violation with each of its violations in
+// order, along with their section, and summary once all were reported. close
+// finishes writing, e.g. for formats which need the whole report at once.
+type reporter interface {
+	start(report *report) error
+	violation(section *section, v *violation) error
+	summary() error
+	close() error
+}
+
+// newReporter creates the reporter of a format writing to w, where path is
+// the destination, configured by the outputs.
+type newReporter func(w io.Writer, o *outputs, path string) (reporter, error)
+
+var (
+	// formats are the supported output formats, in registration order.
+	formats []string
+
+	// reporters create the reporter of each format.
+	reporters = make(map[string]newReporter)
+)
+
+// registerFormat registers the reporter of the format, e.g. from the init
+// function of the file implementing it.
+func registerFormat(name string, create newReporter) {
+	if _, ok := reporters[name]; ok {
+		panic("format " + name + " registered twice")
+	}
+	formats = append(formats, name)
+	reporters[name] = create
+}
+
+func init() {
+	registerFormat("text", func(w io.Writer, o *outputs, path string) (reporter, error) {
+		color := o.colorize(path)
+		return wholeReport(w, func(w io.Writer, report *report) error {
+			return writeText(w, report, color, o.sources)
+		}), nil
+	})
+	registerFormat("json", func(w io.Writer, o *outputs, path string) (reporter, error) {
+		return wholeReport(w, writeJSON), nil
+	})
+	registerFormat("template", func(w io.Writer, o *outputs, path string) (reporter, error) {
+		if o.template == nil {
+			return nil, fmt.Errorf("template format requires a template")
+		}
+		return &templateReporter{w: w, tmpl: o.template}, nil
+	})
+	registerFormat("gerrit", func(w io.Writer, o *outputs, path string) (reporter, error) {
+		runID := gerritRunID()
+		return wholeReport(w, func(w io.Writer, report *report) error {
+			return writeGerrit(w, report, runID)
+		}), nil
+	})
+	registerFormat("bitbucket", func(w io.Writer, o *outputs, path string) (reporter, error) {
+		return wholeReport(w, writeBitbucket), nil
+	})
+	registerFormat("azdo", func(w io.Writer, o *outputs, path string) (reporter, error) {
+		return wholeReport(w, writeAzdo), nil
+	})
+	registerFormat("teamcity", func(w io.Writer, o *outputs, path string) (reporter, error) {
+		return wholeReport(w, writeTeamCity), nil
+	})
+	registerFormat("sonarqube", func(w io.Writer, o *outputs, path string) (reporter, error) {
+		return wholeReport(w, writeSonarQube), nil
+	})
+	registerFormat("sarif", func(w io.Writer, o *outputs, path string) (reporter, error) {
+		return wholeReport(w, writeSARIF), nil
+	})
+}
+
+// writeReport reports every violation of the report with the reporter.
+func writeReport(r reporter, report *report) error {
+	if err := r.start(report); err != nil {
+		return err
+	}
+	for _, section := range report.Sections {
+		for _, v := range section.Violations {
+			if err := r.violation(section, v); err != nil {
+				return err
+			}
+		}
+	}
+	if err := r.summary(); err != nil {
+		return err
+	}
+	return r.close()
+}
+
+// wholeReporter is the reporter of formats written at once from the whole
+// report, when closed.
+type wholeReporter struct {
+	w      io.Writer
+	write  func(w io.Writer, report *report) error
+	report *report
+}
+
+func wholeReport(w io.Writer, write func(w io.Writer, report *report) error) reporter {
+	return &wholeReporter{w: w, write: write}
+}
+
+func (r *wholeReporter) start(report *report) error {
+	r.report = report
+	return nil
+}
+
+func (r *wholeReporter) violation(*section, *violation) error { return nil }
+
+func (r *wholeReporter) summary() error { return nil }
+
+func (r *wholeReporter) close() error {
+	return r.write(r.w, r.report)
+}
+
+// ANSI escape codes used by the text format.
+const (
+	colorReset  = "\x1b[0m"
+	colorBold   = "\x1b[1m"
+	colorRed    = "\x1b[31m"
+	colorGreen  = "\x1b[32m"
+	colorYellow = "\x1b[33m"
+)
+
+// writeText writes the violations of every section under a heading with their
+// count, labelled when dry running, followed by the exercised expectations if
+// any, and the health score if configured. With sources, headings of rules
+// tell where they were read from. Dependencies are aligned on their arrows,
+// and when color is set, headings and kinds of violations are colorized.
+func writeText(w io.Writer, report *report, color, sources bool) error {
+	paint := func(code, text string) string {
+		if !color {
+			return text
+		}
+		return code + text + colorReset
+	}
+
+	for _, section := range report.Sections {
+		if len(section.Violations) == 0 {
+			continue
+		}
+		details, kindColor := plural(len(section.Violations), "violation"), colorRed
+		if section.Severity == severityWarn {
+			details, kindColor = "warning, "+details, colorYellow
+		}
+		if report.DryRun {
+			details = "dry run, " + details
+		}
+		if sources && section.Source != "" {
+			details += ", from " + section.Source
+		}
+		fmt.Fprintf(w, "%s (%s)\n", paint(colorBold, section.Name), details)
+		lines := make([]string, len(section.Violations))
+		for i, violation := range section.Violations {
+			lines[i] = violation.String()
+		}
+		for _, line := range align(lines) {
+			fmt.Fprintln(w, paintKind(paint, kindColor, line))
+		}
+	}
+	for _, section := range report.Sections {
+		if len(section.Exercised) == 0 {
+			continue
+		}
+		fmt.Fprintf(w, "%s (expected, %s)\n", paint(colorBold, section.Name), plural(len(section.Exercised), "dependency"))
+		for _, dependency := range align(section.Exercised) {
+			fmt.Fprintf(w, "%s  %s\n", paint(colorGreen, "- exercised"), dependency)
+		}
+	}
+	if report.Score != nil {
+		fmt.Fprintln(w, paint(colorBold, report.Score.String()))
+	}
+	return nil
+}
+
+// paintKind paints the kind of a violation, e.g. `- disallowed` in
+// `- disallowed foo -> bar`.
+func paintKind(paint func(code, text string) string, code, violation string) string {
+	const width = len("- disallowed")
+	if !strings.HasPrefix(violation, "- ") || len(violation) < width {
+		return violation
+	}
+	return paint(code, violation[:width]) + violation[width:]
+}
+
+// align pads lines so that their first arrows are aligned.
+func align(lines []string) []string {
+	width := 0
+	for _, line := range lines {
+		if i := strings.Index(line, " -> "); i > width {
+			width = i
+		}
+	}
+	aligned := make([]string, len(lines))
+	for j, line := range lines {
+		if i := strings.Index(line, " -> "); i >= 0 {
+			line = line[:i] + strings.Repeat(" ", width-i) + line[i:]
+		}
+		aligned[j] = line
+	}
+	return aligned
+}
+
+func plural(count int, noun string) string {
+	if count == 1 {
+		return fmt.Sprintf("1 %s", noun)
+	}
+	if strings.HasSuffix(noun, "y") {
+		return fmt.Sprintf("%d %sies", count, strings.TrimSuffix(noun, "y"))
+	}
+	return fmt.Sprintf("%d %ss", count, noun)
+}
+
+func writeJSON(w io.Writer, report *report) error {
+	encoder := json.NewEncoder(w)
+	encoder.SetIndent("", "  ")
+	return encoder.Encode(report)
+}
+
+// splitPosition splits the position of a violation into the slash separated
+// path of the file, relative to the module root, and the line. It returns
+// false for positions which are not, e.g. of load errors out of the module.
+func splitPosition(position string) (string, int, bool) {
+	parts := strings.Split(position, ":")
+	if len(parts) < 2 || parts[0] == "" || filepath.IsAbs(parts[0]) {
+		return "", 0, false
+	}
+	line, err := strconv.Atoi(parts[1])
+	if err != nil {
+		return "", 0, false
+	}
+	return filepath.ToSlash(parts[0]), line, true
+}
+
+// gerritReview is the part of Gerrit's ReviewInput carrying robot comments,
+// by file.
+type gerritReview struct {
+	Message       string                           `json:"message,omitempty"`
+	RobotComments map[string][]*gerritRobotComment `json:"robot_comments"`
+}
+
+// gerritRobotComment is Gerrit's RobotCommentInput.
+type gerritRobotComment struct {
+	RobotID    string `json:"robot_id"`
+	RobotRunID string `json:"robot_run_id"`
+	Line       int    `json:"line,omitempty"`
+	Message    string `json:"message"`
+}
+
+// writeGerrit writes the violations as Gerrit robot comments of the run,
+// inline for violations with a position, i.e. the imports. Other violations
+// only make the message of the review.
+func writeGerrit(w io.Writer, report *report, runID string) error {
+	review := &gerritReview{RobotComments: make(map[string][]*gerritRobotComment)}
+	var others []string
+	for _, section := range report.Sections {
+		for _, violation := range section.Violations {
+			message := fmt.Sprintf("%s (%s): %s", section.Name, section.Severity, violation.String())
+			path, line, ok := splitPosition(violation.Position)
+			if !ok {
+				others = append(others, message)
+				continue
+			}
+			review.RobotComments[path] = append(review.RobotComments[path], &gerritRobotComment{
+				RobotID:    "depper",
+				RobotRunID: runID,
+				Line:       line,
+				Message:    message,
+			})
+		}
+	}
+	if len(others) != 0 {
+		review.Message = "depper\n" + strings.Join(others, "\n")
+	}
+	encoder := json.NewEncoder(w)
+	encoder.SetIndent("", "  ")
+	return encoder.Encode(review)
+}
+
+// bitbucketInsights is a Bitbucket Server Code Insights report, along with
+// its annotations, which are published with separate requests.
+type bitbucketInsights struct {
+	Report struct {
+		Title    string           `json:"title"`
+		Details  string           `json:"details"`
+		Result   string           `json:"result"`
+		Reporter string           `json:"reporter"`
+		Data     []*bitbucketData `json:"data"`
+	} `json:"report"`
+	Annotations []*bitbucketAnnotation `json:"annotations"`
+}
+
+type bitbucketData struct {
+	Title string `json:"title"`
+	Type  string `json:"type"`
+	Value int    `json:"value"`
+}
+
+type bitbucketAnnotation struct {
+	Path     string `json:"path,omitempty"`
+	Line     int    `json:"line,omitempty"`
+	Message  string `json:"message"`
+	Severity string `json:"severity"`
+	Type     string `json:"type"`
+}
+
+// maxBitbucketAnnotations is the number of annotations Bitbucket accepts per
+// report.
+const maxBitbucketAnnotations = 1000
+
+// writeBitbucket writes the report as a Code Insights report, failing when
+// there are errors unless dry running, with an annotation per violation, on
+// its file and line when it has a position.
+func writeBitbucket(w io.Writer, report *report) error {
+	var insights bitbucketInsights
+	insights.Report.Title = "depper"
+	insights.Report.Details = fmt.Sprintf("%s, %s", plural(report.Errors, "error"), plural(report.Warnings, "warning"))
+	insights.Report.Result = "PASS"
+	if report.Errors != 0 && !report.DryRun {
+		insights.Report.Result = "FAIL"
+	}
+	insights.Report.Reporter = "depper"
+	insights.Report.Data = []*bitbucketData{
+		{Title: "Errors", Type: "NUMBER", Value: report.Errors},
+		{Title: "Warnings", Type: "NUMBER", Value: report.Warnings},
+	}
+	insights.Annotations = []*bitbucketAnnotation{}
+	for _, section := range report.Sections {
+		for _, violation := range section.Violations {
+			if len(insights.Annotations) == maxBitbucketAnnotations {
+				break
+			}
+			annotation := &bitbucketAnnotation{
+				Message:  fmt.Sprintf("%s: %s", section.Name, violation.String()),
+				Severity: "HIGH",
+				Type:     "CODE_SMELL",
+			}
+			if section.Severity == severityWarn {
+				annotation.Severity = "MEDIUM"
+			}
+			if path, line, ok := splitPosition(violation.Position); ok {
+				annotation.Path, annotation.Line = path, line
+			}
+			insights.Annotations = append(insights.Annotations, annotation)
+		}
+	}
+	encoder := json.NewEncoder(w)
+	encoder.SetIndent("", "  ")
+	return encoder.Encode(insights)
+}
+
+// writeAzdo writes a `##vso[task.logissue]` logging command per violation,
+// with its file and line when it has a position, so that Azure Pipelines
+// lists them with the run.
+func writeAzdo(w io.Writer, report *report) error {
+	escape := func(s string, property bool) string {
+		replacements := []string{"%", "%AZP25", "\r", "%0D", "\n", "%0A"}
+		if property {
+			replacements = append(replacements, ";", "%3B", "]", "%5D")
+		}
+		return strings.NewReplacer(replacements...).Replace(s)
+	}
+	for _, section := range report.Sections {
+		issueType := "error"
+		if section.Severity == severityWarn {
+			issueType = "warning"
+		}
+		for _, violation := range section.Violations {
+			properties := "type=" + issueType
+			if path, line, ok := splitPosition(violation.Position); ok {
+				properties += fmt.Sprintf(";sourcepath=%s;linenumber=%d", escape(path, true), line)
+			}
+			properties += ";code=" + escape(section.ID, true)
+			message := fmt.Sprintf("%s: %s", section.Name, violation.String())
+			if _, err := fmt.Fprintf(w, "##vso[task.logissue %s]%s\n", properties, escape(message, false)); err != nil {
+				return err
+			}
+		}
+	}
+	return nil
+}
+
+// writeTeamCity writes TeamCity service messages: an inspection type per rule
+// or check with violations, an inspection per violation, on its file and line
+// when it has a position, the health score as a build statistic if configured,
+// and a build problem when there are errors, unless dry running.
+func writeTeamCity(w io.Writer, report *report) error {
+	escape := strings.NewReplacer("|", "||", "'", "|'", "\n", "|n", "\r", "|r", "[", "|[", "]", "|]").Replace
+	for _, section := range report.Sections {
+		if len(section.Violations) == 0 {
+			continue
+		}
+		fmt.Fprintf(w, "##teamcity[inspectionType id='%s' name='%s' category='depper' description='%s']\n",
+			escape(section.ID), escape(section.Name), escape(section.Name))
+		severity := "ERROR"
+		if section.Severity == severityWarn {
+			severity = "WARNING"
+		}
+		for _, violation := range section.Violations {
+			location := ""
+			if path, line, ok := splitPosition(violation.Position); ok {
+				location = fmt.Sprintf(" file='%s' line='%d'", escape(path), line)
+			}
+			fmt.Fprintf(w, "##teamcity[inspection typeId='%s' message='%s'%s SEVERITY='%s']\n",
+				escape(section.ID), escape(violation.String()), location, severity)
+		}
+	}
+	if report.Score != nil {
+		fmt.Fprintf(w, "##teamcity[buildStatisticValue key='depper.score' value='%g']\n", report.Score.Score)
+	}
+	if report.Errors != 0 && !report.DryRun {
+		_, err := fmt.Fprintf(w, "##teamcity[buildProblem description='%s' identity='depper']\n",
+			escape("depper found "+plural(report.Errors, "error")))
+		return err
+	}
+	return nil
+}
+
+// sonarIssue is an issue of SonarQube's Generic Issue Import format.
+type sonarIssue struct {
+	EngineID        string `json:"engineId"`
+	RuleID          string `json:"ruleId"`
+	Severity        string `json:"severity"`
+	Type            string `json:"type"`
+	PrimaryLocation struct {
+		Message   string          `json:"message"`
+		FilePath  string          `json:"filePath"`
+		TextRange *sonarTextRange `json:"textRange,omitempty"`
+	} `json:"primaryLocation"`
+}
+
+type sonarTextRange struct {
+	StartLine int `json:"startLine"`
+}
+
+// writeSonarQube writes the violations in SonarQube's Generic Issue Import
+// format, as code smells on the offending imports when they have a position.
+// As issues must be on a file, others are on the `go.mod` of the module.
+func writeSonarQube(w io.Writer, report *report) error {
+	issues := []*sonarIssue{}
+	for _, section := range report.Sections {
+		for _, violation := range section.Violations {
+			issue := &sonarIssue{EngineID: "depper", RuleID: section.ID, Severity: "MAJOR", Type: "CODE_SMELL"}
+			if section.Severity == severityWarn {
+				issue.Severity = "MINOR"
+			}
+			issue.PrimaryLocation.Message = fmt.Sprintf("%s: %s", section.Name, violation.String())
+			issue.PrimaryLocation.FilePath = "go.mod"
+			if path, line, ok := splitPosition(violation.Position); ok {
+				issue.PrimaryLocation.FilePath = path
+				issue.PrimaryLocation.TextRange = &sonarTextRange{StartLine: line}
+			}
+			issues = append(issues, issue)
+		}
+	}
+	encoder := json.NewEncoder(w)
+	encoder.SetIndent("", "  ")
+	return encoder.Encode(map[string]interface{}{"issues": issues})
+}
+
+// sarifLog is a SARIF 2.1.0 log, of the subset needed to report violations.
+type sarifLog struct {
+	Version string      `json:"version"`
+	Schema  string      `json:"$schema"`
+	Runs    []*sarifRun `json:"runs"`
+}
+
+type sarifRun struct {
+	Tool struct {
+		Driver struct {
+			Name           string       `json:"name"`
+			InformationURI string       `json:"informationUri"`
+			Rules          []*sarifRule `json:"rules"`
+		} `json:"driver"`
+	} `json:"tool"`
+	Results []*sarifResult `json:"results"`
+}
+
+type sarifRule struct {
+	ID                   string       `json:"id"`
+	Name                 string       `json:"name"`
+	ShortDescription     sarifMessage `json:"shortDescription"`
+	DefaultConfiguration struct {
+		Level string `json:"level"`
+	} `json:"defaultConfiguration"`
+}
+
+type sarifMessage struct {
+	Text string `json:"text"`
+}
+
+type sarifResult struct {
+	RuleID              string            `json:"ruleId"`
+	Level               string            `json:"level"`
+	PartialFingerprints map[string]string `json:"partialFingerprints"`
+	Message             sarifMessage      `json:"message"`
+	Locations           []*sarifLocation  `json:"locations"`
+	RelatedLocations    []*sarifLocation  `json:"relatedLocations,omitempty"`
+	Fixes               []*sarifFix       `json:"fixes,omitempty"`
+}
+
+type sarifLocation struct {
+	ID               int                    `json:"id,omitempty"`
+	PhysicalLocation *sarifPhysicalLocation `json:"physicalLocation,omitempty"`
+	LogicalLocations []*sarifLogical        `json:"logicalLocations,omitempty"`
+	Message          *sarifMessage          `json:"message,omitempty"`
+}
+
+type sarifPhysicalLocation struct {
+	ArtifactLocation sarifArtifact `json:"artifactLocation"`
+	Region           *sarifRegion  `json:"region,omitempty"`
+}
+
+type sarifArtifact struct {
+	URI string `json:"uri"`
+}
+
+type sarifRegion struct {
+	StartLine   int `json:"startLine"`
+	StartColumn int `json:"startColumn,omitempty"`
+	EndLine     int `json:"endLine,omitempty"`
+	EndColumn   int `json:"endColumn,omitempty"`
+}
+
+type sarifLogical struct {
+	FullyQualifiedName string `json:"fullyQualifiedName"`
+	Kind               string `json:"kind"`
+}
+
+type sarifFix struct {
+	Description     sarifMessage           `json:"description"`
+	ArtifactChanges []*sarifArtifactChange `json:"artifactChanges"`
+}
+
+type sarifArtifactChange struct {
+	ArtifactLocation sarifArtifact       `json:"artifactLocation"`
+	Replacements     []*sarifReplacement `json:"replacements"`
+}
+
+type sarifReplacement struct {
+	DeletedRegion sarifRegion `json:"deletedRegion"`
+}
+
+// fixableKinds are the kinds of violations removing the offending import
+// obviously fixes, e.g. blank imports which are only there for their side
+// effects. Removing a disallowed import, on the other hand, breaks the code
+// using it.
+var fixableKinds = map[string]bool{
+	kindBlank: true,
+}
+
+// writeSARIF writes the report as a SARIF log, with a rule per rule or check.
+// Violations with a position are located on the offending import, and those
+// removing the import fixes come with the fix deleting its line. Others are
+// located on their package. Violations of rules read from files are related
+// to the file.
+func writeSARIF(w io.Writer, report *report) error {
+	run := &sarifRun{Results: []*sarifResult{}}
+	run.Tool.Driver.Name = "depper"
+	run.Tool.Driver.InformationURI = "https://github.com/helloeave/depper"
+	run.Tool.Driver.Rules = []*sarifRule{}
+	for _, section := range report.Sections {
+		level := "error"
+		if section.Severity == severityWarn {
+			level = "warning"
+		}
+		rule := &sarifRule{ID: section.ID, Name: section.Name, ShortDescription: sarifMessage{Text: section.Name}}
+		rule.DefaultConfiguration.Level = level
+		run.Tool.Driver.Rules = append(run.Tool.Driver.Rules, rule)
+
+		for _, violation := range section.Violations {
+			result := &sarifResult{
+				RuleID:              section.ID,
+				Level:               level,
+				PartialFingerprints: map[string]string{"depper/v1": violation.ID},
+				Message:             sarifMessage{Text: violation.String()},
+			}
+			if uri, ok := sourceURI(section.Source); ok {
+				result.RelatedLocations = []*sarifLocation{{
+					ID:               1,
+					PhysicalLocation: &sarifPhysicalLocation{ArtifactLocation: sarifArtifact{URI: uri}},
+					Message:          &sarifMessage{Text: fmt.Sprintf("rule %s", section.Name)},
+				}}
+			}
+			path, line, ok := splitPosition(violation.Position)
+			if !ok {
+				location := &sarifLocation{}
+				if violation.From != "" {
+					location.LogicalLocations = []*sarifLogical{{FullyQualifiedName: violation.From, Kind: "module"}}
+				}
+				result.Locations = []*sarifLocation{location}
+				run.Results = append(run.Results, result)
+				continue
+			}
+
+			result.Locations = []*sarifLocation{{PhysicalLocation: &sarifPhysicalLocation{
+				ArtifactLocation: sarifArtifact{URI: path},
+				Region:           &sarifRegion{StartLine: line},
+			}}}
+			if fixableKinds[violation.Kind] {
+				result.Fixes = []*sarifFix{{
+					Description: sarifMessage{Text: fmt.Sprintf("Remove the import of %s", violation.To)},
+					ArtifactChanges: []*sarifArtifactChange{{
+						ArtifactLocation: sarifArtifact{URI: path},
+						Replacements: []*sarifReplacement{{
+							DeletedRegion: sarifRegion{StartLine: line, StartColumn: 1, EndLine: line + 1, EndColumn: 1},
+						}},
+					}},
+				}}
+			}
+			run.Results = append(run.Results, result)
+		}
+	}
+
+	encoder := json.NewEncoder(w)
+	encoder.SetIndent("", "  ")
+	return encoder.Encode(&sarifLog{
+		Version: "2.1.0",
+		Schema:  "https://json.schemastore.org/sarif-2.1.0.json",
+		Runs:    []*sarifRun{run},
+	})
+}
+
+// sourceURI returns the URI of the file a rule was read from, relative to the
+// current directory when within it, and false for rules not read from files,
+// e.g. presets, remote files or those of the standard input.
+func sourceURI(source string) (string, bool) {
+	if source == "" || source == "standard input" || source == "--rule" || strings.Contains(source, ":") && !filepath.IsAbs(source) {
+		return "", false
+	}
+	if !filepath.IsAbs(source) {
+		return filepath.ToSlash(source), true
+	}
+	if cwd, err := os.Getwd(); err == nil {
+		if rel, err := filepath.Rel(cwd, source); err == nil && rel != ".." && !strings.HasPrefix(rel, ".."+string(filepath.Separator)) {
+			return filepath.ToSlash(rel), true
+		}
+	}
+	uri := filepath.ToSlash(source)
+	if !strings.HasPrefix(uri, "/") {
+		uri = "/" + uri
+	}
+	return "file://" + uri, true
+}
+
+// templateViolation is the data each violation is rendered with in the
+// template format, where Violation is the violation as formatted in the text
+// format.
+type templateViolation struct {
+	*violation
+	Severity  string
+	Violation string
+}
+
+// templateReporter is the reporter of the template format, rendering every
+// violation through the template as they are reported, followed by the report
+// through the template's `summary` template if it defines one, e.g.
+//
+//	{{.Severity}}: {{.Rule}} {{.Violation}}
+//	{{define "summary"}}{{.Errors}} errors, {{.Warnings}} warnings{{end}}
+type templateReporter struct {
+	w      io.Writer
+	tmpl   *template.Template
+	report *report
+}
+
+func (r *templateReporter) start(report *report) error {
+	r.report = report
+	return nil
+}
+
+func (r *templateReporter) violation(section *section, v *violation) error {
+	return r.tmpl.Execute(r.w, templateViolation{
+		violation: v,
+		Severity:  section.Severity,
+		Violation: v.String(),
+	})
+}
+
+func (r *templateReporter) summary() error {
+	if summary := r.tmpl.Lookup("summary"); summary != nil {
+		return summary.Execute(r.w, r.report)
+	}
+	return nil
+}
+
+func (r *templateReporter) close() error { return nil }
+
+// outputs is a repeatable flag of output formats, each written to its own
+// destination, e.g. `--format=json:report.json --format=text:-`. Formats
+// without a destination are written to the default output.
+type outputs struct {
+	formats []string
+
+	// template is the template for the template format
+	template *template.Template
+
+	// color is one of auto, always or never, where auto colorizes the
+	// text format on terminals unless NO_COLOR is set
+	color string
+	// sources shows where rules were read from in the text format
+	sources bool
+}
+
+func (o *outputs) String() string {
+	return strings.Join(o.formats, ",")
+}
+
+func (o *outputs) Set(value string) error {
+	format := strings.SplitN(value, ":", 2)[0]
+	if _, ok := reporters[format]; !ok {
+		return fmt.Errorf("unknown format %s", format)
+	}
+	o.formats = append(o.formats, value)
+	return nil
+}
+
+// write writes the report in every format to its destination, where `-` is
+// the standard output.
+func (o *outputs) write(report *report, defaultOutput string) error {
+	formats := o.formats
+	if len(formats) == 0 {
+		formats = []string{"text"}
+	}
+	for _, value := range formats {
+		parts := strings.SplitN(value, ":", 2)
+		format, path := parts[0], defaultOutput
+		if len(parts) == 2 {
+			path = parts[1]
+		}
+		write := func(w io.Writer) error {
+			r, err := reporters[format](w, o, path)
+			if err != nil {
+				return err
+			}
+			return writeReport(r, report)
+		}
+		if err := writeTo(path, write); err != nil {
+			return err
+		}
+	}
+	return nil
+}
+
+// gerritRunID returns the ID of the run robot comments belong to, the
+// BUILD_ID of the CI job if any.
+func gerritRunID() string {
+	if id := os.Getenv("BUILD_ID"); id != "" {
+		return id
+	}
+	return "depper"
+}
+
+// colorize indicates whether text written to path is colorized.
+func (o *outputs) colorize(path string) bool {
+	switch o.color {
+	case "always":
+		return true
+	case "never":
+		return false
+	default:
+		if path != "-" || os.Getenv("NO_COLOR") != "" {
+			return false
+		}
+		info, err := os.Stdout.Stat()
+		return err == nil && info.Mode()&os.ModeCharDevice != 0
+	}
+}
+
+func writeTo(path string, write func(w io.Writer) error) error {
+	if path == "-" {
+		return write(os.Stdout)
+	}
+	file, err := os.Create(path)
+	if err != nil {
+		return err
+	}
+	if err := write(file); err != nil {
+		file.Close()
+		return err
+	}
+	return file.Close()
+}
@@ -0,0 +1,414 @@
+// Licensed under the Apache License, Version 2.0 (the "License");
+// you may not use this file except in compliance with the License.
+// You may obtain a copy of the License at
+//
+// http://www.apache.org/licenses/LICENSE-2.0
+//
+// Unless required by applicable law or agreed to in writing, software
+// distributed under the License is distributed on an "AS IS" BASIS,
+// WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+// See the License for the specific language governing permissions and
+// limitations under the License.
+
+package main
+
+import (
+	"bytes"
+	"encoding/json"
+	"fmt"
+	"io"
+	"io/ioutil"
+	"os"
+	"path/filepath"
+	"text/template"
+
+	"github.com/stretchr/testify/require"
+)
+
+// sampleReport returns a fixture report, with an error rule, a warn rule, and
+// a rule without violations.
+func sampleReport() *report {
+	var report report
+	services := report.add("", "services", severityError, []*violation{
+		&violation{Kind: kindDisallowed, From: "foo", To: "bar"},
+	})
+	services.Exercised = []string{"foo -> baz", "foo -> qux"}
+	report.add("", "utilities", severityWarn, []*violation{
+		&violation{Kind: kindDisallowed, From: "util", To: "foo"},
+		&violation{Kind: kindMissing, From: "util/old"},
+	})
+	report.add("", "clean", severityError, nil)
+	report.add("", "test only packages", severityError, []*violation{
+		&violation{Kind: kindTestOnly, From: "foo", To: "testutil", Position: "foo/foo.go:4"},
+	})
+	return &report
+}
+
+func (s *Zuite) TestReport() {
+	report := sampleReport()
+	require.Equal(s.T(), 2, report.Errors)
+	require.Equal(s.T(), 2, report.Warnings)
+	require.Len(s.T(), report.Sections, 4)
+	require.Equal(s.T(), []*violation{}, report.Sections[2].Violations)
+	require.Equal(s.T(), "test only packages", report.Sections[3].Name)
+
+	// Violations are attributed to their section.
+	require.Equal(s.T(), []string{
+		"services: disallowed foo -> bar",
+		"utilities: disallowed util -> foo",
+		"utilities: missing util/old",
+		"test only packages: test only foo/foo.go:4: foo -> testutil",
+	}, errorStrings(report.violations()))
+}
+
+func (s *Zuite) TestWriteText() {
+	var buf bytes.Buffer
+	require.NoError(s.T(), writeText(&buf, sampleReport(), false, false))
+	require.Equal(s.T(), `services (1 violation)
+- disallowed foo -> bar
+utilities (warning, 2 violations)
+- disallowed util -> foo
+- missing    util/old
+test only packages (1 violation)
+- test only  foo/foo.go:4: foo -> testutil
+services (expected, 2 dependencies)
+- exercised  foo -> baz
+- exercised  foo -> qux
+`, buf.String())
+
+	buf.Reset()
+	require.NoError(s.T(), writeText(&buf, sampleReport(), true, false))
+	require.Contains(s.T(), buf.String(), "\x1b[1mutilities\x1b[0m (warning, 2 violations)\n"+
+		"\x1b[33m- disallowed\x1b[0m util -> foo\n"+
+		"\x1b[33m- missing   \x1b[0m util/old\n")
+
+	// Dry runs label what would be violations.
+	buf.Reset()
+	dryRun := sampleReport()
+	dryRun.DryRun = true
+	require.NoError(s.T(), writeText(&buf, dryRun, false, false))
+	require.Contains(s.T(), buf.String(), "services (dry run, 1 violation)\n")
+	require.Contains(s.T(), buf.String(), "utilities (dry run, warning, 2 violations)\n")
+}
+
+func (s *Zuite) TestAlign() {
+	require.Equal(s.T(), []string{
+		"- disallowed foo           -> bar",
+		"- missing    foo/bar",
+		"- expected   foo/bar/baz   -> bar",
+		"- alias      foo.go:3: foo -> bar, must be imported as b -> c",
+	}, align([]string{
+		"- disallowed foo -> bar",
+		"- missing    foo/bar",
+		"- expected   foo/bar/baz -> bar",
+		"- alias      foo.go:3: foo -> bar, must be imported as b -> c",
+	}))
+}
+
+func (s *Zuite) TestWriteJSON() {
+	var buf bytes.Buffer
+	require.NoError(s.T(), writeJSON(&buf, sampleReport()))
+
+	var actual report
+	require.NoError(s.T(), json.Unmarshal(buf.Bytes(), &actual))
+	require.Equal(s.T(), sampleReport(), &actual)
+	require.Contains(s.T(), buf.String(), `"violations": []`)
+	require.Contains(s.T(), buf.String(), `"id": "test-only-packages"`)
+	require.NotContains(s.T(), buf.String(), `"dry_run"`)
+	require.Contains(s.T(), buf.String(), `{
+          "id": "874276dc7a0c6213",
+          "rule": "test only packages",
+          "rule_id": "test-only-packages",
+          "kind": "test only",
+          "from": "foo",
+          "to": "testutil",
+          "position": "foo/foo.go:4"
+        }`)
+}
+
+func (s *Zuite) TestWriteGerrit() {
+	var buf bytes.Buffer
+	require.NoError(s.T(), writeGerrit(&buf, sampleReport(), "42"))
+
+	// Violations with a position are inline.
+	var review gerritReview
+	require.NoError(s.T(), json.Unmarshal(buf.Bytes(), &review))
+	require.Equal(s.T(), gerritReview{
+		Message: "depper\n" +
+			"services (error): - disallowed foo -> bar\n" +
+			"utilities (warn): - disallowed util -> foo\n" +
+			"utilities (warn): - missing    util/old",
+		RobotComments: map[string][]*gerritRobotComment{
+			"foo/foo.go": {{
+				RobotID:    "depper",
+				RobotRunID: "42",
+				Line:       4,
+				Message:    "test only packages (error): - test only  foo/foo.go:4: foo -> testutil",
+			}},
+		},
+	}, review)
+}
+
+func (s *Zuite) TestWriteBitbucket() {
+	var buf bytes.Buffer
+	require.NoError(s.T(), writeBitbucket(&buf, sampleReport()))
+
+	var insights bitbucketInsights
+	require.NoError(s.T(), json.Unmarshal(buf.Bytes(), &insights))
+	require.Equal(s.T(), "FAIL", insights.Report.Result)
+	require.Equal(s.T(), "2 errors, 2 warnings", insights.Report.Details)
+	require.Equal(s.T(), []*bitbucketData{{Title: "Errors", Type: "NUMBER", Value: 2}, {Title: "Warnings", Type: "NUMBER", Value: 2}}, insights.Report.Data)
+	require.Equal(s.T(), []*bitbucketAnnotation{
+		{Message: "services: - disallowed foo -> bar", Severity: "HIGH", Type: "CODE_SMELL"},
+		{Message: "utilities: - disallowed util -> foo", Severity: "MEDIUM", Type: "CODE_SMELL"},
+		{Message: "utilities: - missing    util/old", Severity: "MEDIUM", Type: "CODE_SMELL"},
+		{Path: "foo/foo.go", Line: 4, Message: "test only packages: - test only  foo/foo.go:4: foo -> testutil", Severity: "HIGH", Type: "CODE_SMELL"},
+	}, insights.Annotations)
+
+	// Dry runs pass.
+	report := sampleReport()
+	report.DryRun = true
+	buf.Reset()
+	require.NoError(s.T(), writeBitbucket(&buf, report))
+	require.Contains(s.T(), buf.String(), `"result": "PASS"`)
+}
+
+func (s *Zuite) TestWriteAzdo() {
+	var buf bytes.Buffer
+	report := sampleReport()
+	report.add("", "percent; done", severityError, []*violation{{Kind: kindMissing, From: "100%", Message: "line\nbreak"}})
+	require.NoError(s.T(), writeAzdo(&buf, report))
+	require.Equal(s.T(), `##vso[task.logissue type=error;code=services]services: - disallowed foo -> bar
+##vso[task.logissue type=warning;code=utilities]utilities: - disallowed util -> foo
+##vso[task.logissue type=warning;code=utilities]utilities: - missing    util/old
+##vso[task.logissue type=error;sourcepath=foo/foo.go;linenumber=4;code=test-only-packages]test only packages: - test only  foo/foo.go:4: foo -> testutil
+##vso[task.logissue type=error;code=percent-done]percent; done: - missing    100%AZP25, line%0Abreak
+`, buf.String())
+}
+
+func (s *Zuite) TestWriteTeamCity() {
+	var buf bytes.Buffer
+	require.NoError(s.T(), writeTeamCity(&buf, sampleReport()))
+	require.Equal(s.T(), `##teamcity[inspectionType id='services' name='services' category='depper' description='services']
+##teamcity[inspection typeId='services' message='- disallowed foo -> bar' SEVERITY='ERROR']
+##teamcity[inspectionType id='utilities' name='utilities' category='depper' description='utilities']
+##teamcity[inspection typeId='utilities' message='- disallowed util -> foo' SEVERITY='WARNING']
+##teamcity[inspection typeId='utilities' message='- missing    util/old' SEVERITY='WARNING']
+##teamcity[inspectionType id='test-only-packages' name='test only packages' category='depper' description='test only packages']
+##teamcity[inspection typeId='test-only-packages' message='- test only  foo/foo.go:4: foo -> testutil' file='foo/foo.go' line='4' SEVERITY='ERROR']
+##teamcity[buildProblem description='depper found 2 errors' identity='depper']
+`, buf.String())
+
+	// Values are escaped, and dry runs have no build problem.
+	var report report
+	report.add("", "no [brackets]", severityError, []*violation{{Kind: kindMissing, From: "it's", Message: "a|b"}})
+	report.DryRun = true
+	buf.Reset()
+	require.NoError(s.T(), writeTeamCity(&buf, &report))
+	require.Equal(s.T(), `##teamcity[inspectionType id='no-brackets' name='no |[brackets|]' category='depper' description='no |[brackets|]']
+##teamcity[inspection typeId='no-brackets' message='- missing    it|'s, a||b' SEVERITY='ERROR']
+`, buf.String())
+}
+
+func (s *Zuite) TestWriteSonarQube() {
+	var buf bytes.Buffer
+	require.NoError(s.T(), writeSonarQube(&buf, sampleReport()))
+
+	var issues struct {
+		Issues []*sonarIssue `json:"issues"`
+	}
+	require.NoError(s.T(), json.Unmarshal(buf.Bytes(), &issues))
+	require.Len(s.T(), issues.Issues, 4)
+	require.Equal(s.T(), "services", issues.Issues[0].RuleID)
+	require.Equal(s.T(), "MAJOR", issues.Issues[0].Severity)
+	require.Equal(s.T(), "go.mod", issues.Issues[0].PrimaryLocation.FilePath)
+	require.Nil(s.T(), issues.Issues[0].PrimaryLocation.TextRange)
+	require.Equal(s.T(), "MINOR", issues.Issues[1].Severity)
+	require.Equal(s.T(), "test only packages: - test only  foo/foo.go:4: foo -> testutil", issues.Issues[3].PrimaryLocation.Message)
+	require.Equal(s.T(), "foo/foo.go", issues.Issues[3].PrimaryLocation.FilePath)
+	require.Equal(s.T(), 4, issues.Issues[3].PrimaryLocation.TextRange.StartLine)
+	require.Contains(s.T(), buf.String(), `"engineId": "depper"`)
+	require.Contains(s.T(), buf.String(), `"type": "CODE_SMELL"`)
+
+	buf.Reset()
+	require.NoError(s.T(), writeSonarQube(&buf, &report{}))
+	require.Equal(s.T(), "{\n  \"issues\": []\n}\n", buf.String())
+}
+
+func (s *Zuite) TestWriteSARIF() {
+	report := sampleReport()
+	report.Sections[0].Source = "preset:deprecated-std"
+	report.Sections[3].Source = "shared/platform.yaml"
+	report.add("", "blank imports", severityError, []*violation{{Kind: kindBlank, From: "foo", To: "net/http/pprof", Position: "foo/foo.go:5"}})
+	var buf bytes.Buffer
+	require.NoError(s.T(), writeSARIF(&buf, report))
+
+	var log sarifLog
+	require.NoError(s.T(), json.Unmarshal(buf.Bytes(), &log))
+	require.Equal(s.T(), "2.1.0", log.Version)
+	require.Len(s.T(), log.Runs, 1)
+	run := log.Runs[0]
+	require.Equal(s.T(), "depper", run.Tool.Driver.Name)
+	require.Len(s.T(), run.Tool.Driver.Rules, 5)
+	require.Equal(s.T(), "warning", run.Tool.Driver.Rules[1].DefaultConfiguration.Level)
+	require.Len(s.T(), run.Results, 5)
+
+	services := run.Results[0]
+	require.Equal(s.T(), "services", services.RuleID)
+	require.Equal(s.T(), "error", services.Level)
+	require.Equal(s.T(), map[string]string{"depper/v1": report.Sections[0].Violations[0].ID}, services.PartialFingerprints)
+	require.Nil(s.T(), services.Locations[0].PhysicalLocation)
+	require.Equal(s.T(), "foo", services.Locations[0].LogicalLocations[0].FullyQualifiedName)
+	require.Empty(s.T(), services.RelatedLocations)
+
+	testOnly := run.Results[3]
+	require.Equal(s.T(), "foo/foo.go", testOnly.Locations[0].PhysicalLocation.ArtifactLocation.URI)
+	require.Equal(s.T(), 4, testOnly.Locations[0].PhysicalLocation.Region.StartLine)
+	// Violations are related to the file of their rule.
+	require.Equal(s.T(), "shared/platform.yaml", testOnly.RelatedLocations[0].PhysicalLocation.ArtifactLocation.URI)
+	require.Equal(s.T(), "rule test only packages", testOnly.RelatedLocations[0].Message.Text)
+	require.Empty(s.T(), testOnly.Fixes)
+
+	blank := run.Results[4]
+	require.Len(s.T(), blank.Fixes, 1)
+	require.Equal(s.T(), "Remove the import of net/http/pprof", blank.Fixes[0].Description.Text)
+	change := blank.Fixes[0].ArtifactChanges[0]
+	require.Equal(s.T(), "foo/foo.go", change.ArtifactLocation.URI)
+	require.Equal(s.T(), sarifRegion{StartLine: 5, StartColumn: 1, EndLine: 6, EndColumn: 1}, change.Replacements[0].DeletedRegion)
+}
+
+func (s *Zuite) TestSourceURI() {
+	cwd, err := os.Getwd()
+	require.NoError(s.T(), err)
+	for source, uri := range map[string]string{
+		"depper.yaml":                         "depper.yaml",
+		filepath.Join(cwd, "rules", "a.yaml"): "rules/a.yaml",
+		"/etc/depper/rules.yaml":              "file:///etc/depper/rules.yaml",
+	} {
+		got, ok := sourceURI(source)
+		require.True(s.T(), ok, source)
+		require.Equal(s.T(), uri, got)
+	}
+	for _, source := range []string{"", "standard input", "--rule", "preset:deprecated-std", "https://example.com/platform.yaml", "module:example.com/rules@v1.0.0/platform.yaml"} {
+		_, ok := sourceURI(source)
+		require.False(s.T(), ok, source)
+	}
+}
+
+func (s *Zuite) TestSplitPosition() {
+	path, line, ok := splitPosition("foo/foo.go:4")
+	require.True(s.T(), ok)
+	require.Equal(s.T(), "foo/foo.go", path)
+	require.Equal(s.T(), 4, line)
+	for _, position := range []string{"", "foo/foo.go", "/go/src/foo/foo.go:4:2", "foo/foo.go:x"} {
+		_, _, ok := splitPosition(position)
+		require.False(s.T(), ok, position)
+	}
+}
+
+func (s *Zuite) TestWriteTemplate() {
+	dir, err := ioutil.TempDir("", "depper")
+	require.NoError(s.T(), err)
+	defer os.RemoveAll(dir)
+	path := filepath.Join(dir, "report.txt")
+	render := func(text string) string {
+		formats := &outputs{template: template.Must(template.New("violation").Parse(text))}
+		require.NoError(s.T(), formats.Set("template"))
+		require.NoError(s.T(), formats.write(sampleReport(), path))
+		data, err := ioutil.ReadFile(path)
+		require.NoError(s.T(), err)
+		return string(data)
+	}
+
+	require.Equal(s.T(), `error: services - disallowed foo -> bar
+warn: utilities - disallowed util -> foo
+warn: utilities - missing    util/old
+error: test only packages - test only  foo/foo.go:4: foo -> testutil
+2 errors, 2 warnings
+`, render(`{{.Severity}}: {{.Rule}} {{.Violation}}
+{{define "summary"}}{{.Errors}} errors, {{.Warnings}} warnings
+{{end}}`))
+
+	// Violations expose their fields.
+	require.Equal(s.T(), "disallowed foo bar ;disallowed util foo ;missing util/old  ;test only foo testutil foo/foo.go:4;",
+		render("{{.Kind}} {{.From}} {{.To}} {{.Position}};"))
+
+	// The summary is optional.
+	require.Equal(s.T(), "- disallowed foo -> bar;- disallowed util -> foo;- missing    util/old;- test only  foo/foo.go:4: foo -> testutil;",
+		render("{{.Violation}};"))
+
+	// Template formats require a template.
+	formats := &outputs{}
+	require.NoError(s.T(), formats.Set("template"))
+	require.EqualError(s.T(), formats.write(sampleReport(), path), "template format requires a template")
+}
+
+func (s *Zuite) TestOutputs() {
+	dir, err := ioutil.TempDir("", "depper")
+	require.NoError(s.T(), err)
+	defer os.RemoveAll(dir)
+
+	formats := &outputs{}
+	require.EqualError(s.T(), formats.Set("xml"), "unknown format xml")
+	require.NoError(s.T(), formats.Set("json:"+filepath.Join(dir, "report.json")))
+	require.NoError(s.T(), formats.Set("text"))
+
+	report := sampleReport()
+	require.NoError(s.T(), formats.write(report, filepath.Join(dir, "report.txt")))
+
+	var expectedJSON, expectedText bytes.Buffer
+	require.NoError(s.T(), writeJSON(&expectedJSON, report))
+	require.NoError(s.T(), writeText(&expectedText, report, false, false))
+
+	actualJSON, err := ioutil.ReadFile(filepath.Join(dir, "report.json"))
+	require.NoError(s.T(), err)
+	require.Equal(s.T(), expectedJSON.String(), string(actualJSON))
+	actualText, err := ioutil.ReadFile(filepath.Join(dir, "report.txt"))
+	require.NoError(s.T(), err)
+	require.Equal(s.T(), expectedText.String(), string(actualText))
+}
+
+// countingReporter counts what it is called with, as a custom format.
+type countingReporter struct {
+	w          io.Writer
+	violations int
+}
+
+func (r *countingReporter) start(*report) error { return nil }
+
+func (r *countingReporter) violation(section *section, v *violation) error {
+	r.violations++
+	return nil
+}
+
+func (r *countingReporter) summary() error {
+	_, err := fmt.Fprintf(r.w, "%d violations", r.violations)
+	return err
+}
+
+func (r *countingReporter) close() error { return nil }
+
+func (s *Zuite) TestRegisterFormat() {
+	dir, err := ioutil.TempDir("", "depper")
+	require.NoError(s.T(), err)
+	defer os.RemoveAll(dir)
+
+	registerFormat("count", func(w io.Writer, o *outputs, path string) (reporter, error) {
+		return &countingReporter{w: w}, nil
+	})
+	defer func() {
+		delete(reporters, "count")
+		formats = formats[:len(formats)-1]
+	}()
+	require.Equal(s.T(), "count", formats[len(formats)-1])
+	require.Panics(s.T(), func() {
+		registerFormat("count", nil)
+	})
+
+	outputs := &outputs{}
+	require.NoError(s.T(), outputs.Set("count:"+filepath.Join(dir, "count.txt")))
+	require.NoError(s.T(), outputs.write(sampleReport(), "-"))
+	count, err := ioutil.ReadFile(filepath.Join(dir, "count.txt"))
+	require.NoError(s.T(), err)
+	require.Equal(s.T(), "4 violations", string(count))
+}
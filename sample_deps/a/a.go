@@ -10,6 +10,9 @@
 // See the License for the specific language governing permissions and
 // limitations under the License.
 
+// Package a is at the bottom of the sample dependency graph.
+//
+// depper:layer=domain
 package a
 
 import "fmt"
@@ -0,0 +1,209 @@
+// Licensed under the Apache License, Version 2.0 (the "License");
+// you may not use this file except in compliance with the License.
+// You may obtain a copy of the License at
+//
+// http://www.apache.org/licenses/LICENSE-2.0
+//
+// Unless required by applicable law or agreed to in writing, software
+// distributed under the License is distributed on an "AS IS" BASIS,
+// WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+// See the License for the specific language governing permissions and
+// limitations under the License.
+
+package main
+
+import (
+	"fmt"
+	"reflect"
+	"sort"
+	"strings"
+
+	"gopkg.in/yaml.v2"
+)
+
+// schema is a JSON Schema, of the subset needed to describe configs.
+type schema struct {
+	Schema               string             `json:"$schema,omitempty"`
+	Title                string             `json:"title,omitempty"`
+	Type                 string             `json:"type"`
+	Properties           map[string]*schema `json:"properties,omitempty"`
+	AdditionalProperties interface{}        `json:"additionalProperties,omitempty"`
+	Items                *schema            `json:"items,omitempty"`
+	Enum                 []string           `json:"enum,omitempty"`
+}
+
+// schemaEnums are the values fields are limited to, by yaml name.
+var schemaEnums = map[string][]string{
+	"severity": {severityError, severityWarn},
+	"tool":     {"cosign", "minisign"},
+}
+
+// configSchema returns the schema of configs, generated from the definitions
+// so that they never disagree.
+func configSchema() *schema {
+	s := schemaOf(reflect.TypeOf(defs{}))
+	s.Schema = "http://json-schema.org/draft-07/schema#"
+	s.Title = "depper config"
+	return s
+}
+
+// schemaOf returns the schema of values of the type as decoded from yaml,
+// where structs only have the fields with yaml tags.
+func schemaOf(t reflect.Type) *schema {
+	switch t.Kind() {
+	case reflect.Ptr:
+		return schemaOf(t.Elem())
+	case reflect.String:
+		return &schema{Type: "string"}
+	case reflect.Bool:
+		return &schema{Type: "boolean"}
+	case reflect.Int:
+		return &schema{Type: "integer"}
+	case reflect.Slice:
+		return &schema{Type: "array", Items: schemaOf(t.Elem())}
+	case reflect.Map:
+		return &schema{Type: "object", AdditionalProperties: schemaOf(t.Elem())}
+	case reflect.Struct:
+		s := &schema{Type: "object", Properties: make(map[string]*schema), AdditionalProperties: false}
+		for i := 0; i < t.NumField(); i++ {
+			field := t.Field(i)
+			tag, ok := field.Tag.Lookup("yaml")
+			if !ok {
+				continue
+			}
+			name := strings.Split(tag, ",")[0]
+			if strings.HasSuffix(tag, ",inline") {
+				for name, property := range schemaOf(field.Type).Properties {
+					s.Properties[name] = property
+				}
+				continue
+			}
+			s.Properties[name] = schemaOf(field.Type)
+			s.Properties[name].Enum = schemaEnums[name]
+		}
+		return s
+	}
+	panic(fmt.Sprintf("no schema for %s", t))
+}
+
+// validateYAML validates the yaml input against the schema of v, as per
+// schemaOf, and reports every mismatch by its path, e.g.
+// `rules[1].may_depnd: unknown field`.
+func validateYAML(input []byte, v interface{}) error {
+	return validateFields(input, v, false)
+}
+
+// validateConfig validates the config input as per validateYAML, but for the
+// unknown fields of configs declaring a schema version newer than supported,
+// which are left for schemaWarning to warn about rather than failing.
+func validateConfig(input []byte) error {
+	var declared struct {
+		Config struct {
+			SchemaVersion int `yaml:"schema_version"`
+		} `yaml:"config"`
+	}
+	// Malformed versions are reported by the validation.
+	_ = yaml.Unmarshal(input, &declared)
+	return validateFields(input, defs{}, declared.Config.SchemaVersion > maxSchemaVersion)
+}
+
+// validateFields validates the yaml input against the schema of v, skipping
+// unknown fields if told to.
+func validateFields(input []byte, v interface{}, skipUnknown bool) error {
+	var value interface{}
+	if err := yaml.Unmarshal(input, &value); err != nil {
+		return err
+	}
+	var all, mismatches []string
+	schemaOf(reflect.TypeOf(v)).validate("", value, &all)
+	for _, mismatch := range all {
+		if !skipUnknown || !strings.HasSuffix(mismatch, ": unknown field") {
+			mismatches = append(mismatches, mismatch)
+		}
+	}
+	if len(mismatches) != 0 {
+		return fmt.Errorf("invalid config, %s", strings.Join(mismatches, ", "))
+	}
+	return nil
+}
+
+// validate validates the value at path, adding mismatches. Null values are
+// valid, as yaml decodes them into zero values. As yaml does, strings may be
+// any scalar.
+func (s *schema) validate(path string, value interface{}, mismatches *[]string) {
+	mismatch := func(format string, args ...interface{}) {
+		at := path
+		if at == "" {
+			at = "config"
+		}
+		*mismatches = append(*mismatches, at+": "+fmt.Sprintf(format, args...))
+	}
+	if value == nil {
+		return
+	}
+	switch s.Type {
+	case "string":
+		switch value.(type) {
+		case []interface{}, map[interface{}]interface{}:
+			mismatch("must be a string")
+			return
+		}
+		if len(s.Enum) != 0 {
+			for _, allowed := range s.Enum {
+				if fmt.Sprint(value) == allowed {
+					return
+				}
+			}
+			mismatch("must be one of %s", strings.Join(s.Enum, ", "))
+		}
+	case "boolean":
+		if _, ok := value.(bool); !ok {
+			mismatch("must be a boolean")
+		}
+	case "integer":
+		if _, ok := value.(int); !ok {
+			mismatch("must be an integer")
+		}
+	case "array":
+		items, ok := value.([]interface{})
+		if !ok {
+			mismatch("must be a list")
+			return
+		}
+		for i, item := range items {
+			s.Items.validate(fmt.Sprintf("%s[%d]", path, i), item, mismatches)
+		}
+	case "object":
+		fields, ok := value.(map[interface{}]interface{})
+		if !ok {
+			mismatch("must be a mapping")
+			return
+		}
+		var (
+			names  []string
+			byName = make(map[string]interface{})
+		)
+		for key, field := range fields {
+			names = append(names, fmt.Sprint(key))
+			byName[fmt.Sprint(key)] = field
+		}
+		sort.Strings(names)
+		for _, name := range names {
+			at := name
+			if path != "" {
+				at = path + "." + name
+			}
+			var property *schema
+			if s.Properties != nil {
+				property = s.Properties[name]
+			} else if additional, ok := s.AdditionalProperties.(*schema); ok {
+				property = additional
+			}
+			if property == nil {
+				*mismatches = append(*mismatches, at+": unknown field")
+				continue
+			}
+			property.validate(at, byName[name], mismatches)
+		}
+	}
+}
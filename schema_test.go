@@ -0,0 +1,96 @@
+// Licensed under the Apache License, Version 2.0 (the "License");
+// you may not use this file except in compliance with the License.
+// You may obtain a copy of the License at
+//
+// http://www.apache.org/licenses/LICENSE-2.0
+//
+// Unless required by applicable law or agreed to in writing, software
+// distributed under the License is distributed on an "AS IS" BASIS,
+// WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+// See the License for the specific language governing permissions and
+// limitations under the License.
+
+package main
+
+import (
+	"encoding/json"
+
+	"github.com/stretchr/testify/require"
+)
+
+func (s *Zuite) TestConfigSchema() {
+	config := configSchema()
+	require.Equal(s.T(), "object", config.Type)
+	require.Equal(s.T(), false, config.AdditionalProperties)
+
+	// Selectors are inlined in rules.
+	rule := config.Properties["rules"].Items
+	for _, name := range []string{"name", "packages", "package_name", "annotation", "may_depend", "severity"} {
+		require.Contains(s.T(), rule.Properties, name)
+	}
+	require.Equal(s.T(), "array", rule.Properties["may_depend"].Type)
+	require.Equal(s.T(), "string", rule.Properties["may_depend"].Items.Type)
+	require.Equal(s.T(), []string{"error", "warn"}, rule.Properties["severity"].Enum)
+	require.Equal(s.T(), "integer", config.Properties["layouts"].Items.Properties["depth"].Type)
+	require.Equal(s.T(), "boolean", config.Properties["import_aliases"].Items.Properties["no_alias"].Type)
+	require.Equal(s.T(), &schema{Type: "array", Items: &schema{Type: "string"}}, config.Properties["equivalence_groups"].AdditionalProperties)
+
+	data, err := json.Marshal(config)
+	require.NoError(s.T(), err)
+	require.Contains(s.T(), string(data), `"$schema":"http://json-schema.org/draft-07/schema#"`)
+}
+
+func (s *Zuite) TestValidateYAML() {
+	validate := func(input string) error {
+		return validateYAML([]byte(input), defs{})
+	}
+
+	require.NoError(s.T(), validate(``))
+	require.NoError(s.T(), validate(`
+config:
+  working_package: wp
+rules:
+  - name: services
+    packages: services/.*
+    may_depend:
+      - util
+      - 2fa
+    severity: warn
+equivalence_groups:
+  uuid:
+    - github.com/google/uuid
+layouts:
+  - name: layers
+    packages: .*
+    depth: 2
+blank_imports:
+`))
+
+	// Every mismatch is reported, by path.
+	require.EqualError(s.T(), validate(`
+config:
+  working_pkg: wp
+rules:
+  - name: services
+    packages: services/.*
+    may_depnd:
+      - util
+  - name: dal
+    packages: [dal]
+    severity: fatal
+layouts:
+  - depth: two
+equivalence_groups:
+  uuid: github.com/google/uuid
+`), "invalid config, config.working_pkg: unknown field, equivalence_groups.uuid: must be a list, "+
+		"layouts[0].depth: must be an integer, rules[0].may_depnd: unknown field, "+
+		"rules[1].packages: must be a string, rules[1].severity: must be one of error, warn")
+	require.EqualError(s.T(), validate(`- rules`), "invalid config, config: must be a mapping")
+
+	_, err := parse([]byte(`
+rules:
+  - name: services
+    package: services/.*
+`))
+	require.EqualError(s.T(), err, "invalid config, rules[0].package: unknown field")
+}
@@ -0,0 +1,129 @@
+// Licensed under the Apache License, Version 2.0 (the "License");
+// you may not use this file except in compliance with the License.
+// You may obtain a copy of the License at
+//
+// http://www.apache.org/licenses/LICENSE-2.0
+//
+// Unless required by applicable law or agreed to in writing, software
+// distributed under the License is distributed on an "AS IS" BASIS,
+// WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+// See the License for the specific language governing permissions and
+// limitations under the License.
+
+package main
+
+import (
+	"fmt"
+	"math"
+)
+
+// scoreWeights are the points the health score loses per violation, per
+// tangle, per dependency of the average working package, and per exception.
+// Unset weights default to those of defaultScoreWeights.
+type scoreWeights struct {
+	Violations *int `yaml:"violations"`
+	Tangles    *int `yaml:"tangles"`
+	FanOut     *int `yaml:"fan_out"`
+	Exceptions *int `yaml:"exceptions"`
+}
+
+// defaultScoreWeights are the weights of the health score, by default.
+var defaultScoreWeights = map[string]int{
+	"violations": 1,
+	"tangles":    5,
+	"fan_out":    1,
+	"exceptions": 1,
+}
+
+// health is the composite architecture score of a run, out of 100, and what
+// it is made of, so that one number can be trended.
+type health struct {
+	Score float64 `json:"score"`
+
+	// Violations are those of the report, but for tangles.
+	Violations int `json:"violations"`
+
+	// Tangles are the cycles among groups.
+	Tangles int `json:"tangles"`
+
+	// FanOut is the average number of dependencies of working packages,
+	// but for the standard library.
+	FanOut float64 `json:"fan_out"`
+
+	// Exceptions are the deprecated dependencies of rules, and the imports
+	// suppressed with `//depper:allow`, i.e. the debt taken on rules.
+	Exceptions int `json:"exceptions"`
+}
+
+// weight returns the weight, or its default if unset.
+func (weights *scoreWeights) weight(name string, weight *int) float64 {
+	if weight == nil {
+		return float64(defaultScoreWeights[name])
+	}
+	return float64(*weight)
+}
+
+// validate checks the weights are not negative.
+func (weights *scoreWeights) validate() error {
+	for name, weight := range map[string]*int{"violations": weights.Violations, "tangles": weights.Tangles, "fan_out": weights.FanOut, "exceptions": weights.Exceptions} {
+		if weight != nil && *weight < 0 {
+			return fmt.Errorf("score weight %s must not be negative", name)
+		}
+	}
+	return nil
+}
+
+// score returns the health of the checked graph, out of 100 minus the
+// weighted violations, tangles, average fan-out and exceptions, and never
+// below 0.
+func (defs *defs) score(report *report, g *graph) *health {
+	h := &health{}
+	for _, v := range report.violations() {
+		if v.Kind == kindCycle {
+			h.Tangles++
+		} else {
+			h.Violations++
+		}
+	}
+
+	working, dependencies := 0, 0
+	for _, pkg := range g.nodes() {
+		if pkg.goroot || !defs.isWorking(pkg.name) {
+			continue
+		}
+		working++
+		for _, depPkg := range g.dependencies(pkg) {
+			if !depPkg.goroot {
+				dependencies++
+			}
+		}
+		for _, file := range pkg.files {
+			for _, imp := range file.imports {
+				if imp.allow != "" {
+					h.Exceptions++
+				}
+			}
+		}
+	}
+	if working != 0 {
+		h.FanOut = math.Round(float64(dependencies)/float64(working)*100) / 100
+	}
+	for _, rule := range defs.Rules {
+		h.Exceptions += len(rule.Expected)
+	}
+
+	weights := defs.Score
+	penalty := weights.weight("violations", weights.Violations)*float64(h.Violations) +
+		weights.weight("tangles", weights.Tangles)*float64(h.Tangles) +
+		weights.weight("fan_out", weights.FanOut)*h.FanOut +
+		weights.weight("exceptions", weights.Exceptions)*float64(h.Exceptions)
+	h.Score = math.Max(0, math.Round((100-penalty)*10)/10)
+	return h
+}
+
+// String returns the score and what it is made of, e.g. `health score 87.5:
+// 3 violations, 1 tangle, fan-out 4.5, 2 exceptions`.
+func (h *health) String() string {
+	return fmt.Sprintf("health score %g: %s, %s, fan-out %g, %s",
+		h.Score, plural(h.Violations, "violation"), plural(h.Tangles, "tangle"), h.FanOut, plural(h.Exceptions, "exception"))
+}
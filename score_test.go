@@ -0,0 +1,70 @@
+// Licensed under the Apache License, Version 2.0 (the "License");
+// you may not use this file except in compliance with the License.
+// You may obtain a copy of the License at
+//
+// http://www.apache.org/licenses/LICENSE-2.0
+//
+// Unless required by applicable law or agreed to in writing, software
+// distributed under the License is distributed on an "AS IS" BASIS,
+// WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+// See the License for the specific language governing permissions and
+// limitations under the License.
+
+package main
+
+import (
+	"bytes"
+
+	"github.com/stretchr/testify/require"
+)
+
+func (s *Zuite) TestScore() {
+	defs, err := parse([]byte(`
+config:
+  working_package: wp
+rules:
+  - name: services
+    packages: services/.*
+    may_depend:
+      - <.*>
+      - models/.*
+    deprecated_dependencies:
+      - services/user -> dal/legacy
+score:
+  fan_out: 2
+  exceptions: 3
+`))
+	require.NoError(s.T(), err)
+	g := graphOf(map[string]*pkg{
+		"wp/services/user": &pkg{name: "wp/services/user", files: []*goFile{{name: "services/user/user.go", imports: []*goImport{
+			{path: "wp/dal/sql", line: 4, allow: "predates the dal"},
+		}}}},
+		"wp/dal/legacy":   &pkg{name: "wp/dal/legacy"},
+		"wp/dal/sql":      &pkg{name: "wp/dal/sql"},
+		"wp/models/user":  &pkg{name: "wp/models/user"},
+		"github.com/x/db": &pkg{name: "github.com/x/db"},
+		"fmt":             &pkg{name: "fmt", goroot: true},
+	}, "wp/services/user -> wp/dal/legacy", "wp/services/user -> wp/dal/sql", "wp/services/user -> fmt", "wp/dal/sql -> github.com/x/db", "wp/models/user -> fmt")
+	var report report
+	report.add("", "services", severityError, []*violation{{Kind: kindDisallowed, From: "wp/services/user", To: "wp/dal/sql"}})
+	report.add("", "layers", severityError, []*violation{{Kind: kindCycle, From: "wp/dal/sql", To: "wp/services/user"}})
+
+	// Four working packages with three dependencies but for the standard
+	// library, a deprecated dependency and a suppressed import.
+	h := defs.score(&report, g)
+	require.Equal(s.T(), &health{Score: 86.5, Violations: 1, Tangles: 1, FanOut: 0.75, Exceptions: 2}, h)
+	require.Equal(s.T(), "health score 86.5: 1 violation, 1 tangle, fan-out 0.75, 2 exceptions", h.String())
+
+	report.Score = h
+	var buf bytes.Buffer
+	require.NoError(s.T(), writeText(&buf, &report, false, false))
+	require.Contains(s.T(), buf.String(), "\nhealth score 86.5: 1 violation, 1 tangle, fan-out 0.75, 2 exceptions\n")
+
+	_, err = parse([]byte(`
+config:
+  working_package: wp
+score:
+  tangles: -1
+`))
+	require.EqualError(s.T(), err, "score weight tangles must not be negative")
+}
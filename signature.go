@@ -0,0 +1,121 @@
+// Licensed under the Apache License, Version 2.0 (the "License");
+// you may not use this file except in compliance with the License.
+// You may obtain a copy of the License at
+//
+// http://www.apache.org/licenses/LICENSE-2.0
+//
+// Unless required by applicable law or agreed to in writing, software
+// distributed under the License is distributed on an "AS IS" BASIS,
+// WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+// See the License for the specific language governing permissions and
+// limitations under the License.
+
+package main
+
+import (
+	"fmt"
+	"io/ioutil"
+	"os"
+	"os/exec"
+	"path/filepath"
+	"strings"
+)
+
+// signatures requires included rule files to be signed with the key, by
+// minisign or cosign. Signatures are detached, next to the files they sign,
+// e.g. `platform.yaml.minisig` or `platform.yaml.sig`.
+type signatures struct {
+	Tool string `yaml:"tool"`
+	Key  string `yaml:"key"`
+}
+
+// signatureExts are the extensions of signatures, by tool.
+var signatureExts = map[string]string{
+	"minisign": ".minisig",
+	"cosign":   ".sig",
+}
+
+// verifyInclude verifies the signature of the included file, found next to
+// it, if signatures are required. Signatures of URLs are cached in cacheDir
+// under the pin of the file, so that runs with the file cached need no
+// network.
+func (sigs *signatures) verifyInclude(entry, dir, cacheDir string, input []byte) error {
+	if sigs == nil {
+		return nil
+	}
+	ext, ok := signatureExts[sigs.Tool]
+	if !ok {
+		return fmt.Errorf("unknown signature tool %s, must be minisign or cosign", sigs.Tool)
+	}
+	if sigs.Key == "" {
+		return fmt.Errorf("signatures need a key")
+	}
+
+	var (
+		unpinned, pin = splitPin(entry)
+		signature     []byte
+		cached        string
+		err           error
+	)
+	switch {
+	case strings.HasPrefix(unpinned, "module:"):
+		signature, err = moduleFile(strings.TrimPrefix(unpinned, "module:")+ext, dir, nil)
+	case strings.HasPrefix(unpinned, "https://") || strings.HasPrefix(unpinned, "http://"):
+		cached = filepath.Join(cacheDir, pin+ext)
+		if signature, err := ioutil.ReadFile(cached); err == nil && sigs.verify(input, signature) == nil {
+			return nil
+		}
+		signature, err = fetch(unpinned + ext)
+	default:
+		path := unpinned
+		if !filepath.IsAbs(path) {
+			path = filepath.Join(dir, path)
+		}
+		signature, err = ioutil.ReadFile(path + ext)
+	}
+	if err != nil {
+		return fmt.Errorf("no signature for %s: %s", entry, err)
+	}
+	if err := sigs.verify(input, signature); err != nil {
+		return fmt.Errorf("failed to verify the signature of %s: %s", entry, err)
+	}
+
+	// Caching is best effort.
+	if cached != "" {
+		if err := os.MkdirAll(cacheDir, 0755); err == nil {
+			ioutil.WriteFile(cached, signature, 0644)
+		}
+	}
+	return nil
+}
+
+// verify verifies the signature of the input with the tool.
+func (sigs *signatures) verify(input, signature []byte) error {
+	dir, err := ioutil.TempDir("", "depper")
+	if err != nil {
+		return err
+	}
+	defer os.RemoveAll(dir)
+	file, sig := filepath.Join(dir, "file"), filepath.Join(dir, "file"+signatureExts[sigs.Tool])
+	if err := ioutil.WriteFile(file, input, 0644); err != nil {
+		return err
+	}
+	if err := ioutil.WriteFile(sig, signature, 0644); err != nil {
+		return err
+	}
+
+	var cmd *exec.Cmd
+	switch sigs.Tool {
+	case "minisign":
+		cmd = exec.Command("minisign", "-V", "-q", "-p", sigs.Key, "-m", file, "-x", sig)
+	case "cosign":
+		cmd = exec.Command("cosign", "verify-blob", "--key", sigs.Key, "--signature", sig, file)
+	}
+	if out, err := cmd.CombinedOutput(); err != nil {
+		if len(out) == 0 {
+			return err
+		}
+		return fmt.Errorf("%s", strings.TrimSpace(string(out)))
+	}
+	return nil
+}
@@ -0,0 +1,107 @@
+// Licensed under the Apache License, Version 2.0 (the "License");
+// you may not use this file except in compliance with the License.
+// You may obtain a copy of the License at
+//
+// http://www.apache.org/licenses/LICENSE-2.0
+//
+// Unless required by applicable law or agreed to in writing, software
+// distributed under the License is distributed on an "AS IS" BASIS,
+// WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+// See the License for the specific language governing permissions and
+// limitations under the License.
+
+package main
+
+import (
+	"crypto/sha256"
+	"fmt"
+	"io/ioutil"
+	"net/http"
+	"net/http/httptest"
+	"os"
+	"path/filepath"
+	"runtime"
+
+	"github.com/stretchr/testify/require"
+)
+
+func (s *Zuite) TestSignatures() {
+	if runtime.GOOS == "windows" {
+		s.T().Skip("needs a shell")
+	}
+	dir, err := ioutil.TempDir("", "depper")
+	require.NoError(s.T(), err)
+	defer os.RemoveAll(dir)
+
+	// A stand-in minisign accepts signatures reading `good` made with the
+	// key.
+	bin := filepath.Join(dir, "bin")
+	require.NoError(s.T(), os.MkdirAll(bin, 0755))
+	require.NoError(s.T(), ioutil.WriteFile(filepath.Join(bin, "minisign"), []byte(`#!/bin/sh
+[ "$1 $2 $3" = "-V -q -p" ] && [ "$(cat "$4")" = key ] && [ "$(cat "$8")" = good ] && exit 0
+echo "Signature verification failed"
+exit 1
+`), 0755))
+	path := os.Getenv("PATH")
+	defer os.Setenv("PATH", path)
+	os.Setenv("PATH", bin+string(os.PathListSeparator)+path)
+
+	files := map[string]string{
+		"keys/policy.pub":              "key",
+		"shared/platform.yaml":         "rules:\n  - name: no sdk\n    packages: .*\n    may_not_depend:\n      - sdk\n",
+		"shared/platform.yaml.minisig": "good",
+		"shared/tampered.yaml":         "rules: []\n",
+		"shared/tampered.yaml.minisig": "bad",
+		"shared/unsigned.yaml":         "rules: []\n",
+	}
+	s.writeFiles(dir, files)
+	config := func(include string) string {
+		path := filepath.Join(dir, "depper.yaml")
+		require.NoError(s.T(), ioutil.WriteFile(path, []byte(`
+config:
+  working_package: wp
+  cache_dir: .depper
+  signatures:
+    tool: minisign
+    key: keys/policy.pub
+include:
+  - preset:deprecated-std
+  - `+include+`
+`), 0644))
+		return path
+	}
+
+	// Presets need no signature.
+	defs, err := parseFile(config("shared/platform.yaml"))
+	require.NoError(s.T(), err)
+	require.Len(s.T(), defs.Rules, 2)
+
+	_, err = parseFile(config("shared/tampered.yaml"))
+	require.EqualError(s.T(), err, "failed to verify the signature of shared/tampered.yaml: Signature verification failed")
+	_, err = parseFile(config("shared/unsigned.yaml"))
+	require.Error(s.T(), err)
+	require.Contains(s.T(), err.Error(), "no signature for shared/unsigned.yaml")
+
+	// Signatures of URLs are cached along with the files, so that offline
+	// runs verify them too.
+	rules := files["shared/platform.yaml"]
+	server := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		body, ok := map[string]string{"/platform.yaml": rules, "/platform.yaml.minisig": "good"}[r.URL.Path]
+		if !ok {
+			http.NotFound(w, r)
+			return
+		}
+		w.Write([]byte(body))
+	}))
+	pin := fmt.Sprintf("%x", sha256.Sum256([]byte(rules)))
+	remote := server.URL + "/platform.yaml@sha256:" + pin
+	_, err = parseFile(config(remote))
+	server.Close()
+	require.NoError(s.T(), err)
+	require.FileExists(s.T(), filepath.Join(dir, ".depper/include", pin+".minisig"))
+	defs, err = parseFile(config(remote))
+	require.NoError(s.T(), err)
+	require.Len(s.T(), defs.Rules, 2)
+
+	require.EqualError(s.T(), (&signatures{Tool: "gpg", Key: "key"}).verifyInclude("platform.yaml", dir, "", nil), "unknown signature tool gpg, must be minisign or cosign")
+}
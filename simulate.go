@@ -0,0 +1,163 @@
+// Licensed under the Apache License, Version 2.0 (the "License");
+// you may not use this file except in compliance with the License.
+// You may obtain a copy of the License at
+//
+// http://www.apache.org/licenses/LICENSE-2.0
+//
+// Unless required by applicable law or agreed to in writing, software
+// distributed under the License is distributed on an "AS IS" BASIS,
+// WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+// See the License for the specific language governing permissions and
+// limitations under the License.
+
+package main
+
+import (
+	"fmt"
+	"strings"
+)
+
+// pairs is a repeatable flag of `from=to` pairs of packages, written as in
+// rules or by import path, e.g. the edge `services/user=dal/mongo`, or the
+// move `dal/mongo=storage/mongo`.
+type pairs []string
+
+func (p *pairs) String() string {
+	return strings.Join(*p, ", ")
+}
+
+func (p *pairs) Set(value string) error {
+	if _, _, err := splitPair(value); err != nil {
+		return err
+	}
+	*p = append(*p, value)
+	return nil
+}
+
+func splitPair(value string) (string, string, error) {
+	parts := strings.SplitN(value, "=", 2)
+	if len(parts) != 2 || strings.TrimSpace(parts[0]) == "" || strings.TrimSpace(parts[1]) == "" {
+		return "", "", fmt.Errorf("malformed %s, must be from=to", value)
+	}
+	return strings.TrimSpace(parts[0]), strings.TrimSpace(parts[1]), nil
+}
+
+// simulate returns the violations which moving packages and adding the edges
+// to the graph would introduce, i.e. those of checking the graph with the
+// changes, but not without, told apart by their IDs once existing violations
+// are moved too. Moving a package moves its subpackages, and merges it with
+// any package already at the new path. Edges are added after moves, between
+// packages at their new paths; packages not part of the graph yet, e.g. yet
+// to be written, are added, to the standard library when written `<pkg>`. The
+// graph itself is left as is.
+//
+// Edges are not tagged, so rules with build tags, which only consider tagged
+// dependencies, cannot be simulated.
+func (defs *defs) simulate(g *graph, moves, edges []string) ([]*violation, error) {
+	for _, rule := range defs.Rules {
+		if len(rule.BuildTags) != 0 {
+			return nil, fmt.Errorf("rule %s has build tags, which cannot be simulated", rule.Name)
+		}
+	}
+
+	move, err := defs.mover(g, moves)
+	if err != nil {
+		return nil, err
+	}
+	simulated := moved(g, move)
+	for _, edge := range edges {
+		from, to, err := splitPair(edge)
+		if err != nil {
+			return nil, err
+		}
+		simulated.depend(defs.simulatedPkg(simulated, from), defs.simulatedPkg(simulated, to))
+	}
+
+	existing := make(map[string]bool)
+	for _, v := range defs.check(g, nil, false).violations() {
+		movedViolation := *v
+		movedViolation.From, movedViolation.To = move(v.From), move(v.To)
+		existing[movedViolation.fingerprint()] = true
+	}
+	var introduced []*violation
+	for _, v := range defs.check(simulated, nil, false).violations() {
+		if !existing[v.ID] {
+			introduced = append(introduced, v)
+		}
+	}
+	return introduced, nil
+}
+
+// mover returns the new path of packages after the moves, which must each
+// move some package of the graph. Later moves take precedence.
+func (defs *defs) mover(g *graph, moves []string) (func(string) string, error) {
+	type pathMove struct{ from, to string }
+	var pathMoves []pathMove
+	for _, value := range moves {
+		from, to, err := splitPair(value)
+		if err != nil {
+			return nil, err
+		}
+		if _, ok := g.pkgs[from]; !ok {
+			from = qualify(defs.Config.WorkingPackage, from)
+		}
+		to = qualify(defs.Config.WorkingPackage, to)
+		found := false
+		for name := range g.pkgs {
+			found = found || name == from || strings.HasPrefix(name, from+"/")
+		}
+		if !found {
+			return nil, fmt.Errorf("no package of the graph to move at %s", from)
+		}
+		pathMoves = append(pathMoves, pathMove{from, to})
+	}
+	return func(name string) string {
+		for i := len(pathMoves) - 1; i >= 0; i-- {
+			if name == pathMoves[i].from || strings.HasPrefix(name, pathMoves[i].from+"/") {
+				return pathMoves[i].to + strings.TrimPrefix(name, pathMoves[i].from)
+			}
+		}
+		return name
+	}, nil
+}
+
+// moved returns a copy of the graph with its packages at the path move
+// returns for them, merging packages moved to the same path.
+func moved(g *graph, move func(string) string) *graph {
+	simulated := newGraph(g.root)
+	for _, root := range g.roots {
+		simulated.roots = append(simulated.roots, move(root))
+	}
+	for _, loadError := range g.loadErrors {
+		simulated.addLoadError(loadError)
+	}
+	for _, node := range g.nodes() {
+		movedNode := *node
+		movedNode.name = move(node.name)
+		if merged := simulated.add(&movedNode); merged != &movedNode {
+			merged.files = append(append([]*goFile(nil), merged.files...), node.files...)
+		}
+	}
+	for _, node := range g.nodes() {
+		from := simulated.pkgs[move(node.name)]
+		for _, dep := range g.dependencies(node) {
+			if to := simulated.pkgs[move(dep.name)]; to != from {
+				simulated.depend(from, to)
+			}
+		}
+	}
+	return simulated
+}
+
+// simulatedPkg returns the package of the graph written as in rules or by
+// import path, adding it if the graph has none.
+func (defs *defs) simulatedPkg(g *graph, expr string) *pkg {
+	if pkg, ok := g.pkgs[expr]; ok {
+		return pkg
+	}
+	name := qualify(defs.Config.WorkingPackage, expr)
+	if pkg, ok := g.pkgs[name]; ok {
+		return pkg
+	}
+	return g.add(&pkg{name: name, goroot: strings.HasPrefix(expr, "<") && strings.HasSuffix(expr, ">")})
+}
@@ -0,0 +1,106 @@
+// Licensed under the Apache License, Version 2.0 (the "License");
+// you may not use this file except in compliance with the License.
+// You may obtain a copy of the License at
+//
+// http://www.apache.org/licenses/LICENSE-2.0
+//
+// Unless required by applicable law or agreed to in writing, software
+// distributed under the License is distributed on an "AS IS" BASIS,
+// WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+// See the License for the specific language governing permissions and
+// limitations under the License.
+
+package main
+
+import (
+	"github.com/stretchr/testify/require"
+)
+
+func (s *Zuite) TestSimulate() {
+	defs, err := parse([]byte(`
+config:
+  working_package: wp
+rules:
+  - name: services
+    packages: services/.*
+    may_not_depend:
+      - dal/.*
+      - <database/sql>
+`))
+	require.NoError(s.T(), err)
+	g := graphOf(map[string]*pkg{
+		"wp/services/user":  &pkg{name: "wp/services/user"},
+		"wp/services/order": &pkg{name: "wp/services/order"},
+		"wp/dal/sql":        &pkg{name: "wp/dal/sql"},
+		"wp/models":         &pkg{name: "wp/models"},
+	}, "wp/services/order -> wp/dal/sql")
+
+	// Only violations the edges introduce are reported, not existing ones,
+	// and packages yet to be written are added.
+	violations, err := defs.simulate(g, nil, []string{"services/user=dal/mongo", "services/user=models"})
+	require.NoError(s.T(), err)
+	require.Equal(s.T(), []string{"- disallowed wp/services/user -> wp/dal/mongo"}, lines(violations))
+	require.NotContains(s.T(), g.pkgs, "wp/dal/mongo")
+	require.Empty(s.T(), g.dependenciesOf("wp/services/user"))
+
+	violations, err = defs.simulate(g, nil, []string{"wp/services/user=<database/sql>"})
+	require.NoError(s.T(), err)
+	require.Equal(s.T(), []string{"- disallowed wp/services/user -> database/sql"}, lines(violations))
+
+	violations, err = defs.simulate(g, nil, []string{"services/user=models"})
+	require.NoError(s.T(), err)
+	require.Empty(s.T(), violations)
+
+	defs.Rules[0].BuildTags = []string{"integration"}
+	_, err = defs.simulate(g, nil, []string{"services/user=models"})
+	require.EqualError(s.T(), err, "rule services has build tags, which cannot be simulated")
+
+	var added pairs
+	require.EqualError(s.T(), added.Set("services/user"), "malformed services/user, must be from=to")
+}
+
+func (s *Zuite) TestSimulate_move() {
+	defs, err := parse([]byte(`
+config:
+  working_package: wp
+rules:
+  - name: services
+    packages: services/.*
+    may_not_depend:
+      - dal/.*
+`))
+	require.NoError(s.T(), err)
+	g := graphOf(map[string]*pkg{
+		"wp/services/user":    &pkg{name: "wp/services/user"},
+		"wp/services/order":   &pkg{name: "wp/services/order"},
+		"wp/dal/sql":          &pkg{name: "wp/dal/sql"},
+		"wp/legacy/db":        &pkg{name: "wp/legacy/db"},
+		"wp/legacy/db/conn":   &pkg{name: "wp/legacy/db/conn"},
+		"wp/legacy/db/schema": &pkg{name: "wp/legacy/db/schema"},
+	}, "wp/services/order -> wp/dal/sql", "wp/services/user -> wp/legacy/db/conn", "wp/legacy/db/conn -> wp/legacy/db/schema")
+
+	// Subpackages move along, and existing violations, moved or not, are not
+	// reported again.
+	violations, err := defs.simulate(g, []string{"legacy=dal/legacy"}, nil)
+	require.NoError(s.T(), err)
+	require.Equal(s.T(), []string{"- disallowed wp/services/user -> wp/dal/legacy/db/conn"}, lines(violations))
+	require.Contains(s.T(), g.pkgs, "wp/legacy/db/conn")
+
+	violations, err = defs.simulate(g, []string{"services/order=services/billing", "dal=storage"}, nil)
+	require.NoError(s.T(), err)
+	require.Empty(s.T(), violations)
+
+	// Edges are added between packages at their new paths.
+	violations, err = defs.simulate(g, []string{"dal=storage"}, []string{"services/user=storage/sql"})
+	require.NoError(s.T(), err)
+	require.Empty(s.T(), violations)
+	violations, err = defs.simulate(g, []string{"legacy/db=dal/db"}, []string{"services/order=dal/db"})
+	require.NoError(s.T(), err)
+	require.Equal(s.T(), []string{
+		"- disallowed wp/services/order -> wp/dal/db",
+		"- disallowed wp/services/user -> wp/dal/db/conn",
+	}, lines(violations))
+
+	_, err = defs.simulate(g, []string{"models=dal/models"}, nil)
+	require.EqualError(s.T(), err, "no package of the graph to move at wp/models")
+}
@@ -0,0 +1,64 @@
+// Licensed under the Apache License, Version 2.0 (the "License");
+// you may not use this file except in compliance with the License.
+// You may obtain a copy of the License at
+//
+// http://www.apache.org/licenses/LICENSE-2.0
+//
+// Unless required by applicable law or agreed to in writing, software
+// distributed under the License is distributed on an "AS IS" BASIS,
+// WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+// See the License for the specific language governing permissions and
+// limitations under the License.
+
+package main
+
+// enforceSince drops the disallowed dependencies of rules every import of
+// which predates the point of the blamer, so that rules are only enforced on
+// new code while legacy code burns down. Dependencies the packages no longer
+// import directly are kept. It returns the number of violations dropped.
+func (defs *defs) enforceSince(report *report, g *graph, tagged map[string]*graph, b *blamer) int {
+	graphs := defs.sectionGraphs(g, tagged)
+	dropped := 0
+	for _, section := range report.Sections {
+		ruleGraph, ok := graphs[section.ID]
+		if !ok || ruleGraph == nil {
+			continue
+		}
+		kept := filterViolations(section.Violations, func(v *violation) bool {
+			return v.Kind != kindDisallowed || !legacyImport(ruleGraph.pkgs[v.From], v.To, b)
+		})
+		if kept == nil {
+			kept = []*violation{}
+		}
+		count := len(section.Violations) - len(kept)
+		if section.Severity == severityWarn {
+			report.Warnings -= count
+		} else {
+			report.Errors -= count
+		}
+		section.Violations = kept
+		dropped += count
+	}
+	return dropped
+}
+
+// legacyImport indicates whether the package imports the path, and every one
+// of its imports of it predates the point of the blamer.
+func legacyImport(pkg *pkg, path string, b *blamer) bool {
+	if pkg == nil {
+		return false
+	}
+	imported := false
+	for _, file := range pkg.files {
+		for _, imp := range file.imports {
+			if imp.path != path {
+				continue
+			}
+			if !b.old(file.name, imp.line) {
+				return false
+			}
+			imported = true
+		}
+	}
+	return imported
+}
@@ -0,0 +1,85 @@
+// Licensed under the Apache License, Version 2.0 (the "License");
+// you may not use this file except in compliance with the License.
+// You may obtain a copy of the License at
+//
+// http://www.apache.org/licenses/LICENSE-2.0
+//
+// Unless required by applicable law or agreed to in writing, software
+// distributed under the License is distributed on an "AS IS" BASIS,
+// WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+// See the License for the specific language governing permissions and
+// limitations under the License.
+
+package main
+
+import (
+	"io/ioutil"
+	"os"
+	"os/exec"
+	"path/filepath"
+
+	"github.com/stretchr/testify/require"
+)
+
+func (s *Zuite) TestEnforceSince() {
+	dir, err := ioutil.TempDir("", "depper")
+	require.NoError(s.T(), err)
+	defer os.RemoveAll(dir)
+
+	git := func(args ...string) {
+		cmd := exec.Command("git", append([]string{"-c", "user.name=depper", "-c", "user.email=depper@example.com"}, args...)...)
+		cmd.Dir = dir
+		cmd.Env = append(os.Environ(), "GIT_AUTHOR_DATE=2020-01-01T00:00:00Z", "GIT_COMMITTER_DATE=2020-01-01T00:00:00Z")
+		out, err := cmd.CombinedOutput()
+		require.NoError(s.T(), err, string(out))
+	}
+	s.writeFiles(dir, map[string]string{
+		"services/user/user.go": "package user\n\nimport (\n\t_ \"wp/dal/legacy\"\n)\n",
+	})
+	git("init", "-q")
+	git("add", ".")
+	git("commit", "-q", "-m", "legacy")
+	git("tag", "v1")
+	s.writeFiles(dir, map[string]string{
+		"services/user/user.go": "package user\n\nimport (\n\t_ \"wp/dal/legacy\"\n\t_ \"wp/dal/sql\"\n)\n",
+	})
+
+	defs, err := parse([]byte(`
+config:
+  working_package: wp
+rules:
+  - name: no db
+    packages: services/.*
+    may_not_depend:
+      - dal/.*
+`))
+	require.NoError(s.T(), err)
+	g := graphOf(map[string]*pkg{
+		"wp/services/user":  &pkg{name: "wp/services/user", files: []*goFile{{name: "services/user/user.go", imports: []*goImport{{path: "wp/dal/legacy", line: 4}, {path: "wp/dal/sql", line: 5}}}}},
+		"wp/services/order": &pkg{name: "wp/services/order", files: []*goFile{{name: "services/order/order.go", imports: []*goImport{{path: "wp/dal/sql", line: 3}}}}},
+		"wp/dal/legacy":     &pkg{name: "wp/dal/legacy"},
+		"wp/dal/sql":        &pkg{name: "wp/dal/sql"},
+	}, "wp/services/user -> wp/dal/legacy", "wp/services/user -> wp/dal/sql", "wp/services/order -> wp/dal/sql")
+
+	// Imports of the revision, or before the date, are not enforced, unlike
+	// uncommitted ones, and those of untracked files.
+	for _, point := range []string{"v1", "2021-01-01"} {
+		b, err := newBlamer(dir, point)
+		require.NoError(s.T(), err)
+		report := defs.check(g, nil, false)
+		require.Equal(s.T(), 1, defs.enforceSince(report, g, nil, b), point)
+		require.Equal(s.T(), 2, report.Errors)
+		require.Equal(s.T(), []string{
+			"- disallowed wp/services/order -> wp/dal/sql",
+			"- disallowed wp/services/user -> wp/dal/sql",
+		}, lines(report.Sections[0].Violations), point)
+	}
+
+	// Before the first commit, every import is new.
+	b, err := newBlamer(dir, "2019-01-01")
+	require.NoError(s.T(), err)
+	require.Equal(s.T(), 0, defs.enforceSince(defs.check(g, nil, false), g, nil, b))
+
+	_, err = newBlamer(dir, "v2")
+	require.EqualError(s.T(), err, "v2 is neither a date nor a revision of the git checkout at "+filepath.Clean(dir))
+}
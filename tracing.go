@@ -0,0 +1,237 @@
+// Licensed under the Apache License, Version 2.0 (the "License");
+// you may not use this file except in compliance with the License.
+// You may obtain a copy of the License at
+//
+// http://www.apache.org/licenses/LICENSE-2.0
+//
+// Unless required by applicable law or agreed to in writing, software
+// distributed under the License is distributed on an "AS IS" BASIS,
+// WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+// See the License for the specific language governing permissions and
+// limitations under the License.
+
+package main
+
+import (
+	"bytes"
+	"crypto/rand"
+	"encoding/hex"
+	"encoding/json"
+	"fmt"
+	"net/http"
+	"net/url"
+	"sort"
+	"strconv"
+	"strings"
+	"sync"
+	"time"
+)
+
+// tracer records the spans of a run, e.g. collecting the graph and checking
+// each rule, and exports them to an OpenTelemetry collector over OTLP/HTTP
+// with the JSON encoding. It is configured by the standard environment
+// variables, e.g. OTEL_EXPORTER_OTLP_ENDPOINT, and joins the trace of
+// TRACEPARENT if set, e.g. of the CI pipeline. A nil tracer records nothing.
+type tracer struct {
+	endpoint string
+	headers  map[string]string
+	service  string
+	traceID  string
+	parentID string // of the remote parent span, if any
+
+	mu    sync.Mutex
+	spans []*span
+}
+
+// span is a timed operation of a run. Methods of nil spans do nothing, so
+// that runs need not check whether they are traced.
+type span struct {
+	tracer     *tracer
+	id         string
+	parentID   string
+	name       string
+	start, end time.Time
+	attributes map[string]interface{}
+}
+
+// newTracer returns the tracer configured by the environment, as looked up
+// with getenv, or nil if no endpoint is set.
+func newTracer(getenv func(string) string) *tracer {
+	endpoint := getenv("OTEL_EXPORTER_OTLP_TRACES_ENDPOINT")
+	if endpoint == "" {
+		if base := getenv("OTEL_EXPORTER_OTLP_ENDPOINT"); base != "" {
+			endpoint = strings.TrimSuffix(base, "/") + "/v1/traces"
+		}
+	}
+	if endpoint == "" {
+		return nil
+	}
+	t := &tracer{
+		endpoint: endpoint,
+		headers:  make(map[string]string),
+		service:  getenv("OTEL_SERVICE_NAME"),
+		traceID:  randomID(16),
+	}
+	if t.service == "" {
+		t.service = "depper"
+	}
+	for _, header := range strings.Split(getenv("OTEL_EXPORTER_OTLP_HEADERS"), ",") {
+		parts := strings.SplitN(header, "=", 2)
+		if len(parts) != 2 {
+			continue
+		}
+		value, err := url.QueryUnescape(strings.TrimSpace(parts[1]))
+		if err != nil {
+			value = parts[1]
+		}
+		t.headers[strings.TrimSpace(parts[0])] = value
+	}
+
+	// W3C trace context, i.e. version-trace id-parent id-flags.
+	if parts := strings.Split(getenv("TRACEPARENT"), "-"); len(parts) == 4 && len(parts[1]) == 32 && len(parts[2]) == 16 {
+		t.traceID, t.parentID = parts[1], parts[2]
+	}
+	return t
+}
+
+// randomID returns n random bytes, hex encoded.
+func randomID(n int) string {
+	id := make([]byte, n)
+	rand.Read(id)
+	return hex.EncodeToString(id)
+}
+
+// start starts a root span of the tracer.
+func (t *tracer) start(name string) *span {
+	if t == nil {
+		return nil
+	}
+	return t.record(&span{parentID: t.parentID, name: name})
+}
+
+func (t *tracer) record(s *span) *span {
+	s.tracer, s.id, s.start = t, randomID(8), time.Now()
+	s.attributes = make(map[string]interface{})
+	t.mu.Lock()
+	t.spans = append(t.spans, s)
+	t.mu.Unlock()
+	return s
+}
+
+// child starts a span within the span.
+func (s *span) child(name string) *span {
+	if s == nil {
+		return nil
+	}
+	return s.tracer.record(&span{parentID: s.id, name: name})
+}
+
+// set sets an attribute of the span, a string, int or bool.
+func (s *span) set(key string, value interface{}) {
+	if s == nil {
+		return
+	}
+	s.tracer.mu.Lock()
+	s.attributes[key] = value
+	s.tracer.mu.Unlock()
+}
+
+// finish ends the span.
+func (s *span) finish() {
+	if s == nil {
+		return
+	}
+	s.tracer.mu.Lock()
+	s.end = time.Now()
+	s.tracer.mu.Unlock()
+}
+
+// otlpAttribute is an attribute as encoded by OTLP/JSON.
+type otlpAttribute struct {
+	Key   string                 `json:"key"`
+	Value map[string]interface{} `json:"value"`
+}
+
+func otlpAttributes(attributes map[string]interface{}) []*otlpAttribute {
+	var keys []string
+	for key := range attributes {
+		keys = append(keys, key)
+	}
+	sort.Strings(keys)
+	encoded := make([]*otlpAttribute, 0, len(keys))
+	for _, key := range keys {
+		var value map[string]interface{}
+		switch v := attributes[key].(type) {
+		case int:
+			// 64 bit integers are strings in JSON.
+			value = map[string]interface{}{"intValue": strconv.Itoa(v)}
+		case float64:
+			value = map[string]interface{}{"doubleValue": v}
+		case bool:
+			value = map[string]interface{}{"boolValue": v}
+		default:
+			value = map[string]interface{}{"stringValue": fmt.Sprint(v)}
+		}
+		encoded = append(encoded, &otlpAttribute{Key: key, Value: value})
+	}
+	return encoded
+}
+
+// export sends the spans recorded so far to the collector. Unfinished spans
+// end now.
+func (t *tracer) export() error {
+	if t == nil {
+		return nil
+	}
+	t.mu.Lock()
+	var spans []interface{}
+	for _, s := range t.spans {
+		end := s.end
+		if end.IsZero() {
+			end = time.Now()
+		}
+		spans = append(spans, map[string]interface{}{
+			"traceId":           t.traceID,
+			"spanId":            s.id,
+			"parentSpanId":      s.parentID,
+			"name":              s.name,
+			"kind":              1, // internal
+			"startTimeUnixNano": strconv.FormatInt(s.start.UnixNano(), 10),
+			"endTimeUnixNano":   strconv.FormatInt(end.UnixNano(), 10),
+			"attributes":        otlpAttributes(s.attributes),
+		})
+	}
+	t.mu.Unlock()
+
+	payload, err := json.Marshal(map[string]interface{}{
+		"resourceSpans": []interface{}{map[string]interface{}{
+			"resource": map[string]interface{}{
+				"attributes": otlpAttributes(map[string]interface{}{"service.name": t.service}),
+			},
+			"scopeSpans": []interface{}{map[string]interface{}{
+				"scope": map[string]string{"name": "depper"},
+				"spans": spans,
+			}},
+		}},
+	})
+	if err != nil {
+		return err
+	}
+	req, err := http.NewRequest("POST", t.endpoint, bytes.NewReader(payload))
+	if err != nil {
+		return err
+	}
+	req.Header.Set("Content-Type", "application/json")
+	for key, value := range t.headers {
+		req.Header.Set(key, value)
+	}
+	resp, err := httpClient.Do(req)
+	if err != nil {
+		return err
+	}
+	defer resp.Body.Close()
+	if resp.StatusCode/100 != 2 {
+		return fmt.Errorf("failed to export traces to %s: %s", t.endpoint, resp.Status)
+	}
+	return nil
+}
@@ -0,0 +1,101 @@
+// Licensed under the Apache License, Version 2.0 (the "License");
+// you may not use this file except in compliance with the License.
+// You may obtain a copy of the License at
+//
+// http://www.apache.org/licenses/LICENSE-2.0
+//
+// Unless required by applicable law or agreed to in writing, software
+// distributed under the License is distributed on an "AS IS" BASIS,
+// WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+// See the License for the specific language governing permissions and
+// limitations under the License.
+
+package main
+
+import (
+	"encoding/json"
+	"net/http"
+	"net/http/httptest"
+
+	"github.com/stretchr/testify/require"
+)
+
+func (s *Zuite) TestTracer() {
+	env := func(vars map[string]string) func(string) string {
+		return func(key string) string { return vars[key] }
+	}
+	require.Nil(s.T(), newTracer(env(nil)))
+	require.Nil(s.T(), newTracer(env(nil)).start("run").child("collect"))
+
+	var (
+		exported struct {
+			ResourceSpans []struct {
+				Resource struct {
+					Attributes []*otlpAttribute `json:"attributes"`
+				} `json:"resource"`
+				ScopeSpans []struct {
+					Spans []struct {
+						TraceID      string           `json:"traceId"`
+						SpanID       string           `json:"spanId"`
+						ParentSpanID string           `json:"parentSpanId"`
+						Name         string           `json:"name"`
+						Attributes   []*otlpAttribute `json:"attributes"`
+					} `json:"spans"`
+				} `json:"scopeSpans"`
+			} `json:"resourceSpans"`
+		}
+		path, token string
+	)
+	server := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		path, token = r.URL.Path, r.Header.Get("Authorization")
+		require.NoError(s.T(), json.NewDecoder(r.Body).Decode(&exported))
+	}))
+	defer server.Close()
+
+	tracer := newTracer(env(map[string]string{
+		"OTEL_EXPORTER_OTLP_ENDPOINT": server.URL + "/",
+		"OTEL_EXPORTER_OTLP_HEADERS":  "Authorization=Bearer%20token",
+		"TRACEPARENT":                 "00-4bf92f3577b34da6a3ce929d0e0e4736-00f067aa0ba902b7-01",
+	}))
+	require.NotNil(s.T(), tracer)
+
+	// Rules are checked in spans of their own.
+	defs, err := parse([]byte(`
+config:
+  working_package: wp
+rules:
+  - name: services
+    packages: services/.*
+    may_not_depend:
+      - dal/.*
+`))
+	require.NoError(s.T(), err)
+	defs.trace = tracer.start("depper check")
+	g := graphOf(map[string]*pkg{
+		"wp/services/user": &pkg{name: "wp/services/user"},
+		"wp/dal/user":      &pkg{name: "wp/dal/user"},
+	}, "wp/services/user -> wp/dal/user")
+	defs.check(g, nil, false)
+	defs.trace.finish()
+	require.NoError(s.T(), tracer.export())
+
+	require.Equal(s.T(), "/v1/traces", path)
+	require.Equal(s.T(), "Bearer token", token)
+	require.Equal(s.T(), []*otlpAttribute{{Key: "service.name", Value: map[string]interface{}{"stringValue": "depper"}}}, exported.ResourceSpans[0].Resource.Attributes)
+	spans := exported.ResourceSpans[0].ScopeSpans[0].Spans
+	require.Len(s.T(), spans, 3)
+	require.Equal(s.T(), "depper check", spans[0].Name)
+	require.Equal(s.T(), "00f067aa0ba902b7", spans[0].ParentSpanID)
+	require.Equal(s.T(), "check", spans[1].Name)
+	require.Equal(s.T(), spans[0].SpanID, spans[1].ParentSpanID)
+	require.Equal(s.T(), "check rule", spans[2].Name)
+	require.Equal(s.T(), spans[1].SpanID, spans[2].ParentSpanID)
+	require.Equal(s.T(), []*otlpAttribute{
+		{Key: "depper.packages", Value: map[string]interface{}{"intValue": "1"}},
+		{Key: "depper.rule.id", Value: map[string]interface{}{"stringValue": "services"}},
+		{Key: "depper.violations", Value: map[string]interface{}{"intValue": "1"}},
+	}, spans[2].Attributes)
+	for _, span := range spans {
+		require.Equal(s.T(), "4bf92f3577b34da6a3ce929d0e0e4736", span.TraceID)
+	}
+}
@@ -0,0 +1,79 @@
+// Licensed under the Apache License, Version 2.0 (the "License");
+// you may not use this file except in compliance with the License.
+// You may obtain a copy of the License at
+//
+// http://www.apache.org/licenses/LICENSE-2.0
+//
+// Unless required by applicable law or agreed to in writing, software
+// distributed under the License is distributed on an "AS IS" BASIS,
+// WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+// See the License for the specific language governing permissions and
+// limitations under the License.
+
+package main
+
+import (
+	"fmt"
+	"runtime"
+	"runtime/debug"
+)
+
+// version and revision of the binary, set when building, e.g. with
+// `-ldflags "-X main.version=v1.4.0 -X main.revision=$(git rev-parse HEAD)"`.
+// The version otherwise defaults to the one of the module, when installed
+// with go install or go get.
+var version, revision string
+
+// Range of the `schema_version` of configs this binary understands. Configs
+// declaring a newer version use fields or semantics it does not know of.
+const (
+	minSchemaVersion = 1
+	maxSchemaVersion = 1
+)
+
+// buildInfo is what `depper version` reports.
+type buildInfo struct {
+	Version          string `json:"version"`
+	Revision         string `json:"revision,omitempty"`
+	GoVersion        string `json:"go_version"`
+	MinSchemaVersion int    `json:"min_schema_version"`
+	MaxSchemaVersion int    `json:"max_schema_version"`
+}
+
+func currentBuild() *buildInfo {
+	info := &buildInfo{
+		Version:          version,
+		Revision:         revision,
+		GoVersion:        runtime.Version(),
+		MinSchemaVersion: minSchemaVersion,
+		MaxSchemaVersion: maxSchemaVersion,
+	}
+	if info.Version == "" {
+		info.Version = "(devel)"
+		if module, ok := debug.ReadBuildInfo(); ok && module.Main.Version != "" {
+			info.Version = module.Main.Version
+		}
+	}
+	return info
+}
+
+func (info *buildInfo) String() string {
+	s := "depper " + info.Version
+	if info.Revision != "" {
+		s += " (" + info.Revision + ")"
+	}
+	return fmt.Sprintf("%s built with %s, config schema versions %d to %d", s, info.GoVersion, info.MinSchemaVersion, info.MaxSchemaVersion)
+}
+
+// schemaWarning warns when the config declares a schema version this binary
+// does not support, e.g. so that stale binaries are noticed in rollouts.
+func (defs *defs) schemaWarning() string {
+	declared := defs.Config.SchemaVersion
+	if declared == 0 || declared >= minSchemaVersion && declared <= maxSchemaVersion {
+		return ""
+	}
+	if declared > maxSchemaVersion {
+		return fmt.Sprintf("config declares schema_version %d, newer than the %d supported by %s, upgrade depper", declared, maxSchemaVersion, currentBuild().Version)
+	}
+	return fmt.Sprintf("config declares schema_version %d, older than the %d supported by %s", declared, minSchemaVersion, currentBuild().Version)
+}
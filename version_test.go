@@ -0,0 +1,52 @@
+// Licensed under the Apache License, Version 2.0 (the "License");
+// you may not use this file except in compliance with the License.
+// You may obtain a copy of the License at
+//
+// http://www.apache.org/licenses/LICENSE-2.0
+//
+// Unless required by applicable law or agreed to in writing, software
+// distributed under the License is distributed on an "AS IS" BASIS,
+// WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+// See the License for the specific language governing permissions and
+// limitations under the License.
+
+package main
+
+import (
+	"runtime"
+
+	"github.com/stretchr/testify/require"
+)
+
+func (s *Zuite) TestCurrentBuild() {
+	defer func(v, r string) { version, revision = v, r }(version, revision)
+	version, revision = "v1.4.0", "1a2b3c"
+	require.Equal(s.T(), "depper v1.4.0 (1a2b3c) built with "+runtime.Version()+", config schema versions 1 to 1", currentBuild().String())
+
+	version, revision = "", ""
+	require.Equal(s.T(), "depper (devel) built with "+runtime.Version()+", config schema versions 1 to 1", currentBuild().String())
+}
+
+func (s *Zuite) TestSchemaWarning() {
+	defer func(v string) { version = v }(version)
+	version = "v1.4.0"
+
+	for _, config := range []string{"rules: []", "config:\n  schema_version: 1"} {
+		defs, err := parse([]byte(config))
+		require.NoError(s.T(), err)
+		require.Empty(s.T(), defs.schemaWarning())
+	}
+	defs, err := parse([]byte("config:\n  schema_version: 2"))
+	require.NoError(s.T(), err)
+	require.Equal(s.T(), "config declares schema_version 2, newer than the 1 supported by v1.4.0, upgrade depper", defs.schemaWarning())
+
+	// Fields of newer schemas are left for the warning, unlike those of
+	// supported ones, and other mismatches.
+	defs, err = parse([]byte("config:\n  schema_version: 2\nnew_thing: true"))
+	require.NoError(s.T(), err)
+	require.NotEmpty(s.T(), defs.schemaWarning())
+	_, err = parse([]byte("config:\n  schema_version: 1\nnew_thing: true"))
+	require.EqualError(s.T(), err, "invalid config, new_thing: unknown field")
+	_, err = parse([]byte("config:\n  schema_version: 2\nrules: true"))
+	require.EqualError(s.T(), err, "invalid config, rules: must be a list")
+}
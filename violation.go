@@ -0,0 +1,138 @@
+// Licensed under the Apache License, Version 2.0 (the "License");
+// you may not use this file except in compliance with the License.
+// You may obtain a copy of the License at
+//
+// http://www.apache.org/licenses/LICENSE-2.0
+//
+// Unless required by applicable law or agreed to in writing, software
+// distributed under the License is distributed on an "AS IS" BASIS,
+// WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+// See the License for the specific language governing permissions and
+// limitations under the License.
+
+package main
+
+import (
+	"crypto/sha256"
+	"fmt"
+	"strings"
+)
+
+// Kinds of violations.
+const (
+	kindDisallowed = "disallowed"
+	kindExpected   = "expected"
+	kindMissing    = "missing"
+	kindRequired   = "required"
+	kindDuplicate  = "duplicate"
+	kindTestOnly   = "test only"
+	kindBlank      = "blank"
+	kindAlias      = "alias"
+	kindMisplaced  = "misplaced"
+	kindCycle      = "cycle"
+	kindDependent  = "dependent"
+	kindCgo        = "cgo"
+	kindGlobal     = "global"
+	kindSwallowed  = "swallowed"
+	kindEmbed      = "embed"
+	kindBroken     = "broken"
+)
+
+// violation is a violation of a rule or check, e.g. a disallowed dependency
+// from one package to another. Packages are written as in definitions, i.e.
+// `<pkg>` for standard library packages.
+type violation struct {
+	ID       string `json:"id"`
+	Rule     string `json:"rule"`
+	RuleID   string `json:"rule_id"`
+	Kind     string `json:"kind"`
+	From     string `json:"from,omitempty"`
+	To       string `json:"to,omitempty"`
+	Position string `json:"position,omitempty"`
+	Message  string `json:"message,omitempty"`
+
+	// Blame is the commit which introduced the violation, when asked.
+	Blame *blame `json:"blame,omitempty"`
+}
+
+// fingerprint returns the ID of the violation, stable across runs: a hash of
+// its rule ID, kind and packages, or its message without packages, rather
+// than positions which change with unrelated edits.
+func (v *violation) fingerprint() string {
+	key := []string{v.RuleID, v.Kind, v.From, v.To}
+	if v.From == "" && v.To == "" {
+		key = append(key, v.Message)
+	}
+	return fmt.Sprintf("%x", sha256.Sum256([]byte(strings.Join(key, "\x00"))))[:16]
+}
+
+// target identifies the violation by what was depended on rather than by
+// the importer, i.e. by its rule ID, kind and target package, or message
+// without one.
+func (v *violation) target() string {
+	key := []string{v.RuleID, v.Kind, v.To}
+	if v.To == "" {
+		key = append(key, v.From, v.Message)
+	}
+	return strings.Join(key, "\x00")
+}
+
+// details describes the violation without its rule nor kind, e.g.
+// `foo/foo.go:4: foo -> bar, use baz`.
+func (v *violation) details() string {
+	var parts []string
+	if v.From != "" || v.To != "" {
+		var dependency []string
+		if v.From != "" {
+			dependency = append(dependency, v.From)
+		}
+		if v.To != "" {
+			dependency = append(dependency, v.To)
+		}
+		parts = append(parts, strings.Join(dependency, " -> "))
+	}
+	if v.Message != "" {
+		parts = append(parts, v.Message)
+	}
+	details := strings.Join(parts, ", ")
+	if v.Position != "" {
+		details = v.Position + ": " + details
+	}
+	return details
+}
+
+// String formats the violation as a line of the text format, e.g.
+// `- disallowed foo -> bar`.
+func (v *violation) String() string {
+	return fmt.Sprintf("- %-10s %s", v.Kind, v.details())
+}
+
+func (v *violation) Error() string {
+	if v.Rule == "" {
+		return fmt.Sprintf("%s %s", v.Kind, v.details())
+	}
+	return fmt.Sprintf("%s: %s %s", v.Rule, v.Kind, v.details())
+}
+
+// filterViolations returns the violations to keep, in order.
+func filterViolations(violations []*violation, keep func(v *violation) bool) []*violation {
+	var kept []*violation
+	for _, v := range violations {
+		if keep(v) {
+			kept = append(kept, v)
+		}
+	}
+	return kept
+}
+
+// ofKind returns a filter keeping violations of any of the kinds.
+func ofKind(kinds ...string) func(v *violation) bool {
+	return func(v *violation) bool {
+		for _, kind := range kinds {
+			if v.Kind == kind {
+				return true
+			}
+		}
+		return false
+	}
+}
@@ -0,0 +1,89 @@
+// Licensed under the Apache License, Version 2.0 (the "License");
+// you may not use this file except in compliance with the License.
+// You may obtain a copy of the License at
+//
+// http://www.apache.org/licenses/LICENSE-2.0
+//
+// Unless required by applicable law or agreed to in writing, software
+// distributed under the License is distributed on an "AS IS" BASIS,
+// WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+// See the License for the specific language governing permissions and
+// limitations under the License.
+
+package main
+
+import (
+	"github.com/stretchr/testify/require"
+)
+
+func (s *Zuite) TestViolation() {
+	cases := []struct {
+		violation   *violation
+		text, error string
+	}{
+		{
+			&violation{Rule: "services", Kind: kindDisallowed, From: "foo", To: "<log>", Message: "use zap"},
+			"- disallowed foo -> <log>, use zap",
+			"services: disallowed foo -> <log>, use zap",
+		},
+		{
+			&violation{Rule: "services", Kind: kindMissing, From: "foo/old"},
+			"- missing    foo/old",
+			"services: missing foo/old",
+		},
+		{
+			&violation{Rule: "legacy", Kind: kindExpected, To: "legacy/.*"},
+			"- expected   legacy/.*",
+			"legacy: expected legacy/.*",
+		},
+		{
+			&violation{Rule: "equivalence group uuid", Kind: kindDuplicate, Message: "a, b"},
+			"- duplicate  a, b",
+			"equivalence group uuid: duplicate a, b",
+		},
+		{
+			&violation{Kind: kindAlias, From: "foo", To: "bar", Position: "foo/foo.go:4", Message: "must be imported as b"},
+			"- alias      foo/foo.go:4: foo -> bar, must be imported as b",
+			"alias foo/foo.go:4: foo -> bar, must be imported as b",
+		},
+	}
+	for _, c := range cases {
+		require.Equal(s.T(), c.text, c.violation.String())
+		require.EqualError(s.T(), c.violation, c.error)
+	}
+}
+
+func (s *Zuite) TestViolation_fingerprint() {
+	v := &violation{RuleID: "services", Kind: kindDisallowed, From: "foo", To: "bar", Position: "foo/foo.go:4"}
+	require.Len(s.T(), v.fingerprint(), 16)
+
+	// Positions and messages do not matter, rules, kinds and packages do.
+	moved := *v
+	moved.Position, moved.Message = "foo/foo.go:12", "use baz"
+	require.Equal(s.T(), v.fingerprint(), moved.fingerprint())
+	for _, other := range []*violation{
+		{RuleID: "utilities", Kind: kindDisallowed, From: "foo", To: "bar"},
+		{RuleID: "services", Kind: kindExpected, From: "foo", To: "bar"},
+		{RuleID: "services", Kind: kindDisallowed, From: "foo", To: "baz"},
+		{RuleID: "services", Kind: kindDisallowed, From: "fo", To: "obar"},
+	} {
+		require.NotEqual(s.T(), v.fingerprint(), other.fingerprint())
+	}
+
+	// Without packages, messages tell violations apart.
+	a := &violation{RuleID: "uuid", Kind: kindDuplicate, Message: "a, b"}
+	b := &violation{RuleID: "uuid", Kind: kindDuplicate, Message: "a, c"}
+	require.NotEqual(s.T(), a.fingerprint(), b.fingerprint())
+}
+
+func (s *Zuite) TestFilterViolations() {
+	violations := []*violation{
+		&violation{Kind: kindDisallowed, From: "foo", To: "bar"},
+		&violation{Kind: kindMissing, From: "foo/old"},
+		&violation{Kind: kindDisallowed, From: "bar", To: "baz"},
+		&violation{Kind: kindCycle, From: "baz", To: "foo"},
+	}
+	require.Equal(s.T(), []*violation{violations[0], violations[2]}, filterViolations(violations, ofKind(kindDisallowed)))
+	require.Equal(s.T(), []*violation{violations[1], violations[3]}, filterViolations(violations, ofKind(kindMissing, kindCycle)))
+	require.Nil(s.T(), filterViolations(violations, ofKind(kindBroken)))
+}
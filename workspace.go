@@ -0,0 +1,154 @@
+// Licensed under the Apache License, Version 2.0 (the "License");
+// you may not use this file except in compliance with the License.
+// You may obtain a copy of the License at
+//
+// http://www.apache.org/licenses/LICENSE-2.0
+//
+// Unless required by applicable law or agreed to in writing, software
+// distributed under the License is distributed on an "AS IS" BASIS,
+// WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+// See the License for the specific language governing permissions and
+// limitations under the License.
+
+package main
+
+import (
+	"fmt"
+	"io/ioutil"
+	"os"
+	"os/exec"
+	"path/filepath"
+	"strings"
+)
+
+// isRemote indicates whether the workspace entry is the URL of a repository,
+// e.g. `https://github.com/org/billing` or `git@github.com:org/billing.git`,
+// rather than a module root.
+func isRemote(entry string) bool {
+	return strings.Contains(entry, "://") || strings.HasPrefix(entry, "git@")
+}
+
+// workspaceRoots returns the module roots of the workspace, cloning remote
+// entries shallowly under cacheDir, or updating their clones.
+func (defs *defs) workspaceRoots(cacheDir string) ([]string, error) {
+	var roots []string
+	for _, entry := range defs.Config.Workspace {
+		if !isRemote(entry) {
+			roots = append(roots, entry)
+			continue
+		}
+		root := filepath.Join(cacheDir, slugify(entry))
+		var cmds [][]string
+		if _, err := os.Stat(filepath.Join(root, ".git")); err == nil {
+			cmds = [][]string{
+				{"git", "-C", root, "fetch", "--depth", "1", "origin", "HEAD"},
+				{"git", "-C", root, "reset", "--hard", "FETCH_HEAD"},
+			}
+		} else {
+			if err := os.MkdirAll(cacheDir, 0755); err != nil {
+				return nil, err
+			}
+			cmds = [][]string{{"git", "clone", "--depth", "1", entry, root}}
+		}
+		for _, args := range cmds {
+			cmd := exec.Command(args[0], args[1:]...)
+			cmd.Env = defs.env
+			if len(cmd.Env) != 0 {
+				cmd.Env = append(os.Environ(), defs.env...)
+			}
+			if out, err := cmd.CombinedOutput(); err != nil {
+				return nil, fmt.Errorf("failed to clone %s: %s", entry, strings.TrimSpace(string(out)))
+			}
+		}
+		roots = append(roots, root)
+	}
+	return roots, nil
+}
+
+// collectWorkspace returns the graph merged with every package of every
+// module of the workspace, building with the given tags. Each module is
+// collected as the working package, so that rules may span modules, e.g. by
+// overriding their working package. The graph itself is left as is, as it
+// may be cached.
+//
+// Remote entries are cloned in the cache directory.
+func (defs *defs) collectWorkspace(g *graph, tags []string) (*graph, error) {
+	cacheDir, err := defs.cacheDir()
+	if err != nil {
+		return nil, err
+	}
+	roots, err := defs.workspaceRoots(filepath.Join(cacheDir, "workspace"))
+	if err != nil {
+		return nil, err
+	}
+	merged := newGraph(g.root)
+	merged.merge(g)
+	for _, root := range roots {
+		cfg := defs.loadConfig(root, tags)
+		module, err := enclosingModule(root, cfg.Env)
+		if err != nil {
+			return nil, err
+		}
+		workspace := *defs
+		workspace.Config.WorkingPackage = module.Path
+		moduleGraph, err := workspace.collectPackages(root, []string{"./..."}, tags)
+		if err != nil {
+			return nil, fmt.Errorf("failed to collect %s: %s", root, err)
+		}
+		merged.merge(moduleGraph)
+	}
+	return merged, nil
+}
+
+// moduleRoot prepares, under cacheDir, a main module requiring the published
+// module version, e.g. `github.com/org/lib@v1.4.0`, along with the
+// dependencies of its packages, which are downloaded into the module cache.
+// It returns the root of the main module, and the path of the published one.
+func (defs *defs) moduleRoot(modVersion, cacheDir string) (string, string, error) {
+	at := strings.Index(modVersion, "@")
+	if at <= 0 || at == len(modVersion)-1 {
+		return "", "", fmt.Errorf("module %s must be module@version", modVersion)
+	}
+	path := modVersion[:at]
+	root := filepath.Join(cacheDir, slugify(path))
+	if err := os.MkdirAll(root, 0755); err != nil {
+		return "", "", err
+	}
+
+	// Start afresh, so that versions audited before are not required anymore.
+	if err := ioutil.WriteFile(filepath.Join(root, "go.mod"), []byte("module depper.audit\n"), 0644); err != nil {
+		return "", "", err
+	}
+	if err := os.Remove(filepath.Join(root, "go.sum")); err != nil && !os.IsNotExist(err) {
+		return "", "", err
+	}
+	cmd := exec.Command("go", "get", path+"/..."+modVersion[at:])
+	cmd.Dir = root
+	if len(defs.env) != 0 {
+		cmd.Env = append(os.Environ(), defs.env...)
+	}
+	if out, err := cmd.CombinedOutput(); err != nil {
+		return "", "", fmt.Errorf("failed to download %s: %s", modVersion, strings.TrimSpace(string(out)))
+	}
+	return root, path, nil
+}
+
+// collectModule collects every package of the published module version as
+// the working package, building with the given tags, without a checkout. The
+// main module requiring it is prepared in the cache directory.
+func (defs *defs) collectModule(modVersion string, tags []string) (*graph, error) {
+	cacheDir, err := defs.cacheDir()
+	if err != nil {
+		return nil, err
+	}
+	root, path, err := defs.moduleRoot(modVersion, filepath.Join(cacheDir, "module"))
+	if err != nil {
+		return nil, err
+	}
+	g, err := defs.collectPackages(root, []string{path + "/..."}, tags)
+	if err != nil {
+		return nil, err
+	}
+	g.root = path
+	return g, nil
+}
@@ -0,0 +1,149 @@
+// Licensed under the Apache License, Version 2.0 (the "License");
+// you may not use this file except in compliance with the License.
+// You may obtain a copy of the License at
+//
+// http://www.apache.org/licenses/LICENSE-2.0
+//
+// Unless required by applicable law or agreed to in writing, software
+// distributed under the License is distributed on an "AS IS" BASIS,
+// WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+// See the License for the specific language governing permissions and
+// limitations under the License.
+
+package main
+
+import (
+	"archive/zip"
+	"bytes"
+	"io/ioutil"
+	"os"
+	"os/exec"
+	"path/filepath"
+
+	"github.com/stretchr/testify/require"
+)
+
+func (s *Zuite) TestCollectWorkspace() {
+	dir, err := ioutil.TempDir("", "depper")
+	require.NoError(s.T(), err)
+	defer os.RemoveAll(dir)
+
+	files := map[string]string{
+		"a/depper.yaml":             "config:\n  working_package: example.com/a\n  workspace:\n    - ../b\n",
+		"a/go.mod":                  "module example.com/a\n\nrequire example.com/b v0.1.0\n\nreplace example.com/b => ../b\n",
+		"a/main.go":                 "package main\n\nimport _ \"example.com/a/client\"\n\nfunc main() {}\n",
+		"a/client/client.go":        "package client\n\nimport _ \"example.com/b/api\"\n",
+		"b/go.mod":                  "module example.com/b\n",
+		"b/api/api.go":              "package api\n\nimport _ \"example.com/b/internal/store\"\n",
+		"b/internal/store/store.go": "package store\n\nimport _ \"database/sql\"\n",
+	}
+	s.writeFiles(dir, files)
+
+	// Workspace roots are relative to the config.
+	defs, err := readFile(filepath.Join(dir, "a/depper.yaml"))
+	require.NoError(s.T(), err)
+	require.Equal(s.T(), []string{filepath.Join(dir, "b")}, defs.Config.Workspace)
+	require.NoError(s.T(), defs.compile())
+
+	// Packages of other modules are leaves, unless collected with the
+	// workspace.
+	g, err := defs.collectPackages(filepath.Join(dir, "a"), nil, nil)
+	require.NoError(s.T(), err)
+	require.Empty(s.T(), g.dependenciesOf("example.com/b/api"))
+	merged, err := defs.collectWorkspace(g, nil)
+	require.NoError(s.T(), err)
+	require.Empty(s.T(), merged.loadErrors)
+	require.Equal(s.T(), "example.com/a", merged.root)
+	require.Equal(s.T(), []string{"example.com/a/client", "example.com/b/api", "example.com/b/internal/store"}, names(merged.path("example.com/a/client", "example.com/b/internal/store")))
+	require.Len(s.T(), merged.pkgs["example.com/b/api"].files, 1)
+	require.Empty(s.T(), g.dependenciesOf("example.com/b/api"))
+}
+
+func (s *Zuite) TestWorkspaceRoots_remote() {
+	dir, err := ioutil.TempDir("", "depper")
+	require.NoError(s.T(), err)
+	defer os.RemoveAll(dir)
+
+	repo := filepath.Join(dir, "repo")
+	require.NoError(s.T(), os.MkdirAll(repo, 0755))
+	require.NoError(s.T(), ioutil.WriteFile(filepath.Join(repo, "go.mod"), []byte("module example.com/remote\n"), 0644))
+	for _, args := range [][]string{
+		{"init", "-q"},
+		{"add", "go.mod"},
+		{"-c", "user.name=depper", "-c", "user.email=depper@example.com", "commit", "-q", "-m", "init"},
+	} {
+		cmd := exec.Command("git", args...)
+		cmd.Dir = repo
+		out, err := cmd.CombinedOutput()
+		require.NoError(s.T(), err, string(out))
+	}
+
+	// Remote entries are cloned, and updated when cloned already.
+	var defs defs
+	url := "file://" + repo
+	defs.Config.Workspace = []string{url, filepath.Join(dir, "local")}
+	cacheDir := filepath.Join(dir, "cache")
+	for i := 0; i < 2; i++ {
+		roots, err := defs.workspaceRoots(cacheDir)
+		require.NoError(s.T(), err)
+		require.Equal(s.T(), []string{filepath.Join(cacheDir, slugify(url)), filepath.Join(dir, "local")}, roots)
+		_, err = os.Stat(filepath.Join(roots[0], "go.mod"))
+		require.NoError(s.T(), err)
+	}
+
+	defs.Config.Workspace = []string{"file://" + filepath.Join(dir, "missing")}
+	_, err = defs.workspaceRoots(cacheDir)
+	require.Error(s.T(), err)
+}
+
+func (s *Zuite) TestCollectModule() {
+	dir, err := ioutil.TempDir("", "depper")
+	require.NoError(s.T(), err)
+	defer os.RemoveAll(dir)
+
+	// The module is served by a file system proxy.
+	versions := filepath.Join(dir, "proxy/example.com/lib/@v")
+	require.NoError(s.T(), os.MkdirAll(versions, 0755))
+	require.NoError(s.T(), ioutil.WriteFile(filepath.Join(versions, "list"), []byte("v1.4.0\n"), 0644))
+	require.NoError(s.T(), ioutil.WriteFile(filepath.Join(versions, "v1.4.0.info"), []byte(`{"Version":"v1.4.0"}`), 0644))
+	require.NoError(s.T(), ioutil.WriteFile(filepath.Join(versions, "v1.4.0.mod"), []byte("module example.com/lib\n"), 0644))
+	var zipped bytes.Buffer
+	archive := zip.NewWriter(&zipped)
+	for name, contents := range map[string]string{
+		"go.mod":                 "module example.com/lib\n",
+		"api/api.go":             "package api\n\nimport _ \"example.com/lib/internal/db\"\n",
+		"internal/db/db.go":      "package db\n\nimport _ \"database/sql\"\n",
+		"internal/db/db_test.go": "package db\n\nimport _ \"testing\"\n",
+	} {
+		w, err := archive.Create("example.com/lib@v1.4.0/" + name)
+		require.NoError(s.T(), err)
+		_, err = w.Write([]byte(contents))
+		require.NoError(s.T(), err)
+	}
+	require.NoError(s.T(), archive.Close())
+	require.NoError(s.T(), ioutil.WriteFile(filepath.Join(versions, "v1.4.0.zip"), zipped.Bytes(), 0644))
+
+	defs := &defs{env: []string{
+		"GOPROXY=file://" + filepath.ToSlash(filepath.Join(dir, "proxy")),
+		"GOSUMDB=off",
+		"GOFLAGS=-modcacherw",
+		"GOMODCACHE=" + filepath.Join(dir, "modcache"),
+		"DEPPER_CACHE=" + filepath.Join(dir, "cache"),
+	}}
+	defs.Config.WorkingPackage = "example.com/lib"
+	require.NoError(s.T(), defs.compile())
+
+	// The packages of the module are working packages, rooted at the module.
+	g, err := defs.collectModule("example.com/lib@v1.4.0", nil)
+	require.NoError(s.T(), err)
+	require.Empty(s.T(), g.loadErrors)
+	require.Equal(s.T(), "example.com/lib", g.root)
+	require.Equal(s.T(), []string{"example.com/lib/api", "example.com/lib/internal/db"}, g.roots)
+	require.Equal(s.T(), []string{"example.com/lib/api", "example.com/lib/internal/db", "database/sql"}, names(g.path("example.com/lib/api", "database/sql")))
+	require.Len(s.T(), g.pkgs["example.com/lib/internal/db"].files, 1)
+
+	_, err = defs.collectModule("example.com/lib@v2.0.0", nil)
+	require.Error(s.T(), err)
+	_, err = defs.collectModule("example.com/lib", nil)
+	require.EqualError(s.T(), err, "module example.com/lib must be module@version")
+}